@@ -0,0 +1,409 @@
+package arduboy
+
+import (
+	"fmt"
+)
+
+// One decoded AVR instruction. Only the raw opcode is kept; everything else
+// (mnemonic, operands, targets) is decoded from it when asked
+type AvrInstruction struct {
+	Address int    // Byte address in flash
+	Opcode  uint16 // First (or only) word
+	Extra   uint16 // Second word of 32 bit instructions (call, jmp, lds, sts)
+	Size    int    // 2 or 4 bytes
+}
+
+type avrFormat int
+
+const (
+	avrFmtNone   avrFormat = iota
+	avrFmtRdRr             // Two registers, 0-31
+	avrFmtRd               // One register, 0-31
+	avrFmtRdK              // Register 16-31 and an 8 bit constant
+	avrFmtMovw             // Two even registers
+	avrFmtMuls             // Two registers, 16-31
+	avrFmtFmul             // Two registers, 16-23
+	avrFmtAdiw             // Register 24/26/28/30 and a 6 bit constant
+	avrFmtIn               // Register and I/O address
+	avrFmtOut              // I/O address and register
+	avrFmtIOBit            // Lower I/O address and bit
+	avrFmtRegBit           // Register and bit
+	avrFmtBranch           // 7 bit relative
+	avrFmtRel              // 12 bit relative
+	avrFmtAbs              // 22 bit absolute
+	avrFmtLds              // Register and data address
+	avrFmtSts              // Data address and register
+	avrFmtLd               // Register and pointer (from the table)
+	avrFmtSt               // Pointer (from the table) and register
+	avrFmtLdd              // Register and pointer plus displacement
+	avrFmtStd              // Pointer plus displacement and register
+	avrFmtFixed            // Operands are just the pointer from the table
+)
+
+type avrOpcode struct {
+	mask     uint16
+	value    uint16
+	mnemonic string
+	format   avrFormat
+	pointer  string // For loads and stores
+}
+
+// The whole instruction set the 32u4 understands. Order matters: the first
+// match wins, so specific encodings come before general ones
+var avrOpcodes = []avrOpcode{
+	{0xFFFF, 0x0000, "nop", avrFmtNone, ""},
+	{0xFF00, 0x0100, "movw", avrFmtMovw, ""},
+	{0xFF00, 0x0200, "muls", avrFmtMuls, ""},
+	{0xFF88, 0x0300, "mulsu", avrFmtFmul, ""},
+	{0xFF88, 0x0308, "fmul", avrFmtFmul, ""},
+	{0xFF88, 0x0380, "fmuls", avrFmtFmul, ""},
+	{0xFF88, 0x0388, "fmulsu", avrFmtFmul, ""},
+	{0xFC00, 0x0400, "cpc", avrFmtRdRr, ""},
+	{0xFC00, 0x0800, "sbc", avrFmtRdRr, ""},
+	{0xFC00, 0x0C00, "add", avrFmtRdRr, ""},
+	{0xFC00, 0x1000, "cpse", avrFmtRdRr, ""},
+	{0xFC00, 0x1400, "cp", avrFmtRdRr, ""},
+	{0xFC00, 0x1800, "sub", avrFmtRdRr, ""},
+	{0xFC00, 0x1C00, "adc", avrFmtRdRr, ""},
+	{0xFC00, 0x2000, "and", avrFmtRdRr, ""},
+	{0xFC00, 0x2400, "eor", avrFmtRdRr, ""},
+	{0xFC00, 0x2800, "or", avrFmtRdRr, ""},
+	{0xFC00, 0x2C00, "mov", avrFmtRdRr, ""},
+	{0xF000, 0x3000, "cpi", avrFmtRdK, ""},
+	{0xF000, 0x4000, "sbci", avrFmtRdK, ""},
+	{0xF000, 0x5000, "subi", avrFmtRdK, ""},
+	{0xF000, 0x6000, "ori", avrFmtRdK, ""},
+	{0xF000, 0x7000, "andi", avrFmtRdK, ""},
+	{0xD208, 0x8000, "ldd", avrFmtLdd, "Z"},
+	{0xD208, 0x8008, "ldd", avrFmtLdd, "Y"},
+	{0xD208, 0x8200, "std", avrFmtStd, "Z"},
+	{0xD208, 0x8208, "std", avrFmtStd, "Y"},
+	{0xFE0F, 0x9000, "lds", avrFmtLds, ""},
+	{0xFE0F, 0x9001, "ld", avrFmtLd, "Z+"},
+	{0xFE0F, 0x9002, "ld", avrFmtLd, "-Z"},
+	{0xFE0F, 0x9004, "lpm", avrFmtLd, "Z"},
+	{0xFE0F, 0x9005, "lpm", avrFmtLd, "Z+"},
+	{0xFE0F, 0x9006, "elpm", avrFmtLd, "Z"},
+	{0xFE0F, 0x9007, "elpm", avrFmtLd, "Z+"},
+	{0xFE0F, 0x9009, "ld", avrFmtLd, "Y+"},
+	{0xFE0F, 0x900A, "ld", avrFmtLd, "-Y"},
+	{0xFE0F, 0x900C, "ld", avrFmtLd, "X"},
+	{0xFE0F, 0x900D, "ld", avrFmtLd, "X+"},
+	{0xFE0F, 0x900E, "ld", avrFmtLd, "-X"},
+	{0xFE0F, 0x900F, "pop", avrFmtRd, ""},
+	{0xFE0F, 0x9200, "sts", avrFmtSts, ""},
+	{0xFE0F, 0x9201, "st", avrFmtSt, "Z+"},
+	{0xFE0F, 0x9202, "st", avrFmtSt, "-Z"},
+	{0xFE0F, 0x9209, "st", avrFmtSt, "Y+"},
+	{0xFE0F, 0x920A, "st", avrFmtSt, "-Y"},
+	{0xFE0F, 0x920C, "st", avrFmtSt, "X"},
+	{0xFE0F, 0x920D, "st", avrFmtSt, "X+"},
+	{0xFE0F, 0x920E, "st", avrFmtSt, "-X"},
+	{0xFE0F, 0x920F, "push", avrFmtRd, ""},
+	{0xFFFF, 0x9408, "sec", avrFmtNone, ""},
+	{0xFFFF, 0x9418, "sez", avrFmtNone, ""},
+	{0xFFFF, 0x9428, "sen", avrFmtNone, ""},
+	{0xFFFF, 0x9438, "sev", avrFmtNone, ""},
+	{0xFFFF, 0x9448, "ses", avrFmtNone, ""},
+	{0xFFFF, 0x9458, "seh", avrFmtNone, ""},
+	{0xFFFF, 0x9468, "set", avrFmtNone, ""},
+	{0xFFFF, 0x9478, "sei", avrFmtNone, ""},
+	{0xFFFF, 0x9488, "clc", avrFmtNone, ""},
+	{0xFFFF, 0x9498, "clz", avrFmtNone, ""},
+	{0xFFFF, 0x94A8, "cln", avrFmtNone, ""},
+	{0xFFFF, 0x94B8, "clv", avrFmtNone, ""},
+	{0xFFFF, 0x94C8, "cls", avrFmtNone, ""},
+	{0xFFFF, 0x94D8, "clh", avrFmtNone, ""},
+	{0xFFFF, 0x94E8, "clt", avrFmtNone, ""},
+	{0xFFFF, 0x94F8, "cli", avrFmtNone, ""},
+	{0xFFFF, 0x9409, "ijmp", avrFmtNone, ""},
+	{0xFFFF, 0x9419, "eijmp", avrFmtNone, ""},
+	{0xFFFF, 0x9508, "ret", avrFmtNone, ""},
+	{0xFFFF, 0x9509, "icall", avrFmtNone, ""},
+	{0xFFFF, 0x9518, "reti", avrFmtNone, ""},
+	{0xFFFF, 0x9519, "eicall", avrFmtNone, ""},
+	{0xFFFF, 0x9588, "sleep", avrFmtNone, ""},
+	{0xFFFF, 0x9598, "break", avrFmtNone, ""},
+	{0xFFFF, 0x95A8, "wdr", avrFmtNone, ""},
+	{0xFFFF, 0x95C8, "lpm", avrFmtNone, ""},
+	{0xFFFF, 0x95D8, "elpm", avrFmtNone, ""},
+	{0xFFFF, 0x95E8, "spm", avrFmtNone, ""},
+	{0xFFFF, 0x95F8, "spm", avrFmtFixed, "Z+"},
+	{0xFE0F, 0x9400, "com", avrFmtRd, ""},
+	{0xFE0F, 0x9401, "neg", avrFmtRd, ""},
+	{0xFE0F, 0x9402, "swap", avrFmtRd, ""},
+	{0xFE0F, 0x9403, "inc", avrFmtRd, ""},
+	{0xFE0F, 0x9405, "asr", avrFmtRd, ""},
+	{0xFE0F, 0x9406, "lsr", avrFmtRd, ""},
+	{0xFE0F, 0x9407, "ror", avrFmtRd, ""},
+	{0xFE0F, 0x940A, "dec", avrFmtRd, ""},
+	{0xFE0E, 0x940C, "jmp", avrFmtAbs, ""},
+	{0xFE0E, 0x940E, "call", avrFmtAbs, ""},
+	{0xFF00, 0x9600, "adiw", avrFmtAdiw, ""},
+	{0xFF00, 0x9700, "sbiw", avrFmtAdiw, ""},
+	{0xFF00, 0x9800, "cbi", avrFmtIOBit, ""},
+	{0xFF00, 0x9900, "sbic", avrFmtIOBit, ""},
+	{0xFF00, 0x9A00, "sbi", avrFmtIOBit, ""},
+	{0xFF00, 0x9B00, "sbis", avrFmtIOBit, ""},
+	{0xFC00, 0x9C00, "mul", avrFmtRdRr, ""},
+	{0xF800, 0xB000, "in", avrFmtIn, ""},
+	{0xF800, 0xB800, "out", avrFmtOut, ""},
+	{0xF000, 0xC000, "rjmp", avrFmtRel, ""},
+	{0xF000, 0xD000, "rcall", avrFmtRel, ""},
+	{0xF000, 0xE000, "ldi", avrFmtRdK, ""},
+	{0xFC07, 0xF000, "brcs", avrFmtBranch, ""},
+	{0xFC07, 0xF001, "breq", avrFmtBranch, ""},
+	{0xFC07, 0xF002, "brmi", avrFmtBranch, ""},
+	{0xFC07, 0xF003, "brvs", avrFmtBranch, ""},
+	{0xFC07, 0xF004, "brlt", avrFmtBranch, ""},
+	{0xFC07, 0xF005, "brhs", avrFmtBranch, ""},
+	{0xFC07, 0xF006, "brts", avrFmtBranch, ""},
+	{0xFC07, 0xF007, "brie", avrFmtBranch, ""},
+	{0xFC07, 0xF400, "brcc", avrFmtBranch, ""},
+	{0xFC07, 0xF401, "brne", avrFmtBranch, ""},
+	{0xFC07, 0xF402, "brpl", avrFmtBranch, ""},
+	{0xFC07, 0xF403, "brvc", avrFmtBranch, ""},
+	{0xFC07, 0xF404, "brge", avrFmtBranch, ""},
+	{0xFC07, 0xF405, "brhc", avrFmtBranch, ""},
+	{0xFC07, 0xF406, "brtc", avrFmtBranch, ""},
+	{0xFC07, 0xF407, "brid", avrFmtBranch, ""},
+	{0xFE08, 0xF800, "bld", avrFmtRegBit, ""},
+	{0xFE08, 0xFA00, "bst", avrFmtRegBit, ""},
+	{0xFE08, 0xFC00, "sbrc", avrFmtRegBit, ""},
+	{0xFE08, 0xFE00, "sbrs", avrFmtRegBit, ""},
+}
+
+func avrIsLong(w uint16) bool {
+	return (w&0xFE0C) == 0x940C || (w&0xFE0F) == 0x9000 || (w&0xFE0F) == 0x9200
+}
+
+// Decode the instruction at the given byte address. A 32 bit instruction cut
+// off by the end of the data is decoded as if its second word were 0, and an
+// address outside the data decodes as 0 (nop)
+func DecodeAvr(data []byte, address int) AvrInstruction {
+	result := AvrInstruction{Address: address, Size: 2}
+	if address < 0 {
+		return result
+	}
+	if address+1 < len(data) {
+		result.Opcode = uint16(data[address]) | uint16(data[address+1])<<8
+	}
+	if avrIsLong(result.Opcode) {
+		result.Size = 4
+		if address+3 < len(data) {
+			result.Extra = uint16(data[address+2]) | uint16(data[address+3])<<8
+		}
+	}
+	return result
+}
+
+// Decode the whole program from the start as one long run of instructions.
+// Data mixed into the code (such as PROGMEM) decodes as garbage, but the
+// decoder falls back in line with the real code quickly
+func DisassembleAvr(data []byte) []AvrInstruction {
+	result := make([]AvrInstruction, 0, len(data)/2)
+	for pos := 0; pos+1 < len(data); {
+		ins := DecodeAvr(data, pos)
+		result = append(result, ins)
+		pos += ins.Size
+	}
+	return result
+}
+
+func (ins AvrInstruction) opcode() *avrOpcode {
+	for i := range avrOpcodes {
+		if ins.Opcode&avrOpcodes[i].mask == avrOpcodes[i].value {
+			return &avrOpcodes[i]
+		}
+	}
+	return nil
+}
+
+func avrRelative(ins AvrInstruction, offset int, bits int) int {
+	if offset&(1<<(bits-1)) != 0 {
+		offset -= 1 << bits
+	}
+	return ins.Address + 2 + offset*2
+}
+
+func (ins AvrInstruction) absolute() int {
+	return (int(ins.Opcode&0x1F0)<<13 | int(ins.Opcode&1)<<16 | int(ins.Extra)) * 2
+}
+
+// Target of call or rcall
+func (ins AvrInstruction) callTarget() (int, bool) {
+	if (ins.Opcode & 0xFE0E) == 0x940E {
+		return ins.absolute(), true
+	} else if (ins.Opcode & 0xF000) == 0xD000 {
+		return avrRelative(ins, int(ins.Opcode&0xFFF), 12), true
+	}
+	return 0, false
+}
+
+// Target of jmp or rjmp
+func (ins AvrInstruction) jumpTarget() (int, bool) {
+	if (ins.Opcode & 0xFE0E) == 0x940C {
+		return ins.absolute(), true
+	} else if (ins.Opcode & 0xF000) == 0xC000 {
+		return avrRelative(ins, int(ins.Opcode&0xFFF), 12), true
+	}
+	return 0, false
+}
+
+// Target of conditional branches (brbs/brbc, which covers breq, brne, brcc, etc)
+func (ins AvrInstruction) branchTarget() (int, bool) {
+	if (ins.Opcode & 0xF800) == 0xF000 {
+		return avrRelative(ins, int(ins.Opcode>>3)&0x7F, 7), true
+	}
+	return 0, false
+}
+
+// Byte address this instruction may go to other than the next one: the
+// target of any call, jump, or branch
+func (ins AvrInstruction) Target() (int, bool) {
+	if target, ok := ins.callTarget(); ok {
+		return target, true
+	} else if target, ok := ins.jumpTarget(); ok {
+		return target, true
+	}
+	return ins.branchTarget()
+}
+
+// cpse, sbrc, sbrs, sbic, sbis
+func (ins AvrInstruction) isSkip() bool {
+	return (ins.Opcode&0xFC00) == 0x1000 || (ins.Opcode&0xFC08) == 0xFC00 || (ins.Opcode&0xFD00) == 0x9900
+}
+
+// ret, reti, ijmp, eijmp: the code after these isn't reached by falling through
+func (ins AvrInstruction) isEnd() bool {
+	return ins.Opcode == 0x9508 || ins.Opcode == 0x9518 || ins.Opcode == 0x9409 || ins.Opcode == 0x9419
+}
+
+// icall, eicall
+func (ins AvrInstruction) isIndirectCall() bool {
+	return ins.Opcode == 0x9509 || ins.Opcode == 0x9519
+}
+
+// Destination and source of mov (single) and movw (pair; returns the low registers)
+func (ins AvrInstruction) move() (int, int, bool, bool) {
+	if (ins.Opcode & 0xFF00) == 0x0100 {
+		return int(ins.Opcode>>4&0xF) * 2, int(ins.Opcode&0xF) * 2, true, true
+	} else if (ins.Opcode & 0xFC00) == 0x2C00 {
+		return int(ins.Opcode>>4) & 0x1F, int(ins.Opcode&0xF) | int(ins.Opcode>>5)&0x10, false, true
+	}
+	return 0, 0, false, false
+}
+
+// Register and value of ldi, also counting clr (eor/sub of a register with itself)
+func (ins AvrInstruction) constant() (int, int, bool) {
+	if (ins.Opcode & 0xF000) == 0xE000 {
+		return 16 + int(ins.Opcode>>4)&0xF, int(ins.Opcode>>4)&0xF0 | int(ins.Opcode&0xF), true
+	}
+	if (ins.Opcode&0xFC00) == 0x2400 || (ins.Opcode&0xFC00) == 0x1800 {
+		d := int(ins.Opcode>>4) & 0x1F
+		if d == int(ins.Opcode&0xF)|int(ins.Opcode>>5)&0x10 {
+			return d, 0, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Registers (as a bitmask) the instruction changes. Only needs to be good
+// enough to know when a register value can't be tracked any further
+func (ins AvrInstruction) writes() uint32 {
+	w := ins.Opcode
+	d := int(w>>4) & 0x1F
+	switch {
+	case (w & 0xFF00) == 0x0100: // movw
+		return 3 << (int(w>>4&0xF) * 2)
+	case (w&0xFE00) == 0x0200 || (w&0xFC00) == 0x9C00: // muls, mulsu, fmul, mul
+		return 3
+	case w >= 0x0800 && w < 0x1000, w >= 0x1800 && w < 0x3000: // sbc, add, sub, adc, and, eor, or, mov
+		return 1 << d
+	case w >= 0x4000 && w < 0x8000, (w & 0xF000) == 0xE000: // sbci, subi, ori, andi, ldi
+		return 1 << (16 + d&0xF)
+	case (w & 0xD200) == 0x8000, (w & 0xFE00) == 0x9000, (w & 0xF800) == 0xB000, (w & 0xFE08) == 0xF800: // ld, lds, pop, lpm, in, bld
+		return 1 << d
+	case (w & 0xFE00) == 0x9400: // One operand ops (com, neg, swap, inc, asr, lsr, ror, dec)
+		switch w & 0xF {
+		case 0, 1, 2, 3, 5, 6, 7, 0xA:
+			return 1 << d
+		}
+	case (w & 0xFE00) == 0x9600: // adiw, sbiw
+		return 3 << (24 + int(w>>4&3)*2)
+	}
+	return 0
+}
+
+// The instruction name and operands, in roughly the style of avr-objdump.
+// Jump and branch targets are absolute byte addresses. Unknown opcodes are
+// shown as .word
+func (ins AvrInstruction) Disassemble() (string, string) {
+	op := ins.opcode()
+	if op == nil {
+		return ".word", fmt.Sprintf("0x%04x", ins.Opcode)
+	}
+	w := ins.Opcode
+	rd := int(w>>4) & 0x1F
+	rr := int(w&0xF) | int(w>>5)&0x10
+	rdhi := 16 + int(w>>4)&0xF
+	k := int(w>>4)&0xF0 | int(w&0xF)
+	q := int(w&7) | int(w>>7)&0x18 | int(w>>8)&0x20
+	switch op.format {
+	case avrFmtRdRr:
+		return op.mnemonic, fmt.Sprintf("r%d, r%d", rd, rr)
+	case avrFmtRd:
+		return op.mnemonic, fmt.Sprintf("r%d", rd)
+	case avrFmtRdK:
+		return op.mnemonic, fmt.Sprintf("r%d, 0x%02x", rdhi, k)
+	case avrFmtMovw:
+		return op.mnemonic, fmt.Sprintf("r%d, r%d", int(w>>4&0xF)*2, int(w&0xF)*2)
+	case avrFmtMuls:
+		return op.mnemonic, fmt.Sprintf("r%d, r%d", rdhi, 16+int(w&0xF))
+	case avrFmtFmul:
+		return op.mnemonic, fmt.Sprintf("r%d, r%d", 16+int(w>>4&7), 16+int(w&7))
+	case avrFmtAdiw:
+		return op.mnemonic, fmt.Sprintf("r%d, 0x%02x", 24+int(w>>4&3)*2, int(w>>2)&0x30|int(w&0xF))
+	case avrFmtIn:
+		return op.mnemonic, fmt.Sprintf("r%d, 0x%02x", rd, int(w>>5)&0x30|int(w&0xF))
+	case avrFmtOut:
+		return op.mnemonic, fmt.Sprintf("0x%02x, r%d", int(w>>5)&0x30|int(w&0xF), rd)
+	case avrFmtIOBit:
+		return op.mnemonic, fmt.Sprintf("0x%02x, %d", int(w>>3)&0x1F, w&7)
+	case avrFmtRegBit:
+		return op.mnemonic, fmt.Sprintf("r%d, %d", rd, w&7)
+	case avrFmtBranch, avrFmtRel, avrFmtAbs:
+		target, _ := ins.Target()
+		return op.mnemonic, fmt.Sprintf("0x%04x", target)
+	case avrFmtLds:
+		return op.mnemonic, fmt.Sprintf("r%d, 0x%04x", rd, ins.Extra)
+	case avrFmtSts:
+		return op.mnemonic, fmt.Sprintf("0x%04x, r%d", ins.Extra, rd)
+	case avrFmtLd:
+		return op.mnemonic, fmt.Sprintf("r%d, %s", rd, op.pointer)
+	case avrFmtSt:
+		return op.mnemonic, fmt.Sprintf("%s, r%d", op.pointer, rd)
+	case avrFmtLdd:
+		if q == 0 {
+			return "ld", fmt.Sprintf("r%d, %s", rd, op.pointer)
+		}
+		return op.mnemonic, fmt.Sprintf("r%d, %s+%d", rd, op.pointer, q)
+	case avrFmtStd:
+		if q == 0 {
+			return "st", fmt.Sprintf("%s, r%d", op.pointer, rd)
+		}
+		return op.mnemonic, fmt.Sprintf("%s+%d, r%d", op.pointer, q, rd)
+	case avrFmtFixed:
+		return op.mnemonic, op.pointer
+	}
+	return op.mnemonic, ""
+}
+
+// Same as Disassemble, but as one string
+func (ins AvrInstruction) String() string {
+	mnemonic, operands := ins.Disassemble()
+	if operands == "" {
+		return mnemonic
+	}
+	return mnemonic + "\t" + operands
+}
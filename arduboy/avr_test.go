@@ -0,0 +1,106 @@
+package arduboy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDisassembleAvr(t *testing.T) {
+	program := []byte{
+		0x0c, 0x94, 0x94, 0x04, // jmp 0x928
+		0x80, 0xe2, // ldi r24, 0x20
+		0xce, 0x01, // movw r24, r28
+		0x80, 0x91, 0x00, 0x01, // lds r24, 0x0100
+		0x8d, 0x91, // ld r24, X+
+		0x8a, 0x85, // ldd r24, Y+10
+		0x80, 0x81, // ld r24, Z
+		0x59, 0x98, // cbi 0x0b, 1
+		0xbd, 0x92, // st X+, r11
+		0x81, 0xbd, // out 0x21, r24
+		0x21, 0x96, // adiw r28, 0x01
+		0xf1, 0xf7, // brne back to the adiw
+		0xff, 0xcf, // rjmp to itself
+		0x08, 0x95, // ret
+		0xff, 0xff, // not an instruction
+	}
+	expected := []string{
+		"jmp\t0x0928", "ldi\tr24, 0x20", "movw\tr24, r28", "lds\tr24, 0x0100", "ld\tr24, X+",
+		"ldd\tr24, Y+10", "ld\tr24, Z", "cbi\t0x0b, 1", "st\tX+, r11", "out\t0x21, r24",
+		"adiw\tr28, 0x01", "brne\t0x0018", "rjmp\t0x001c", "ret", ".word\t0xffff",
+	}
+	instructions := DisassembleAvr(program)
+	if len(instructions) != len(expected) {
+		t.Fatalf("Expected %d instructions, got %d", len(expected), len(instructions))
+	}
+	for i, ins := range instructions {
+		if ins.String() != expected[i] {
+			t.Fatalf("Instruction %d at %x: expected '%s', got '%s'", i, ins.Address, expected[i], ins.String())
+		}
+	}
+	if target, ok := instructions[0].Target(); !ok || target != 0x928 {
+		t.Fatalf("Wrong jmp target: %x", target)
+	}
+	if _, ok := instructions[1].Target(); ok {
+		t.Fatalf("ldi shouldn't have a target")
+	}
+}
+
+func TestAnnotateSketch(t *testing.T) {
+	file, err := os.Open(fileTestPath("qr-generator.hex"))
+	if err != nil {
+		t.Fatalf("Couldn't open hex: %s", err)
+	}
+	defer file.Close()
+	sketch, err := HexToBin(file)
+	if err != nil {
+		t.Fatalf("Couldn't convert hex: %s", err)
+	}
+	var output bytes.Buffer
+	if err = WriteDisassembly(&output, sketch, AnnotateSketch(sketch)); err != nil {
+		t.Fatalf("Couldn't disassemble: %s", err)
+	}
+	for _, expected := range []string{
+		"jmp     0x0928\t; <__init>; vector 0: RESET",
+		"; <__vector_23>; vector 23: TIMER0_OVF",
+		"<lcdBootProgram>:\n   65c:\t.byte\t0xd5, 0xf0",
+		"menu patch site: patchable",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("Disassembly missing '%s'", expected)
+		}
+	}
+}
+
+func TestFindScreenInitTables(t *testing.T) {
+	// Almost a table (wrong ending), then a table at an odd address with a different contrast
+	data := make([]byte, 64)
+	copy(data[3:], LCDBOOTPROGRAM[:7])
+	copy(data[21:], LCDBOOTPROGRAM)
+	data[21+7] = CONTRAST_DIM
+	found := findScreenInitTables(data)
+	if len(found) != 1 || found[0] != 21 {
+		t.Fatalf("Expected one table at 21, got %v", found)
+	}
+	if PatchScreen(data, false, CONTRAST_DIMMEST) != 1 || data[21+7] != CONTRAST_DIMMEST {
+		t.Fatalf("Screen patch didn't apply")
+	}
+}
+
+func TestPatchMenuButtons_BackwardVector(t *testing.T) {
+	// A timer0 vector with an rjmp back past the start of the program
+	program := make([]byte, 1024)
+	program[TIMER0OVFVector*AvrVectorSize] = 0x00
+	program[TIMER0OVFVector*AvrVectorSize+1] = 0xC8
+	if ins := DecodeAvr(program, -4002); ins.Opcode != 0 || ins.Extra != 0 {
+		t.Fatalf("Expected nothing decoded before the program, got %s", ins.String())
+	}
+	ok, message := PatchMenuButtons(program)
+	if ok {
+		t.Fatalf("Menu patch shouldn't apply to a vector outside the program")
+	}
+	if !strings.HasPrefix(message, "No menu patch applied") {
+		t.Fatalf("Unexpected message: %s", message)
+	}
+}
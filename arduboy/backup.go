@@ -0,0 +1,242 @@
+package arduboy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	BackupManifestFile  = "manifest.json"
+	BackupSketchFile    = "sketch.hex"
+	BackupFlashFile     = "flash.bin"
+	BackupEepromFile    = "eeprom.bin"
+	BackupFlashcartFile = "flashcart.bin"
+	BackupVersion       = 1
+)
+
+// Everything about a full device backup, stored as json inside the backup zip.
+// The flashcart fields are empty if the flashcart wasn't backed up
+type BackupManifest struct {
+	Version         int
+	Timestamp       time.Time
+	Device          *ExtendedDeviceInfo
+	SketchLength    int
+	SketchMD5       string
+	FlashMD5        string // Full flash, including bootloader
+	EepromMD5       string
+	FlashcartLength int    `json:",omitempty"`
+	FlashcartSlots  int    `json:",omitempty"`
+	FlashcartMD5    string `json:",omitempty"`
+}
+
+func writeBackupFile(archive *zip.Writer, name string, data []byte, modified time.Time) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// Read the sketch, whole flash, eeprom, and optionally the flashcart from the
+// device and write them all as a zip archive into 'output'. The flashcart is
+// read slot by slot, so only the used portion is saved
+func BackupDevice(sercon io.ReadWriteCloser, device *BasicDeviceInfo, output io.Writer, includeFlashcart bool,
+	progress ProgressReporter) (*BackupManifest, error) {
+	var err error
+	manifest := BackupManifest{
+		Version:   BackupVersion,
+		Timestamp: time.Now(),
+	}
+	manifest.Device, err = QueryDevice(device, sercon, false)
+	if err != nil {
+		return nil, err
+	}
+	archive := zip.NewWriter(output)
+
+	// Flash and sketch come from the same read; the sketch is just a convenience
+	flash, err := ReadFlash(sercon)
+	if err != nil {
+		return nil, err
+	}
+	manifest.FlashMD5 = Md5String(flash)
+	sketch := TrimUnused(flash[:FlashSize-manifest.Device.Bootloader.Length], FlashPageSize)
+	manifest.SketchLength = len(sketch)
+	manifest.SketchMD5 = Md5String(sketch)
+	var sketchHex bytes.Buffer
+	if err = BinToHex(sketch, &sketchHex); err != nil {
+		return nil, err
+	}
+	if err = writeBackupFile(archive, BackupFlashFile, flash, manifest.Timestamp); err != nil {
+		return nil, err
+	}
+	if err = writeBackupFile(archive, BackupSketchFile, sketchHex.Bytes(), manifest.Timestamp); err != nil {
+		return nil, err
+	}
+	progress.report(Progress{Phase: ProgressPhaseRead, Slot: -1, Block: -1,
+		Message: fmt.Sprintf("Backed up flash (sketch is %d bytes)", len(sketch))})
+
+	eeprom, err := ReadEeprom(sercon)
+	if err != nil {
+		return nil, err
+	}
+	manifest.EepromMD5 = Md5String(eeprom)
+	if err = writeBackupFile(archive, BackupEepromFile, eeprom, manifest.Timestamp); err != nil {
+		return nil, err
+	}
+	progress.report(Progress{Phase: ProgressPhaseRead, Slot: -1, Block: -1,
+		Message: "Backed up eeprom"})
+
+	if includeFlashcart && manifest.Device.HasFlashcart {
+		var flashcart bytes.Buffer
+		manifest.FlashcartLength, manifest.FlashcartSlots, err = ReadWholeFlashcart(sercon, &flashcart, progress)
+		if err != nil {
+			return nil, err
+		}
+		manifest.FlashcartMD5 = Md5String(flashcart.Bytes())
+		if err = writeBackupFile(archive, BackupFlashcartFile, flashcart.Bytes(), manifest.Timestamp); err != nil {
+			return nil, err
+		}
+		progress.report(Progress{Phase: ProgressPhaseRead, Slot: -1, Block: -1,
+			Message: fmt.Sprintf("Backed up flashcart (%d slots, %d bytes)", manifest.FlashcartSlots, manifest.FlashcartLength)})
+	}
+
+	rawmanifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeBackupFile(archive, BackupManifestFile, rawmanifest, manifest.Timestamp); err != nil {
+		return nil, err
+	}
+	return &manifest, archive.Close()
+}
+
+// Load a file from the backup, checking its hash against the manifest
+func readBackupFile(archive *zip.Reader, name string, md5 string) ([]byte, error) {
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if Md5String(data) != md5 {
+		return nil, fmt.Errorf("backup file %s is corrupt: md5 doesn't match manifest", name)
+	}
+	return data, nil
+}
+
+// Read just the manifest out of a backup
+func ReadBackupManifest(archive *zip.Reader) (*BackupManifest, error) {
+	file, err := archive.Open(BackupManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var result BackupManifest
+	err = json.NewDecoder(file).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Version != BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version: %d", result.Version)
+	}
+	if result.Device == nil || result.Device.Bootloader == nil {
+		return nil, fmt.Errorf("backup manifest missing device information")
+	}
+	return &result, nil
+}
+
+// Restore a backup made with BackupDevice onto the given device. Everything is
+// checked before anything is written: the backup files must match their
+// hashes, the sketch area must be the same size, and if the flashcart is being
+// restored, the device must have one of the same capacity. The bootloader is
+// never written (the bootloader can't overwrite itself)
+func RestoreDevice(sercon io.ReadWriteCloser, device *BasicDeviceInfo, archive *zip.Reader, restoreFlashcart bool,
+	progress ProgressReporter) (*BackupManifest, error) {
+	manifest, err := ReadBackupManifest(archive)
+	if err != nil {
+		return nil, err
+	}
+	extdata, err := QueryDevice(device, sercon, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compatibility checks
+	if extdata.Bootloader.Length != manifest.Device.Bootloader.Length {
+		return nil, fmt.Errorf("bootloader size differs: backup has %d, device has %d",
+			manifest.Device.Bootloader.Length, extdata.Bootloader.Length)
+	}
+	if extdata.Bootloader.MD5 != manifest.Device.Bootloader.MD5 {
+		log.Printf("WARN: bootloader differs from backup; it will NOT be restored\n")
+	}
+	restoreFlashcart = restoreFlashcart && manifest.FlashcartMD5 != ""
+	if restoreFlashcart {
+		if !extdata.HasFlashcart {
+			return nil, fmt.Errorf("backup has a flashcart but device doesn't")
+		}
+		if extdata.Jedec.Capacity != manifest.Device.Jedec.Capacity {
+			return nil, fmt.Errorf("flashcart capacity differs: backup has %d, device has %d",
+				manifest.Device.Jedec.Capacity, extdata.Jedec.Capacity)
+		}
+	}
+
+	// Load everything up front so a bad backup doesn't leave a half-written device.
+	// The sketch is restored from the full flash, the hex is just for people
+	flash, err := readBackupFile(archive, BackupFlashFile, manifest.FlashMD5)
+	if err != nil {
+		return nil, err
+	}
+	sketch := TrimUnused(flash[:FlashSize-extdata.Bootloader.Length], FlashPageSize)
+	if Md5String(sketch) != manifest.SketchMD5 {
+		return nil, fmt.Errorf("backup sketch doesn't match manifest")
+	}
+	eeprom, err := readBackupFile(archive, BackupEepromFile, manifest.EepromMD5)
+	if err != nil {
+		return nil, err
+	}
+	var flashcart []byte
+	if restoreFlashcart {
+		flashcart, err = readBackupFile(archive, BackupFlashcartFile, manifest.FlashcartMD5)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Now actually write it all
+	var sketchHex bytes.Buffer
+	if err = BinToHex(sketch, &sketchHex); err != nil {
+		return nil, err
+	}
+	if _, _, err = WriteHex(sercon, &sketchHex, true, progress); err != nil {
+		return nil, err
+	}
+	progress.report(Progress{Phase: ProgressPhaseWrite, Slot: -1, Block: -1,
+		Message: fmt.Sprintf("Restored sketch (%d bytes)", len(sketch))})
+	if err = WriteEeprom(sercon, eeprom); err != nil {
+		return nil, err
+	}
+	progress.report(Progress{Phase: ProgressPhaseWrite, Slot: -1, Block: -1,
+		Message: "Restored eeprom"})
+	if restoreFlashcart {
+		blocks, err := WriteWholeFlashcart(sercon, bytes.NewReader(flashcart), len(flashcart), true, progress)
+		if err != nil {
+			return nil, err
+		}
+		progress.report(Progress{Phase: ProgressPhaseWrite, Slot: -1, Block: -1,
+			Message: fmt.Sprintf("Restored flashcart (%d blocks)", blocks)})
+	}
+	return manifest, nil
+}
@@ -0,0 +1,96 @@
+package arduboy
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+)
+
+// Make an emulated device with a random sketch, eeprom, and the minicart
+func newBackupTestEmulator(t *testing.T, capacity int) *EmulatedDevice {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, capacity)
+	rand.Read(emu.Flash[:10000])
+	rand.Read(emu.Eeprom)
+	minicart, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart: %s", err)
+	}
+	copy(emu.Flashcart, minicart)
+	return emu
+}
+
+func backupEmulator(t *testing.T, emu *EmulatedDevice) (*BackupManifest, *zip.Reader) {
+	var output bytes.Buffer
+	manifest, err := BackupDevice(emu, &BasicDeviceInfo{}, &output, true, nil)
+	if err != nil {
+		t.Fatalf("Couldn't backup device: %s", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(output.Bytes()), int64(output.Len()))
+	if err != nil {
+		t.Fatalf("Couldn't open backup: %s", err)
+	}
+	return manifest, archive
+}
+
+func TestBackupRestore(t *testing.T) {
+	emu := newBackupTestEmulator(t, 1<<20)
+	original := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	copy(original.Flash, emu.Flash)
+	copy(original.Eeprom, emu.Eeprom)
+	copy(original.Flashcart, emu.Flashcart)
+
+	manifest, archive := backupEmulator(t, emu)
+	if manifest.SketchLength != 79*FlashPageSize {
+		t.Fatalf("Expected sketch length %d, got %d", 79*FlashPageSize, manifest.SketchLength)
+	}
+	if manifest.FlashcartSlots != 13 {
+		t.Fatalf("Expected 13 flashcart slots, got %d", manifest.FlashcartSlots)
+	}
+	readManifest, err := ReadBackupManifest(archive)
+	if err != nil {
+		t.Fatalf("Couldn't read manifest: %s", err)
+	}
+	if readManifest.FlashMD5 != Md5String(emu.Flash) || readManifest.Device.Jedec.Capacity != 1<<20 {
+		t.Fatalf("Manifest doesn't describe the device: %v", readManifest)
+	}
+
+	// Restore onto a blank device
+	target := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	_, err = RestoreDevice(target, &BasicDeviceInfo{}, archive, true, nil)
+	if err != nil {
+		t.Fatalf("Couldn't restore device: %s", err)
+	}
+	if !bytes.Equal(target.Flash, original.Flash) {
+		t.Fatalf("Flash not restored")
+	}
+	if !bytes.Equal(target.Eeprom, original.Eeprom) {
+		t.Fatalf("Eeprom not restored")
+	}
+	if !bytes.Equal(target.Flashcart, original.Flashcart) {
+		t.Fatalf("Flashcart not restored")
+	}
+}
+
+func TestRestoreIncompatible(t *testing.T) {
+	emu := newBackupTestEmulator(t, 1<<20)
+	_, archive := backupEmulator(t, emu)
+
+	check := func(target *EmulatedDevice, restoreFlashcart bool, expectSuccess bool) {
+		original := bytes.Clone(target.Eeprom)
+		_, err := RestoreDevice(target, &BasicDeviceInfo{}, archive, restoreFlashcart, nil)
+		if (err == nil) != expectSuccess {
+			t.Fatalf("Expected success: %t, got error: %s", expectSuccess, err)
+		}
+		if !expectSuccess && !bytes.Equal(original, target.Eeprom) {
+			t.Fatalf("Failed restore still wrote to the device")
+		}
+	}
+
+	check(newTestEmulator(t, ArduboyFXDeviceKey, 1<<21), true, false)
+	check(newTestEmulator(t, ArduboyFXDeviceKey, 0), true, false)
+	check(newTestEmulator(t, ArduboyDeviceKey, 1<<20), true, false)
+	// Without the flashcart, the capacity doesn't matter
+	check(newTestEmulator(t, ArduboyFXDeviceKey, 1<<21), false, true)
+}
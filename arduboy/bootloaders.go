@@ -0,0 +1,125 @@
+package arduboy
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+)
+
+//go:embed bootloaders.toml
+var knownBootloadersRaw []byte
+
+// Information about a particular official bootloader build. See bootloaders.toml
+type KnownBootloader struct {
+	MD5        string
+	Name       string
+	Version    string
+	Board      string
+	Length     int
+	Flashcart  bool
+	LedControl bool
+	MenuPatch  bool
+	Outdated   bool
+	Notes      string
+}
+
+type knownBootloaderFile struct {
+	Bootloader []KnownBootloader
+}
+
+var (
+	knownBootloaders     map[string]*KnownBootloader
+	knownBootloadersLock sync.Mutex
+)
+
+// Parse a bootloader database in the same format as the embedded bootloaders.toml
+func ParseKnownBootloaders(reader io.Reader) ([]KnownBootloader, error) {
+	var file knownBootloaderFile
+	err := toml.NewDecoder(reader).Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+	for i := range file.Bootloader {
+		file.Bootloader[i].MD5 = strings.ToLower(file.Bootloader[i].MD5)
+		if len(file.Bootloader[i].MD5) != 32 {
+			return nil, fmt.Errorf("bootloader %d has invalid md5: %s", i, file.Bootloader[i].MD5)
+		}
+		length := file.Bootloader[i].Length
+		if length <= 0 || length > CaterinaTotalSize || length%FlashPageSize != 0 {
+			return nil, fmt.Errorf("bootloader %s has invalid length: %d", file.Bootloader[i].MD5, length)
+		}
+	}
+	return file.Bootloader, nil
+}
+
+// Must be called with the lock held
+func loadEmbeddedBootloaders() {
+	if knownBootloaders != nil {
+		return
+	}
+	knownBootloaders = make(map[string]*KnownBootloader)
+	bootloaders, err := ParseKnownBootloaders(bytes.NewReader(knownBootloadersRaw))
+	if err != nil {
+		panic(fmt.Sprintf("PROGRAM ERROR: embedded bootloader database invalid: %s", err))
+	}
+	for i := range bootloaders {
+		knownBootloaders[bootloaders[i].MD5] = &bootloaders[i]
+	}
+}
+
+// Add more known bootloaders on top of the embedded database, such as builds
+// from a local file. Entries with the same MD5 replace existing ones
+func AddKnownBootloaders(bootloaders []KnownBootloader) {
+	knownBootloadersLock.Lock()
+	defer knownBootloadersLock.Unlock()
+	loadEmbeddedBootloaders()
+	for i := range bootloaders {
+		known := bootloaders[i]
+		knownBootloaders[known.MD5] = &known
+	}
+}
+
+// Find a known bootloader by MD5, or nil if the build is unknown
+func FindKnownBootloader(md5 string) *KnownBootloader {
+	knownBootloadersLock.Lock()
+	defer knownBootloadersLock.Unlock()
+	loadEmbeddedBootloaders()
+	return knownBootloaders[strings.ToLower(md5)]
+}
+
+// How many builds are in the database. With none, every bootloader is
+// unknown, which says nothing about whether it was modified
+func KnownBootloaderCount() int {
+	knownBootloadersLock.Lock()
+	defer knownBootloadersLock.Unlock()
+	loadEmbeddedBootloaders()
+	return len(knownBootloaders)
+}
+
+// Given the bootloader region of flash (the last CaterinaTotalSize bytes, which
+// is the largest bootloader), find a known build at the end of it. Tries every
+// bootloader length in the database
+func IdentifyBootloader(region []byte) *KnownBootloader {
+	knownBootloadersLock.Lock()
+	loadEmbeddedBootloaders()
+	lengths := make(map[int]bool)
+	for _, known := range knownBootloaders {
+		lengths[known.Length] = true
+	}
+	knownBootloadersLock.Unlock()
+	for length := range lengths {
+		if length > len(region) {
+			continue
+		}
+		known := FindKnownBootloader(Md5String(region[len(region)-length:]))
+		if known != nil && known.Length == length {
+			return known
+		}
+	}
+	return nil
+}
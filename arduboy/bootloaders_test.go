@@ -0,0 +1,154 @@
+package arduboy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseKnownBootloaders(t *testing.T) {
+	known, err := ParseKnownBootloaders(strings.NewReader(`
+[[bootloader]]
+MD5 = "0123456789ABCDEF0123456789ABCDEF"
+Name = "Cathy3K"
+Version = "1.3"
+Board = "ArduboyFX"
+Length = 3072
+Flashcart = true
+LedControl = true
+MenuPatch = true
+
+[[bootloader]]
+MD5 = "fedcba9876543210fedcba9876543210"
+Name = "Caterina"
+Length = 4096
+Outdated = true
+`))
+	if err != nil {
+		t.Fatalf("Couldn't parse bootloaders: %s", err)
+	}
+	if len(known) != 2 {
+		t.Fatalf("Expected 2 bootloaders, got %d", len(known))
+	}
+	if known[0].MD5 != "0123456789abcdef0123456789abcdef" {
+		t.Fatalf("Expected md5 to be lowercased, got %s", known[0].MD5)
+	}
+	if known[0].Name != "Cathy3K" || known[0].Board != "ArduboyFX" || !known[0].Flashcart || !known[0].MenuPatch {
+		t.Fatalf("Bootloader parsed wrong: %v", known[0])
+	}
+	if known[1].Length != 4096 || !known[1].Outdated || known[1].Flashcart {
+		t.Fatalf("Bootloader parsed wrong: %v", known[1])
+	}
+
+	_, err = ParseKnownBootloaders(strings.NewReader("[[bootloader]]\nMD5 = \"abc\"\nLength = 3072"))
+	if err == nil {
+		t.Fatalf("Expected error for invalid md5")
+	}
+	_, err = ParseKnownBootloaders(strings.NewReader("[[bootloader]]\nMD5 = \"0123456789abcdef0123456789abcdef\"\nLength = 100"))
+	if err == nil {
+		t.Fatalf("Expected error for invalid length")
+	}
+}
+
+func TestEmbeddedBootloaders(t *testing.T) {
+	// Just make sure the embedded database is valid
+	_, err := ParseKnownBootloaders(strings.NewReader(string(knownBootloadersRaw)))
+	if err != nil {
+		t.Fatalf("Embedded bootloader database invalid: %s", err)
+	}
+}
+
+func TestIdentifyBootloader(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	info, err := GetBootloaderInfo(emu)
+	if err != nil {
+		t.Fatalf("Couldn't get bootloader info: %s", err)
+	}
+	if info.Known != nil {
+		t.Fatalf("Emulated bootloader should not be known")
+	}
+	if info.MD5 != Md5String(emu.Flash[FlashSize-CathyTotalSize:]) {
+		t.Fatalf("Bootloader md5 not computed from the end of flash")
+	}
+	// An empty database can't say a build is unknown, so nothing to warn about
+	if KnownBootloaderCount() == 0 && len(info.Warnings) != 0 {
+		t.Fatalf("Expected no warnings without known builds, got %v", info.Warnings)
+	}
+
+	// Other tests use the same emulated bootloader, so put the database back after
+	defer func() {
+		knownBootloadersLock.Lock()
+		knownBootloaders = nil
+		knownBootloadersLock.Unlock()
+	}()
+	AddKnownBootloaders([]KnownBootloader{{MD5: "0123456789abcdef0123456789abcdef", Name: "Cathy3K", Length: 3072}})
+	info, err = GetBootloaderInfo(emu)
+	if err != nil {
+		t.Fatalf("Couldn't get bootloader info: %s", err)
+	}
+	if len(info.Warnings) != 1 || !strings.Contains(info.Warnings[0], "Unknown") {
+		t.Fatalf("Expected an unknown bootloader warning, got %v", info.Warnings)
+	}
+
+	// Pretend the emulated bootloader is a 2K build; the length should follow
+	AddKnownBootloaders([]KnownBootloader{{
+		MD5:      Md5String(emu.Flash[FlashSize-2048:]),
+		Name:     "Cathy2K",
+		Version:  "test",
+		Length:   2048,
+		Outdated: true,
+	}})
+	info, err = GetBootloaderInfo(emu)
+	if err != nil {
+		t.Fatalf("Couldn't get bootloader info: %s", err)
+	}
+	if info.Known == nil || info.Known.Name != "Cathy2K" {
+		t.Fatalf("Expected bootloader to be identified, got %v", info.Known)
+	}
+	if info.Length != 2048 || info.Startpage != (FlashSize-2048)/FlashPageSize {
+		t.Fatalf("Bootloader length not taken from known build: %d, %d", info.Length, info.Startpage)
+	}
+	if len(info.Warnings) != 1 || !strings.Contains(info.Warnings[0], "outdated") {
+		t.Fatalf("Expected an outdated warning, got %v", info.Warnings)
+	}
+}
+
+// Official bootloader .hex files put in testfiles/bootloaders must all be
+// identified, which is how new bootloaders.toml entries get verified
+func TestIdentifyBootloader_Official(t *testing.T) {
+	files, err := filepath.Glob(fileTestPath(filepath.Join("bootloaders", "*.hex")))
+	if err != nil {
+		t.Fatalf("Couldn't list bootloader images: %s", err)
+	}
+	if len(files) == 0 {
+		t.Skip("No official bootloader images in testfiles/bootloaders")
+	}
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Couldn't open %s: %s", path, err)
+		}
+		bootloader, err := HexToBin(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("Couldn't convert %s: %s", path, err)
+		}
+		if len(bootloader) > FlashSize {
+			t.Fatalf("%s is bigger than flash", path)
+		}
+		// Flash as the device has it: the bootloader at the end, erased before it
+		flash := MakePadding(FlashSize)
+		copy(flash, bootloader)
+		known := IdentifyBootloader(flash[FlashSize-CaterinaTotalSize:])
+		if known == nil {
+			hashes := make([]string, 0)
+			for _, length := range []int{2048, CathyTotalSize, CaterinaTotalSize} {
+				hashes = append(hashes, fmt.Sprintf("last %d: %s", length, Md5String(flash[FlashSize-length:])))
+			}
+			t.Fatalf("%s not identified; md5 of the %s", path, strings.Join(hashes, ", "))
+		}
+		t.Logf("%s is %s %s (%s)", filepath.Base(path), known.Name, known.Version, known.Board)
+	}
+}
@@ -0,0 +1,113 @@
+package arduboy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// How far a whole flashcart write got, saved to disk as each block finishes so
+// an interrupted write can pick up where it left off. A checkpoint is only
+// good for the exact same source file written to the same kind of device
+type FlashcartCheckpoint struct {
+	SourceMD5     string
+	SourceLength  int
+	Device        string // Bootloader device type
+	JedecID       string
+	Capacity      int
+	LastGoodBlock int // -1 if no block has been written yet
+	Timestamp     time.Time
+}
+
+// Start a new checkpoint for writing the given source to the given device.
+// The source is hashed and then seeked back to the start
+func NewFlashcartCheckpoint(source io.ReadSeeker, extdata *ExtendedDeviceInfo) (*FlashcartCheckpoint, error) {
+	if extdata.Jedec == nil {
+		return nil, fmt.Errorf("device has no flashcart")
+	}
+	hash := md5.New()
+	length, err := io.Copy(hash, source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = source.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &FlashcartCheckpoint{
+		SourceMD5:     hex.EncodeToString(hash.Sum(nil)),
+		SourceLength:  int(length),
+		Device:        extdata.Bootloader.Device,
+		JedecID:       extdata.Jedec.ID,
+		Capacity:      extdata.Jedec.Capacity,
+		LastGoodBlock: -1,
+		Timestamp:     time.Now(),
+	}, nil
+}
+
+// Load a checkpoint previously written with Save
+func LoadFlashcartCheckpoint(path string) (*FlashcartCheckpoint, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var result FlashcartCheckpoint
+	if err = json.Unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Write the checkpoint to the given path. The file is replaced all at once, so
+// getting interrupted here doesn't lose the previous checkpoint
+func (c *FlashcartCheckpoint) Save(path string) error {
+	c.Timestamp = time.Now()
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err = os.WriteFile(temp, raw, 0660); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Whether a write described by 'current' (a fresh checkpoint) can continue
+// from this one. Returns an error describing the first thing that differs
+func (c *FlashcartCheckpoint) CheckResume(current *FlashcartCheckpoint) error {
+	if c.SourceMD5 != current.SourceMD5 || c.SourceLength != current.SourceLength {
+		return fmt.Errorf("source file changed since checkpoint (md5 %s, now %s)", c.SourceMD5, current.SourceMD5)
+	}
+	if c.Device != current.Device || c.JedecID != current.JedecID {
+		return fmt.Errorf("different device than checkpoint (%s %s, now %s %s)",
+			c.Device, c.JedecID, current.Device, current.JedecID)
+	}
+	if c.Capacity != current.Capacity {
+		return fmt.Errorf("flashcart capacity differs from checkpoint (%d, now %d)", c.Capacity, current.Capacity)
+	}
+	return nil
+}
+
+// Same as WriteWholeFlashcart (or WriteWholeFlashcartDiff if diff is set), but
+// starts after the checkpoint's last good block, and saves the checkpoint to
+// the given path after each block is written and verified. The input must be
+// the whole source from the start; skipped blocks are read and thrown away.
+// Returns the total blocks (including skipped ones) and the number written
+// NOTE: DOES NOT CHECK FOR FLASHCART EXISTENCE OR SIZE
+func WriteWholeFlashcartCheckpointed(sercon io.ReadWriter, input io.Reader, checkpoint *FlashcartCheckpoint, path string,
+	verify bool, diff bool, progress ProgressReporter) (int, int, error) {
+	return writeWholeFlashcart(sercon, input, checkpoint.SourceLength, wholeFlashcartWrite{
+		verify:     verify,
+		diff:       diff,
+		startBlock: checkpoint.LastGoodBlock + 1,
+		blockDone: func(block int) error {
+			checkpoint.LastGoodBlock = block
+			return checkpoint.Save(path)
+		},
+		progress: progress,
+	})
+}
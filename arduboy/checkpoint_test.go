@@ -0,0 +1,97 @@
+package arduboy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func newTestCheckpoint(t *testing.T, emu *EmulatedDevice, cart []byte) *FlashcartCheckpoint {
+	extdata, err := QueryDevice(&BasicDeviceInfo{}, emu, false)
+	if err != nil {
+		t.Fatalf("Couldn't query emulated device: %s", err)
+	}
+	checkpoint, err := NewFlashcartCheckpoint(bytes.NewReader(cart), extdata)
+	if err != nil {
+		t.Fatalf("Couldn't create checkpoint: %s", err)
+	}
+	return checkpoint
+}
+
+func TestFlashcartCheckpoint_Resume(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	cart := make([]byte, 5*FXBlockSize+1000)
+	rand.Read(cart)
+	path, err := newRandomFilepath("checkpoint.json")
+	if err != nil {
+		t.Fatalf("Couldn't make checkpoint path: %s", err)
+	}
+
+	checkpoint := newTestCheckpoint(t, emu, cart)
+	if checkpoint.LastGoodBlock != -1 || checkpoint.SourceLength != len(cart) || checkpoint.SourceMD5 != Md5String(cart) {
+		t.Fatalf("New checkpoint wrong: %v", checkpoint)
+	}
+
+	// Pretend the first 3 blocks were written before getting interrupted
+	checkpoint.LastGoodBlock = 2
+	blocks, written, err := WriteWholeFlashcartCheckpointed(emu, bytes.NewReader(cart), checkpoint, path, true, false, nil)
+	if err != nil {
+		t.Fatalf("Couldn't resume flashcart write: %s", err)
+	}
+	if blocks != 6 || written != 3 {
+		t.Fatalf("Expected 3 of 6 blocks written, got %d of %d", written, blocks)
+	}
+	if !bytes.Equal(emu.Flashcart[:3*FXBlockSize], MakePadding(3*FXBlockSize)) {
+		t.Fatalf("Resumed write touched blocks before the checkpoint")
+	}
+	if !bytes.Equal(emu.Flashcart[3*FXBlockSize:len(cart)], cart[3*FXBlockSize:]) {
+		t.Fatalf("Flashcart doesn't match after resumed write")
+	}
+
+	saved, err := LoadFlashcartCheckpoint(path)
+	if err != nil {
+		t.Fatalf("Couldn't load checkpoint: %s", err)
+	}
+	if saved.LastGoodBlock != 5 {
+		t.Fatalf("Expected checkpoint at block 5, got %d", saved.LastGoodBlock)
+	}
+	if err = saved.CheckResume(newTestCheckpoint(t, emu, cart)); err != nil {
+		t.Fatalf("Saved checkpoint should match: %s", err)
+	}
+
+	// A finished checkpoint has nothing left to write
+	blocks, written, err = WriteWholeFlashcartCheckpointed(emu, bytes.NewReader(cart), saved, path, true, false, nil)
+	if err != nil {
+		t.Fatalf("Couldn't resume finished write: %s", err)
+	}
+	if blocks != 6 || written != 0 {
+		t.Fatalf("Expected 0 of 6 blocks written, got %d of %d", written, blocks)
+	}
+
+	// A source shorter than the checkpoint can't be resumed
+	_, _, err = WriteWholeFlashcartCheckpointed(emu, bytes.NewReader(cart[:FXBlockSize]), saved, path, true, false, nil)
+	if err == nil {
+		t.Fatalf("Expected error resuming past the end of the source")
+	}
+}
+
+func TestFlashcartCheckpoint_Mismatch(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	cart := make([]byte, 2*FXBlockSize)
+	rand.Read(cart)
+	checkpoint := newTestCheckpoint(t, emu, cart)
+
+	changed := bytes.Clone(cart)
+	changed[100]++
+	if checkpoint.CheckResume(newTestCheckpoint(t, emu, changed)) == nil {
+		t.Fatalf("Changed source should not match checkpoint")
+	}
+	bigger := newTestEmulator(t, ArduboyFXDeviceKey, 1<<21)
+	if checkpoint.CheckResume(newTestCheckpoint(t, bigger, cart)) == nil {
+		t.Fatalf("Different capacity should not match checkpoint")
+	}
+	mini := newTestEmulator(t, ArduboyMiniDeviceKey, 1<<20)
+	if checkpoint.CheckResume(newTestCheckpoint(t, mini, cart)) == nil {
+		t.Fatalf("Different device should not match checkpoint")
+	}
+}
@@ -0,0 +1,133 @@
+package arduboy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	ConfigFolder     = "ardugotools"
+	ConfigFile       = "config.toml"
+	ConfigEnvironVar = "ARDUGOTOOLS_CONFIG"
+)
+
+// An extra board to recognize when scanning. VidPid can be written either as
+// it appears in VidPidTable ("VID:PID=2341:0036") or just "2341:0036"
+type BoardConfig struct {
+	VidPid     string
+	Name       string
+	Bootloader bool
+}
+
+// An extra flash chip manufacturer, by the first byte of the jedec id
+type JedecConfig struct {
+	Id           int
+	Manufacturer string
+}
+
+// Defaults for working with devices, used wherever the user doesn't say
+// otherwise. The zero value means "no preference" for everything but
+// Contrast, which uses CONTRAST_NOCHANGE
+type DeviceDefaults struct {
+	Port             string   // Device to use when none is given
+	OverrideCapacity int      // Force flashcart capacity (NOT RECOMMENDED)
+	PatchSsd1309     bool     // Patch sketches for SSD1309 screens
+	PatchMicroLED    bool     // Patch sketches for the micro's LED polarity
+	Contrast         int      // Patch sketches to this contrast
+	Devices          []string // Devices to choose package binaries for, in order
+}
+
+// User settings, loaded from a toml file. See README for the format
+type Config struct {
+	Board    []BoardConfig
+	Jedec    []JedecConfig
+	Defaults DeviceDefaults
+}
+
+// Where the config file is unless the environment says otherwise: the user's
+// config folder (such as ~/.config/ardugotools/config.toml)
+func DefaultConfigPath() (string, error) {
+	if path := os.Getenv(ConfigEnvironVar); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ConfigFolder, ConfigFile), nil
+}
+
+// Put the vidpid in the same format as the VidPidTable keys
+func normalizeVidPid(vidpid string) (string, error) {
+	vidpid = strings.ToUpper(strings.TrimSpace(vidpid))
+	vidpid = strings.TrimPrefix(vidpid, "VID:PID=")
+	parts := strings.Split(vidpid, ":")
+	if len(parts) != 2 || len(parts[0]) != 4 || len(parts[1]) != 4 {
+		return "", fmt.Errorf("invalid vid/pid '%s', expected something like 2341:0036", vidpid)
+	}
+	return "VID:PID=" + vidpid, nil
+}
+
+// Parse a config file. Anything missing from the file keeps its default
+func ParseConfig(reader io.Reader) (*Config, error) {
+	result := Config{
+		Defaults: DeviceDefaults{Contrast: CONTRAST_NOCHANGE},
+	}
+	err := toml.NewDecoder(reader).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result.Board {
+		result.Board[i].VidPid, err = normalizeVidPid(result.Board[i].VidPid)
+		if err != nil {
+			return nil, fmt.Errorf("board %d: %w", i, err)
+		}
+		if result.Board[i].Name == "" {
+			return nil, fmt.Errorf("board %s has no name", result.Board[i].VidPid)
+		}
+	}
+	for _, jedec := range result.Jedec {
+		if jedec.Id <= 0 || jedec.Id > 0xFF || jedec.Manufacturer == "" {
+			return nil, fmt.Errorf("invalid jedec manufacturer: id %d, name '%s'", jedec.Id, jedec.Manufacturer)
+		}
+	}
+	if result.Defaults.Contrast < CONTRAST_NOCHANGE || result.Defaults.Contrast > CONTRAST_HIGHEST {
+		return nil, fmt.Errorf("invalid default contrast: %d", result.Defaults.Contrast)
+	}
+	if result.Defaults.OverrideCapacity < 0 {
+		return nil, fmt.Errorf("invalid default capacity: %d", result.Defaults.OverrideCapacity)
+	}
+	return &result, nil
+}
+
+// Load the config file at the given path. A missing file isn't an error,
+// it's just the default config
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ParseConfig(strings.NewReader(""))
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return ParseConfig(file)
+}
+
+// Add the config's boards and jedec manufacturers to the built-in tables.
+// Entries with the same key replace the built-in ones. Not safe to call while
+// scanning for devices
+func (c *Config) Apply() {
+	for _, board := range c.Board {
+		VidPidTable[board.VidPid] = BasicBoardInfo{Name: board.Name, IsBootloader: board.Bootloader}
+	}
+	for _, jedec := range c.Jedec {
+		JedecManufacturerKeys[jedec.Id] = jedec.Manufacturer
+	}
+}
@@ -0,0 +1,103 @@
+package arduboy
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(`
+[[board]]
+VidPid = "2e8a:00c0"
+Name = "RP2040 Adapter"
+Bootloader = true
+
+[[board]]
+VidPid = "VID:PID=1234:5678"
+Name = "Homebrew"
+
+[[jedec]]
+Id = 0x85
+Manufacturer = "Puya"
+
+[defaults]
+Port = "COM5"
+OverrideCapacity = 16777216
+PatchSsd1309 = true
+Contrast = 0x7F
+Devices = ["ArduboyFX", "Arduboy"]
+`))
+	if err != nil {
+		t.Fatalf("Couldn't parse config: %s", err)
+	}
+	if len(config.Board) != 2 || config.Board[0].VidPid != "VID:PID=2E8A:00C0" || config.Board[1].VidPid != "VID:PID=1234:5678" {
+		t.Fatalf("Boards parsed wrong: %v", config.Board)
+	}
+	if !config.Board[0].Bootloader || config.Board[1].Bootloader {
+		t.Fatalf("Board bootloader flags wrong: %v", config.Board)
+	}
+	if len(config.Jedec) != 1 || config.Jedec[0].Id != 0x85 {
+		t.Fatalf("Jedec parsed wrong: %v", config.Jedec)
+	}
+	d := config.Defaults
+	if d.Port != "COM5" || d.OverrideCapacity != 1<<24 || !d.PatchSsd1309 || d.PatchMicroLED ||
+		d.Contrast != CONTRAST_DIM || len(d.Devices) != 2 || d.Devices[1] != "Arduboy" {
+		t.Fatalf("Defaults parsed wrong: %v", d)
+	}
+
+	bad := []string{
+		"[[board]]\nVidPid = \"2341\"\nName = \"Bad\"",
+		"[[board]]\nVidPid = \"2341:0036\"",
+		"[[jedec]]\nId = 300\nManufacturer = \"Big\"",
+		"[defaults]\nContrast = 256",
+		"[defaults]\nOverrideCapacity = -1",
+	}
+	for _, b := range bad {
+		if _, err = ParseConfig(strings.NewReader(b)); err == nil {
+			t.Fatalf("Expected error for config: %s", b)
+		}
+	}
+}
+
+func TestLoadConfig_Missing(t *testing.T) {
+	config, err := LoadConfig(filepath.Join(testPath(), "doesnotexist.toml"))
+	if err != nil {
+		t.Fatalf("Missing config should not be an error: %s", err)
+	}
+	if config.Defaults.Contrast != CONTRAST_NOCHANGE || config.Defaults.Port != "" || len(config.Board) != 0 {
+		t.Fatalf("Missing config should be the default: %v", config)
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(`
+[[board]]
+VidPid = "2e8a:00c0"
+Name = "RP2040 Adapter"
+Bootloader = true
+
+[[jedec]]
+Id = 0x85
+Manufacturer = "Puya"
+`))
+	if err != nil {
+		t.Fatalf("Couldn't parse config: %s", err)
+	}
+	defer func() {
+		delete(VidPidTable, "VID:PID=2E8A:00C0")
+		delete(JedecManufacturerKeys, 0x85)
+	}()
+	config.Apply()
+	board, ok := VidPidTable["VID:PID=2E8A:00C0"]
+	if !ok || board.Name != "RP2040 Adapter" || !board.IsBootloader {
+		t.Fatalf("Board not added: %v", board)
+	}
+	if JedecManufacturerKeys[0x85] != "Puya" {
+		t.Fatalf("Jedec manufacturer not added")
+	}
+	// Built-ins are still there
+	if VidPidTable["VID:PID=2341:0036"].Name != Board_ArduboyLeonardo {
+		t.Fatalf("Built-in board missing after apply")
+	}
+}
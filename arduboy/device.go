@@ -155,6 +155,8 @@ type BootloaderInfo struct {
 	IsCaterina bool
 	Version    int
 	MD5        string
+	Known      *KnownBootloader // nil if this isn't a build we know about
+	Warnings   []string         // Problems with the bootloader worth telling the user
 }
 
 type ExtendedDeviceInfo struct {
@@ -172,13 +174,21 @@ func VidPidString(vid string, pid string) string {
 // Retrieve a list of all connected arduboys and any information that can be parsed
 // without actually connected to the ports
 func GetBasicDevices() ([]BasicDeviceInfo, error) {
+	return getBasicDevices(true)
+}
+
+// The actual device scan. Repeated scans (such as when watching) don't want
+// to hear about every unrelated port each time, so logging is optional
+func getBasicDevices(verbose bool) ([]BasicDeviceInfo, error) {
 	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
 		return nil, err
 	}
 	result := make([]BasicDeviceInfo, 0)
 	if len(ports) == 0 {
-		log.Println("No serial ports found!")
+		if verbose {
+			log.Println("No serial ports found!")
+		}
 		return result, nil
 	}
 	for _, port := range ports {
@@ -200,10 +210,10 @@ func GetBasicDevices() ([]BasicDeviceInfo, error) {
 					break
 				}
 			}
-			if !foundDevice {
+			if !foundDevice && verbose {
 				log.Println("Non-arduboy device on port ", port.Name, ": ", vidpid)
 			}
-		} else {
+		} else if verbose {
 			log.Println("Port not USB: ", port.Name)
 		}
 	}
@@ -213,8 +223,15 @@ func GetBasicDevices() ([]BasicDeviceInfo, error) {
 // Connect to given port and force bootloader. Accepts "any" as a special port identifier,
 // will connect to "first" connection found. If exact port is given and no bootloader
 // specified, will reboot device and NOT connect, since it is not always possible to
-// reconnect on the same port. If "any" given, will attempt a reconnect after 2 seconds
+// reconnect on the same port. If "any" given, will attempt a reconnect after 2 seconds.
+// Ports with a scheme go through that transport instead of a local serial port:
+// emulated:// connects to an emulated device stored in that directory, trace://
+// replays a trace file recorded with a TraceConnection, and tcp:// and rfc2217://
+// connect to devices shared over the network (see RegisterTransport)
 func ConnectWithBootloader(port string) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+	if connect, address := findTransport(port); connect != nil {
+		return connect(address)
+	}
 	// To make life WAY easier, just query for all arduboys again (even though the user
 	// may have already done this)
 	devices, err := GetBasicDevices()
@@ -262,6 +279,49 @@ func ConnectWithBootloader(port string) (io.ReadWriteCloser, *BasicDeviceInfo, e
 	return sercon, device, nil
 }
 
+// Put every connected device into bootloader mode, returning the bootloaders
+// found afterwards. Nothing is left connected; use ConnectWithBootloader on each
+// port. Devices which fail to reset are logged and skipped, since one bad device
+// shouldn't stop the rest
+func ResetAllToBootloader() ([]BasicDeviceInfo, error) {
+	devices, err := GetBasicDevices()
+	if err != nil {
+		return nil, err
+	}
+	resetCount := 0
+	for _, device := range devices {
+		if device.IsBootloader {
+			continue
+		}
+		log.Println("Attempting to reset device ", device.Port, " (not bootloader)")
+		sercon, err := serial.Open(device.Port, &serial.Mode{BaudRate: RebootBaudRate})
+		if err != nil {
+			log.Printf("Couldn't reset %s: %s\n", device.SmallString(), err)
+			continue
+		}
+		err = sercon.Close()
+		if err != nil {
+			log.Printf("Couldn't reset %s: %s\n", device.SmallString(), err)
+			continue
+		}
+		resetCount++
+	}
+	if resetCount > 0 {
+		time.Sleep(ResetToBootloaderWait)
+		devices, err = GetBasicDevices()
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := make([]BasicDeviceInfo, 0, len(devices))
+	for _, device := range devices {
+		if device.IsBootloader {
+			result = append(result, device)
+		}
+	}
+	return result, nil
+}
+
 // Exit the given bootloader
 func ExitBootloader(sercon io.ReadWriteCloser) error {
 	rwep := ReadWriteErrorPass{rw: sercon}
@@ -292,6 +352,9 @@ func GetBootloaderInfo(sercon io.ReadWriter) (*BootloaderInfo, error) {
 	var version [2]byte
 	rwep.WritePass([]byte("V"))
 	rwep.ReadPass(version[:])
+	if rwep.err != nil {
+		return nil, rwep.err
+	}
 	result.Version, err = strconv.Atoi(string(version[:]))
 	if err != nil {
 		return nil, err
@@ -307,7 +370,8 @@ func GetBootloaderInfo(sercon io.ReadWriter) (*BootloaderInfo, error) {
 		result.IsCaterina = result.Version < 10
 	}
 
-	// TODO: this part NEEDS to be improved!! There's a cathy2K and potentially other bootloaders!
+	// This is only a guess: there's a cathy2K and potentially other bootloaders! Known
+	// builds (checked after the read) override it
 	if result.IsCaterina {
 		result.Length = CaterinaTotalSize
 	} else {
@@ -323,14 +387,43 @@ func GetBootloaderInfo(sercon io.ReadWriter) (*BootloaderInfo, error) {
 	rwep.WritePass(ReadFlashCommand(uint16(CaterinaTotalSize)))
 	rwep.ReadPass(rawbl[:])
 
-	// Cut it down to size before doing work on it. Calculate the hash
-	bootloader := rawbl[:result.Length]
+	if rwep.err != nil {
+		return nil, rwep.err
+	}
+
+	// A known build tells us the true length, which may not be what we guessed
+	result.Known = IdentifyBootloader(rawbl[:])
+	if result.Known != nil {
+		result.Length = result.Known.Length
+		result.Startpage = (FlashSize - result.Length) / FlashPageSize
+	}
+
+	// Cut it down to size before doing work on it. Calculate the hash. The
+	// bootloader is always at the very end of flash
+	bootloader := rawbl[CaterinaTotalSize-result.Length:]
 	result.MD5 = Md5String(bootloader)
 
 	analysis := AnalyzeSketch(bootloader, true)
 	result.Device = analysis.DetectedDevice
+	result.Warnings = bootloaderWarnings(&result)
 
-	return &result, rwep.err
+	return &result, nil
+}
+
+// Everything a user might want to know is wrong with their bootloader
+func bootloaderWarnings(info *BootloaderInfo) []string {
+	result := make([]string, 0)
+	if info.Known == nil {
+		if KnownBootloaderCount() > 0 {
+			result = append(result, fmt.Sprintf("Unknown bootloader build (MD5: %s); it may be modified or simply not in the database", info.MD5))
+		}
+	} else if info.Known.Outdated {
+		result = append(result, fmt.Sprintf("Bootloader %s %s is outdated; consider updating it", info.Known.Name, info.Known.Version))
+	}
+	if info.Version < MinBootloaderWithFlash {
+		result = append(result, fmt.Sprintf("Bootloader version %d is too old for flashcart support (need %d)", info.Version, MinBootloaderWithFlash))
+	}
+	return result
 }
 
 // Ask device for JEDEC info.
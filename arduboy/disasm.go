@@ -0,0 +1,193 @@
+package arduboy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	AvrVectorSize   = 4  // Each vector is a jmp
+	AvrVectorCount  = 43 // On the 32u4
+	TIMER0OVFVector = 23 // The one the menu patch replaces
+
+	disasmDataRowSize = 8
+)
+
+// Names of the 32u4 interrupt vectors, in order
+var AvrVectorNames = [AvrVectorCount]string{
+	"RESET", "INT0", "INT1", "INT2", "INT3", "RESERVED5", "RESERVED6", "INT6",
+	"RESERVED8", "PCINT0", "USB_GEN", "USB_COM", "WDT", "RESERVED13", "RESERVED14",
+	"RESERVED15", "TIMER1_CAPT", "TIMER1_COMPA", "TIMER1_COMPB", "TIMER1_COMPC",
+	"TIMER1_OVF", "TIMER0_COMPA", "TIMER0_COMPB", "TIMER0_OVF", "SPI_STC",
+	"USART1_RX", "USART1_UDRE", "USART1_TX", "ANALOG_COMP", "ADC", "EE_READY",
+	"TIMER3_CAPT", "TIMER3_COMPA", "TIMER3_COMPB", "TIMER3_COMPC", "TIMER3_OVF",
+	"TWI", "SPM_READY", "TIMER4_COMPA", "TIMER4_COMPB", "TIMER4_COMPD",
+	"TIMER4_OVF", "TIMER4_FPF",
+}
+
+// Something known about a particular place in a sketch, for the disassembly
+type SketchAnnotation struct {
+	Address int
+	Length  int    // Nonzero if this is data rather than code (shown as bytes)
+	Label   string // Name for the address, shown above it and wherever it's jumped to
+	Comment string // Shown next to the instruction
+}
+
+// Known opcodes worth pointing out wherever they appear
+var sketchOpcodeComments = []struct {
+	bytes   []byte
+	comment string
+}{
+	{ARDUBOYFXEnableBytes, "FX chip select low (enable)"},
+	{ARDUBOYFXDisableBytes, "FX chip select high (disable)"},
+	{ARDUBOYMINIEnableBytes, "Arduboy Mini FX chip select low (enable)"},
+	{ARDUBOYMINIDisableBytes, "Arduboy Mini FX chip select high (disable)"},
+}
+
+// Find the things in a sketch worth pointing out in a disassembly: the
+// interrupt vectors, FX chip select, the menu patch site, and the screen
+// init table
+func AnnotateSketch(program []byte) []SketchAnnotation {
+	result := make([]SketchAnnotation, 0)
+	// Vectors all jump somewhere; the unused ones all jump to the same place
+	targets := make(map[int][]int)
+	for v := 0; v < AvrVectorCount; v++ {
+		target, ok := DecodeAvr(program, v*AvrVectorSize).jumpTarget()
+		if !ok {
+			break
+		}
+		targets[target] = append(targets[target], v)
+		result = append(result, SketchAnnotation{
+			Address: v * AvrVectorSize,
+			Comment: fmt.Sprintf("vector %d: %s", v, AvrVectorNames[v]),
+		})
+	}
+	for target, vectors := range targets {
+		label := fmt.Sprintf("__vector_%d", vectors[0])
+		if len(vectors) > 1 {
+			label = "__bad_interrupt"
+		} else if vectors[0] == 0 {
+			label = "__init"
+		}
+		result = append(result, SketchAnnotation{Address: target, Label: label})
+	}
+	for pos := 0; pos+1 < len(program); pos += 2 {
+		for _, known := range sketchOpcodeComments {
+			if bytes.HasPrefix(program[pos:], known.bytes) {
+				result = append(result, SketchAnnotation{Address: pos, Comment: known.comment})
+			}
+		}
+	}
+	if len(program) > TIMER0OVFVector*AvrVectorSize+AvrVectorSize {
+		if address, ok := DecodeAvr(program, TIMER0OVFVector*AvrVectorSize).jumpTarget(); ok {
+			site, message := findMenuPatchSite(program)
+			comment := "menu patch site: can't patch (" + strings.TrimSuffix(strings.TrimPrefix(message, "No menu patch applied. "), ".") + ")"
+			if site != nil {
+				comment = fmt.Sprintf("menu patch site: patchable (%d byte ISR)", site.Length)
+			}
+			result = append(result, SketchAnnotation{Address: address, Comment: comment})
+		}
+	}
+	for _, address := range findScreenInitTables(program) {
+		result = append(result, SketchAnnotation{
+			Address: address,
+			Length:  len(LCDBOOTPROGRAM),
+			Label:   "lcdBootProgram",
+			Comment: fmt.Sprintf("screen init table (contrast 0x%02x)", program[address+7]),
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+// Raw bytes in the disassembly, several to a line
+func writeDisasmBytes(sb *strings.Builder, address int, data []byte, comments []string) {
+	for row := 0; row < len(data); row += disasmDataRowSize {
+		hexbytes := make([]string, 0, disasmDataRowSize)
+		for _, b := range data[row:min(row+disasmDataRowSize, len(data))] {
+			hexbytes = append(hexbytes, fmt.Sprintf("0x%02x", b))
+		}
+		fmt.Fprintf(sb, "%6x:\t.byte\t%s", address+row, strings.Join(hexbytes, ", "))
+		if row == 0 && len(comments) > 0 {
+			fmt.Fprintf(sb, "\t; %s", strings.Join(comments, "; "))
+		}
+		sb.WriteString("\n")
+	}
+}
+
+// Write a full disassembly of the program in the style of avr-objdump,
+// with the annotations shown as labels and comments. Data annotations are
+// shown as bytes rather than decoded
+func WriteDisassembly(writer io.Writer, program []byte, annotations []SketchAnnotation) error {
+	byAddress := make(map[int][]SketchAnnotation)
+	labels := make(map[int]string)
+	for _, a := range annotations {
+		byAddress[a.Address] = append(byAddress[a.Address], a)
+		if a.Label != "" {
+			labels[a.Address] = a.Label
+		}
+	}
+	dataStarts := make([]int, 0)
+	for _, a := range annotations {
+		if a.Length > 0 {
+			dataStarts = append(dataStarts, a.Address)
+		}
+	}
+	sort.Ints(dataStarts)
+	nextData := func(pos int) int {
+		i := sort.SearchInts(dataStarts, pos+1)
+		if i < len(dataStarts) {
+			return dataStarts[i]
+		}
+		return len(program)
+	}
+	var sb strings.Builder
+	for pos := 0; pos+1 < len(program); {
+		comments := make([]string, 0)
+		dataEnd := pos
+		for _, a := range byAddress[pos] {
+			if a.Label != "" {
+				fmt.Fprintf(&sb, "\n%08x <%s>:\n", pos, a.Label)
+			}
+			if a.Comment != "" {
+				comments = append(comments, a.Comment)
+			}
+			dataEnd = max(dataEnd, a.Address+a.Length)
+		}
+		if dataEnd > pos {
+			// Keep the instructions after the data aligned
+			dataEnd = min(dataEnd+dataEnd&1, len(program))
+			writeDisasmBytes(&sb, pos, program[pos:dataEnd], comments)
+			pos = dataEnd
+			continue
+		}
+		ins := DecodeAvr(program, pos)
+		// Data doesn't have to start on an instruction boundary
+		if next := nextData(pos); next < pos+ins.Size {
+			writeDisasmBytes(&sb, pos, program[pos:next], comments)
+			pos = next
+			continue
+		}
+		hexbytes := make([]string, 0, 4)
+		for i := pos; i < pos+ins.Size && i < len(program); i++ {
+			hexbytes = append(hexbytes, fmt.Sprintf("%02x", program[i]))
+		}
+		mnemonic, operands := ins.Disassemble()
+		if target, ok := ins.Target(); ok && labels[target] != "" {
+			comments = append([]string{"<" + labels[target] + ">"}, comments...)
+		}
+		fmt.Fprintf(&sb, "%6x:\t%-12s\t%-7s %s", pos, strings.Join(hexbytes, " "), mnemonic, operands)
+		if len(comments) > 0 {
+			fmt.Fprintf(&sb, "\t; %s", strings.Join(comments, "; "))
+		}
+		sb.WriteString("\n")
+		pos += ins.Size
+	}
+	_, err := io.WriteString(writer, sb.String())
+	return err
+}
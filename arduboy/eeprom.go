@@ -3,19 +3,41 @@ package arduboy
 import (
 	"fmt"
 	"io"
+
+	"github.com/marcinbor85/gohex"
 )
 
+// A piece of eeprom at a particular address, such as from a .eep file
+type EepromSegment struct {
+	Address int
+	Data    []byte
+}
+
+func validateEepromRange(address int, length int) error {
+	if address < 0 || length < 0 || address+length > EepromSize {
+		return fmt.Errorf("Eeprom range out of bounds: %d bytes at %d (size: %d)", length, address, EepromSize)
+	}
+	return nil
+}
+
 // Read the entire flash memory, including bootloader. This is ironically faster than
 // just reading the sketch
 func ReadEeprom(sercon io.ReadWriter) ([]byte, error) {
+	return ReadEepromAt(sercon, 0, EepromSize)
+}
+
+// Read only part of the eeprom, starting at the given address
+func ReadEepromAt(sercon io.ReadWriter, address int, length int) ([]byte, error) {
+	if err := validateEepromRange(address, length); err != nil {
+		return nil, err
+	}
 	rwep := ReadWriteErrorPass{rw: sercon}
-	// Read from address 0
-	rwep.WritePass(AddressCommandFlashPage(0))
+	// Eeprom addresses are just the byte offset (unlike flash)
+	rwep.WritePass(AddressCommandRaw(uint16(address)))
 	onebyte := make([]byte, 1)
-	result := make([]byte, EepromSize)
+	result := make([]byte, length)
 	rwep.ReadPass(onebyte)
-	rwep.WritePass(ReadEepromCommand(uint16(EepromSize)))
-	// Read the WHOLE memory (size of eeprom)
+	rwep.WritePass(ReadEepromCommand(uint16(length)))
 	rwep.ReadPass(result)
 	return result, rwep.err
 }
@@ -25,22 +47,64 @@ func WriteEeprom(sercon io.ReadWriter, data []byte) error {
 	if len(data) != EepromSize {
 		return fmt.Errorf("Wrong data size for eeprom! Expect: %d", EepromSize)
 	}
+	return WriteEepromAt(sercon, 0, data)
+}
+
+// Write data to only part of the eeprom, starting at the given address.
+// Much faster than writing the whole thing when only a few bytes changed
+func WriteEepromAt(sercon io.ReadWriter, address int, data []byte) error {
+	if err := validateEepromRange(address, len(data)); err != nil {
+		return err
+	}
 	rwep := ReadWriteErrorPass{rw: sercon}
 	// This eeprom thing actually takes a while. Turn the light to yellow,
 	// then defer the reset
 	SetRgbButtonState(sercon, LEDCtrlBtnOff|LEDCtrlRdOn|LEDCtrlGrOn)
 	defer ResetRgbButtonState(sercon)
-	// Write to address 0
 	onebyte := make([]byte, 1)
-	rwep.WritePass(AddressCommandFlashPage(0))
+	rwep.WritePass(AddressCommandRaw(uint16(address)))
 	rwep.ReadPass(onebyte)
-	rwep.WritePass(WriteEepromCommand(uint16(EepromSize)))
-	// Write the WHOLE memory (size of eeprom)
+	rwep.WritePass(WriteEepromCommand(uint16(len(data))))
 	rwep.WritePass(data)
 	rwep.ReadPass(onebyte)
 	return rwep.err
 }
 
+// Write each segment to its place in eeprom, leaving everything else alone
+func WriteEepromSegments(sercon io.ReadWriter, segments []EepromSegment) error {
+	for _, segment := range segments {
+		if err := WriteEepromAt(sercon, segment.Address, segment.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse intel hex meant for eeprom, such as the .eep file avr-gcc builds
+// alongside a sketch. Every segment must fit within eeprom
+func ParseEepromHex(reader io.Reader) ([]EepromSegment, error) {
+	hexmem := gohex.NewMemory()
+	err := hexmem.ParseIntelHex(reader)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]EepromSegment, 0)
+	for _, segment := range hexmem.GetDataSegments() {
+		if err := validateEepromRange(int(segment.Address), len(segment.Data)); err != nil {
+			return nil, err
+		}
+		result = append(result, EepromSegment{Address: int(segment.Address), Data: segment.Data})
+	}
+	return result, nil
+}
+
+// Put the segments on top of a full eeprom image (modifies it)
+func ApplyEepromSegments(eeprom []byte, segments []EepromSegment) {
+	for _, segment := range segments {
+		copy(eeprom[segment.Address:], segment.Data)
+	}
+}
+
 // Delete the entire eeprom
 func DeleteEeprom(sercon io.ReadWriter) error {
 	eeprom := make([]byte, EepromSize)
@@ -0,0 +1,507 @@
+package arduboy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// I/O addresses (for in/out) of the eeprom registers on the 32u4. The data
+// space addresses (for lds/sts) are avrIOOffset higher
+const (
+	avrEECR     = 0x1F
+	avrEEARL    = 0x21
+	avrEEARH    = 0x22
+	avrIOOffset = 0x20
+)
+
+// Limits on how far the analysis looks around any one instruction. The
+// analysis is only a guess anyway, and looking further mostly finds garbage
+const (
+	eepromTraceBudget  = 64 // Instructions explored when checking if a function is an eeprom routine
+	eepromTraceDepth   = 2  // How deep into calls the routine check follows
+	eepromResolveSteps = 16 // Instructions searched backwards for a constant register value
+	eepromLoopSteps    = 12 // Instructions searched forwards for a loop bound
+	eepromInlineSteps  = 8  // Instructions searched around an inline EEAR write
+)
+
+// A single place in the sketch which reads or writes eeprom at a known address
+type EepromAccess struct {
+	CodeAddress int  // Byte address in flash of the call or register write
+	Start       int  // First eeprom address accessed
+	Length      int  // Number of bytes accessed
+	Write       bool // Whether this writes (otherwise it only reads)
+	Loop        bool // Whether the range was estimated from a loop around the access
+}
+
+// The estimated eeprom usage of a sketch, found by scanning the code for
+// eeprom accesses. Only accesses with constant addresses can be placed, so
+// this is a lower bound on what the sketch really uses
+type EepromFootprint struct {
+	Accesses   []EepromAccess `json:",omitempty"`
+	Unresolved int            // Accesses whose address couldn't be figured out
+	UsesSystem bool           // Whether the sketch touches the Arduboy2 system area
+	Start      int            // Start of the sketch data range, outside the system area
+	End        int            // End (exclusive) of the sketch data range. 0 if none found
+}
+
+type eepromRoutine struct {
+	Block bool // Address in r22:r23 and length in r20:r21, rather than address in r24:r25
+	Write bool
+}
+
+type avrProgram struct {
+	instructions []AvrInstruction
+	index        map[int]int // Byte address to instruction index
+	routines     map[int]*eepromRoutine
+	inRoutine    map[int]bool // Instruction indexes which are part of an eeprom routine
+}
+
+func newAvrProgram(bindata []byte) *avrProgram {
+	result := avrProgram{
+		instructions: DisassembleAvr(bindata),
+		index:        make(map[int]int),
+		routines:     make(map[int]*eepromRoutine),
+		inRoutine:    make(map[int]bool),
+	}
+	for i, ins := range result.instructions {
+		result.index[ins.Address] = i
+	}
+	return &result
+}
+
+// Register written to the given I/O address, by either out or sts
+func (ins AvrInstruction) ioWrite() (int, int, bool) {
+	if (ins.Opcode & 0xF800) == 0xB800 {
+		return int(ins.Opcode>>5)&0x30 | int(ins.Opcode&0xF), int(ins.Opcode>>4) & 0x1F, true
+	} else if (ins.Opcode&0xFE0F) == 0x9200 && ins.Extra >= avrIOOffset {
+		return int(ins.Extra) - avrIOOffset, int(ins.Opcode>>4) & 0x1F, true
+	}
+	return 0, 0, false
+}
+
+// Whether this is sbi on EECR, and if so whether it starts a read or write
+func (ins AvrInstruction) eepromStrobe() (bool, bool) {
+	if (ins.Opcode&0xFF00) != 0x9A00 || int(ins.Opcode>>3)&0x1F != avrEECR {
+		return false, false
+	}
+	bit := ins.Opcode & 7
+	return bit == 0, bit == 1 || bit == 2
+}
+
+// Registers which a call may change, in the avr-gcc calling convention
+func avrCallClobbered(reg int) bool {
+	return reg == 0 || (reg >= 18 && reg <= 27) || reg >= 30
+}
+
+func (p *avrProgram) instructionAt(address int) (int, bool) {
+	i, ok := p.index[address]
+	return i, ok
+}
+
+type eepromTracePath struct {
+	index int
+	alias [32]int // Which argument register each register still holds, or -1
+}
+
+type eepromTrace struct {
+	source  int // Argument register the address came from, -1 if not an argument
+	found   bool
+	read    bool
+	write   bool
+	budget  int
+	visited map[int]bool
+}
+
+// Explore a function for EEAR writes and EECR strobes, keeping track of
+// which registers still hold the function arguments
+func (p *avrProgram) traceRoutine(start int, alias [32]int, depth int, t *eepromTrace) {
+	work := []eepromTracePath{{index: start, alias: alias}}
+	for len(work) > 0 {
+		path := work[len(work)-1]
+		work = work[:len(work)-1]
+		for i := path.index; i >= 0 && i < len(p.instructions); i++ {
+			if t.budget <= 0 || t.visited[i] {
+				break
+			}
+			t.visited[i] = true
+			t.budget--
+			ins := p.instructions[i]
+			if ins.isEnd() {
+				break
+			}
+			if io, reg, ok := ins.ioWrite(); ok && io == avrEEARL && !t.found {
+				t.found = true
+				t.source = path.alias[reg]
+			}
+			if read, write := ins.eepromStrobe(); read || write {
+				t.read = t.read || read
+				t.write = t.write || write
+			}
+			if target, ok := ins.callTarget(); ok || ins.isIndirectCall() {
+				if ti, ok := p.instructionAt(target); ok && depth < eepromTraceDepth && !ins.isIndirectCall() {
+					p.traceRoutine(ti, path.alias, depth+1, t)
+				}
+				for r := range path.alias {
+					if avrCallClobbered(r) {
+						path.alias[r] = -1
+					}
+				}
+				continue
+			}
+			if target, ok := ins.jumpTarget(); ok {
+				if ti, ok := p.instructionAt(target); ok {
+					work = append(work, eepromTracePath{index: ti, alias: path.alias})
+				}
+				break
+			}
+			if target, ok := ins.branchTarget(); ok {
+				if ti, ok := p.instructionAt(target); ok {
+					work = append(work, eepromTracePath{index: ti, alias: path.alias})
+				}
+			} else if ins.isSkip() {
+				work = append(work, eepromTracePath{index: i + 2, alias: path.alias})
+			}
+			if d, r, pair, ok := ins.move(); ok {
+				path.alias[d] = path.alias[r]
+				if pair {
+					path.alias[d+1] = path.alias[r+1]
+				}
+				continue
+			}
+			written := ins.writes()
+			for r := range path.alias {
+				if written&(1<<r) != 0 {
+					path.alias[r] = -1
+				}
+			}
+		}
+	}
+}
+
+// Find every function which is called and looks like an eeprom library
+// routine (eeprom_read_byte, eeprom_write_block, etc), or a wrapper around one
+func (p *avrProgram) findRoutines() {
+	var args [32]int
+	for r := range args {
+		args[r] = r
+	}
+	for _, ins := range p.instructions {
+		target, ok := ins.callTarget()
+		if !ok {
+			continue
+		}
+		ti, ok := p.instructionAt(target)
+		if _, seen := p.routines[target]; !ok || seen {
+			continue
+		}
+		t := eepromTrace{source: -1, budget: eepromTraceBudget, visited: make(map[int]bool)}
+		p.traceRoutine(ti, args, 0, &t)
+		if t.found && (t.read || t.write) && (t.source == 24 || t.source == 22) {
+			p.routines[target] = &eepromRoutine{Block: t.source == 22, Write: t.write}
+			for i := range t.visited {
+				p.inRoutine[i] = true
+			}
+		} else {
+			p.routines[target] = nil
+		}
+	}
+}
+
+// Search backwards from the given instruction for a constant loaded into the
+// register. Returns the register the constant was loaded into, which may not
+// be the one asked for if the value was moved around
+func (p *avrProgram) resolve(index int, reg int) (int, int, bool) {
+	if reg == 1 {
+		return 0, reg, true // avr-gcc always keeps r1 at zero
+	}
+	for i := index - 1; i >= 0 && i >= index-eepromResolveSteps; i-- {
+		ins := p.instructions[i]
+		if ins.isEnd() {
+			return 0, reg, false
+		}
+		if _, ok := ins.jumpTarget(); ok {
+			return 0, reg, false
+		}
+		if _, ok := ins.callTarget(); ok || ins.isIndirectCall() {
+			if avrCallClobbered(reg) {
+				return 0, reg, false
+			}
+			continue
+		}
+		if d, value, ok := ins.constant(); ok && d == reg {
+			return value, reg, true
+		}
+		if d, r, pair, ok := ins.move(); ok {
+			if pair && d == reg&^1 {
+				reg = r + reg&1
+			} else if !pair && d == reg {
+				reg = r
+				if reg == 1 {
+					return 0, reg, true
+				}
+			}
+			continue
+		}
+		if ins.writes()&(1<<reg) != 0 {
+			return 0, reg, false
+		}
+	}
+	return 0, reg, false
+}
+
+// Resolve a 16 bit value held in a register pair. Constant offsets added with
+// adiw/sbiw are followed too, since a base address plus an offset is common
+func (p *avrProgram) resolvePair(index int, lo int, hi int) (int, int, int, bool) {
+	offset := 0
+	from := index
+	for i := index - 1; i >= 0 && i >= index-eepromResolveSteps; i-- {
+		ins := p.instructions[i]
+		w := ins.Opcode
+		if (w&0xFE00) == 0x9600 && 24+int(w>>4&3)*2 == lo && hi == lo+1 { // adiw, sbiw
+			k := int(w>>2)&0x30 | int(w&0xF)
+			if (w & 0x0100) != 0 {
+				k = -k
+			}
+			offset += k
+		} else if d, r, pair, ok := ins.move(); ok && pair && d == lo && hi == lo+1 {
+			lo, hi = r, r+1
+		} else if ins.writes()&(1<<lo|1<<hi) != 0 || ins.isEnd() || ins.isIndirectCall() {
+			break
+		} else if _, ok := ins.callTarget(); ok {
+			break
+		} else if _, ok := ins.jumpTarget(); ok {
+			break
+		} else {
+			continue
+		}
+		from = i
+	}
+	lov, loreg, lok := p.resolve(from, lo)
+	hiv, hireg, hok := p.resolve(from, hi)
+	return (lov | hiv<<8) + offset, loreg, hireg, lok && hok
+}
+
+// If the address registers are counters in a loop around the access (like
+// what EEPROM.put and EEPROM.get compile to), find where the loop ends.
+// Returns the end address and how much the address goes up each time around
+func (p *avrProgram) loopEnd(index int, start int, lo int, hi int) (int, int, bool) {
+	// The counter must survive the call, or it can't be the loop counter
+	if avrCallClobbered(lo) || avrCallClobbered(hi) {
+		return 0, 0, false
+	}
+	step := 0
+	for i := index + 1; i < len(p.instructions) && i <= index+eepromLoopSteps; i++ {
+		ins := p.instructions[i]
+		w := ins.Opcode
+		if (w&0xFF00) == 0x9600 && 24+int(w>>4&3)*2 == lo { // adiw
+			step = int(w>>2)&0x30 | int(w&0xF)
+		} else if (w&0xF000) == 0x5000 && 16+int(w>>4&0xF) == lo { // subi (negative)
+			step = (256 - (int(w>>4)&0xF0 | int(w&0xF))) & 0xFF
+		} else if w == uint16(0x9403|lo<<4) { // inc
+			step = 1
+		}
+		endlo, found := -1, false
+		if (w&0xF000) == 0x3000 && 16+int(w>>4&0xF) == lo { // cpi
+			endlo, found = int(w>>4)&0xF0|int(w&0xF), true
+		} else if (w&0xFC00) == 0x1400 && int(w>>4)&0x1F == lo { // cp
+			endlo, _, found = p.resolve(i, int(w&0xF)|int(w>>5)&0x10)
+		}
+		if !found {
+			continue
+		}
+		if step == 0 {
+			return 0, 0, false
+		}
+		end := start&0xFF00 | endlo
+		if i+1 < len(p.instructions) {
+			next := p.instructions[i+1]
+			nw := next.Opcode
+			if (nw&0xFC00) == 0x0400 && int(nw>>4)&0x1F == hi { // cpc
+				if endhi, _, ok := p.resolve(i+1, int(nw&0xF)|int(nw>>5)&0x10); ok {
+					end = endhi<<8 | endlo
+				}
+			} else if (nw&0xF000) == 0xE000 && i+2 < len(p.instructions) { // ldi then cpc
+				after := p.instructions[i+2].Opcode
+				if (after&0xFC00) == 0x0400 && int(after>>4)&0x1F == hi {
+					if endhi, _, ok := p.resolve(i+2, int(after&0xF)|int(after>>5)&0x10); ok {
+						end = endhi<<8 | endlo
+					}
+				}
+			}
+		}
+		if end <= start {
+			return 0, 0, false
+		}
+		return end, step, true
+	}
+	return 0, 0, false
+}
+
+// Eeprom accesses made by calling one of the eeprom routines
+func (p *avrProgram) callAccess(index int, routine *eepromRoutine) (EepromAccess, bool) {
+	ins := p.instructions[index]
+	access := EepromAccess{CodeAddress: ins.Address, Length: 1, Write: routine.Write}
+	lo, hi := 24, 25
+	if routine.Block {
+		lo, hi = 22, 23
+		length, _, _, ok := p.resolvePair(index, 20, 21)
+		if !ok || length == 0 {
+			return access, false
+		}
+		access.Length = length
+	}
+	start, loreg, hireg, ok := p.resolvePair(index, lo, hi)
+	if !ok {
+		return access, false
+	}
+	access.Start = start
+	if end, step, ok := p.loopEnd(index, start, loreg, hireg); ok {
+		access.Loop = true
+		access.Length = end - start + max(access.Length-step, 0)
+	}
+	return access, true
+}
+
+// Eeprom accesses made by writing EEAR directly in the sketch
+func (p *avrProgram) inlineAccess(index int, reg int) (EepromAccess, bool, bool) {
+	ins := p.instructions[index]
+	access := EepromAccess{CodeAddress: ins.Address, Length: 1}
+	strobe := false
+	for i := index + 1; i < len(p.instructions) && i <= index+eepromInlineSteps; i++ {
+		read, write := p.instructions[i].eepromStrobe()
+		access.Write = access.Write || write
+		strobe = strobe || read || write
+	}
+	// Without a read or write soon after, this is probably just data
+	if !strobe {
+		return access, false, false
+	}
+	lo, _, ok := p.resolve(index, reg)
+	if !ok {
+		return access, true, false
+	}
+	for i := index; i >= 0 && i >= index-eepromInlineSteps; i-- {
+		if io, hreg, isio := p.instructions[i].ioWrite(); isio && io == avrEEARH {
+			hi, _, hok := p.resolve(i, hreg)
+			access.Start = lo | hi<<8
+			return access, true, hok
+		}
+	}
+	return access, true, false
+}
+
+// Statically scan the sketch code for eeprom accesses, estimating the range
+// of eeprom the sketch uses. Finds calls to the avr-libc eeprom routines (which
+// the Arduino EEPROM library uses) and direct writes to the EEAR register. Only
+// constant addresses (and simple loops) can be placed
+func AnalyzeEeprom(bindata []byte) EepromFootprint {
+	result := EepromFootprint{Accesses: make([]EepromAccess, 0)}
+	p := newAvrProgram(bindata)
+	p.findRoutines()
+	for i, ins := range p.instructions {
+		if p.inRoutine[i] {
+			continue
+		}
+		var access EepromAccess
+		var isaccess, resolved bool
+		if target, ok := ins.callTarget(); ok && p.routines[target] != nil {
+			isaccess = true
+			access, resolved = p.callAccess(i, p.routines[target])
+		} else if io, reg, ok := ins.ioWrite(); ok && io == avrEEARL {
+			access, isaccess, resolved = p.inlineAccess(i, reg)
+		}
+		if !isaccess {
+			continue
+		}
+		if !resolved || access.Start+access.Length > EepromSize {
+			result.Unresolved++
+			continue
+		}
+		result.Accesses = append(result.Accesses, access)
+		if access.Start < EepromSystemSize {
+			result.UsesSystem = true
+		}
+		end := access.Start + access.Length
+		if end <= EepromSystemSize {
+			continue
+		}
+		start := max(access.Start, EepromSystemSize)
+		if result.End == 0 || start < result.Start {
+			result.Start = start
+		}
+		result.End = max(result.End, end)
+	}
+	return result
+}
+
+// The eeprom footprint of one game in a flashcart
+type SlotEepromFootprint struct {
+	Title   string
+	Address int // Address of the slot header in the flashcart
+	Eeprom  EepromFootprint
+}
+
+// Two games in a flashcart which use some of the same eeprom
+type EepromOverlap struct {
+	First  string
+	Second string
+	Start  int
+	End    int // Exclusive
+}
+
+// Analyze the eeprom usage of every game in a flashcart file
+func MapFlashcartEeprom(data io.ReadSeeker) ([]SlotEepromFootprint, error) {
+	result := make([]SlotEepromFootprint, 0)
+	scanFunc := func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
+		if header.IsCategory() {
+			return nil
+		}
+		sketch := make([]byte, int(header.ProgramPages)*FlashPageSize)
+		if err := SeekRead(f, int64(int(header.ProgramStart)*FXPageSize), sketch); err != nil {
+			return fmt.Errorf("Couldn't read sketch for %s: %s", header.Title, err)
+		}
+		result = append(result, SlotEepromFootprint{
+			Title:   header.Title,
+			Address: addr,
+			Eeprom:  AnalyzeSketch(sketch, false).Eeprom,
+		})
+		return nil
+	}
+	if _, err := ScanFlashcartFile(data, scanFunc); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Find all pairs of games whose eeprom ranges overlap. The system area is
+// shared on purpose, so it is never counted. Games with accesses that
+// couldn't be resolved may use more than their range says (or have no range
+// at all), so their titles are returned separately: no overlap found for
+// them doesn't mean there isn't one
+func FindEepromOverlaps(slots []SlotEepromFootprint) ([]EepromOverlap, []string) {
+	result := make([]EepromOverlap, 0)
+	unknown := make([]string, 0)
+	for i := range slots {
+		if slots[i].Eeprom.Unresolved > 0 {
+			unknown = append(unknown, slots[i].Title)
+		}
+		for j := i + 1; j < len(slots); j++ {
+			a, b := slots[i].Eeprom, slots[j].Eeprom
+			start, end := max(a.Start, b.Start), min(a.End, b.End)
+			if a.End == 0 || b.End == 0 || start >= end {
+				continue
+			}
+			result = append(result, EepromOverlap{
+				First:  slots[i].Title,
+				Second: slots[j].Title,
+				Start:  start,
+				End:    end,
+			})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].End-result[i].Start > result[j].End-result[j].Start
+	})
+	return result, unknown
+}
@@ -0,0 +1,117 @@
+package arduboy
+
+import (
+	"os"
+	"testing"
+)
+
+const (
+	testReadByteWord  = 0x40 // Word address of the fake eeprom_read_byte
+	testWriteByteWord = 0x50 // Word address of the fake eeprom_write_byte
+)
+
+// A tiny sketch which uses eeprom the way avr-gcc and avr-libc do
+func makeEepromTestSketch() []byte {
+	code := make([]uint16, FlashPageSize) // AnalyzeSketch wants whole pages
+	copy(code, []uint16{
+		0xE280, 0xE091, 0x940E, testReadByteWord, // ldi r24,0x20; ldi r25,0x01; call eeprom_read_byte
+		0xE065, 0xE082, 0xE090, 0x940E, testWriteByteWord, // ldi r22,5; ldi r24,2; ldi r25,0; call eeprom_write_byte
+		0xE4C0, 0xE0D0, 0x01CE, 0x940E, testReadByteWord, // ldi r28,0x40; ldi r29,0; movw r24,r28; call eeprom_read_byte
+		0x9621, 0x35C0, 0x05D1, 0xF7C1, // adiw r28,1; cpi r28,0x50; cpc r29,r1; brne
+		0x9180, 0x0100, 0x9190, 0x0101, 0x940E, testReadByteWord, // lds r24; lds r25; call eeprom_read_byte
+		0xE320, 0xE030, 0xBD32, 0xBD21, 0x9AF8, // ldi r18,0x30; ldi r19,0; out EEARH,r19; out EEARL,r18; sbi EECR,EERE
+		0x9508, // ret
+	})
+	copy(code[testReadByteWord:], []uint16{
+		0x99F9, 0xCFFE, 0xBD92, 0xBD81, 0x9AF8, 0x2799, 0xB580, 0x9508,
+	})
+	copy(code[testWriteByteWord:], []uint16{
+		0x2F26, 0x99F9, 0xCFFE, 0xBA1F, 0xBD92, 0xBD81, 0xBD20, 0xB60F,
+		0x94F8, 0x9AFA, 0x9AF9, 0xBE0F, 0x9601, 0x9508,
+	})
+	result := make([]byte, len(code)*2)
+	for i, w := range code {
+		result[i*2] = byte(w)
+		result[i*2+1] = byte(w >> 8)
+	}
+	return result
+}
+
+func TestAnalyzeEeprom(t *testing.T) {
+	footprint := AnalyzeSketch(makeEepromTestSketch(), false).Eeprom
+	expected := []EepromAccess{
+		{CodeAddress: 0x4, Start: 0x120, Length: 1},
+		{CodeAddress: 0xE, Start: 2, Length: 1, Write: true},
+		{CodeAddress: 0x18, Start: 0x40, Length: 16, Loop: true},
+		{CodeAddress: 0x36, Start: 0x30, Length: 1},
+	}
+	if len(footprint.Accesses) != len(expected) {
+		t.Fatalf("Expected %d accesses, got %v", len(expected), footprint.Accesses)
+	}
+	for i := range expected {
+		if footprint.Accesses[i] != expected[i] {
+			t.Fatalf("Access %d wrong: expected %v, got %v", i, expected[i], footprint.Accesses[i])
+		}
+	}
+	if footprint.Unresolved != 1 || !footprint.UsesSystem || footprint.Start != 0x30 || footprint.End != 0x121 {
+		t.Fatalf("Wrong footprint: %v", footprint)
+	}
+	// Bootloaders aren't analyzed
+	if len(AnalyzeSketch(makeEepromTestSketch(), true).Eeprom.Accesses) != 0 {
+		t.Fatalf("Bootloader shouldn't have eeprom analysis")
+	}
+}
+
+func TestFindEepromOverlaps(t *testing.T) {
+	slots := []SlotEepromFootprint{
+		{Title: "a", Eeprom: EepromFootprint{Start: 16, End: 100}},
+		{Title: "b", Eeprom: EepromFootprint{Start: 90, End: 200}},
+		{Title: "c", Eeprom: EepromFootprint{Start: 200, End: 300}},
+		{Title: "d", Eeprom: EepromFootprint{UsesSystem: true}},
+		{Title: "e", Eeprom: EepromFootprint{Start: 16, End: 20}},
+		{Title: "f", Eeprom: EepromFootprint{Unresolved: 2}},
+	}
+	overlaps, unknown := FindEepromOverlaps(slots)
+	if len(unknown) != 1 || unknown[0] != "f" {
+		t.Fatalf("Expected only f to be unknown, got %v", unknown)
+	}
+	if len(overlaps) != 2 {
+		t.Fatalf("Expected 2 overlaps, got %v", overlaps)
+	}
+	if overlaps[0].First != "a" || overlaps[0].Second != "b" || overlaps[0].Start != 90 || overlaps[0].End != 100 {
+		t.Fatalf("Wrong first overlap: %v", overlaps[0])
+	}
+	if overlaps[1].First != "a" || overlaps[1].Second != "e" {
+		t.Fatalf("Wrong second overlap: %v", overlaps[1])
+	}
+}
+
+func TestMapFlashcartEeprom(t *testing.T) {
+	file, err := os.Open(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't open minicart: %s", err)
+	}
+	defer file.Close()
+	slots, err := MapFlashcartEeprom(file)
+	if err != nil {
+		t.Fatalf("Couldn't map flashcart eeprom: %s", err)
+	}
+	if len(slots) != 10 {
+		t.Fatalf("Expected 10 games, got %d", len(slots))
+	}
+	found := false
+	for _, slot := range slots {
+		if slot.Eeprom.End > slot.Eeprom.Start {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected at least one game with eeprom data in the minicart")
+	}
+	// Some of the minicart games access eeprom in ways that can't be followed,
+	// which has to be reported rather than counted as no overlap
+	_, unknown := FindEepromOverlaps(slots)
+	if len(unknown) == 0 {
+		t.Fatalf("Expected some games with unknown eeprom use in the minicart")
+	}
+}
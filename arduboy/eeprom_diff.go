@@ -0,0 +1,125 @@
+package arduboy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	EepromDiffRowSize = 16
+)
+
+// One row of an eeprom diff which has at least one changed byte
+type EepromDiffRow struct {
+	Address int
+	Left    []byte
+	Right   []byte
+	Changed []bool
+	Regions []string // What the changed bytes are used for
+}
+
+// What the byte at the given eeprom address is used for
+func EepromRegion(address int) string {
+	switch {
+	case address == eepromVersionOffset:
+		return "system: version"
+	case address == eepromSysFlagsOffset:
+		return "system: flags"
+	case address == eepromAudioOffset:
+		return "system: audio"
+	case address < eepromUnitIDOffset:
+		return "system: reserved"
+	case address < eepromUnitNameOffset:
+		return "system: unit id"
+	case address < EepromSystemSize:
+		return "system: unit name"
+	default:
+		return "sketch data"
+	}
+}
+
+// Compare two eeproms (or two pieces of the same size), returning only the rows
+// which differ. Addresses start at the given base
+func DiffEeprom(left []byte, right []byte, base int) ([]EepromDiffRow, int, error) {
+	if len(left) != len(right) {
+		return nil, 0, fmt.Errorf("Can't diff eeproms of different sizes: %d vs %d", len(left), len(right))
+	}
+	result := make([]EepromDiffRow, 0)
+	changedTotal := 0
+	for start := 0; start < len(left); start += EepromDiffRowSize {
+		end := min(start+EepromDiffRowSize, len(left))
+		row := EepromDiffRow{
+			Address: base + start,
+			Left:    left[start:end],
+			Right:   right[start:end],
+			Changed: make([]bool, end-start),
+			Regions: make([]string, 0),
+		}
+		for i := range row.Left {
+			if row.Left[i] != row.Right[i] {
+				row.Changed[i] = true
+				changedTotal++
+				region := EepromRegion(row.Address + i)
+				if len(row.Regions) == 0 || row.Regions[len(row.Regions)-1] != region {
+					row.Regions = append(row.Regions, region)
+				}
+			}
+		}
+		if len(row.Regions) > 0 {
+			result = append(result, row)
+		}
+	}
+	return result, changedTotal, nil
+}
+
+func hexdumpLine(prefix string, address int, data []byte) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s 0x%04x: ", prefix, address)
+	for i := 0; i < EepromDiffRowSize; i++ {
+		if i == EepromDiffRowSize/2 {
+			sb.WriteString(" ")
+		}
+		if i < len(data) {
+			fmt.Fprintf(&sb, "%02x ", data[i])
+		} else {
+			sb.WriteString("   ")
+		}
+	}
+	sb.WriteString(" |")
+	for _, b := range data {
+		if b >= ' ' && b <= '~' {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteByte('.')
+		}
+	}
+	sb.WriteString("|\n")
+	return sb.String()
+}
+
+// Write the diff as a hexdump, similar to a unified diff: each changed row is
+// shown from both sides, with the changed bytes marked underneath
+func WriteEepromDiff(writer io.Writer, rows []EepromDiffRow, leftName string, rightName string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", leftName, rightName)
+	for _, row := range rows {
+		fmt.Fprintf(&sb, "@@ 0x%04x %s\n", row.Address, strings.Join(row.Regions, ", "))
+		sb.WriteString(hexdumpLine("-", row.Address, row.Left))
+		sb.WriteString(hexdumpLine("+", row.Address, row.Right))
+		markers := strings.Repeat(" ", len("- 0x0000: "))
+		for i, changed := range row.Changed {
+			if i == EepromDiffRowSize/2 {
+				markers += " "
+			}
+			if changed {
+				markers += "^^ "
+			} else {
+				markers += "   "
+			}
+		}
+		sb.WriteString(strings.TrimRight(markers, " ") + "\n")
+	}
+	_, err := io.WriteString(writer, sb.String())
+	return err
+}
@@ -0,0 +1,167 @@
+package arduboy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The Arduboy2 library keeps its settings in the first bytes of eeprom. Sketches
+// are supposed to leave this area alone
+const (
+	EepromSystemSize   = 16
+	UnitNameLength     = 6
+	UnitNameTerminator = 0x00
+
+	eepromVersionOffset  = 0
+	eepromSysFlagsOffset = 1
+	eepromAudioOffset    = 2
+	eepromUnitIDOffset   = 8
+	eepromUnitNameOffset = 10
+
+	SysFlagUnitName     = 0x01 // Show the unit name on the boot logo
+	SysFlagShowLogo     = 0x02 // Show the boot logo at all
+	SysFlagShowLogoLEDs = 0x04 // Flash the RGB led during the boot logo
+)
+
+// The Arduboy2 system area of eeprom, decoded
+type EepromSystem struct {
+	Version      uint8
+	SysFlags     uint8 // Raw flags, also decoded below
+	ShowUnitName bool
+	ShowLogo     bool
+	ShowLogoLEDs bool
+	AudioOn      bool
+	UnitID       uint16
+	UnitName     string
+	Warnings     []string `json:",omitempty"` // Things which look wrong, but which the library tolerates
+}
+
+// Changes to make to the system area; nil fields are left alone
+type EepromSystemChanges struct {
+	ShowUnitName *bool
+	ShowLogo     *bool
+	ShowLogoLEDs *bool
+	AudioOn      *bool
+	UnitID       *uint16
+	UnitName     *string
+}
+
+// Decode the system area from the start of the given eeprom (a full dump is fine)
+func ParseEepromSystem(eeprom []byte) (*EepromSystem, error) {
+	if len(eeprom) < EepromSystemSize {
+		return nil, fmt.Errorf("Eeprom too small for system area: %d < %d", len(eeprom), EepromSystemSize)
+	}
+	flags := eeprom[eepromSysFlagsOffset]
+	result := EepromSystem{
+		Version:      eeprom[eepromVersionOffset],
+		SysFlags:     flags,
+		ShowUnitName: flags&SysFlagUnitName != 0,
+		ShowLogo:     flags&SysFlagShowLogo != 0,
+		ShowLogoLEDs: flags&SysFlagShowLogoLEDs != 0,
+		AudioOn:      eeprom[eepromAudioOffset] != 0,
+		UnitID:       binary.LittleEndian.Uint16(eeprom[eepromUnitIDOffset:]),
+		Warnings:     make([]string, 0),
+	}
+	// Same as the library: the name stops at the first 0x00 or 0xFF
+	name := make([]byte, 0, UnitNameLength)
+	for _, b := range eeprom[eepromUnitNameOffset : eepromUnitNameOffset+UnitNameLength] {
+		if b == UnitNameTerminator || b == 0xFF {
+			break
+		}
+		if b < ' ' || b > '~' {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Unit name has unprintable character 0x%02X", b))
+			b = '?'
+		}
+		name = append(name, b)
+	}
+	result.UnitName = string(name)
+	allErased := true
+	for _, b := range eeprom[:EepromSystemSize] {
+		allErased = allErased && b == 0xFF
+	}
+	if allErased {
+		result.Warnings = append(result.Warnings, "System area is erased (library defaults will be used)")
+	}
+	return &result, nil
+}
+
+// Make sure a unit name can be stored and shown by the library
+func ValidateUnitName(name string) error {
+	if len(name) > UnitNameLength {
+		return fmt.Errorf("Unit name '%s' too long: max %d characters", name, UnitNameLength)
+	}
+	for _, c := range []byte(name) {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("Unit name '%s' has invalid character 0x%02X (printable ascii only)", name, c)
+		}
+	}
+	return nil
+}
+
+func setSysFlag(eeprom []byte, flag uint8, value *bool) {
+	if value == nil {
+		return
+	}
+	if *value {
+		eeprom[eepromSysFlagsOffset] |= flag
+	} else {
+		eeprom[eepromSysFlagsOffset] &^= flag
+	}
+}
+
+// Apply the changes to the system area of the given eeprom in place. Only the
+// bytes for the changed fields are touched; flags the library doesn't define
+// and the reserved bytes are kept as they were
+func ApplyEepromSystem(eeprom []byte, changes *EepromSystemChanges) error {
+	if len(eeprom) < EepromSystemSize {
+		return fmt.Errorf("Eeprom too small for system area: %d < %d", len(eeprom), EepromSystemSize)
+	}
+	if changes.UnitName != nil {
+		if err := ValidateUnitName(*changes.UnitName); err != nil {
+			return err
+		}
+	}
+	setSysFlag(eeprom, SysFlagUnitName, changes.ShowUnitName)
+	setSysFlag(eeprom, SysFlagShowLogo, changes.ShowLogo)
+	setSysFlag(eeprom, SysFlagShowLogoLEDs, changes.ShowLogoLEDs)
+	// Any nonzero value means on, so leave it alone if it's already right
+	if changes.AudioOn != nil && *changes.AudioOn != (eeprom[eepromAudioOffset] != 0) {
+		if *changes.AudioOn {
+			eeprom[eepromAudioOffset] = 1
+		} else {
+			eeprom[eepromAudioOffset] = 0
+		}
+	}
+	if changes.UnitID != nil {
+		binary.LittleEndian.PutUint16(eeprom[eepromUnitIDOffset:], *changes.UnitID)
+	}
+	if changes.UnitName != nil {
+		// Like the library, the rest of the name is padded with the terminator
+		for i := 0; i < UnitNameLength; i++ {
+			if i < len(*changes.UnitName) {
+				eeprom[eepromUnitNameOffset+i] = (*changes.UnitName)[i]
+			} else {
+				eeprom[eepromUnitNameOffset+i] = UnitNameTerminator
+			}
+		}
+	}
+	return nil
+}
+
+// The smallest range [start, end) covering every byte that differs between
+// the two. Returns an empty range (0, 0) if they're the same
+func ChangedRange(original []byte, modified []byte) (int, int) {
+	start, end := -1, 0
+	for i := range original {
+		if i < len(modified) && original[i] != modified[i] {
+			if start < 0 {
+				start = i
+			}
+			end = i + 1
+		}
+	}
+	if start < 0 {
+		return 0, 0
+	}
+	return start, end
+}
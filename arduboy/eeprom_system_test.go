@@ -0,0 +1,90 @@
+package arduboy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseEepromSystem(t *testing.T) {
+	eeprom := MakePadding(EepromSize)
+	system, err := ParseEepromSystem(eeprom)
+	if err != nil {
+		t.Fatalf("Couldn't parse erased eeprom: %s", err)
+	}
+	if !system.AudioOn || !system.ShowLogo || !system.ShowUnitName || !system.ShowLogoLEDs || system.UnitName != "" {
+		t.Fatalf("Erased eeprom should be library defaults: %v", system)
+	}
+	if len(system.Warnings) != 1 {
+		t.Fatalf("Expected erased warning, got %v", system.Warnings)
+	}
+	copy(eeprom, []byte{1, SysFlagShowLogo, 0, 0, 0, 0, 0, 0, 0x34, 0x12, 'H', 'I', 0, 'X', 'X', 'X'})
+	system, err = ParseEepromSystem(eeprom)
+	if err != nil {
+		t.Fatalf("Couldn't parse eeprom: %s", err)
+	}
+	if system.Version != 1 || system.AudioOn || !system.ShowLogo || system.ShowUnitName || system.ShowLogoLEDs {
+		t.Fatalf("Flags parsed wrong: %v", system)
+	}
+	if system.UnitID != 0x1234 || system.UnitName != "HI" || len(system.Warnings) != 0 {
+		t.Fatalf("Unit parsed wrong: %v", system)
+	}
+	if _, err = ParseEepromSystem(eeprom[:10]); err == nil {
+		t.Fatalf("Expected error for short eeprom")
+	}
+}
+
+func TestApplyEepromSystem(t *testing.T) {
+	eeprom := MakePadding(EepromSize)
+	original := append([]byte{}, eeprom...)
+	off := false
+	name := "ME"
+	// Setting things to what they already are shouldn't change anything
+	on := true
+	if err := ApplyEepromSystem(eeprom, &EepromSystemChanges{AudioOn: &on, ShowLogo: &on}); err != nil {
+		t.Fatalf("Couldn't apply: %s", err)
+	}
+	if start, end := ChangedRange(original, eeprom); start != end {
+		t.Fatalf("Expected no changes, got %d-%d", start, end)
+	}
+	err := ApplyEepromSystem(eeprom, &EepromSystemChanges{AudioOn: &off, ShowLogoLEDs: &off, UnitName: &name})
+	if err != nil {
+		t.Fatalf("Couldn't apply: %s", err)
+	}
+	system, _ := ParseEepromSystem(eeprom)
+	if system.AudioOn || system.ShowLogoLEDs || !system.ShowLogo || system.UnitName != "ME" {
+		t.Fatalf("Changes not applied: %v", system)
+	}
+	// Unused flags are kept
+	if system.SysFlags != 0xFF&^SysFlagShowLogoLEDs {
+		t.Fatalf("Unexpected flags: %02X", system.SysFlags)
+	}
+	if start, end := ChangedRange(original, eeprom); start != eepromSysFlagsOffset || end != EepromSystemSize {
+		t.Fatalf("Unexpected changed range %d-%d", start, end)
+	}
+	if !bytes.Equal(eeprom[EepromSystemSize:], original[EepromSystemSize:]) {
+		t.Fatalf("Changed outside system area")
+	}
+	name = "TOOLONG"
+	if err = ApplyEepromSystem(eeprom, &EepromSystemChanges{UnitName: &name}); err == nil {
+		t.Fatalf("Expected error for long name")
+	}
+	name = "a\tb"
+	if err = ApplyEepromSystem(eeprom, &EepromSystemChanges{UnitName: &name}); err == nil {
+		t.Fatalf("Expected error for unprintable name")
+	}
+}
+
+func TestWriteEepromAt(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyDeviceKey, 0)
+	original := append([]byte{}, emu.Eeprom...)
+	if err := WriteEepromAt(emu, 10, []byte("HELLO")); err != nil {
+		t.Fatalf("Couldn't write eeprom: %s", err)
+	}
+	copy(original[10:], []byte("HELLO"))
+	if !bytes.Equal(original, emu.Eeprom) {
+		t.Fatalf("Partial eeprom write wrong")
+	}
+	if err := WriteEepromAt(emu, EepromSize-2, []byte("HELLO")); err == nil {
+		t.Fatalf("Expected error writing past end")
+	}
+}
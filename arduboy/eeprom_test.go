@@ -0,0 +1,87 @@
+package arduboy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestReadEepromAt(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyDeviceKey, 0)
+	rand.Read(emu.Eeprom)
+	part, err := ReadEepromAt(emu, 100, 50)
+	if err != nil {
+		t.Fatalf("Couldn't read eeprom: %s", err)
+	}
+	if !bytes.Equal(part, emu.Eeprom[100:150]) {
+		t.Fatalf("Partial eeprom read wrong")
+	}
+	if _, err = ReadEepromAt(emu, 1000, 50); err == nil {
+		t.Fatalf("Expected error reading past end")
+	}
+}
+
+// Like avr-gcc makes: a couple of initializers at different spots
+const testEepromHex = `:0C00200048454C4C4F20574F524C442197
+:1003F000000102030405060708090A0B0C0D0E0F85
+:00000001FF
+`
+
+func TestParseEepromHex(t *testing.T) {
+	segments, err := ParseEepromHex(strings.NewReader(testEepromHex))
+	if err != nil {
+		t.Fatalf("Couldn't parse eeprom hex: %s", err)
+	}
+	if len(segments) != 2 || segments[0].Address != 0x20 || string(segments[0].Data) != "HELLO WORLD!" ||
+		segments[1].Address != 0x3F0 || len(segments[1].Data) != 16 {
+		t.Fatalf("Wrong segments: %v", segments)
+	}
+	emu := newTestEmulator(t, ArduboyDeviceKey, 0)
+	if err = WriteEepromSegments(emu, segments); err != nil {
+		t.Fatalf("Couldn't write segments: %s", err)
+	}
+	expected := MakePadding(EepromSize)
+	ApplyEepromSegments(expected, segments)
+	if !bytes.Equal(expected, emu.Eeprom) {
+		t.Fatalf("Segments written wrong")
+	}
+	// Hex past the end of eeprom (say, a sketch by mistake) is an error
+	if _, err = ParseEepromHex(strings.NewReader(":0104000000FB\n:00000001FF\n")); err == nil {
+		t.Fatalf("Expected error for hex past end of eeprom")
+	}
+}
+
+func TestDiffEeprom(t *testing.T) {
+	left := MakePadding(EepromSize)
+	right := MakePadding(EepromSize)
+	rows, changed, err := DiffEeprom(left, right, 0)
+	if err != nil || len(rows) != 0 || changed != 0 {
+		t.Fatalf("Expected no differences, got %d rows (%v)", len(rows), err)
+	}
+	right[eepromAudioOffset] = 0
+	right[eepromUnitNameOffset] = 'A'
+	right[500] = 5
+	rows, changed, err = DiffEeprom(left, right, 0)
+	if err != nil || len(rows) != 2 || changed != 3 {
+		t.Fatalf("Expected 2 rows with 3 changes, got %d rows %d changes (%v)", len(rows), changed, err)
+	}
+	if strings.Join(rows[0].Regions, ",") != "system: audio,system: unit name" {
+		t.Fatalf("Wrong regions for system row: %v", rows[0].Regions)
+	}
+	if rows[1].Address != 496 || !rows[1].Changed[4] || rows[1].Regions[0] != "sketch data" {
+		t.Fatalf("Wrong sketch row: %v", rows[1])
+	}
+	var output bytes.Buffer
+	if err = WriteEepromDiff(&output, rows, "left", "right"); err != nil {
+		t.Fatalf("Couldn't write diff: %s", err)
+	}
+	for _, expected := range []string{"--- left", "+++ right", "@@ 0x01f0 sketch data", "+ 0x01f0: ff ff ff ff 05"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("Diff missing '%s':\n%s", expected, output.String())
+		}
+	}
+	if _, _, err = DiffEeprom(left, right[:10], 0); err == nil {
+		t.Fatalf("Expected error for different sizes")
+	}
+}
@@ -0,0 +1,435 @@
+package arduboy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	EmulatedPortScheme      = "emulated://"
+	EmulatedStateFile       = "emulator.json"
+	EmulatedFlashFile       = "flash.bin"
+	EmulatedEepromFile      = "eeprom.bin"
+	EmulatedFlashcartFile   = "flashcart.bin"
+	DefaultEmulatedCapacity = 1 << 24
+
+	Board_Emulated = "Emulated Bootloader"
+
+	// The string placed at the start of the fake bootloader area, so you can
+	// tell an emulated device apart when looking at raw flash
+	EmulatedBootloaderMarker = "ARDUGOTOOLS EMULATED BOOTLOADER"
+)
+
+// Reading an emulated device when it has nothing to say. A real device would
+// just never answer, but it's much easier to debug an error than a hang
+var ErrNoEmulatedResponse = errors.New("emulated device has no response to read")
+
+// Everything about an emulated device that isn't raw memory. Stored as
+// json alongside the memory dumps when the device is saved to a directory
+type EmulatedDeviceSettings struct {
+	Device            string
+	SoftwareId        string
+	Version           int
+	LockBits          byte
+	JedecManufacturer byte
+	JedecDevice       byte
+}
+
+// An in-memory emulation of the Caterina / Cathy AVR109 bootloader protocol,
+// enough to run every device function in this package without hardware.
+// Commands are processed as soon as they're fully written; responses
+// queue up and are consumed by Read. Reading with nothing queued is an
+// error rather than a block, since a real device would simply hang.
+type EmulatedDevice struct {
+	EmulatedDeviceSettings
+	Flash     []byte // Always FlashSize, includes the fake bootloader
+	Eeprom    []byte // Always EepromSize
+	Flashcart []byte // nil means no flash chip
+	LedState  byte   // Last value sent with the 'x' command
+	Exited    bool   // Whether the 'E' (exit bootloader) command was sent
+
+	Directory string // If set, Close() saves the device state here
+
+	address uint16 // Raw address as set by the 'A' command
+	input   []byte
+	output  bytes.Buffer
+	closed  bool
+	lock    sync.Mutex
+}
+
+// Produce the bootloader length the real bootloader for this device would
+// have. Caterina is the only 4K bootloader we emulate
+func (s *EmulatedDeviceSettings) BootloaderLength() int {
+	if s.Version == 10 && s.LockBits&0x10 != 0 || s.Version < 10 {
+		return CaterinaTotalSize
+	}
+	return CathyTotalSize
+}
+
+// Create a fake bootloader image which our device detection will recognize
+// as the given device. It is not runnable code, just the signature bytes
+func makeEmulatedBootloader(device string, length int) []byte {
+	result := MakePadding(length)
+	copy(result, EmulatedBootloaderMarker)
+	// Keep the signatures 16 bit aligned, just like real instructions
+	sigstart := int(AlignWidth(uint(len(EmulatedBootloaderMarker)), 2))
+	switch device {
+	case ArduboyFXDeviceKey:
+		copy(result[sigstart:], ARDUBOYFXEnableBytes)
+		copy(result[sigstart+2:], ARDUBOYFXDisableBytes)
+	case ArduboyMiniDeviceKey:
+		copy(result[sigstart:], ARDUBOYMINIEnableBytes)
+		copy(result[sigstart+2:], ARDUBOYMINIDisableBytes)
+	}
+	return result
+}
+
+// Create a new emulated device of the given type (ArduboyDeviceKey, etc) with
+// a flash chip of the given capacity. The capacity must be a power of two, or
+// 0 for no flash chip at all. Plain Arduboys get Caterina, everything else gets
+// a Cathy3K-like bootloader.
+func NewEmulatedDevice(device string, capacity int) (*EmulatedDevice, error) {
+	if capacity < 0 || (capacity > 0 && bits.OnesCount(uint(capacity)) != 1) {
+		return nil, fmt.Errorf("emulated capacity must be a power of two: %d", capacity)
+	}
+	result := EmulatedDevice{
+		EmulatedDeviceSettings: EmulatedDeviceSettings{
+			Device:            device,
+			SoftwareId:        "CATERIN",
+			Version:           MinBootloaderWithFlash,
+			LockBits:          0xEF,
+			JedecManufacturer: 0xEF, // Winbond
+			JedecDevice:       0x40,
+		},
+		Flash:  MakePadding(FlashSize),
+		Eeprom: MakePadding(EepromSize),
+	}
+	switch device {
+	case ArduboyDeviceKey:
+		result.Version = 10
+		result.LockBits = 0xFF
+	case ArduboyFXDeviceKey, ArduboyMiniDeviceKey:
+	default:
+		return nil, fmt.Errorf("unknown device to emulate: %s", device)
+	}
+	if capacity > 0 {
+		result.Flashcart = MakePadding(capacity)
+	}
+	blength := result.BootloaderLength()
+	copy(result.Flash[FlashSize-blength:], makeEmulatedBootloader(device, blength))
+	return &result, nil
+}
+
+// Load an emulated device previously saved with SaveDirectory. The flashcart
+// capacity is simply the size of the flashcart file; a missing flashcart file
+// means no flash chip.
+func LoadEmulatedDevice(dir string) (*EmulatedDevice, error) {
+	var result EmulatedDevice
+	rawsettings, err := os.ReadFile(filepath.Join(dir, EmulatedStateFile))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(rawsettings, &result.EmulatedDeviceSettings)
+	if err != nil {
+		return nil, err
+	}
+	result.Flash, err = os.ReadFile(filepath.Join(dir, EmulatedFlashFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Flash) != FlashSize {
+		return nil, fmt.Errorf("emulated flash wrong size: expected %d, got %d", FlashSize, len(result.Flash))
+	}
+	result.Eeprom, err = os.ReadFile(filepath.Join(dir, EmulatedEepromFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Eeprom) != EepromSize {
+		return nil, fmt.Errorf("emulated eeprom wrong size: expected %d, got %d", EepromSize, len(result.Eeprom))
+	}
+	result.Flashcart, err = os.ReadFile(filepath.Join(dir, EmulatedFlashcartFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		result.Flashcart = nil
+	} else if bits.OnesCount(uint(len(result.Flashcart))) != 1 {
+		return nil, fmt.Errorf("emulated flashcart must be a power of two in size: %d", len(result.Flashcart))
+	}
+	result.Directory = dir
+	return &result, nil
+}
+
+// Save the entire state of the emulated device into the given directory,
+// creating it if necessary
+func (d *EmulatedDevice) SaveDirectory(dir string) error {
+	err := os.MkdirAll(dir, 0770)
+	if err != nil {
+		return err
+	}
+	rawsettings, err := json.MarshalIndent(d.EmulatedDeviceSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(dir, EmulatedStateFile), rawsettings, 0660); err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(dir, EmulatedFlashFile), d.Flash, 0660); err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(dir, EmulatedEepromFile), d.Eeprom, 0660); err != nil {
+		return err
+	}
+	fcpath := filepath.Join(dir, EmulatedFlashcartFile)
+	if d.Flashcart != nil {
+		return os.WriteFile(fcpath, d.Flashcart, 0660)
+	}
+	err = os.Remove(fcpath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Connect to the emulated device stored in the given directory. If there is
+// no device there yet, a fresh ArduboyFX with a 16MB flashcart is created.
+// The state is written back to the directory when the connection is closed
+func ConnectEmulated(dir string) (*EmulatedDevice, *BasicDeviceInfo, error) {
+	device, err := LoadEmulatedDevice(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		device, err = NewEmulatedDevice(ArduboyFXDeviceKey, DefaultEmulatedCapacity)
+		if err != nil {
+			return nil, nil, err
+		}
+		device.Directory = dir
+	}
+	return device, &BasicDeviceInfo{
+		Port:         EmulatedPortScheme + dir,
+		Product:      device.Device,
+		BoardType:    Board_Emulated,
+		IsBootloader: true,
+	}, nil
+}
+
+func (d *EmulatedDevice) respond(data ...byte) {
+	d.output.Write(data)
+}
+
+// Memory for the given bootloader memory type, along with the byte address
+// the current raw address refers to in that memory
+func (d *EmulatedDevice) memory(memtype byte) ([]byte, int, error) {
+	switch memtype {
+	case 'F':
+		return d.Flash, int(d.address) * 2, nil
+	case 'E':
+		return d.Eeprom, int(d.address), nil
+	case 'C':
+		if d.Flashcart == nil {
+			return nil, 0, fmt.Errorf("emulated device has no flashcart")
+		}
+		return d.Flashcart, int(d.address) * FXPageSize, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown memory type '%c'", memtype)
+	}
+}
+
+// Move the address past the given amount of data, the same way the bootloader would
+func (d *EmulatedDevice) advance(memtype byte, length int) {
+	switch memtype {
+	case 'F':
+		d.address += uint16(length / 2)
+	case 'E':
+		d.address += uint16(length)
+	case 'C':
+		d.address += uint16(length / FXPageSize)
+	}
+}
+
+// Figure out the length from a block command. The flashcart uses 0 to mean a full block
+func blockCommandLength(command []byte) int {
+	length := int(command[1])<<8 | int(command[2])
+	if length == 0 && command[3] == 'C' {
+		length = FXBlockSize
+	}
+	return length
+}
+
+func (d *EmulatedDevice) blockRead(command []byte) error {
+	length := blockCommandLength(command)
+	mem, start, err := d.memory(command[3])
+	if err != nil {
+		return err
+	}
+	if start+length > len(mem) {
+		return fmt.Errorf("emulated read past end of memory '%c': %d + %d > %d", command[3], start, length, len(mem))
+	}
+	d.respond(mem[start : start+length]...)
+	d.advance(command[3], length)
+	return nil
+}
+
+func (d *EmulatedDevice) blockWrite(command []byte, data []byte) error {
+	mem, start, err := d.memory(command[3])
+	if err != nil {
+		return err
+	}
+	if start+len(data) > len(mem) {
+		return fmt.Errorf("emulated write past end of memory '%c': %d + %d > %d", command[3], start, len(data), len(mem))
+	}
+	switch command[3] {
+	case 'F':
+		// The bootloader refuses to overwrite itself
+		if start+len(data) > FlashSize-d.BootloaderLength() {
+			return fmt.Errorf("emulated write into bootloader area at %d", start)
+		}
+		copy(mem[start:], data)
+	case 'E':
+		copy(mem[start:], data)
+	case 'C':
+		// Writing at the start of a block erases the entire block. Otherwise, it's
+		// just like real flash: programming can only clear bits
+		if start%FXBlockSize == 0 {
+			copy(mem[start:start+FXBlockSize], MakePadding(FXBlockSize))
+		}
+		for i, b := range data {
+			mem[start+i] &= b
+		}
+	}
+	d.advance(command[3], len(data))
+	d.respond('\r')
+	return nil
+}
+
+// Try to process a single command from the pending input. Returns the amount
+// of input consumed, which is 0 if the command isn't complete yet
+func (d *EmulatedDevice) processCommand() (int, error) {
+	if len(d.input) == 0 {
+		return 0, nil
+	}
+	need := func(length int) bool { return len(d.input) >= length }
+	switch d.input[0] {
+	case 'S':
+		d.respond([]byte(fmt.Sprintf("%-7.7s", d.SoftwareId))...)
+		return 1, nil
+	case 'V':
+		d.respond([]byte(fmt.Sprintf("%02d", d.Version))...)
+		return 1, nil
+	case 'r':
+		d.respond(d.LockBits)
+		return 1, nil
+	case 'j':
+		if d.Flashcart == nil {
+			d.respond(0xFF, 0xFF, 0xFF)
+		} else {
+			d.respond(d.JedecManufacturer, d.JedecDevice, byte(bits.TrailingZeros(uint(len(d.Flashcart)))))
+		}
+		return 1, nil
+	case 'E':
+		d.Exited = true
+		d.respond('\r')
+		return 1, nil
+	case 'A':
+		if !need(3) {
+			return 0, nil
+		}
+		d.address = uint16(d.input[1])<<8 | uint16(d.input[2])
+		d.respond('\r')
+		return 3, nil
+	case 'x':
+		if d.BootloaderLength() == CaterinaTotalSize {
+			// Caterina has no LED control, so this is an unknown command. Like
+			// the real thing, the LED state byte is then run as a command too
+			d.respond('?')
+			return 1, nil
+		}
+		if !need(2) {
+			return 0, nil
+		}
+		d.LedState = d.input[1]
+		d.respond('\r')
+		return 2, nil
+	case 'g':
+		if !need(4) {
+			return 0, nil
+		}
+		return 4, d.blockRead(d.input[:4])
+	case 'B':
+		if !need(4) {
+			return 0, nil
+		}
+		length := blockCommandLength(d.input[:4])
+		if !need(4 + length) {
+			return 0, nil
+		}
+		return 4 + length, d.blockWrite(d.input[:4], d.input[4:4+length])
+	default:
+		// This is what AVR109 does for unknown commands
+		d.respond('?')
+		return 1, nil
+	}
+}
+
+// Send data to the emulated device. Commands are run as soon as they're complete
+func (d *EmulatedDevice) Write(data []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return 0, fmt.Errorf("emulated device closed")
+	}
+	d.input = append(d.input, data...)
+	for {
+		consumed, err := d.processCommand()
+		if err != nil {
+			// Don't let a bad command wedge the emulator forever
+			d.input = nil
+			return 0, err
+		}
+		if consumed == 0 {
+			break
+		}
+		d.input = d.input[consumed:]
+	}
+	return len(data), nil
+}
+
+// Read pending responses from the emulated device
+func (d *EmulatedDevice) Read(data []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return 0, fmt.Errorf("emulated device closed")
+	}
+	if d.output.Len() == 0 {
+		pending := ""
+		if len(d.input) > 0 {
+			pending = fmt.Sprintf(" (incomplete command '%s')", EchoSpaceControls(strings.ToValidUTF8(string(d.input[:1]), "?")))
+		}
+		return 0, fmt.Errorf("%w%s", ErrNoEmulatedResponse, pending)
+	}
+	return d.output.Read(data)
+}
+
+// Close the connection. If the device came from a directory, the state is saved
+// back to that directory
+func (d *EmulatedDevice) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if d.Directory != "" {
+		return d.SaveDirectory(d.Directory)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package arduboy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+)
+
+func newTestEmulator(t *testing.T, device string, capacity int) *EmulatedDevice {
+	emu, err := NewEmulatedDevice(device, capacity)
+	if err != nil {
+		t.Fatalf("Couldn't create emulated device: %s", err)
+	}
+	return emu
+}
+
+func TestEmulatedDevice_Query(t *testing.T) {
+	devices := []string{ArduboyDeviceKey, ArduboyFXDeviceKey, ArduboyMiniDeviceKey}
+	for _, device := range devices {
+		emu := newTestEmulator(t, device, 1<<20)
+		extdata, err := QueryDevice(&BasicDeviceInfo{}, emu, false)
+		if err != nil {
+			t.Fatalf("Couldn't query emulated %s: %s", device, err)
+		}
+		if extdata.Bootloader.Device != device {
+			t.Fatalf("Expected detected device %s, got %s", device, extdata.Bootloader.Device)
+		}
+		if extdata.Bootloader.IsCaterina != (device == ArduboyDeviceKey) {
+			t.Fatalf("Unexpected caterina state for %s: %t", device, extdata.Bootloader.IsCaterina)
+		}
+		if device == ArduboyDeviceKey {
+			// Caterina is too old for a flashcart, even if there's a chip
+			if extdata.HasFlashcart {
+				t.Fatalf("Emulated caterina should not report a flashcart")
+			}
+			continue
+		}
+		if !extdata.HasFlashcart {
+			t.Fatalf("Emulated %s should have a flashcart", device)
+		}
+		if extdata.Jedec.Capacity != 1<<20 {
+			t.Fatalf("Expected capacity %d, got %d", 1<<20, extdata.Jedec.Capacity)
+		}
+		if extdata.Jedec.Manufacturer != "Winbond" {
+			t.Fatalf("Expected Winbond manufacturer, got %s", extdata.Jedec.Manufacturer)
+		}
+	}
+}
+
+func TestEmulatedDevice_NoFlashcart(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 0)
+	extdata, err := QueryDevice(&BasicDeviceInfo{}, emu, false)
+	if err != nil {
+		t.Fatalf("Couldn't query emulated device: %s", err)
+	}
+	if extdata.HasFlashcart {
+		t.Fatalf("Expected no flashcart on emulated device without capacity")
+	}
+}
+
+// Caterina has no LED control, so the emulator has to answer like it does
+// for unknown commands, including running the state byte as a command
+func TestEmulatedDevice_LedControl(t *testing.T) {
+	for _, device := range []string{ArduboyDeviceKey, ArduboyFXDeviceKey} {
+		emu := newTestEmulator(t, device, 0)
+		if _, err := emu.Write(RgbButtonCommandRaw(LEDCtrlBtnOff | LEDCtrlRdOn)); err != nil {
+			t.Fatalf("Couldn't send led control: %s", err)
+		}
+		response := make([]byte, 4)
+		n, err := emu.Read(response)
+		if err != nil {
+			t.Fatalf("No response to led control: %s", err)
+		}
+		expected := "\r"
+		if device == ArduboyDeviceKey {
+			expected = "??"
+		}
+		if string(response[:n]) != expected {
+			t.Fatalf("%s: expected %q for led control, got %q", device, expected, response[:n])
+		}
+		// Whatever the bootloader, setting the LEDs mustn't throw later commands off
+		if err = SetRgbButtonState(emu, LEDCtrlBtnOff|LEDCtrlGrOn); err != nil {
+			t.Fatalf("%s: couldn't set led state: %s", device, err)
+		}
+		if _, err = QueryDevice(&BasicDeviceInfo{}, emu, false); err != nil {
+			t.Fatalf("%s: couldn't query after setting led state: %s", device, err)
+		}
+	}
+}
+
+func TestEmulatedDevice_Eeprom(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	eeprom := make([]byte, EepromSize)
+	rand.Read(eeprom)
+	err := WriteEeprom(emu, eeprom)
+	if err != nil {
+		t.Fatalf("Couldn't write eeprom: %s", err)
+	}
+	readback, err := ReadEeprom(emu)
+	if err != nil {
+		t.Fatalf("Couldn't read eeprom: %s", err)
+	}
+	if !bytes.Equal(eeprom, readback) {
+		t.Fatalf("Eeprom readback doesn't match what was written")
+	}
+	err = DeleteEeprom(emu)
+	if err != nil {
+		t.Fatalf("Couldn't delete eeprom: %s", err)
+	}
+	if !bytes.Equal(emu.Eeprom, MakePadding(EepromSize)) {
+		t.Fatalf("Eeprom not cleared after delete")
+	}
+}
+
+func TestEmulatedDevice_Sketch(t *testing.T) {
+	for _, device := range []string{ArduboyDeviceKey, ArduboyFXDeviceKey} {
+		emu := newTestEmulator(t, device, 1<<20)
+		sketch := make([]byte, 20*1024)
+		rand.Read(sketch)
+		var hex bytes.Buffer
+		err := BinToHex(sketch, &hex)
+		if err != nil {
+			t.Fatalf("Couldn't convert sketch to hex: %s", err)
+		}
+		_, _, err = WriteHex(emu, &hex, true, nil)
+		if err != nil {
+			t.Fatalf("Couldn't write sketch to emulated %s: %s", device, err)
+		}
+		readback, err := ReadSketch(emu, true)
+		if err != nil {
+			t.Fatalf("Couldn't read sketch: %s", err)
+		}
+		if !bytes.Equal(sketch, readback) {
+			t.Fatalf("Sketch readback doesn't match (%d vs %d bytes)", len(sketch), len(readback))
+		}
+		// The bootloader must survive, otherwise the device detection would break
+		extdata, err := QueryDevice(&BasicDeviceInfo{}, emu, false)
+		if err != nil {
+			t.Fatalf("Couldn't query device after sketch write: %s", err)
+		}
+		if extdata.Bootloader.Device != device {
+			t.Fatalf("Bootloader damaged by sketch write: detected %s", extdata.Bootloader.Device)
+		}
+	}
+}
+
+func TestEmulatedDevice_WholeFlashcart(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	minicart, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart: %s", err)
+	}
+	_, err = WriteWholeFlashcart(emu, bytes.NewReader(minicart), len(minicart), true, nil)
+	if err != nil {
+		t.Fatalf("Couldn't write flashcart: %s", err)
+	}
+	var readback bytes.Buffer
+	length, slots, err := ReadWholeFlashcart(emu, &readback, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read flashcart: %s", err)
+	}
+	if slots != 13 {
+		t.Fatalf("Expected 13 slots, got %d", slots)
+	}
+	// The minicart file includes the final empty page, the read does not
+	if length != len(minicart)-FXPageSize || !bytes.Equal(readback.Bytes(), minicart[:length]) {
+		t.Fatalf("Flashcart readback doesn't match (%d vs %d bytes)", length, len(minicart))
+	}
+	categories, err := ScanFlashcartMeta(emu, true)
+	if err != nil {
+		t.Fatalf("Couldn't scan flashcart meta: %s", err)
+	}
+	filecategories, err := ScanFlashcartFileMeta(bytes.NewReader(minicart), true)
+	if err != nil {
+		t.Fatalf("Couldn't scan file meta: %s", err)
+	}
+	if len(categories) != len(filecategories) {
+		t.Fatalf("Device and file scan differ: %d vs %d categories", len(categories), len(filecategories))
+	}
+	for i := range categories {
+		if categories[i].Image != filecategories[i].Image {
+			t.Fatalf("Device and file scan images differ in category %d", i)
+		}
+	}
+}
+
+// The image conversions run alongside the scan, and used to write into the
+// result while it was still growing (or after it was returned). Run with
+// -race to catch that directly; otherwise missing images give it away
+func TestEmulatedDevice_ScanFlashcartMetaImages(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	minicart, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart: %s", err)
+	}
+	copy(emu.Flashcart, minicart)
+	expected, err := ScanFlashcartFileMeta(bytes.NewReader(minicart), true)
+	if err != nil {
+		t.Fatalf("Couldn't scan file meta: %s", err)
+	}
+	for run := 0; run < 5; run++ {
+		categories, err := ScanFlashcartMeta(emu, true)
+		if err != nil {
+			t.Fatalf("Couldn't scan flashcart meta: %s", err)
+		}
+		if len(categories) != len(expected) {
+			t.Fatalf("Expected %d categories, got %d", len(expected), len(categories))
+		}
+		for i, category := range categories {
+			if category.Image == "" || category.Image != expected[i].Image {
+				t.Fatalf("Run %d: wrong image for category %d", run, i)
+			}
+			if len(category.Slots) != len(expected[i].Slots) {
+				t.Fatalf("Run %d: expected %d slots in category %d, got %d", run, len(expected[i].Slots), i, len(category.Slots))
+			}
+			for j, slot := range category.Slots {
+				if slot.Image == "" || slot.Image != expected[i].Slots[j].Image {
+					t.Fatalf("Run %d: wrong image for '%s'", run, slot.Title)
+				}
+			}
+		}
+	}
+}
+
+// WriteFlashcart must preserve the data around what it writes, since
+// the chip can only be written a whole block at a time
+func TestEmulatedDevice_WriteFlashcartBackfill(t *testing.T) {
+	capacity := 4 * FXBlockSize
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, capacity)
+	original := make([]byte, capacity)
+	rand.Read(original)
+	copy(emu.Flashcart, original)
+	expected := make([]byte, capacity)
+	copy(expected, original)
+
+	check := func(address int, length int) {
+		data := make([]byte, length)
+		rand.Read(data)
+		copy(expected[address:], data)
+		realAddress, realLength, err := WriteFlashcart(emu, address, data, nil)
+		if err != nil {
+			t.Fatalf("Couldn't write %d bytes at %d: %s", length, address, err)
+		}
+		if realAddress%FXBlockSize != 0 || realLength%FXBlockSize != 0 {
+			t.Fatalf("Write not block aligned: %d, %d", realAddress, realLength)
+		}
+		if !bytes.Equal(emu.Flashcart, expected) {
+			t.Fatalf("Flashcart damaged writing %d bytes at %d", length, address)
+		}
+		readback, err := ReadFlashcart(emu, address, length)
+		if err != nil {
+			t.Fatalf("Couldn't read back %d bytes at %d: %s", length, address, err)
+		}
+		if !bytes.Equal(readback, data) {
+			t.Fatalf("Readback doesn't match writing %d bytes at %d", length, address)
+		}
+	}
+
+	check(0, 1031)
+	check(65427, 10301)
+	check(FXBlockSize*2-1000, 2000)
+	check(FXBlockSize, FXBlockSize)
+	check(capacity-111104, 111104)
+}
+
+func TestEmulatedDevice_SaveLoad(t *testing.T) {
+	dir, err := newRandomFilepath("emulated")
+	if err != nil {
+		t.Fatalf("Couldn't get emulator directory: %s", err)
+	}
+	emu, basic, err := ConnectEmulated(dir)
+	if err != nil {
+		t.Fatalf("Couldn't connect to new emulated device: %s", err)
+	}
+	if !basic.IsBootloader {
+		t.Fatalf("Emulated device should always be a bootloader")
+	}
+	eeprom := make([]byte, EepromSize)
+	rand.Read(eeprom)
+	err = WriteEeprom(emu, eeprom)
+	if err != nil {
+		t.Fatalf("Couldn't write eeprom: %s", err)
+	}
+	err = emu.Close()
+	if err != nil {
+		t.Fatalf("Couldn't close emulated device: %s", err)
+	}
+	// Now reconnect through the normal path
+	sercon, _, err := ConnectWithBootloader(EmulatedPortScheme + dir)
+	if err != nil {
+		t.Fatalf("Couldn't reconnect to emulated device: %s", err)
+	}
+	defer sercon.Close()
+	readback, err := ReadEeprom(sercon)
+	if err != nil {
+		t.Fatalf("Couldn't read eeprom: %s", err)
+	}
+	if !bytes.Equal(eeprom, readback) {
+		t.Fatalf("Eeprom not persisted in emulator directory")
+	}
+	if len(sercon.(*EmulatedDevice).Flashcart) != DefaultEmulatedCapacity {
+		t.Fatalf("Default emulated capacity not persisted")
+	}
+}
+
+func TestEmulatedDevice_Progress(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	minicart, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart: %s", err)
+	}
+	events := make([]Progress, 0)
+	collect := func(p *Progress) {
+		events = append(events, *p)
+	}
+
+	blocks, err := WriteWholeFlashcart(emu, bytes.NewReader(minicart), len(minicart), true, collect)
+	if err != nil {
+		t.Fatalf("Couldn't write flashcart: %s", err)
+	}
+	// One write and one verify per block, plus the final event
+	if len(events) != blocks*2+1 {
+		t.Fatalf("Expected %d events, got %d", blocks*2+1, len(events))
+	}
+	last := events[len(events)-1]
+	if last.Done != blocks*FXBlockSize || last.Total != last.Done || last.Block != blocks {
+		t.Fatalf("Final event wrong: %v", last)
+	}
+	for i, e := range events[:len(events)-1] {
+		if e.Total != blocks*FXBlockSize || e.Block != i/2 || e.Slot != -1 {
+			t.Fatalf("Event %d wrong: %v", i, e)
+		}
+	}
+
+	events = events[:0]
+	var readback bytes.Buffer
+	_, slots, err := ReadWholeFlashcart(emu, &readback, collect)
+	if err != nil {
+		t.Fatalf("Couldn't read flashcart: %s", err)
+	}
+	if len(events) != slots+1 || events[slots].Done != readback.Len() || events[slots].Total != readback.Len() {
+		t.Fatalf("Read events wrong: %v", events)
+	}
+	for i := 0; i < slots; i++ {
+		if events[i].Slot != i || events[i].Message == "" {
+			t.Fatalf("Read event %d wrong: %v", i, events[i])
+		}
+	}
+}
+
+func TestEmulatedDevice_WholeFlashcartDiff(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	cart := make([]byte, 5*FXBlockSize+1000)
+	rand.Read(cart)
+	blocks, written, err := WriteWholeFlashcartDiff(emu, bytes.NewReader(cart), len(cart), true, nil)
+	if err != nil {
+		t.Fatalf("Couldn't write flashcart: %s", err)
+	}
+	if blocks != 6 || written != 6 {
+		t.Fatalf("Expected all 6 blocks written on a blank cart, got %d of %d", written, blocks)
+	}
+
+	// Change a byte in block 2 and the end of the data (last block)
+	cart[2*FXBlockSize+50]++
+	cart[len(cart)-1]++
+	events := make([]Progress, 0)
+	blocks, written, err = WriteWholeFlashcartDiff(emu, bytes.NewReader(cart), len(cart), true, func(p *Progress) {
+		if p.Phase == ProgressPhaseWrite && p.Message != "" {
+			events = append(events, *p)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Couldn't diff write flashcart: %s", err)
+	}
+	if blocks != 6 || written != 2 {
+		t.Fatalf("Expected 2 of 6 blocks written, got %d of %d", written, blocks)
+	}
+	if len(events) != 2 || events[0].Block != 2 || events[1].Block != 5 {
+		t.Fatalf("Wrong blocks written: %v", events)
+	}
+	if !bytes.Equal(emu.Flashcart[:len(cart)], cart) {
+		t.Fatalf("Flashcart doesn't match after diff write")
+	}
+	if !bytes.Equal(emu.Flashcart[len(cart):len(cart)+FXPageSize], MakePadding(FXPageSize)) {
+		t.Fatalf("Flashcart not followed by an empty page")
+	}
+}
@@ -81,6 +81,24 @@ func (h *FxHeader) IsOldFormat() bool {
 	return h.HasFxData() && h.DataPages == 0xFFFF
 }
 
+// Number of FX data pages in the slot whose header is at the given address.
+// The old format doesn't say, so the data is assumed to run up to the save,
+// or to the end of the slot if there isn't one (this may include the padding
+// that aligns the save)
+func (h *FxHeader) FxDataPages(addr int) int {
+	if !h.HasFxData() {
+		return 0
+	}
+	if !h.IsOldFormat() {
+		return int(h.DataPages)
+	}
+	end := addr/FXPageSize + int(h.SlotPages)
+	if h.HasFxSave() {
+		end = int(h.SaveStart)
+	}
+	return max(end-int(h.DataStart), 0)
+}
+
 // Generate the bytes you can write to the flashcart
 func (header *FxHeader) MakeHeader() ([]byte, error) {
 	result := make([]byte, FxHeaderLength)
@@ -274,14 +292,15 @@ func ReadFlashcartOptimized(sercon io.ReadWriter, page uint16, length uint16) ([
 // Write any arbitrary amount of data to the flash, perserving any data surrounding
 // it (since writing flashes the entire 65k block). Return the actual address it started
 // writing to, and the total write size
-func WriteFlashcart(sercon io.ReadWriter, address int, data []byte, logProgress bool) (int, int, error) {
+func WriteFlashcart(sercon io.ReadWriter, address int, data []byte, progress ProgressReporter) (int, int, error) {
 	blockAlignedAddress := (address / FXBlockSize) * FXBlockSize
 	backfillLength := address - blockAlignedAddress
+	// The total amount that will be written, once the data is made whole blocks
+	totalLength := int(AlignWidth(uint(backfillLength+len(data)), uint(FXBlockSize)))
 	// Read backfill to get the data block aligned and not accidentally clear pre data
 	if backfillLength > 0 {
-		if logProgress {
-			log.Printf("Reading backfill to preserve block data: %d bytes at address %d", backfillLength, blockAlignedAddress)
-		}
+		progress.report(Progress{Phase: ProgressPhaseBackfill, Total: totalLength, Slot: -1, Block: -1,
+			Message: fmt.Sprintf("Reading backfill to preserve block data: %d bytes at address %d", backfillLength, blockAlignedAddress)})
 		backfill, err := ReadFlashcart(sercon, blockAlignedAddress, backfillLength)
 		if err != nil {
 			return 0, 0, err
@@ -293,9 +312,8 @@ func WriteFlashcart(sercon io.ReadWriter, address int, data []byte, logProgress
 	if overflow > 0 {
 		leftover := FXBlockSize - overflow
 		readAddress := blockAlignedAddress + len(data)
-		if logProgress {
-			log.Printf("Reading %d bytes of leftover data at address %d", leftover, readAddress)
-		}
+		progress.report(Progress{Phase: ProgressPhaseBackfill, Total: totalLength, Slot: -1, Block: -1,
+			Message: fmt.Sprintf("Reading %d bytes of leftover data at address %d", leftover, readAddress)})
 		leftoverData, err := ReadFlashcart(sercon, readAddress, leftover)
 		if err != nil {
 			return 0, 0, err
@@ -316,9 +334,8 @@ func WriteFlashcart(sercon io.ReadWriter, address int, data []byte, logProgress
 		//var rgbState uint8 = LEDCtrlBtnOff | uint8(i&0b111)
 		//SetRgbButtonState(sercon, rgbState)
 		flashcart_page := uint16((blockAlignedAddress + i) / FXPageSize)
-		if logProgress {
-			log.Printf("Writing block# %d at page %d", blocknum, flashcart_page)
-		}
+		progress.report(Progress{Phase: ProgressPhaseWrite, Done: i, Total: len(data), Slot: -1, Block: blocknum,
+			Message: fmt.Sprintf("Writing block# %d at page %d", blocknum, flashcart_page)})
 		rwep.WritePass(AddressCommandFlashcartPage(flashcart_page))
 		rwep.ReadPass(onebyte)
 		rwep.WritePass(WriteFlashcartCommand(0)) //Yes, apparently it's 0 for full block
@@ -329,6 +346,7 @@ func WriteFlashcart(sercon io.ReadWriter, address int, data []byte, logProgress
 		}
 		blocknum++
 	}
+	progress.report(Progress{Phase: ProgressPhaseWrite, Done: len(data), Total: len(data), Slot: -1, Block: blocknum})
 
 	return blockAlignedAddress, len(data), nil
 }
@@ -338,7 +356,7 @@ func WriteFlashcart(sercon io.ReadWriter, address int, data []byte, logProgress
 // This is slightly slower than mindless block reading, but can be overall faster
 // because it's not reading the entire flash memory (plus you can get more
 // interesting logging + data). NOTE: DOES NOT CHECK FOR FLASHCART EXISTENCE!
-func ReadWholeFlashcart(sercon io.ReadWriter, output io.Writer, logProgress bool) (int, int, error) {
+func ReadWholeFlashcart(sercon io.ReadWriter, output io.Writer, progress ProgressReporter) (int, int, error) {
 	headerAddr := 0
 	headerCount := 0
 	headerRaw := make([]byte, FxHeaderLength)
@@ -361,6 +379,8 @@ func ReadWholeFlashcart(sercon io.ReadWriter, output io.Writer, logProgress bool
 		if err != nil {
 			switch err.(type) {
 			case *NotHeaderError: // This is fine, we're just at the end
+				progress.report(Progress{Phase: ProgressPhaseRead, Done: headerAddr, Total: headerAddr,
+					Slot: headerCount, Block: -1})
 				return headerAddr, headerCount, nil
 			default:
 				return 0, 0, err
@@ -369,10 +389,9 @@ func ReadWholeFlashcart(sercon io.ReadWriter, output io.Writer, logProgress bool
 
 		slotSize := int(header.SlotPages) * FXPageSize
 
-		if logProgress {
-			log.Printf("[%d] Reading: %s (%s - %s) - %d bytes\n",
-				headerCount+1, header.Title, header.Developer, header.Version, slotSize)
-		}
+		progress.report(Progress{Phase: ProgressPhaseRead, Done: headerAddr, Slot: headerCount, Block: -1,
+			Message: fmt.Sprintf("[%d] Reading: %s (%s - %s) - %d bytes",
+				headerCount+1, header.Title, header.Developer, header.Version, slotSize)})
 
 		// Write the header. We'll be reading the rest of the slot now
 		_, err = output.Write(headerRaw)
@@ -393,10 +412,41 @@ func ReadWholeFlashcart(sercon io.ReadWriter, output io.Writer, logProgress bool
 }
 
 // Write an entire flashcart starting at the normal address and going to the end.
-// Does not care about any existing data on the flashcart.
+// Does not care about any existing data on the flashcart. The input size is only
+// used for progress reporting, and can be 0 if unknown.
 // NOTE: DOES NOT CHECK FOR FLASHCART EXISTENCE OR SIZE
-func WriteWholeFlashcart(sercon io.ReadWriter, input io.Reader, verify bool, logProgress bool) (int, error) {
-	currentBlock := 0
+func WriteWholeFlashcart(sercon io.ReadWriter, input io.Reader, inputSize int, verify bool, progress ProgressReporter) (int, error) {
+	blocks, _, err := writeWholeFlashcart(sercon, input, inputSize, wholeFlashcartWrite{verify: verify, progress: progress})
+	return blocks, err
+}
+
+// Same as WriteWholeFlashcart, but each block is read from the device first
+// and only written (and verified) if it's different. Reading is much faster
+// than erasing and writing, so this is great for small changes to a big
+// flashcart. Returns the total blocks and the number actually written
+func WriteWholeFlashcartDiff(sercon io.ReadWriter, input io.Reader, inputSize int, verify bool, progress ProgressReporter) (int, int, error) {
+	return writeWholeFlashcart(sercon, input, inputSize, wholeFlashcartWrite{verify: verify, diff: true, progress: progress})
+}
+
+// The ways a whole flashcart write can differ from the plain write
+type wholeFlashcartWrite struct {
+	verify     bool
+	diff       bool
+	startBlock int             // Blocks before this are skipped, both in the input and on the device
+	blockDone  func(int) error // Called with each block once it's known to be good on the device
+	progress   ProgressReporter
+}
+
+func writeWholeFlashcart(sercon io.ReadWriter, input io.Reader, inputSize int, options wholeFlashcartWrite) (int, int, error) {
+	verify := options.verify
+	progress := options.progress
+	currentBlock := options.startBlock
+	writtenBlocks := 0
+	totalSize := 0
+	if inputSize > 0 {
+		// The end page is always written, and the write is whole blocks
+		totalSize = int(AlignWidth(uint(inputSize+FXPageSize), uint(FXBlockSize)))
+	}
 	// This writer writes FULL fx blocks (its smallest writable chunk size). This is
 	// beneficial: we will fill unused bytes with 0xFF (there should only be one
 	// instance), and this combined with the multireader:
@@ -412,6 +462,19 @@ func WriteWholeFlashcart(sercon io.ReadWriter, input io.Reader, verify bool, log
 	}
 	endReader := bytes.NewReader(endPage)
 	flashcartReader := io.MultiReader(input, endReader)
+	if currentBlock > 0 {
+		skip := int64(currentBlock * FXBlockSize)
+		skipped, err := io.CopyN(io.Discard, flashcartReader, skip)
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if skipped <= skip-int64(FXBlockSize) {
+			return 0, 0, fmt.Errorf("input ends before starting block %d", currentBlock)
+		} else if skipped != skip {
+			// The last (partial) block was already written, so there's nothing to do
+			return currentBlock, 0, nil
+		}
+	}
 	rwep := ReadWriteErrorPass{rw: sercon}
 	defer ResetRgbButtonState(sercon)
 
@@ -443,17 +506,36 @@ func WriteWholeFlashcart(sercon io.ReadWriter, input io.Reader, verify bool, log
 				running = false
 			} else {
 				// Wow, some other error! Fancy... but also we die
-				return 0, err
+				return 0, 0, err
 			}
 		}
 
-		if logProgress {
-			log.Printf("Writing block %d (%d bytes written)\n", currentBlock, currentBlock*FXBlockSize)
-		}
-
 		// everything uses flashcart pages so....
 		currentPage := uint16(currentBlock * FxPagesPerBlock)
 
+		// Skip blocks which are already correct on the device
+		if options.diff {
+			progress.report(Progress{Phase: ProgressPhaseCompare, Done: currentBlock * FXBlockSize, Total: totalSize,
+				Slot: -1, Block: currentBlock})
+			err = ReadFlashcartOptimizedInto(sercon, currentPage, compareBuffer)
+			if err != nil {
+				return 0, 0, err
+			}
+			if bytes.Equal(bufferRaw, compareBuffer) {
+				if options.blockDone != nil {
+					if err = options.blockDone(currentBlock); err != nil {
+						return 0, 0, err
+					}
+				}
+				currentBlock++
+				continue
+			}
+		}
+
+		progress.report(Progress{Phase: ProgressPhaseWrite, Done: currentBlock * FXBlockSize, Total: totalSize,
+			Slot: -1, Block: currentBlock,
+			Message: fmt.Sprintf("Writing block %d (%d bytes written)", currentBlock, currentBlock*FXBlockSize)})
+
 		// Write the data to the device
 		rwep.WritePass(AddressCommandFlashcartPage(currentPage))
 		rwep.ReadPass(onebyte)
@@ -462,27 +544,38 @@ func WriteWholeFlashcart(sercon io.ReadWriter, input io.Reader, verify bool, log
 		rwep.ReadPass(onebyte)
 
 		if rwep.err != nil {
-			return 0, rwep.err
+			return 0, 0, rwep.err
 		}
 
 		// Now verify the data
 		if verify {
+			progress.report(Progress{Phase: ProgressPhaseVerify, Done: currentBlock * FXBlockSize, Total: totalSize,
+				Slot: -1, Block: currentBlock})
 			// Turn off LEDs for... I don't know, SOME kind of indication?
 			SetRgbButtonState(sercon, LEDCtrlBtnOff)
 			err = ReadFlashcartOptimizedInto(sercon, currentPage, compareBuffer)
 			if err != nil {
-				return 0, err
+				return 0, 0, err
 			}
 			if !bytes.Equal(bufferRaw, compareBuffer) {
-				return 0, fmt.Errorf("Flashcart validation failed at block %d!", currentBlock)
+				return 0, 0, fmt.Errorf("Flashcart validation failed at block %d!", currentBlock)
+			}
+		}
+
+		if options.blockDone != nil {
+			if err = options.blockDone(currentBlock); err != nil {
+				return 0, 0, err
 			}
 		}
 
 		// Move to the next block
 		currentBlock++
+		writtenBlocks++
 	}
+	progress.report(Progress{Phase: ProgressPhaseWrite, Done: currentBlock * FXBlockSize,
+		Total: currentBlock * FXBlockSize, Slot: -1, Block: currentBlock})
 
-	return currentBlock, nil
+	return currentBlock, writtenBlocks, nil
 }
 
 // Scan through the flashcart, calling the given function for each header
@@ -586,6 +679,21 @@ ScanFlashcartLoop:
 	return headerCount, nil
 }
 
+// Fill in the data pages field of every old format header in the given
+// flashcart, converting it to the new format. Only the headers change.
+// Returns the number of headers upgraded
+func UpgradeFlashcartHeaders(flashcart []byte) (int, error) {
+	upgraded := 0
+	_, err := ScanFlashcartFile(bytes.NewReader(flashcart), func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
+		if header.IsOldFormat() {
+			Write2ByteValue(uint16(header.FxDataPages(addr)), flashcart, addr+FxHeaderDataSizeIndex)
+			upgraded++
+		}
+		return nil
+	})
+	return upgraded, err
+}
+
 // A wrapper for ScanFlashcart which only returns the basic flashcart size in bytes and slots
 func ScanFlashcartSize(sercon io.ReadWriter) (int, int, error) {
 	scanFunc := func(con io.ReadWriter, header *FxHeader, addr int, headers int) error {
@@ -657,18 +765,27 @@ func MapHeaderResult(result *[]HeaderCategory, header *FxHeader, addr int) (*str
 func ScanFlashcartMeta(sercon io.ReadWriter, getImages bool) ([]HeaderCategory, error) {
 	result := make([]HeaderCategory, 0)
 	errchan := make(chan error)
+	// Where each image eventually goes. These can't be pointers into 'result',
+	// since appending categories moves them around
+	type imageTarget struct {
+		category int
+		slot     int
+		image    string
+	}
+	images := make([]*imageTarget, 0)
+	pending := 0 // Number of image conversions that haven't reported back yet
 
 	scanFunc := func(con io.ReadWriter, header *FxHeader, addr int, headers int) error {
 		// Dump the errors and quit the reader as soon as possible
 		select {
 		case err := <-errchan:
+			pending--
 			if err != nil {
 				return err
 			}
 		default:
 		}
-		// Where to eventually write the completed image (goroutine)
-		writeimg, err := MapHeaderResult(&result, header, addr)
+		_, err := MapHeaderResult(&result, header, addr)
 		if err != nil {
 			return err
 		}
@@ -679,6 +796,13 @@ func ScanFlashcartMeta(sercon io.ReadWriter, getImages bool) ([]HeaderCategory,
 			if err != nil {
 				return err
 			}
+			category := len(result) - 1
+			target := &imageTarget{category: category, slot: len(result[category].Slots) - 1}
+			if header.IsCategory() {
+				target.slot = -1
+			}
+			images = append(images, target)
+			pending++
 			go func() {
 				outbytes, err := RawToPalettedTitle(imgbytes)
 				if err != nil {
@@ -690,7 +814,7 @@ func ScanFlashcartMeta(sercon io.ReadWriter, getImages bool) ([]HeaderCategory,
 					errchan <- err
 					return
 				}
-				*writeimg = "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngraw)
+				target.image = "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngraw)
 				errchan <- nil
 			}()
 		}
@@ -709,16 +833,19 @@ func ScanFlashcartMeta(sercon io.ReadWriter, getImages bool) ([]HeaderCategory,
 		return nil, err
 	}
 
-	// No error? Dump the errchan to be sure
-ErrorDump:
-	for {
-		select {
-		case err = <-errchan:
-			if err != nil {
-				return nil, err
-			}
-		default:
-			break ErrorDump
+	// No error? Wait for the remaining images to finish converting
+	for ; pending > 0; pending-- {
+		err = <-errchan
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, target := range images {
+		if target.slot < 0 {
+			result[target.category].Image = target.image
+		} else {
+			result[target.category].Slots[target.slot].Image = target.image
 		}
 	}
 
@@ -0,0 +1,264 @@
+package arduboy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+)
+
+// One slot to write into a flashcart. A slot without a sketch is a category
+// (which only uses the title, info, and image)
+type Slot struct {
+	Title     string
+	Version   string
+	Developer string
+	Info      string
+	Image     []byte // The title screen, FxHeaderImageLength bytes
+	Sketch    []byte // The raw program, unpatched (patches are applied as it's written)
+	FxData    []byte
+	FxSave    []byte
+}
+
+func (s *Slot) IsCategory() bool {
+	return len(s.Sketch) == 0
+}
+
+// Builds a flashcart one slot at a time, doing all the layout, alignment,
+// hashing, and patching. Slots are written wherever the output currently is
+type FlashcartBuilder struct {
+	Output       io.WriteSeeker
+	CategoryId   int
+	Slots        int
+	LastSlotPage uint16
+	// Settings for the slots written from now on
+	ValidateCategoryStructure bool
+	ValidateImageLength       bool
+	PatchMenu                 bool
+	PatchMicroLED             bool
+	PatchSsd1309              bool
+	Contrast                  int
+}
+
+func NewFlashcartBuilder(output io.WriteSeeker) *FlashcartBuilder {
+	return &FlashcartBuilder{
+		Output:                    output,
+		CategoryId:                -1,     //Start at -1 to make incrementing for categories easier
+		LastSlotPage:              0xFFFF, // first slot always has this as 0xFFFF
+		ValidateCategoryStructure: true,
+		ValidateImageLength:       true,
+		PatchMenu:                 true,
+		PatchMicroLED:             false,
+		PatchSsd1309:              false,
+		Contrast:                  CONTRAST_NOCHANGE,
+	}
+}
+
+func (builder *FlashcartBuilder) initHeader() FxHeader {
+	return FxHeader{
+		PreviousPage: builder.LastSlotPage,
+		NextPage:     0xFFFF,
+		ProgramStart: 0xFFFF,
+		DataStart:    0xFFFF,
+		DataPages:    0xFFFF, // This is how old programs did it
+		SaveStart:    0xFFFF,
+	}
+}
+
+// Write the entirety of a slot to the output, returning the number of bytes
+// written. Most of the header is calculated here. The slot itself isn't modified
+func (builder *FlashcartBuilder) WriteSlot(slot *Slot) (int, error) {
+	addr, err := builder.Output.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't determine current seek position on slot %d: %s", builder.Slots, err)
+	}
+	// Addr is now the beginning of the slot. Any other calcs should be
+	// based off this value
+	header := builder.initHeader()
+	header.Title = slot.Title
+	header.Version = slot.Version
+	header.Developer = slot.Developer
+	header.Info = slot.Info
+	var slotSize = FXPageSize + FxHeaderImageLength
+	slotEnd := func() uint16 {
+		return uint16((int(addr) + slotSize) / FXPageSize)
+	}
+	// Everything gets aligned and patched, so work on copies
+	image := append([]byte{}, slot.Image...)
+	sketch := append([]byte{}, slot.Sketch...)
+	fxdata := append([]byte{}, slot.FxData...)
+	fxsave := append([]byte{}, slot.FxSave...)
+	if len(image) != FxHeaderImageLength {
+		if builder.ValidateImageLength {
+			return 0, fmt.Errorf("Invalid image length on slot %d!", builder.Slots)
+		} else if len(image) < FxHeaderImageLength {
+			image = AlignData(image, FxHeaderImageLength)
+		} else {
+			image = image[:FxHeaderImageLength]
+		}
+	}
+	if slot.IsCategory() {
+		if len(fxdata) > 0 {
+			return 0, fmt.Errorf("FX data without sketch in slot %d!", builder.Slots)
+		}
+		if len(fxsave) > 0 {
+			return 0, fmt.Errorf("FX save without sketch in slot %d!", builder.Slots)
+		}
+	} else {
+		if builder.Slots < 2 && builder.ValidateCategoryStructure {
+			return 0, fmt.Errorf("First two slots MUST be categories! ")
+		}
+		// Wasteful but it's like 32KiB max... we need the pre-modded sketch to calculate the sha256
+		premodsketch := make([]byte, len(sketch), FlashSize)
+		copy(premodsketch, sketch)
+		premodsketch = AlignData(premodsketch, FXPageSize)
+		if builder.PatchMenu {
+			patched, message := PatchMenuButtons(sketch)
+			if patched {
+				log.Printf(message)
+			}
+		}
+		if builder.PatchMicroLED {
+			PatchMicroLED(sketch)
+		}
+		patchcount := PatchScreen(sketch, builder.PatchSsd1309, builder.Contrast)
+		if patchcount > 0 {
+			log.Printf("Patched %d screen parameter(s) (ssd1309: %t, contrast: %x)", patchcount, builder.PatchSsd1309, builder.Contrast)
+		}
+		sketch = AlignData(sketch, FlashPageSize)
+		pages := len(sketch) / FlashPageSize
+		if pages > 0xFF {
+			// Don't even consider the bootloader, there is a max size for the header
+			return 0, fmt.Errorf("Sketch in slot %d too large!", builder.Slots)
+		}
+		header.ProgramStart = slotEnd()
+		header.ProgramPages = uint8(pages) // length is PRE fx-padding...
+		sketch = AlignData(sketch, FXPageSize)
+		slotSize += len(sketch)
+		if len(fxdata) > 0 {
+			fxdata = AlignData(fxdata, FXPageSize)
+			header.DataStart = slotEnd()
+			header.DataPages = uint16(len(fxdata) / FXPageSize)
+			slotSize += len(fxdata)
+			// MUST patch the sketch to point to this data
+			copy(sketch[FxDataPointerAddress:], RETI_INSTRUCTION)
+			Write2ByteValue(header.DataStart, sketch, FxDataPointerAddress+2)
+		}
+		if len(fxsave) > 0 {
+			fxsave = AlignData(fxsave, FxSaveAlignment)
+			// Need to align fx save to a 4K boundary. The alignment goes at the
+			// BEGINNING of the save
+			var prealignment int = int(AlignWidth(uint(addr)+uint(slotSize), FxSaveAlignment)) - int(addr) - int(slotSize)
+			fxsave = append(MakePadding(prealignment), fxsave...)
+			slotSize += prealignment
+			header.SaveStart = slotEnd()
+			slotSize += len(fxsave) - prealignment
+			// MUST patch the sketch to point to this save
+			copy(sketch[FxSavePointerAddress:], RETI_INSTRUCTION)
+			Write2ByteValue(header.SaveStart, sketch, FxSavePointerAddress+2)
+		}
+		// ONLY calculate hash if not a category (this is how old tools did it; it doesn't matter much)
+		header.Sha256, err = calculateHeaderHash(premodsketch, fxdata)
+		if err != nil {
+			return 0, fmt.Errorf("Couldn't hash header: %s", err)
+		}
+	}
+	// ALWAYS write the category (it tells which programs are in which category)
+	header.Category = uint8(builder.CategoryId)
+	if slot.IsCategory() {
+		header.Category += 1
+	}
+	// Finish up writing header values now that we know all alignments
+	if slotSize&0xFF > 0 {
+		return 0, fmt.Errorf("ARDUGOTOOLS PROGRAM ERROR: Slot size misaligned: %d", slotSize)
+	}
+	header.SlotPages = uint16(slotSize / FXPageSize)
+	header.NextPage = slotEnd()
+	// Create the header
+	headerraw, err := header.MakeHeader()
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't compile header: %s", err)
+	}
+	totalWritten := 0
+	// Write out all the individual blocks of data
+	for _, data := range [][]byte{headerraw, image, sketch, fxdata, fxsave} {
+		written, err := builder.Output.Write(data)
+		totalWritten += written
+		if err != nil {
+			return totalWritten, fmt.Errorf("Couldn't write to flashcart: %s", err)
+		}
+	}
+	if totalWritten != slotSize {
+		return totalWritten, fmt.Errorf("ARDUGOTOOLS PROGRAM ERROR: Expected to write %d for '%s', actually wrote %d", slotSize, header.Title, totalWritten)
+	}
+	log.Printf("Wrote slot %d: '%s' (%d bytes)\n", builder.Slots, header.Title, slotSize)
+	builder.Slots += 1
+	if slot.IsCategory() {
+		builder.CategoryId += 1
+	}
+	builder.LastSlotPage = uint16(int(addr) / FXPageSize)
+	return slotSize, nil
+}
+
+// Write the page of padding that ends every flashcart. Call this once all
+// the slots are written
+func (builder *FlashcartBuilder) Finish() error {
+	_, err := builder.Output.Write(MakePadding(FXPageSize))
+	return err
+}
+
+// Pull every slot out of a flashcart, the same way parse_flashcart does. The
+// slots point into the given flashcart, and the sketches are as they were
+// written (patches and all). Feeding these back into a builder recreates the
+// flashcart
+func FlashcartSlots(flashcart []byte) ([]*Slot, error) {
+	slots := make([]*Slot, 0)
+	_, err := ScanFlashcartFile(bytes.NewReader(flashcart), func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
+		slotEnd := addr + int(header.SlotPages)*FXPageSize
+		if slotEnd > len(flashcart) {
+			return fmt.Errorf("Slot %d ('%s') runs past the end of the flashcart", index, header.Title)
+		}
+		// Pointers in a damaged header can go anywhere, so check every part
+		section := func(what string, start int, length int) ([]byte, error) {
+			if start < 0 || length < 0 || start+length > len(flashcart) {
+				return nil, fmt.Errorf("Slot %d ('%s') %s (%d bytes at 0x%x) is outside the flashcart", index, header.Title, what, length, start)
+			}
+			return flashcart[start : start+length], nil
+		}
+		slot := &Slot{
+			Title:     header.Title,
+			Version:   header.Version,
+			Developer: header.Developer,
+			Info:      header.Info,
+		}
+		var err error
+		if slot.Image, err = section("title image", addr+FXPageSize, FxHeaderImageLength); err != nil {
+			return err
+		}
+		if !header.IsCategory() {
+			slot.Sketch, err = section("sketch", int(header.ProgramStart)*FXPageSize, int(header.ProgramPages)*FlashPageSize)
+			if err != nil {
+				return err
+			}
+			if header.HasFxData() {
+				slot.FxData, err = section("FX data", int(header.DataStart)*FXPageSize, header.FxDataPages(addr)*FXPageSize)
+				if err != nil {
+					return err
+				}
+			}
+			if header.HasFxSave() {
+				start := int(header.SaveStart) * FXPageSize
+				slot.FxSave, err = section("FX save", start, slotEnd-start)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		slots = append(slots, slot)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
@@ -0,0 +1,113 @@
+package arduboy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFlashcartBuilder_Transparent(t *testing.T) {
+	minibin, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart.bin: %s", err)
+	}
+	original := append([]byte{}, minibin...)
+	slots, err := FlashcartSlots(minibin)
+	if err != nil {
+		t.Fatalf("Couldn't read slots: %s", err)
+	}
+	if len(slots) != 13 {
+		t.Fatalf("Expected 13 slots, got %d", len(slots))
+	}
+	testbin := buildTestFlashcart(slots, t)
+	if !bytes.Equal(minibin, original) {
+		t.Fatalf("Builder modified the slot data!")
+	}
+	if !bytes.Equal(minibin, testbin) {
+		t.Fatalf("Written flashcart not equivalent!")
+	}
+}
+
+func TestFlashcartBuilder_Invalid(t *testing.T) {
+	testpath, err := newRandomFilepath("builder_invalid.bin")
+	if err != nil {
+		t.Fatalf("Couldn't get path to test file: %s", err)
+	}
+	file, err := os.Create(testpath)
+	if err != nil {
+		t.Fatalf("Couldn't create %s: %s", testpath, err)
+	}
+	defer file.Close()
+	builder := NewFlashcartBuilder(file)
+	image := make([]byte, FxHeaderImageLength)
+	if _, err = builder.WriteSlot(&Slot{Title: "Game", Image: image, Sketch: make([]byte, FlashPageSize)}); err == nil {
+		t.Fatalf("Expected error writing a game before the categories")
+	}
+	if _, err = builder.WriteSlot(&Slot{Title: "Category", Image: image[:10]}); err == nil {
+		t.Fatalf("Expected error writing a short image")
+	}
+	if _, err = builder.WriteSlot(&Slot{Title: "Category", Image: image, FxData: make([]byte, 10)}); err == nil {
+		t.Fatalf("Expected error writing FX data into a category")
+	}
+	builder.ValidateImageLength = false
+	written, err := builder.WriteSlot(&Slot{Title: "Category", Image: image[:10]})
+	if err != nil {
+		t.Fatalf("Couldn't write category with short image: %s", err)
+	}
+	if written != FXPageSize+FxHeaderImageLength || builder.Slots != 1 || builder.CategoryId != 0 {
+		t.Fatalf("Unexpected state after category: %d bytes, %d slots, category %d", written, builder.Slots, builder.CategoryId)
+	}
+}
+
+func TestFlashcartSlots_Invalid(t *testing.T) {
+	original, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart.bin: %s", err)
+	}
+	lasers := 115 * FXPageSize
+	for _, corrupt := range []struct {
+		what  string
+		index int
+		page  uint16
+	}{
+		{"sketch", FxHeaderProgramPageIndex, 0x7000},
+		{"FX data", FxHeaderDataPageIndex, 0x7000},
+		{"FX save", FxHeaderSavePageIndex, 0x7000},
+		{"FX save", FxHeaderSavePageIndex, 1000}, // Past the end of the slot, but in the flashcart
+	} {
+		minicart := append([]byte{}, original...)
+		Write2ByteValue(corrupt.page, minicart, lasers+corrupt.index)
+		_, err = FlashcartSlots(minicart)
+		if err == nil || !strings.Contains(err.Error(), corrupt.what) {
+			t.Fatalf("Expected %s error with page %d, got %v", corrupt.what, corrupt.page, err)
+		}
+	}
+}
+
+// Build a flashcart from the given slots with the default settings
+func buildTestFlashcart(slots []*Slot, t *testing.T) []byte {
+	testpath, err := newRandomFilepath("built.bin")
+	if err != nil {
+		t.Fatalf("Couldn't get path to test file: %s", err)
+	}
+	file, err := os.Create(testpath)
+	if err != nil {
+		t.Fatalf("Couldn't create %s: %s", testpath, err)
+	}
+	defer file.Close()
+	builder := NewFlashcartBuilder(file)
+	for _, slot := range slots {
+		if _, err = builder.WriteSlot(slot); err != nil {
+			t.Fatalf("Couldn't write slot '%s': %s", slot.Title, err)
+		}
+	}
+	if err = builder.Finish(); err != nil {
+		t.Fatalf("Couldn't finish flashcart: %s", err)
+	}
+	result, err := os.ReadFile(testpath)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %s", testpath, err)
+	}
+	return result
+}
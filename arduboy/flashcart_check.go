@@ -0,0 +1,292 @@
+package arduboy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// An unused vector (RESERVED8) which is never patched, which is what the
+// vectors used for the FX pointers were before they were patched
+const unpatchedVector = 8 * AvrVectorSize
+
+// Something wrong with a flashcart, found by CheckFlashcart
+type FlashcartProblem struct {
+	Slot    int // -1 if it's about the whole flashcart
+	Address int
+	Title   string
+	Problem string
+	Warning bool // Suspicious, but the flashcart still works
+	Fixable bool
+	Fixed   bool
+}
+
+// A slot found while following the chain of headers
+type checkedSlot struct {
+	index  int
+	addr   int
+	page   int
+	header *FxHeader
+}
+
+// Everything needed while checking (and possibly repairing) a flashcart
+type flashcartChecker struct {
+	flashcart []byte
+	repair    bool
+	problems  []FlashcartProblem
+}
+
+func (c *flashcartChecker) report(slot *checkedSlot, warning bool, fix func(), format string, args ...interface{}) {
+	problem := FlashcartProblem{
+		Slot:    -1,
+		Problem: fmt.Sprintf(format, args...),
+		Warning: warning,
+		Fixable: fix != nil,
+	}
+	if slot != nil {
+		problem.Slot = slot.index
+		problem.Address = slot.addr
+		problem.Title = slot.header.Title
+	}
+	if fix != nil && c.repair {
+		fix()
+		problem.Fixed = true
+	}
+	c.problems = append(c.problems, problem)
+}
+
+// Parse the header at the given page, or nil if there isn't one
+func (c *flashcartChecker) headerAt(page int) *FxHeader {
+	addr := page * FXPageSize
+	if page < 0 || addr+FxHeaderLength > len(c.flashcart) {
+		return nil
+	}
+	header, _, err := ParseHeader(c.flashcart[addr:])
+	if err != nil {
+		return nil
+	}
+	return header
+}
+
+func (c *flashcartChecker) write2(slot *checkedSlot, index int, value int) func() {
+	return func() { Write2ByteValue(uint16(value), c.flashcart, slot.addr+index) }
+}
+
+// Follow the header chain like the bootloader menu does (with NextPage),
+// checking it against the slot sizes and previous pages along the way
+func (c *flashcartChecker) followChain() []*checkedSlot {
+	slots := make([]*checkedSlot, 0)
+	previous := 0xFFFF
+	for page := 0; ; {
+		header := c.headerAt(page)
+		if header == nil {
+			if page == 0 {
+				c.report(nil, false, nil, "No slot header at the start of the flashcart")
+			}
+			break
+		}
+		slot := &checkedSlot{index: len(slots), addr: page * FXPageSize, page: page, header: header}
+		slots = append(slots, slot)
+		if int(header.PreviousPage) != previous {
+			c.report(slot, false, c.write2(slot, FxHeaderPreviousPageIndex, previous),
+				"PreviousPage is %d, should be %d", header.PreviousPage, previous)
+		}
+		previous = page
+		// The slot size and the next page should agree. If they don't, believe
+		// whichever one actually leads to another header
+		bySize := page + int(header.SlotPages)
+		byNext := int(header.NextPage)
+		next := byNext
+		if bySize != byNext {
+			if byNext <= page || (c.headerAt(byNext) == nil && c.headerAt(bySize) != nil) {
+				next = bySize
+				c.report(slot, false, c.write2(slot, FxHeaderNextPageIndex, bySize),
+					"NextPage is %d, but the slot ends at %d", byNext, bySize)
+			} else {
+				c.report(slot, false, c.write2(slot, FxHeaderSlotSizeIndex, byNext-page),
+					"SlotPages is %d, but the next slot is at %d", header.SlotPages, byNext)
+			}
+		}
+		if next <= page {
+			c.report(slot, false, nil, "Slot chain goes backwards (to page %d)", next)
+			break
+		}
+		page = next
+	}
+	return slots
+}
+
+// Where the slot ends, in pages, according to the chain
+func (s *checkedSlot) end(slots []*checkedSlot) int {
+	if s.index+1 < len(slots) {
+		return slots[s.index+1].page
+	}
+	return s.page + int(s.header.SlotPages)
+}
+
+// Check the category structure: the bootloader category comes first, and
+// categories are numbered in order with their games following them
+func (c *flashcartChecker) checkCategories(slots []*checkedSlot) {
+	if len(slots) > 0 && !slots[0].header.IsCategory() {
+		c.report(slots[0], false, nil, "First slot should be the bootloader category")
+	}
+	category := -1
+	for _, slot := range slots {
+		if slot.header.IsCategory() {
+			category++
+		} else if category < 0 {
+			continue // Already reported
+		}
+		if int(slot.header.Category) != category {
+			value := category
+			fix := func() { c.flashcart[slot.addr+FxHeaderCategoryIndex] = byte(value) }
+			c.report(slot, false, fix, "Category is %d, should be %d", slot.header.Category, category)
+		}
+	}
+}
+
+// Check the program, data, and save pointers of a game against its slot
+func (c *flashcartChecker) checkPointers(slot *checkedSlot, end int) bool {
+	h := slot.header
+	if h.IsCategory() {
+		if h.HasFxData() || h.HasFxSave() {
+			c.report(slot, true, nil, "Category has FX data or save pointers")
+		}
+		return true
+	}
+	ok := true
+	outside := func(what string, start int, pages int, min int) {
+		if start < min || start+pages > end {
+			c.report(slot, false, nil, "%s (pages %d-%d) is outside the slot (pages %d-%d)", what, start, start+pages, min, end)
+			ok = false
+		}
+	}
+	programPages := (int(h.ProgramPages)*FlashPageSize + FXPageSize - 1) / FXPageSize
+	if h.ProgramPages == 0 {
+		c.report(slot, false, nil, "Game has no program")
+		ok = false
+	}
+	outside("Program", int(h.ProgramStart), programPages, slot.page+FxPreamblePages)
+	used := int(h.ProgramStart) + programPages
+	if h.HasFxData() {
+		if h.IsOldFormat() {
+			c.report(slot, true, c.write2(slot, FxHeaderDataSizeIndex, h.FxDataPages(slot.addr)),
+				"Header is in the old format (no FX data length)")
+		}
+		outside("FX data", int(h.DataStart), h.FxDataPages(slot.addr), used)
+		used = int(h.DataStart) + h.FxDataPages(slot.addr)
+	}
+	if h.HasFxSave() {
+		outside("FX save", int(h.SaveStart), 1, used)
+		if (int(h.SaveStart)*FXPageSize)%FxSaveAlignment != 0 {
+			c.report(slot, false, nil, "FX save at page %d isn't aligned to %d bytes", h.SaveStart, FxSaveAlignment)
+		}
+	}
+	return ok
+}
+
+// Check the FX pointers patched into the sketch against the header
+func (c *flashcartChecker) checkSketchPointers(slot *checkedSlot, sketch []byte) {
+	for _, pointer := range []struct {
+		name    string
+		address int
+		has     bool
+		page    uint16
+	}{
+		{"data", FxDataPointerAddress, slot.header.HasFxData(), slot.header.DataStart},
+		{"save", FxSavePointerAddress, slot.header.HasFxSave(), slot.header.SaveStart},
+	} {
+		found := readFxPointer(sketch, pointer.address)
+		at := int(slot.header.ProgramStart)*FXPageSize + pointer.address
+		if pointer.has && (!found.Patched || found.Page != int(pointer.page)) {
+			fix := func() {
+				copy(c.flashcart[at:], RETI_INSTRUCTION)
+				Write2ByteValue(pointer.page, c.flashcart, at+2)
+			}
+			c.report(slot, false, fix, "Sketch FX %s pointer doesn't point to page %d", pointer.name, pointer.page)
+		} else if !pointer.has && found.Patched {
+			// The vector was originally a jump to the bad interrupt handler, like this one
+			fix := func() { copy(c.flashcart[at:at+AvrVectorSize], sketch[unpatchedVector:]) }
+			c.report(slot, true, fix, "Sketch has an FX %s pointer but the slot has no FX %s", pointer.name, pointer.name)
+		}
+	}
+}
+
+// The sketch as it was before flashcart building patched the FX pointers in
+func unpatchFxPointers(sketch []byte) []byte {
+	result := append([]byte{}, sketch...)
+	if len(result) < unpatchedVector+AvrVectorSize {
+		return result
+	}
+	for _, address := range []int{FxDataPointerAddress, FxSavePointerAddress} {
+		if readFxPointer(result, address).Patched {
+			copy(result[address:address+AvrVectorSize], result[unpatchedVector:])
+		}
+	}
+	return result
+}
+
+// Check the stored hash, which is of the sketch before any patches plus the
+// FX data. The FX pointers can be undone, but the menu and screen patches
+// can't, so those sketches can't be checked
+func (c *flashcartChecker) checkHash(slot *checkedSlot, sketch []byte) {
+	if slot.header.Sha256 == hex.EncodeToString(bytes.Repeat([]byte{0xFF}, FxHeaderHashLength)) {
+		c.report(slot, true, nil, "No hash stored")
+		return
+	}
+	var fxdata []byte
+	if slot.header.HasFxData() {
+		start := int(slot.header.DataStart) * FXPageSize
+		fxdata = c.flashcart[start : start+slot.header.FxDataPages(slot.addr)*FXPageSize]
+	}
+	unpatched := AlignData(unpatchFxPointers(sketch), FXPageSize)
+	hash, err := calculateHeaderHash(unpatched, fxdata)
+	if err != nil || hash == slot.header.Sha256 {
+		return
+	}
+	if slot.header.IsOldFormat() {
+		// The inferred data length includes any padding before the save
+		trimmed := TrimUnused(fxdata, FXPageSize)
+		if trimmedHash, _ := calculateHeaderHash(unpatched, trimmed); trimmedHash == slot.header.Sha256 {
+			return
+		}
+		c.report(slot, true, nil, "Hash can't be checked: the old format header doesn't give the FX data length")
+		return
+	}
+	patched := menuPatchPresent(sketch)
+	for _, address := range findScreenInitTables(sketch) {
+		patched = patched || string(sketch[address:address+len(LCDBOOTPROGRAM)]) != LCDBOOTPROGRAM
+	}
+	if patched {
+		c.report(slot, true, nil, "Hash can't be checked: the sketch has menu or screen patches")
+		return
+	}
+	raw, _ := hex.DecodeString(hash)
+	fix := func() { copy(c.flashcart[slot.addr+FxHeaderHashIndex:], raw) }
+	c.report(slot, false, fix, "Hash is %s, should be %s", slot.header.Sha256, hash)
+}
+
+// Check that a flashcart is consistent: the header chain, slot sizes, the
+// program/data/save pointers, category numbering, hashes, and the FX
+// pointers patched into sketches. If repair is set, the problems which can
+// be fixed are fixed directly in the given flashcart
+func CheckFlashcart(flashcart []byte, repair bool) ([]FlashcartProblem, int) {
+	c := flashcartChecker{flashcart: flashcart, repair: repair, problems: make([]FlashcartProblem, 0)}
+	slots := c.followChain()
+	c.checkCategories(slots)
+	for _, slot := range slots {
+		end := slot.end(slots)
+		if end*FXPageSize > len(flashcart) {
+			c.report(slot, false, nil, "Slot runs past the end of the flashcart")
+			continue
+		}
+		if !c.checkPointers(slot, end) || slot.header.IsCategory() {
+			continue
+		}
+		start := int(slot.header.ProgramStart) * FXPageSize
+		sketch := append([]byte{}, flashcart[start:start+int(slot.header.ProgramPages)*FlashPageSize]...)
+		c.checkSketchPointers(slot, sketch)
+		c.checkHash(slot, sketch)
+	}
+	return c.problems, len(slots)
+}
@@ -0,0 +1,94 @@
+package arduboy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckFlashcart_Clean(t *testing.T) {
+	minicart, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart: %s", err)
+	}
+	problems, slots := CheckFlashcart(minicart, false)
+	if slots != 13 {
+		t.Fatalf("Expected 13 slots, got %d", slots)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestCheckFlashcart_Repair(t *testing.T) {
+	original, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart: %s", err)
+	}
+	minicart := append([]byte{}, original...)
+	page := func(p int) int { return p * FXPageSize }
+	Write2ByteValue(7, minicart, page(115)+FxHeaderPreviousPageIndex) // Lasers
+	Write2ByteValue(300, minicart, page(216)+FxHeaderNextPageIndex)   // Chri-Bocchi Cat
+	Write2ByteValue(90, minicart, page(308)+FxHeaderSlotSizeIndex)    // Bangi
+	minicart[page(604)+FxHeaderCategoryIndex] = 1                     // Catacombs
+	minicart[page(492)+FxHeaderHashIndex] ^= 0xFF                     // Choplifter (not menu patched)
+
+	problems, _ := CheckFlashcart(minicart, false)
+	expected := []int{3, 4, 5, 9, 7}
+	found := make(map[int]bool)
+	for _, problem := range problems {
+		if !problem.Fixable || problem.Fixed || problem.Warning {
+			t.Fatalf("Problem should be fixable and not fixed: %v", problem)
+		}
+		found[problem.Slot] = true
+	}
+	for _, slot := range expected {
+		if !found[slot] {
+			t.Fatalf("Expected a problem in slot %d, got %v", slot, problems)
+		}
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), problems)
+	}
+
+	problems, _ = CheckFlashcart(minicart, true)
+	for _, problem := range problems {
+		if !problem.Fixed {
+			t.Fatalf("Problem wasn't fixed: %v", problem)
+		}
+	}
+	if !bytes.Equal(minicart, original) {
+		t.Fatalf("Repaired flashcart doesn't match the original")
+	}
+}
+
+func TestCheckFlashcart_FxPointers(t *testing.T) {
+	original := loadFullCart("makecart.bin", t)
+	cart := append([]byte{}, original...)
+	// TexasHoldEmFX: header at page 2979, sketch at 2984, FX data at 3097, save at 4112
+	header := 2979 * FXPageSize
+	sketch := 2984 * FXPageSize
+	Write2ByteValue(3000, cart, sketch+FxDataPointerAddress+2)
+	Write2ByteValue(0xFFFF, cart, header+FxHeaderDataSizeIndex)
+	problems, _ := CheckFlashcart(cart, true)
+	for _, problem := range problems {
+		if problem.Slot == 6 && !problem.Fixed {
+			t.Fatalf("Problem wasn't fixed: %v", problem)
+		}
+	}
+	if !bytes.Equal(cart, original) {
+		t.Fatalf("Repaired flashcart doesn't match the original")
+	}
+
+	// A save off its alignment can't be fixed
+	Write2ByteValue(4113, cart, header+FxHeaderSavePageIndex)
+	problems, _ = CheckFlashcart(cart, false)
+	found := false
+	for _, problem := range problems {
+		found = found || (problem.Slot == 6 && !problem.Fixable && strings.Contains(problem.Problem, "aligned"))
+	}
+	if !found {
+		t.Fatalf("Expected an unfixable save alignment problem, got %v", problems)
+	}
+}
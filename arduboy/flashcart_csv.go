@@ -0,0 +1,239 @@
+package arduboy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The CSV cart index used by Mr.Blinky's flashcart-builder.py and the web
+// cart builder. Semicolon separated, with this header row (the misspelling
+// is theirs). Files are relative to the index
+const (
+	FlashcartCsvName  = "flashcart-index.csv"
+	csvTitleThreshold = 100 // Same as title_image in flashcart scripts
+)
+
+// Columns in the CSV index
+const (
+	csvList = iota
+	csvTitle
+	csvTitleScreen
+	csvHexFile
+	csvDataFile
+	csvSaveFile
+	csvVersion
+	csvDeveloper
+	csvInfo
+	csvColumns
+)
+
+var FlashcartCsvHeader = []string{"List", "Discription", "Title screen", "Hex file", "Data file", "Save file", "Version", "Developer", "Info"}
+
+var unsafeFileName = regexp.MustCompile(`[^a-zA-Z0-9_\-]+`)
+
+// A name for files made from a slot. Titles aren't unique, but slot numbers are
+func slotFileName(index int, title string) string {
+	return fmt.Sprintf("%03d-%s", index, strings.Trim(unsafeFileName.ReplaceAllString(title, "_"), "_"))
+}
+
+// Read the given file from a CSV index. Empty filenames are no data. Indexes
+// made on windows use backslashes
+func readCsvFile(basePath string, filename string) ([]byte, error) {
+	filename = strings.TrimSpace(filename)
+	if filename == "" {
+		return nil, nil
+	}
+	filename = filepath.FromSlash(strings.ReplaceAll(filename, "\\", "/"))
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(basePath, filename)
+	}
+	return os.ReadFile(filename)
+}
+
+// Load the slot described by one row of a CSV index
+func readCsvSlot(basePath string, row []string) (*Slot, error) {
+	slot := Slot{
+		Title:     row[csvTitle],
+		Version:   row[csvVersion],
+		Developer: row[csvDeveloper],
+		Info:      row[csvInfo],
+	}
+	image, err := readCsvFile(basePath, row[csvTitleScreen])
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read title screen: %s", err)
+	}
+	if image != nil {
+		paletted, err := RawImageToPalettedTitle(bytes.NewReader(image), csvTitleThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't convert title screen '%s': %s", row[csvTitleScreen], err)
+		}
+		slot.Image, _, err = PalettedToRaw(paletted, ScreenWidth, ScreenHeight)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't convert title screen '%s': %s", row[csvTitleScreen], err)
+		}
+	} else {
+		slot.Image = MakePadding(FxHeaderImageLength) // Nothing in the menu, but it still works
+	}
+	hexfile, err := readCsvFile(basePath, row[csvHexFile])
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read hex file: %s", err)
+	}
+	if hexfile != nil {
+		slot.Sketch, err = HexToBin(bytes.NewReader(hexfile))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse hex file '%s': %s", row[csvHexFile], err)
+		}
+	}
+	slot.FxData, err = readCsvFile(basePath, row[csvDataFile])
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read data file: %s", err)
+	}
+	slot.FxSave, err = readCsvFile(basePath, row[csvSaveFile])
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read save file: %s", err)
+	}
+	return &slot, nil
+}
+
+// Read a CSV cart index and all the files it points to, producing the slots
+// to give to a FlashcartBuilder. The list numbers in the index aren't
+// needed (categories are numbered in order) but they're checked
+func ReadFlashcartCsv(csvPath string) ([]*Slot, error) {
+	file, err := os.Open(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comma = ';'
+	reader.FieldsPerRecord = -1 // Older indexes don't have the last three columns
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse csv: %s", err)
+	}
+	basePath := filepath.Dir(csvPath)
+	slots := make([]*Slot, 0)
+	category := -1
+	for i, row := range rows {
+		if i == 0 || len(row) == 0 || strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue // The header, or a blank line
+		}
+		for len(row) < csvColumns {
+			row = append(row, "")
+		}
+		slot, err := readCsvSlot(basePath, row)
+		if err != nil {
+			return nil, fmt.Errorf("Row %d ('%s'): %s", i+1, row[csvTitle], err)
+		}
+		if slot.IsCategory() {
+			category++
+		}
+		if list, err := strconv.Atoi(strings.TrimSpace(row[csvList])); err != nil || list != category {
+			log.Printf("WARNING: row %d ('%s') has list '%s' but is in list %d", i+1, slot.Title, row[csvList], category)
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+// Write out the given data into the export directory, returning the path
+// to put in the index. Nothing is written if there's no data
+func writeCsvFile(outdir string, name string, data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	err := os.MkdirAll(filepath.Join(outdir, filepath.Dir(name)), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(outdir, name), data, 0644)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Unpack a flashcart into a CSV index in the given directory, alongside
+// PNG title screens, hex files, and data/save files. Categories go in
+// "categories", and each game gets a folder in "games". The hex files are
+// the sketches as they are in the flashcart, other than the FX pointers
+// (menu and screen patches can't be undone). Returns the number of slots
+// exported
+func ExportFlashcartCsv(flashcart []byte, outdir string) (int, error) {
+	slots, err := FlashcartSlots(flashcart)
+	if err != nil {
+		return 0, err
+	}
+	err = os.MkdirAll(outdir, 0755)
+	if err != nil {
+		return 0, err
+	}
+	rows := [][]string{FlashcartCsvHeader}
+	category := -1
+	for i, slot := range slots {
+		name := slotFileName(i, slot.Title)
+		folder := "categories"
+		if slot.IsCategory() {
+			category++
+		} else {
+			folder = "games/" + name
+		}
+		row := make([]string, csvColumns)
+		row[csvList] = strconv.Itoa(category)
+		row[csvTitle] = slot.Title
+		row[csvVersion] = slot.Version
+		row[csvDeveloper] = slot.Developer
+		row[csvInfo] = slot.Info
+		paletted, err := RawToPalettedTitle(slot.Image)
+		if err != nil {
+			return 0, fmt.Errorf("Couldn't convert title screen for slot %d: %s", i, err)
+		}
+		png, err := PalettedToImageTitleBW(paletted, "png")
+		if err != nil {
+			return 0, fmt.Errorf("Couldn't convert title screen for slot %d: %s", i, err)
+		}
+		var hexfile bytes.Buffer
+		if !slot.IsCategory() {
+			// The FX pointers are patched in again when building
+			err = BinToHex(unpatchFxPointers(slot.Sketch), &hexfile)
+			if err != nil {
+				return 0, fmt.Errorf("Couldn't convert sketch for slot %d: %s", i, err)
+			}
+		}
+		for _, file := range []struct {
+			column int
+			name   string
+			data   []byte
+		}{
+			{csvTitleScreen, folder + "/" + name + ".png", png},
+			{csvHexFile, folder + "/" + name + ".hex", hexfile.Bytes()},
+			{csvDataFile, folder + "/" + name + "-data.bin", slot.FxData},
+			{csvSaveFile, folder + "/" + name + "-save.bin", slot.FxSave},
+		} {
+			row[file.column], err = writeCsvFile(outdir, file.name, file.data)
+			if err != nil {
+				return 0, fmt.Errorf("Couldn't write %s: %s", file.name, err)
+			}
+		}
+		rows = append(rows, row)
+	}
+	index, err := os.Create(filepath.Join(outdir, FlashcartCsvName))
+	if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+	writer := csv.NewWriter(index)
+	writer.Comma = ';'
+	err = writer.WriteAll(rows)
+	if err != nil {
+		return 0, err
+	}
+	return len(slots), nil
+}
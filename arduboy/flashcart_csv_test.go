@@ -0,0 +1,97 @@
+package arduboy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Build a flashcart from the given index
+func buildFlashcartCsv(csvPath string, t *testing.T) []byte {
+	slots, err := ReadFlashcartCsv(csvPath)
+	if err != nil {
+		t.Fatalf("Couldn't read csv: %s", err)
+	}
+	return buildTestFlashcart(slots, t)
+}
+
+func TestFlashcartCsv_Transparent(t *testing.T) {
+	minibin, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart.bin: %s", err)
+	}
+	outdir, err := newRandomFilepath("csvexport")
+	if err != nil {
+		t.Fatalf("Couldn't get path to test folder: %s", err)
+	}
+	count, err := ExportFlashcartCsv(minibin, outdir)
+	if err != nil {
+		t.Fatalf("Couldn't export csv: %s", err)
+	}
+	if count != 13 {
+		t.Fatalf("Expected 13 slots, got %d", count)
+	}
+	csvPath := filepath.Join(outdir, FlashcartCsvName)
+	if !bytes.Equal(minibin, buildFlashcartCsv(csvPath, t)) {
+		t.Fatalf("Flashcart built from csv not equivalent!")
+	}
+
+	// Older indexes from windows have only six columns and backslashes
+	index, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatalf("Couldn't read index: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(index)), "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, ";")
+		lines[i] = strings.ReplaceAll(strings.Join(fields[:6], ";"), "/", "\\")
+	}
+	err = os.WriteFile(csvPath, []byte(strings.Join(lines, "\r\n")), 0644)
+	if err != nil {
+		t.Fatalf("Couldn't write old index: %s", err)
+	}
+	slots, err := ReadFlashcartCsv(csvPath)
+	if err != nil {
+		t.Fatalf("Couldn't read old csv: %s", err)
+	}
+	if len(slots) != 13 || slots[2].Title != "Hopper" || slots[2].Developer != "" || len(slots[2].Sketch) == 0 {
+		t.Fatalf("Old csv read wrong: %d slots, slot 2: '%s' by '%s'", len(slots), slots[2].Title, slots[2].Developer)
+	}
+}
+
+func TestFlashcartCsv_FxData(t *testing.T) {
+	makecart := loadFullCart("makecart.bin", t)
+	outdir, err := newRandomFilepath("csvexportfx")
+	if err != nil {
+		t.Fatalf("Couldn't get path to test folder: %s", err)
+	}
+	if _, err = ExportFlashcartCsv(makecart, outdir); err != nil {
+		t.Fatalf("Couldn't export csv: %s", err)
+	}
+	rebuilt := buildFlashcartCsv(filepath.Join(outdir, FlashcartCsvName), t)
+	if len(rebuilt) != len(makecart) {
+		t.Fatalf("Rebuilt flashcart is %d bytes, expected %d", len(rebuilt), len(makecart))
+	}
+	// The hash of the menu patched sketch can't come out the same, but nothing
+	// else should be different
+	different := 0
+	for i := range rebuilt {
+		if rebuilt[i] != makecart[i] {
+			different++
+		}
+	}
+	if different > FxHeaderHashLength {
+		t.Fatalf("Rebuilt flashcart has %d bytes different", different)
+	}
+	problems, slots := CheckFlashcart(rebuilt, false)
+	for _, p := range problems {
+		if !p.Warning {
+			t.Fatalf("Rebuilt flashcart has problem in slot %d: %s", p.Slot, p.Problem)
+		}
+	}
+	if slots != 7 {
+		t.Fatalf("Expected 7 slots, got %d", slots)
+	}
+}
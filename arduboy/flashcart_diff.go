@@ -0,0 +1,349 @@
+package arduboy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Where a slot is in one of the flashcarts being compared
+type FlashcartDiffLocation struct {
+	Slot     int
+	Address  int
+	Category string `json:",omitempty"` // Title of the category a game is in
+}
+
+// How one category or game differs between two flashcarts. Old is nil for
+// added slots, New is nil for removed slots
+type FlashcartSlotDiff struct {
+	Title         string
+	Developer     string `json:",omitempty"`
+	Old           *FlashcartDiffLocation
+	New           *FlashcartDiffLocation
+	Added         bool     `json:",omitempty"`
+	Removed       bool     `json:",omitempty"`
+	Moved         bool     `json:",omitempty"` // Out of order compared to the other slots
+	Recategorized bool     `json:",omitempty"`
+	Updated       bool     `json:",omitempty"` // The hash (sketch and FX data) changed
+	Changes       []string `json:",omitempty"` // Everything else which changed, human readable
+}
+
+func (d *FlashcartSlotDiff) IsChanged() bool {
+	return d.Added || d.Removed || d.Moved || d.Recategorized || d.Updated || len(d.Changes) > 0
+}
+
+// The differences between two flashcarts. Only categories and games which
+// changed are listed
+type FlashcartDiff struct {
+	Categories []*FlashcartSlotDiff
+	Games      []*FlashcartSlotDiff
+}
+
+// Everything needed to compare one slot
+type diffSlot struct {
+	location FlashcartDiffLocation
+	header   *FxHeader
+	image    []byte
+	sketch   []byte // With the FX pointers unpatched
+	fxdata   []byte
+	fxsave   []byte
+}
+
+func readDiffSlots(flashcart io.ReadSeeker) ([]*diffSlot, error) {
+	result := make([]*diffSlot, 0)
+	category := ""
+	read := func(f io.ReadSeeker, page int, length int) ([]byte, error) {
+		data := make([]byte, length)
+		return data, SeekRead(f, int64(page)*int64(FXPageSize), data)
+	}
+	_, err := ScanFlashcartFile(flashcart, func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
+		slot := diffSlot{
+			location: FlashcartDiffLocation{Slot: index, Address: addr},
+			header:   header,
+		}
+		var err error
+		if slot.image, err = read(f, addr/FXPageSize+1, FxHeaderImageLength); err != nil {
+			return fmt.Errorf("Couldn't read title image for slot %d: %s", index, err)
+		}
+		if header.IsCategory() {
+			category = header.Title
+		} else {
+			slot.location.Category = category
+			if slot.sketch, err = read(f, int(header.ProgramStart), int(header.ProgramPages)*FlashPageSize); err != nil {
+				return fmt.Errorf("Couldn't read sketch for slot %d: %s", index, err)
+			}
+			slot.sketch = unpatchFxPointers(slot.sketch)
+			if header.HasFxData() {
+				if slot.fxdata, err = read(f, int(header.DataStart), header.FxDataPages(addr)*FXPageSize); err != nil {
+					return fmt.Errorf("Couldn't read FX data for slot %d: %s", index, err)
+				}
+			}
+			if header.HasFxSave() {
+				end := addr/FXPageSize + int(header.SlotPages)
+				if int(header.SaveStart) > end {
+					return fmt.Errorf("FX save for slot %d starts at page %d, past the end of the slot (%d)", index, header.SaveStart, end)
+				}
+				if slot.fxsave, err = read(f, int(header.SaveStart), (end-int(header.SaveStart))*FXPageSize); err != nil {
+					return fmt.Errorf("Couldn't read FX save for slot %d: %s", index, err)
+				}
+			}
+		}
+		result = append(result, &slot)
+		// The scan seeks to the next header itself
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Pair up slots from each side which have the same key, in order. The
+// paired slots are removed from the pending lists
+func pairDiffSlots(before []*diffSlot, after []*diffSlot, key func(*diffSlot) string, pair func(*diffSlot, *diffSlot)) ([]*diffSlot, []*diffSlot) {
+	waiting := make(map[string][]*diffSlot)
+	for _, n := range after {
+		waiting[key(n)] = append(waiting[key(n)], n)
+	}
+	paired := make(map[*diffSlot]bool)
+	unpairedOld := make([]*diffSlot, 0)
+	for _, o := range before {
+		k := key(o)
+		if len(waiting[k]) > 0 {
+			pair(o, waiting[k][0])
+			paired[waiting[k][0]] = true
+			waiting[k] = waiting[k][1:]
+		} else {
+			unpairedOld = append(unpairedOld, o)
+		}
+	}
+	unpairedNew := make([]*diffSlot, 0)
+	for _, n := range after {
+		if !paired[n] {
+			unpairedNew = append(unpairedNew, n)
+		}
+	}
+	return unpairedOld, unpairedNew
+}
+
+// Mark the paired slots which are out of order. The slots which stay in the
+// same order are the longest increasing run of new positions (in old order);
+// the rest moved. This way inserting one game doesn't move every game after it
+func markMoved(pairs [][2]*diffSlot, diffs []*FlashcartSlotDiff) {
+	// Standard patience sorting longest increasing subsequence
+	tails := make([]int, 0) // Index into pairs of the smallest tail for each length
+	previous := make([]int, len(pairs))
+	for i, p := range pairs {
+		pos := sort.Search(len(tails), func(t int) bool {
+			return pairs[tails[t]][1].location.Slot >= p[1].location.Slot
+		})
+		previous[i] = -1
+		if pos > 0 {
+			previous[i] = tails[pos-1]
+		}
+		if pos == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[pos] = i
+		}
+	}
+	inOrder := make(map[int]bool)
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = previous[i] {
+			inOrder[i] = true
+		}
+	}
+	for i := range pairs {
+		diffs[i].Moved = !inOrder[i]
+	}
+}
+
+func describeDataChange(what string, before []byte, after []byte) string {
+	if bytes.Equal(before, after) {
+		return ""
+	} else if len(before) == 0 {
+		return what + " added"
+	} else if len(after) == 0 {
+		return what + " removed"
+	}
+	return what + " contents changed"
+}
+
+// Compare the parts of two paired slots which aren't about where they are
+func compareDiffSlots(o *diffSlot, n *diffSlot, diff *FlashcartSlotDiff) {
+	addChange := func(change string) {
+		if change != "" {
+			diff.Changes = append(diff.Changes, change)
+		}
+	}
+	for _, field := range []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{"Version", o.header.Version, n.header.Version},
+		{"Info", o.header.Info, n.header.Info},
+	} {
+		if field.before != field.after {
+			addChange(fmt.Sprintf("%s changed from '%s' to '%s'", field.name, field.before, field.after))
+		}
+	}
+	if !bytes.Equal(o.image, n.image) {
+		addChange("Title image changed")
+	}
+	if o.header.IsCategory() || n.header.IsCategory() {
+		return
+	}
+	diff.Recategorized = o.location.Category != n.location.Category
+	diff.Updated = o.header.Sha256 != n.header.Sha256
+	if !bytes.Equal(o.sketch, n.sketch) {
+		addChange("Sketch changed")
+	}
+	addChange(describeDataChange("FX data", o.fxdata, n.fxdata))
+	// A save which is only somewhere else is fine, but changed contents means
+	// progress was lost (or gained)
+	if change := describeDataChange("FX save", o.fxsave, n.fxsave); change != "" {
+		addChange(change)
+	} else if len(o.fxsave) > 0 && o.header.SaveStart != n.header.SaveStart {
+		addChange(fmt.Sprintf("FX save relocated from page %d to %d, contents unchanged", o.header.SaveStart, n.header.SaveStart))
+	}
+}
+
+// Compare one kind of slot (categories or games) between the two flashcarts
+func diffSlotList(before []*diffSlot, after []*diffSlot, keys ...func(*diffSlot) string) []*FlashcartSlotDiff {
+	pairs := make([][2]*diffSlot, 0)
+	for _, key := range keys {
+		before, after = pairDiffSlots(before, after, key, func(o *diffSlot, n *diffSlot) {
+			pairs = append(pairs, [2]*diffSlot{o, n})
+		})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0].location.Slot < pairs[j][0].location.Slot })
+	pairDiffs := make([]*FlashcartSlotDiff, len(pairs))
+	for i, p := range pairs {
+		oldLocation, newLocation := p[0].location, p[1].location
+		pairDiffs[i] = &FlashcartSlotDiff{
+			Title:     p[1].header.Title,
+			Developer: p[1].header.Developer,
+			Old:       &oldLocation,
+			New:       &newLocation,
+		}
+		compareDiffSlots(p[0], p[1], pairDiffs[i])
+	}
+	markMoved(pairs, pairDiffs)
+	result := make([]*FlashcartSlotDiff, 0)
+	for _, o := range before {
+		location := o.location
+		result = append(result, &FlashcartSlotDiff{Title: o.header.Title, Developer: o.header.Developer, Old: &location, Removed: true})
+	}
+	for _, d := range pairDiffs {
+		if d.IsChanged() {
+			result = append(result, d)
+		}
+	}
+	for _, n := range after {
+		location := n.location
+		result = append(result, &FlashcartSlotDiff{Title: n.header.Title, Developer: n.header.Developer, New: &location, Added: true})
+	}
+	return result
+}
+
+// Compare the categories and games of two flashcarts. Games are matched by
+// title, developer, and hash first, then by just title and developer (those
+// are the updated games). Categories are matched by title
+func DiffFlashcarts(left io.ReadSeeker, right io.ReadSeeker) (*FlashcartDiff, error) {
+	before, err := readDiffSlots(left)
+	if err != nil {
+		return nil, err
+	}
+	after, err := readDiffSlots(right)
+	if err != nil {
+		return nil, err
+	}
+	split := func(slots []*diffSlot) ([]*diffSlot, []*diffSlot) {
+		categories := make([]*diffSlot, 0)
+		games := make([]*diffSlot, 0)
+		for _, s := range slots {
+			if s.header.IsCategory() {
+				categories = append(categories, s)
+			} else {
+				games = append(games, s)
+			}
+		}
+		return categories, games
+	}
+	oldCategories, oldGames := split(before)
+	newCategories, newGames := split(after)
+	return &FlashcartDiff{
+		Categories: diffSlotList(oldCategories, newCategories,
+			func(s *diffSlot) string { return s.header.Title }),
+		Games: diffSlotList(oldGames, newGames,
+			func(s *diffSlot) string {
+				return s.header.Title + "\x00" + s.header.Developer + "\x00" + s.header.Sha256
+			},
+			func(s *diffSlot) string { return s.header.Title + "\x00" + s.header.Developer }),
+	}, nil
+}
+
+func writeSlotDiff(sb *strings.Builder, d *FlashcartSlotDiff) {
+	name := d.Title
+	if d.Developer != "" {
+		name += " by " + d.Developer
+	}
+	location := func(l *FlashcartDiffLocation) string {
+		result := fmt.Sprintf("slot %d", l.Slot)
+		if l.Category != "" {
+			result += fmt.Sprintf(" in '%s'", l.Category)
+		}
+		return result
+	}
+	switch {
+	case d.Added:
+		fmt.Fprintf(sb, "+ %s (%s)\n", name, location(d.New))
+		return
+	case d.Removed:
+		fmt.Fprintf(sb, "- %s (%s)\n", name, location(d.Old))
+		return
+	}
+	fmt.Fprintf(sb, "~ %s (%s -> %s)\n", name, location(d.Old), location(d.New))
+	for _, flag := range []struct {
+		set  bool
+		what string
+	}{
+		{d.Moved, "Moved"},
+		{d.Recategorized, "Recategorized"},
+		{d.Updated, "Updated (hash changed)"},
+	} {
+		if flag.set {
+			fmt.Fprintf(sb, "    %s\n", flag.what)
+		}
+	}
+	for _, change := range d.Changes {
+		fmt.Fprintf(sb, "    %s\n", change)
+	}
+}
+
+// Write the diff in a human readable form: + for added slots, - for removed,
+// and ~ for changed, followed by what changed
+func WriteFlashcartDiff(writer io.Writer, diff *FlashcartDiff, leftName string, rightName string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", leftName, rightName)
+	for _, section := range []struct {
+		name  string
+		diffs []*FlashcartSlotDiff
+	}{
+		{"Categories", diff.Categories},
+		{"Games", diff.Games},
+	} {
+		if len(section.diffs) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "@@ %s\n", section.name)
+		for _, d := range section.diffs {
+			writeSlotDiff(&sb, d)
+		}
+	}
+	_, err := io.WriteString(writer, sb.String())
+	return err
+}
@@ -0,0 +1,135 @@
+package arduboy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func findSlotDiff(diffs []*FlashcartSlotDiff, title string, t *testing.T) *FlashcartSlotDiff {
+	for _, d := range diffs {
+		if d.Title == title {
+			return d
+		}
+	}
+	t.Fatalf("No diff for '%s'", title)
+	return nil
+}
+
+func hasChange(d *FlashcartSlotDiff, prefix string) bool {
+	for _, c := range d.Changes {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiffFlashcarts_Same(t *testing.T) {
+	makecart := loadFullCart("makecart.bin", t)
+	diff, err := DiffFlashcarts(bytes.NewReader(makecart), bytes.NewReader(makecart))
+	if err != nil {
+		t.Fatalf("Couldn't diff flashcarts: %s", err)
+	}
+	if len(diff.Categories) != 0 || len(diff.Games) != 0 {
+		t.Fatalf("Expected no differences, got %d categories and %d games", len(diff.Categories), len(diff.Games))
+	}
+}
+
+func TestDiffFlashcarts(t *testing.T) {
+	makecart := loadFullCart("makecart.bin", t)
+	slots, err := FlashcartSlots(makecart)
+	if err != nil {
+		t.Fatalf("Couldn't read slots: %s", err)
+	}
+	if len(slots) != 7 {
+		t.Fatalf("Expected 7 slots, got %d", len(slots))
+	}
+	bootloader, category, maze, microcity, miner, prince, texas := slots[0], slots[1], slots[2], slots[3], slots[4], slots[5], slots[6]
+	if maze.Title != "3D Maze" || texas.Title != "TexasHoldEmFX" || len(texas.FxSave) == 0 {
+		t.Fatalf("Unexpected makecart layout: %s, %s", maze.Title, texas.Title)
+	}
+	// Rebuilding needs the sketches as they were before the FX pointers were
+	// patched in, otherwise the hashes change
+	for _, slot := range slots {
+		slot.Sketch = unpatchFxPointers(slot.Sketch)
+	}
+	newMiner := *miner
+	newMiner.Version = "9.9"
+	newMicrocity := *microcity
+	newMicrocity.Sketch = append([]byte{}, microcity.Sketch...)
+	newMicrocity.Sketch[len(newMicrocity.Sketch)-1] ^= 0xFF
+	extra := Slot{Title: "Extra", Image: bootloader.Image}
+	// 3D Maze is gone, TexasHoldEmFX is first (moving its save), PrinceOfArabia
+	// is in a new category
+	rebuilt := buildTestFlashcart([]*Slot{bootloader, category, texas, &newMicrocity, &newMiner, &extra, prince}, t)
+
+	diff, err := DiffFlashcarts(bytes.NewReader(makecart), bytes.NewReader(rebuilt))
+	if err != nil {
+		t.Fatalf("Couldn't diff flashcarts: %s", err)
+	}
+	if len(diff.Categories) != 1 || !diff.Categories[0].Added || diff.Categories[0].Title != "Extra" {
+		t.Fatalf("Expected only the Extra category added, got %v", diff.Categories)
+	}
+	if len(diff.Games) != 5 {
+		t.Fatalf("Expected 5 game diffs, got %d", len(diff.Games))
+	}
+	if d := findSlotDiff(diff.Games, "3D Maze", t); !d.Removed || d.New != nil {
+		t.Fatalf("3D Maze should be removed: %v", d)
+	}
+	if d := findSlotDiff(diff.Games, texas.Title, t); !d.Moved || d.Recategorized || d.Updated ||
+		!hasChange(d, "FX save relocated") || d.Old.Slot != 6 || d.New.Slot != 2 {
+		t.Fatalf("TexasHoldEmFX should be moved with its save relocated: %v", d)
+	}
+	if d := findSlotDiff(diff.Games, microcity.Title, t); d.Moved || !d.Updated || !hasChange(d, "Sketch changed") {
+		t.Fatalf("MicroCity should be updated: %v", d)
+	}
+	if d := findSlotDiff(diff.Games, miner.Title, t); d.Moved || d.Updated || d.Changes[0] != "Version changed from '1.1' to '9.9'" {
+		t.Fatalf("Old Miner should only have a new version: %v", d)
+	}
+	if d := findSlotDiff(diff.Games, prince.Title, t); d.Moved || !d.Recategorized || d.New.Category != "Extra" {
+		t.Fatalf("PrinceOfArabia should be recategorized: %v", d)
+	}
+
+	// Now the save itself is different
+	newTexas := *texas
+	newTexas.FxSave = append([]byte{}, texas.FxSave...)
+	newTexas.FxSave[0] ^= 0xFF
+	rebuilt = buildTestFlashcart([]*Slot{bootloader, category, maze, microcity, miner, prince, &newTexas}, t)
+	diff, err = DiffFlashcarts(bytes.NewReader(makecart), bytes.NewReader(rebuilt))
+	if err != nil {
+		t.Fatalf("Couldn't diff flashcarts: %s", err)
+	}
+	// MicroCity had the menu patch applied, so its hash comes out different
+	// when rebuilt from the flashcart, but that's all
+	if d := findSlotDiff(diff.Games, texas.Title, t); d.Updated || len(d.Changes) != 1 || d.Changes[0] != "FX save contents changed" {
+		t.Fatalf("Expected only the save contents changed, got %v", d)
+	}
+	var output bytes.Buffer
+	if err = WriteFlashcartDiff(&output, diff, "old.bin", "new.bin"); err != nil {
+		t.Fatalf("Couldn't write diff: %s", err)
+	}
+	for _, expected := range []string{
+		"--- old.bin\n+++ new.bin\n@@ Games\n",
+		"~ TexasHoldEmFX (slot 6 in 'cart_build' -> slot 6 in 'cart_build')\n    FX save contents changed\n",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("Diff missing '%s', got:\n%s", expected, output.String())
+		}
+	}
+}
+
+func TestDiffFlashcarts_BadSave(t *testing.T) {
+	original, err := os.ReadFile(fileTestPath("minicart.bin"))
+	if err != nil {
+		t.Fatalf("Couldn't read minicart.bin: %s", err)
+	}
+	// Give Lasers a save which starts after the slot ends
+	minicart := append([]byte{}, original...)
+	Write2ByteValue(1000, minicart, 115*FXPageSize+FxHeaderSavePageIndex)
+	_, err = DiffFlashcarts(bytes.NewReader(original), bytes.NewReader(minicart))
+	if err == nil || !strings.Contains(err.Error(), "FX save") {
+		t.Fatalf("Expected FX save error, got %v", err)
+	}
+}
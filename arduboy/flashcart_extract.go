@@ -0,0 +1,159 @@
+package arduboy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	FlashcartManifestName = "categories.json"
+	PackageSchemaVersion  = 2
+	PackageFlashData      = "flashdata.bin"
+	PackageFlashSave      = "flashsave.bin"
+	PackageTitleImage     = "title.png"
+)
+
+// A category in the manifest written by ExtractFlashcartPackages, with the
+// packages extracted from it (in flashcart order)
+type ExtractedCategory struct {
+	Title    string
+	Info     string
+	Image    string // Title image, relative to the manifest
+	Packages []string
+}
+
+// Write the given game slot as a .arduboy package. The sketch should already
+// have the FX pointers unpatched, since the pages they point to only make
+// sense in the flashcart it came from
+func WritePackage(slot *Slot, name string, writer io.Writer) error {
+	if slot.IsCategory() {
+		return fmt.Errorf("Can't make a package from a category")
+	}
+	binary := PackageBinary{
+		Title:     slot.Title,
+		Filename:  name + ".hex",
+		Device:    AnalyzeSketch(slot.Sketch, false).DetectedDevice,
+		CartImage: PackageTitleImage,
+	}
+	paletted, err := RawToPalettedTitle(slot.Image)
+	if err != nil {
+		return fmt.Errorf("Couldn't convert title image: %s", err)
+	}
+	title, err := PalettedToImageTitleBW(paletted, "png")
+	if err != nil {
+		return fmt.Errorf("Couldn't convert title image: %s", err)
+	}
+	var sketch bytes.Buffer
+	if err = BinToHex(slot.Sketch, &sketch); err != nil {
+		return fmt.Errorf("Couldn't convert sketch: %s", err)
+	}
+	if len(slot.FxData) > 0 {
+		binary.FlashData = PackageFlashData
+	}
+	if len(slot.FxSave) > 0 {
+		binary.FlashSave = PackageFlashSave
+	}
+	info := PackageInfo{
+		SchemaVersion: PackageSchemaVersion,
+		Title:         slot.Title,
+		Description:   slot.Info,
+		Author:        slot.Developer,
+		Version:       slot.Version,
+		Binaries:      []*PackageBinary{&binary},
+	}
+	infojson, err := json.MarshalIndent(&info, "", "  ")
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(writer)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{PackageInfoFile, infojson},
+		{binary.Filename, sketch.Bytes()},
+		{binary.FlashData, slot.FxData},
+		{binary.FlashSave, slot.FxSave},
+		{binary.CartImage, title},
+	} {
+		if file.name == "" {
+			continue
+		}
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// Extract every game in a flashcart as a .arduboy package into the given
+// directory, along with a manifest of which categories they were in (and
+// the category title images). The FX pointers are unpatched from the
+// sketches, but the menu and screen patches can't be undone
+func ExtractFlashcartPackages(flashcart []byte, outdir string) ([]*ExtractedCategory, error) {
+	slots, err := FlashcartSlots(flashcart)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Join(outdir, "categories"), 0755); err != nil {
+		return nil, err
+	}
+	categories := make([]*ExtractedCategory, 0)
+	for i, slot := range slots {
+		name := slotFileName(i, slot.Title)
+		if slot.IsCategory() {
+			category := ExtractedCategory{
+				Title:    slot.Title,
+				Info:     slot.Info,
+				Image:    "categories/" + name + ".png",
+				Packages: make([]string, 0),
+			}
+			paletted, err := RawToPalettedTitle(slot.Image)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't convert title image for slot %d: %s", i, err)
+			}
+			image, err := PalettedToImageTitleBW(paletted, "png")
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't convert title image for slot %d: %s", i, err)
+			}
+			if err = os.WriteFile(filepath.Join(outdir, category.Image), image, 0644); err != nil {
+				return nil, err
+			}
+			categories = append(categories, &category)
+			continue
+		}
+		if len(categories) == 0 {
+			return nil, fmt.Errorf("Slot %d ('%s') isn't in a category", i, slot.Title)
+		}
+		game := *slot
+		game.Sketch = unpatchFxPointers(slot.Sketch)
+		var archive bytes.Buffer
+		if err = WritePackage(&game, name, &archive); err != nil {
+			return nil, fmt.Errorf("Couldn't make package for slot %d ('%s'): %s", i, slot.Title, err)
+		}
+		filename := name + ".arduboy"
+		if err = os.WriteFile(filepath.Join(outdir, filename), archive.Bytes(), 0644); err != nil {
+			return nil, err
+		}
+		category := categories[len(categories)-1]
+		category.Packages = append(category.Packages, filename)
+	}
+	manifest, err := json.MarshalIndent(categories, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(filepath.Join(outdir, FlashcartManifestName), manifest, 0644); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
@@ -0,0 +1,145 @@
+package arduboy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Load a title image written by the extractor back to raw
+func loadExtractedTitle(data []byte, t *testing.T) []byte {
+	paletted, err := RawImageToPalettedTitle(bytes.NewReader(data), 100)
+	if err != nil {
+		t.Fatalf("Couldn't read title image: %s", err)
+	}
+	raw, _, err := PalettedToRaw(paletted, ScreenWidth, ScreenHeight)
+	if err != nil {
+		t.Fatalf("Couldn't convert title image: %s", err)
+	}
+	return raw
+}
+
+// Load an extracted package back into a slot, the same way packageany does
+func loadExtractedPackage(path string, t *testing.T) *Slot {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("Couldn't open package %s: %s", path, err)
+	}
+	defer archive.Close()
+	info, err := ReadPackageInfo(archive)
+	if err != nil {
+		t.Fatalf("Couldn't read package info: %s", err)
+	}
+	binary, err := FindSuitableBinary(&info, "", "")
+	if err != nil {
+		t.Fatalf("Couldn't find binary: %s", err)
+	}
+	data, err := LoadPackageBinary(archive, binary)
+	if err != nil {
+		t.Fatalf("Couldn't load binary: %s", err)
+	}
+	sketch, err := HexToBin(bytes.NewReader(data.Sketch))
+	if err != nil {
+		t.Fatalf("Couldn't convert sketch: %s", err)
+	}
+	image, err := LoadPackageFile(archive, binary.CartImage)
+	if err != nil {
+		t.Fatalf("Couldn't load cart image: %s", err)
+	}
+	return &Slot{
+		Title:     info.Title,
+		Version:   info.Version,
+		Developer: info.Author,
+		Info:      info.Description,
+		Image:     loadExtractedTitle(image, t),
+		Sketch:    sketch,
+		FxData:    data.FlashData,
+		FxSave:    data.FlashSave,
+	}
+}
+
+func TestExtractFlashcartPackages(t *testing.T) {
+	makecart := loadFullCart("makecart.bin", t)
+	outdir, err := newRandomFilepath("extract")
+	if err != nil {
+		t.Fatalf("Couldn't get path to test folder: %s", err)
+	}
+	categories, err := ExtractFlashcartPackages(makecart, outdir)
+	if err != nil {
+		t.Fatalf("Couldn't extract packages: %s", err)
+	}
+	if len(categories) != 2 || len(categories[0].Packages) != 0 || len(categories[1].Packages) != 5 {
+		t.Fatalf("Unexpected categories: %v", categories)
+	}
+	manifest, err := os.ReadFile(filepath.Join(outdir, FlashcartManifestName))
+	if err != nil {
+		t.Fatalf("Couldn't read manifest: %s", err)
+	}
+	var readCategories []*ExtractedCategory
+	if err = json.Unmarshal(manifest, &readCategories); err != nil {
+		t.Fatalf("Couldn't parse manifest: %s", err)
+	}
+
+	// Build the flashcart again from only the manifest and packages
+	slots := make([]*Slot, 0)
+	for _, category := range readCategories {
+		image, err := os.ReadFile(filepath.Join(outdir, category.Image))
+		if err != nil {
+			t.Fatalf("Couldn't read category image: %s", err)
+		}
+		slots = append(slots, &Slot{Title: category.Title, Info: category.Info, Image: loadExtractedTitle(image, t)})
+		for _, p := range category.Packages {
+			slots = append(slots, loadExtractedPackage(filepath.Join(outdir, p), t))
+		}
+	}
+	rebuilt := buildTestFlashcart(slots, t)
+	if len(rebuilt) != len(makecart) {
+		t.Fatalf("Rebuilt flashcart is %d bytes, expected %d", len(rebuilt), len(makecart))
+	}
+	// Only the hash of the menu patched sketch can differ
+	different := 0
+	for i := range rebuilt {
+		if rebuilt[i] != makecart[i] {
+			different++
+		}
+	}
+	if different > FxHeaderHashLength {
+		t.Fatalf("Rebuilt flashcart has %d bytes different", different)
+	}
+}
+
+func TestWritePackage(t *testing.T) {
+	slot := Slot{Title: "Category", Image: MakePadding(FxHeaderImageLength)}
+	var output bytes.Buffer
+	if err := WritePackage(&slot, "category", &output); err == nil {
+		t.Fatalf("Expected error making a package from a category")
+	}
+	slot = Slot{Title: "Game", Developer: "Someone", Image: make([]byte, FxHeaderImageLength), Sketch: MakePadding(FlashPageSize)}
+	if err := WritePackage(&slot, "game", &output); err != nil {
+		t.Fatalf("Couldn't write package: %s", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(output.Bytes()), int64(output.Len()))
+	if err != nil {
+		t.Fatalf("Couldn't read package: %s", err)
+	}
+	names := make(map[string]bool)
+	for _, f := range archive.File {
+		names[f.Name] = true
+	}
+	if len(names) != 3 || !names[PackageInfoFile] || !names["game.hex"] || !names[PackageTitleImage] {
+		t.Fatalf("Unexpected files in package: %v", names)
+	}
+	title, err := archive.Open(PackageTitleImage)
+	if err != nil {
+		t.Fatalf("Couldn't open title: %s", err)
+	}
+	defer title.Close()
+	config, _, err := image.DecodeConfig(title)
+	if err != nil || config.Width != ScreenWidth || config.Height != ScreenHeight {
+		t.Fatalf("Bad title image: %v (%v)", config, err)
+	}
+}
@@ -3,7 +3,6 @@ package arduboy
 import (
 	"archive/zip"
 	"bytes"
-	"fmt"
 	"io"
 	"log"
 	"os"
@@ -18,32 +17,16 @@ type FlashcartReader struct {
 	//Address int // Current address within the flashcart
 }
 
+// A flashcart being written by a lua script. All the work is done by the builder
 type FlashcartWriter struct {
-	File         *os.File
-	CategoryId   int
-	Slots        int
-	LastSlotPage uint16
-	//Address int // Current address within the flashcart
-	// TODO: add settings for menu, contrast, screen patching, etc
-	ValidateCategoryStructure bool
-	ValidateImageLength       bool
-	PatchMenu                 bool
-	PatchMicroLED             bool
-	PatchSsd1309              bool
-	Contrast                  int
+	*FlashcartBuilder
+	File *os.File
 }
 
 func NewFlashcartWriter(file *os.File) *FlashcartWriter {
 	return &FlashcartWriter{
-		File:                      file,
-		CategoryId:                -1,     //Start at -1 to make incrementing for categories easier
-		LastSlotPage:              0xFFFF, // first slot always has this as 0xFFFF
-		ValidateCategoryStructure: true,
-		ValidateImageLength:       true,
-		PatchMenu:                 true,
-		PatchMicroLED:             false,
-		PatchSsd1309:              false,
-		Contrast:                  CONTRAST_NOCHANGE,
+		FlashcartBuilder: NewFlashcartBuilder(file),
+		File:             file,
 	}
 }
 
@@ -53,6 +36,7 @@ type FlashcartState struct {
 	Readers       []*FlashcartReader
 	Writers       []*FlashcartWriter
 	Arguments     []string
+	Defaults      *DeviceDefaults // Patches for new flashcarts and devices for packageany (optional)
 }
 
 // Get full path to given file requested by user. The system has a way to set
@@ -83,7 +67,7 @@ func (state *FlashcartState) CloseAll() []error {
 	for _, f := range state.Writers {
 		log.Printf("Closing flashcart writer '%s'", f.File.Name())
 		// Before closing, you need to write the final 1 page of 0xFF
-		_, err := f.File.Write(MakePadding(FXPageSize))
+		err := f.Finish()
 		if err != nil {
 			log.Printf("ERROR: Couldn't write final page of padding: %s", err)
 			results = append(results, err)
@@ -97,177 +81,28 @@ func (state *FlashcartState) CloseAll() []error {
 	return results
 }
 
-func (writer *FlashcartWriter) initHeader() FxHeader {
-	return FxHeader{
-		PreviousPage: writer.LastSlotPage,
-		NextPage:     0xFFFF,
-		ProgramStart: 0xFFFF,
-		DataStart:    0xFFFF,
-		DataPages:    0xFFFF, // This is how old programs did it
-		SaveStart:    0xFFFF,
-	}
-}
-
 // Write the entirety of a slot given as a table as the first param. Should
-// have some expected fields; most the header stuff is calculated in this
-// function though.
+// have some expected fields; most the header stuff is calculated by the builder
 func (writer *FlashcartWriter) WriteSlot(L *lua.LState) int {
-	slot := L.ToTable(1)
-	if slot == nil {
+	table := L.ToTable(1)
+	if table == nil {
 		L.RaiseError("Must send slot to write_slot!")
 		return 0
 	}
-	addr, err := writer.File.Seek(0, io.SeekCurrent)
+	var slot Slot
+	pullString(table, "title", func(t string) { slot.Title = t })
+	pullString(table, "version", func(v string) { slot.Version = v })
+	pullString(table, "developer", func(d string) { slot.Developer = d })
+	pullString(table, "info", func(i string) { slot.Info = i })
+	pullString(table, "image", func(i string) { slot.Image = []byte(i) })
+	pullString(table, "sketch", func(s string) { slot.Sketch = []byte(s) })
+	pullString(table, "fxdata", func(d string) { slot.FxData = []byte(d) })
+	pullString(table, "fxsave", func(s string) { slot.FxSave = []byte(s) })
+	slotSize, err := writer.FlashcartBuilder.WriteSlot(&slot)
 	if err != nil {
-		L.RaiseError("Couldn't determine current seek position on slot %d: %s", writer.Slots, err)
+		L.RaiseError("%s", err)
 		return 0
 	}
-	// Addr is now the beginning of the slot. Any other calcs should be
-	// based off this value
-	header := writer.initHeader()
-	var slotSize = FXPageSize + FxHeaderImageLength
-	slotEnd := func() uint16 {
-		return uint16((int(addr) + slotSize) / FXPageSize)
-	}
-	var image, sketch, fxdata, fxsave []byte
-	//pullBool(slot, "is_category", func(is bool) { is_category = is })
-	pullString(slot, "title", func(t string) { header.Title = t })
-	pullString(slot, "version", func(v string) { header.Version = v })
-	pullString(slot, "developer", func(d string) { header.Developer = d })
-	pullString(slot, "info", func(i string) { header.Info = i })
-	pullString(slot, "image", func(i string) { image = []byte(i) })
-	pullString(slot, "sketch", func(s string) { sketch = []byte(s) })
-	pullString(slot, "fxdata", func(d string) { fxdata = []byte(d) })
-	pullString(slot, "fxsave", func(s string) { fxsave = []byte(s) })
-	//log.Printf("Write initial lengths: s:%d, fd:%d, fs:%d", len(sketch), len(fxdata), len(fxsave))
-	is_category := len(sketch) == 0
-	if len(image) != FxHeaderImageLength {
-		if writer.ValidateImageLength {
-			L.RaiseError("Invalid image length on slot %d!", writer.Slots)
-			return 0
-		} else if len(image) < FxHeaderImageLength {
-			image = AlignData(image, FxHeaderImageLength)
-		} else {
-			image = image[:FxHeaderImageLength]
-		}
-	}
-	if is_category {
-		writer.CategoryId += 1
-	} else {
-		if writer.Slots < 2 && writer.ValidateCategoryStructure {
-			L.RaiseError("First two slots MUST be categories! ")
-			return 0
-		}
-		// Wasteful but it's like 32KiB max... we need the pre-modded sketch to calculate the sha256
-		premodsketch := make([]byte, len(sketch), FlashSize)
-		copy(premodsketch, sketch)
-		premodsketch = AlignData(premodsketch, FXPageSize)
-		// Pre-align all the data (only if not a category)
-		if len(sketch) > 0 {
-			if writer.PatchMenu {
-				// TODO: patch menu if user asks
-				patched, message := PatchMenuButtons(sketch)
-				if patched {
-					log.Printf(message)
-				}
-			}
-			if writer.PatchMicroLED {
-				PatchMicroLED(sketch)
-			}
-			patchcount := PatchScreen(sketch, writer.PatchSsd1309, writer.Contrast)
-			if patchcount > 0 {
-				log.Printf("Patched %d screen parameter(s) (ssd1309: %t, contrast: %x)", patchcount, writer.PatchSsd1309, writer.Contrast)
-			}
-			sketch = AlignData(sketch, FlashPageSize)
-			pages := len(sketch) / FlashPageSize
-			if pages > 0xFF {
-				// Don't even consider the bootloader, there is a max size for the header
-				L.RaiseError("Sketch in slot %d too large!", writer.Slots)
-				return 0
-			}
-			header.ProgramStart = slotEnd()
-			header.ProgramPages = uint8(pages) // length is PRE fx-padding...
-			sketch = AlignData(sketch, FXPageSize)
-			slotSize += len(sketch)
-		}
-		if len(fxdata) > 0 {
-			if len(sketch) == 0 {
-				L.RaiseError("FX data without sketch in slot %d!", writer.Slots)
-				return 0
-			}
-			fxdata = AlignData(fxdata, FXPageSize)
-			header.DataStart = slotEnd()
-			header.DataPages = uint16(len(fxdata) / FXPageSize)
-			slotSize += len(fxdata)
-			// MUST patch the sketch to point to this data
-			sketch[0x14] = 0x18
-			sketch[0x15] = 0x95
-			Write2ByteValue(header.DataStart, sketch, 0x16)
-		}
-		if len(fxsave) > 0 {
-			if len(sketch) == 0 {
-				L.RaiseError("FX save without sketch in slot %d!", writer.Slots)
-				return 0
-			}
-			fxsave = AlignData(fxsave, FxSaveAlignment)
-			// Need to align fx save to a 4K boundary. The alignment goes at the
-			// BEGINNING of the save
-			var prealignment int = int(AlignWidth(uint(addr)+uint(slotSize), FxSaveAlignment)) - int(addr) - int(slotSize)
-			fxsave = append(MakePadding(prealignment), fxsave...)
-			slotSize += prealignment
-			header.SaveStart = slotEnd()
-			slotSize += len(fxsave) - prealignment
-			// MUST patch the sketch to point to this save
-			sketch[0x18] = 0x18
-			sketch[0x19] = 0x95
-			Write2ByteValue(header.SaveStart, sketch, 0x1a)
-		}
-		// ONLY calculate hash if not a category (this is how old tools did it; it doesn't matter much)
-		header.Sha256, err = calculateHeaderHash(premodsketch, fxdata)
-		if err != nil {
-			L.RaiseError("Couldn't hash header: %s", err)
-			return 0
-		}
-	}
-	// ALWAYS write the category (it tells which programs are in which category)
-	header.Category = uint8(writer.CategoryId)
-	// Finish up writing header values now that we know all alignments
-	if slotSize&0xFF > 0 {
-		L.RaiseError("ARDUGOTOOLS PROGRAM ERROR: Slot size misaligned: %d", slotSize)
-		return 0
-	}
-	header.SlotPages = uint16(slotSize / FXPageSize)
-	header.NextPage = slotEnd()
-	// Create the header
-	headerraw, err := header.MakeHeader()
-	if err != nil {
-		L.RaiseError("Couldn't compile header: %s", err)
-		return 0
-	}
-	totalWritten := 0
-	// Write out all the individual blocks of data
-	sw := func(data []byte) bool {
-		if len(data) > 0 {
-			written, err := writer.File.Write(data)
-			if err != nil {
-				L.RaiseError("Couldn't write to flashcart: %s", err)
-				return true
-			}
-			totalWritten += written
-		}
-		return false
-	}
-	//log.Printf("Write final lengths: h: %d, s:%d, fd:%d, fs:%d", len(headerraw), len(sketch), len(fxdata), len(fxsave))
-	if sw(headerraw) || sw(image) || sw(sketch) || sw(fxdata) || sw(fxsave) {
-		return 0
-	}
-	if totalWritten != slotSize {
-		L.RaiseError("ARDUGOTOOLS PROGRAM ERROR: Expected to write %d for '%s', actually wrote %d", slotSize, header.Title, totalWritten)
-		return 0
-	}
-	log.Printf("Wrote slot %d: '%s' (%d bytes)\n", writer.Slots, header.Title, slotSize)
-	writer.Slots += 1
-	writer.LastSlotPage = uint16(int(addr) / FXPageSize)
 	L.Push(lua.LNumber(slotSize))
 	return 1
 }
@@ -340,10 +175,6 @@ func luaParseFlashcart(L *lua.LState, state *FlashcartState) int {
 	// Simply parse out all the headers using the existing ScanFlashcartFile()
 	var result lua.LTable
 	scanFunc := func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
-		if header.IsOldFormat() {
-			// TODO: eventually, you will need to support this!
-			return fmt.Errorf("Flashcart is in older format (no DataPages field set); can't parse")
-		}
 		var slot lua.LTable
 		slot.RawSetString("title", lua.LString(header.Title))
 		slot.RawSetString("version", lua.LString(header.Version))
@@ -383,7 +214,8 @@ func luaParseFlashcart(L *lua.LState, state *FlashcartState) int {
 			dataStart := int(header.DataStart) * FXPageSize
 			saveStart := int(header.SaveStart) * FXPageSize
 			if header.HasFxData() {
-				fxDataSize = int(header.DataPages) * FXPageSize
+				// Old format headers don't store this, so it may be inferred
+				fxDataSize = header.FxDataPages(addr) * FXPageSize
 			}
 			if header.HasFxSave() {
 				fxSaveSize = addr + int(header.SlotPages)*FXPageSize - saveStart
@@ -437,6 +269,11 @@ func luaNewFlashcart(L *lua.LState, state *FlashcartState) int {
 	// Now that we have a working file, we must immediately add it to the
 	// writers. The writers list is automatically cleaned up
 	writer := NewFlashcartWriter(file)
+	if state.Defaults != nil {
+		writer.PatchSsd1309 = state.Defaults.PatchSsd1309
+		writer.PatchMicroLED = state.Defaults.PatchMicroLED
+		writer.Contrast = state.Defaults.Contrast
+	}
 	state.Writers = append(state.Writers, writer)
 	var result lua.LTable
 	result.RawSetString("write_slot", L.NewFunction(func(IL *lua.LState) int {
@@ -545,6 +382,10 @@ func luaPackageReader(L *lua.LState, state *FlashcartState, readAny bool) int {
 	var binary *PackageBinary
 
 	if readAny {
+		if device == "" && state.Defaults != nil {
+			// Nothing given, so use the configured devices
+			device = strings.Join(state.Defaults.Devices, ",")
+		}
 		devices := strings.Split(device, ",")
 		for i := range devices {
 			devices[i] = strings.Trim(devices[i], " ")
@@ -632,11 +473,18 @@ func luaPackageReader(L *lua.LState, state *FlashcartState, readAny bool) int {
 // -----------------------------
 
 func RunLuaFlashcartGenerator(script string, arguments []string, dir string) (string, error) {
+	return RunLuaFlashcartGeneratorWithDefaults(script, arguments, dir, nil)
+}
+
+// Same as RunLuaFlashcartGenerator, but new flashcarts are patched according
+// to the defaults, and packageany without a device list uses the default devices
+func RunLuaFlashcartGeneratorWithDefaults(script string, arguments []string, dir string, defaults *DeviceDefaults) (string, error) {
 	state := FlashcartState{
 		Readers:       make([]*FlashcartReader, 0),
 		Writers:       make([]*FlashcartWriter, 0),
 		FileDirectory: dir,
 		Arguments:     arguments,
+		Defaults:      defaults,
 	}
 
 	defer state.CloseAll()
@@ -440,6 +440,47 @@ func TestRunLuaFlashcartGenerator_ApplySaves(t *testing.T) {
 	}
 }
 
+// Old format carts must parse, and come back out the same as the new format
+// cart does (rewriting isn't perfectly transparent: header hashes change)
+func TestRunLuaFlashcartGenerator_OldFormat(t *testing.T) {
+	script := `
+a, b = arguments()
+slots = parse_flashcart(a, true)
+newcart = new_flashcart(b)
+for i,v in ipairs(slots) do
+  newcart.write_slot(v)
+end
+  `
+	rewrite := func(cart []byte, name string) []byte {
+		inpath, err := newRandomFilepath(name)
+		if err != nil {
+			t.Fatalf("Couldn't get path to %s: %s", name, err)
+		}
+		if err = os.WriteFile(inpath, cart, 0600); err != nil {
+			t.Fatalf("Couldn't write %s: %s", name, err)
+		}
+		outpath, err := newRandomFilepath("rewritten_" + name)
+		if err != nil {
+			t.Fatalf("Couldn't get path to rewritten %s: %s", name, err)
+		}
+		errout, err := RunLuaFlashcartGenerator(script, []string{inpath, outpath}, "")
+		if err != nil {
+			t.Fatalf("Couldn't run flashcart generator on %s: %s. Log: \n%s", name, err, errout)
+		}
+		result, err := os.ReadFile(outpath)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %s", outpath, err)
+		}
+		return result
+	}
+	oldcart, _ := makeOldFormatCart(t)
+	oldbin := rewrite(oldcart, "oldformat.bin")
+	newbin := rewrite(loadFullCart("makecart.bin", t), "newformat.bin")
+	if !bytes.Equal(oldbin, newbin) {
+		t.Fatalf("Rewritten old format cart not equivalent! %d bytes vs %d", len(oldbin), len(newbin))
+	}
+}
+
 func TestRunLuaFlashcartGenerator_MakeCart(t *testing.T) {
 	script, err := os.ReadFile(fileHelperPath("makecart.lua"))
 	if err != nil {
@@ -487,3 +528,22 @@ func TestFindSuitablePackageImage(t *testing.T) {
 		}
 	}
 }
+
+func TestRunLuaFlashcartGenerator_DefaultDevices(t *testing.T) {
+	script := `
+slot = packageany("cart_build/MicroCity.arduboy")
+log(slot.title)
+  `
+	_, err := RunLuaFlashcartGenerator(script, nil, testPath())
+	if err == nil || !strings.Contains(err.Error(), "No matching binary") {
+		t.Fatalf("Expected no matching binary for packageany without devices, got %v", err)
+	}
+	defaults := DeviceDefaults{Contrast: CONTRAST_NOCHANGE, Devices: []string{"ArduboyFX", "Arduboy"}}
+	logs, err := RunLuaFlashcartGeneratorWithDefaults(script, nil, testPath(), &defaults)
+	if err != nil {
+		t.Fatalf("Error running packageany with default devices: %s", err)
+	}
+	if logs != "MicroCity\n" {
+		t.Fatalf("Expected MicroCity, got '%s'", logs)
+	}
+}
@@ -1,6 +1,8 @@
 package arduboy
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -211,3 +213,64 @@ func TestScanFlashcartFileMeta(t *testing.T) {
 		}
 	}
 }
+
+// A copy of makecart.bin where every slot with FX data has the old format
+// header (no data pages), along with how many slots that was
+func makeOldFormatCart(t *testing.T) ([]byte, int) {
+	oldcart := loadFullCart("makecart.bin", t)
+	count := 0
+	_, err := ScanFlashcartFile(bytes.NewReader(oldcart), func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
+		if header.HasFxData() {
+			Write2ByteValue(0xFFFF, oldcart, addr+FxHeaderDataSizeIndex)
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't scan makecart.bin: %s", err)
+	}
+	return oldcart, count
+}
+
+func TestFxDataPages_OldFormat(t *testing.T) {
+	newcart := loadFullCart("makecart.bin", t)
+	oldcart, _ := makeOldFormatCart(t)
+	expected := make([]int, 0)
+	ScanFlashcartFile(bytes.NewReader(newcart), func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
+		expected = append(expected, header.FxDataPages(addr))
+		return nil
+	})
+	_, err := ScanFlashcartFile(bytes.NewReader(oldcart), func(f io.ReadSeeker, header *FxHeader, addr int, index int) error {
+		if header.HasFxData() && !header.IsOldFormat() {
+			t.Fatalf("Slot %d should be old format", index)
+		}
+		if header.FxDataPages(addr) != expected[index] {
+			t.Fatalf("Slot %d: expected %d data pages, inferred %d", index, expected[index], header.FxDataPages(addr))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't scan old format cart: %s", err)
+	}
+}
+
+func TestUpgradeFlashcartHeaders(t *testing.T) {
+	oldcart, count := makeOldFormatCart(t)
+	if count == 0 {
+		t.Fatalf("makecart.bin should have slots with FX data")
+	}
+	upgraded, err := UpgradeFlashcartHeaders(oldcart)
+	if err != nil {
+		t.Fatalf("Couldn't upgrade headers: %s", err)
+	}
+	if upgraded != count {
+		t.Fatalf("Expected %d headers upgraded, got %d", count, upgraded)
+	}
+	if !bytes.Equal(oldcart, loadFullCart("makecart.bin", t)) {
+		t.Fatalf("Upgraded flashcart doesn't match the new format original")
+	}
+	// Nothing left to upgrade
+	if upgraded, _ = UpgradeFlashcartHeaders(oldcart); upgraded != 0 {
+		t.Fatalf("Expected no headers upgraded the second time, got %d", upgraded)
+	}
+}
@@ -76,3 +76,83 @@ func RenderFlashcartMeta(categories []HeaderCategory, deviceId string, destinati
 	t.Execute(destination, data)
 	return nil
 }
+
+const SketchAnalysisTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+  <title>{{.Name}} Analysis</title>
+  <meta charset="UTF-8">
+  <meta name="description" content="Generated by ardugotools">
+  <style>
+    body {
+      max-width: 800px;
+    }
+    th {
+      text-align: left;
+      padding-right: 1em;
+    }
+    .warning {
+      background-color: yellow;
+    }
+  </style>
+</head>
+<body>
+  <h1>{{.Name}}</h1>
+  <p class="meta">Analyzed {{.Date}}{{if .MD5}} - MD5 {{.MD5}}{{end}}</p>
+  {{with .Analysis}}
+  <h2>Flash</h2>
+  <table>
+    <tr><th>Used</th><td>{{.FlashUsed}} / {{.FlashAvailable}} bytes ({{printf "%.1f" .FlashPercent}}%)</td></tr>
+    <tr><th>Device</th><td>{{.DetectedDevice}}</td></tr>
+  </table>
+  {{if .OverwritesCaterina}}<p class="warning">Sketch overwrites the Caterina bootloader</p>{{end}}
+  {{if .OverwritesCathy}}<p class="warning">Sketch overwrites the Cathy bootloader</p>{{end}}
+  <h2>Menu patch</h2>
+  {{if .MenuPatch.Present}}<p>Present</p>
+  {{else if .MenuPatch.Possible}}<p>Not present, but can be applied</p>
+  {{else}}<p class="warning">{{.MenuPatch.Message}}</p>{{end}}
+  <h2>Display</h2>
+  {{range .Displays}}
+  <p>{{.Controller}} init at {{printf "0x%04x" .Address}}, contrast {{printf "0x%02x" .Contrast}}</p>
+  {{else}}
+  <p class="warning">No display init sequence found</p>
+  {{end}}
+  <h2>FX</h2>
+  <table>
+    <tr><th>Data pointer</th><td>{{if .FxData.Patched}}page {{.FxData.Page}}{{else}}not patched{{end}}</td></tr>
+    <tr><th>Save pointer</th><td>{{if .FxSave.Patched}}page {{.FxSave.Page}}{{else}}not patched{{end}}</td></tr>
+  </table>
+  <h2>Libraries</h2>
+  <table>
+    {{range .Libraries}}
+    <tr><th>{{.Name}}</th><td>{{.Evidence}}</td></tr>
+    {{else}}
+    <tr><td>None recognized</td></tr>
+    {{end}}
+  </table>
+  <h2>Eeprom</h2>
+  {{if gt .Eeprom.End .Eeprom.Start}}
+  <p>Bytes {{.Eeprom.Start}} to {{.Eeprom.End}}{{if .Eeprom.UsesSystem}}, plus the system area{{end}}</p>
+  {{else if .Eeprom.UsesSystem}}
+  <p>System area only</p>
+  {{else}}
+  <p>No eeprom use found</p>
+  {{end}}
+  {{end}}
+</body>
+</html>
+`
+
+func RenderSketchAnalysis(analysis *SketchAnalysis, name string, md5 string, destination io.Writer) error {
+	t, err := template.New("sketch").Parse(SketchAnalysisTemplate)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]interface{})
+	data["Analysis"] = analysis
+	data["Name"] = name
+	data["MD5"] = md5
+	data["Date"] = time.Now().Format(time.RFC1123)
+	return t.Execute(destination, data)
+}
@@ -145,6 +145,89 @@ func FindAnyBinary(info *PackageInfo, device []string) (*PackageBinary, error) {
 	return nil, fmt.Errorf("No matching binary")
 }
 
+// Which package binary devices will run on the given device, best first. FX
+// devices can run plain Arduboy binaries (they just won't use the flashcart),
+// but the Mini's hardware is different enough that it needs its own
+func CompatiblePackageDevices(device string) []string {
+	switch device {
+	case ArduboyFXDeviceKey:
+		return []string{ArduboyFXDeviceKey, ArduboyDeviceKey}
+	default:
+		return []string{device}
+	}
+}
+
+// Find the binary to install on the given device (such as ArduboyFX). If a
+// title is given, that binary is used no matter the device. Otherwise the
+// binary made for the device is preferred, falling back to any compatible one.
+// Like FindSuitableBinary, this won't pick between several equally good binaries
+func FindDeviceBinary(info *PackageInfo, device string, title string) (*PackageBinary, error) {
+	if title != "" {
+		return FindSuitableBinary(info, "", title)
+	}
+	for _, dv := range CompatiblePackageDevices(device) {
+		binary, err := FindAnyBinary(info, []string{dv})
+		if err != nil {
+			continue
+		}
+		var bnames []string
+		for _, pb := range info.Binaries {
+			if strings.EqualFold(pb.Device, dv) {
+				bnames = append(bnames, pb.Title)
+			}
+		}
+		if len(bnames) > 1 {
+			return nil, fmt.Errorf("Multiple %s binaries in package: %s", dv, strings.Join(bnames, ","))
+		}
+		return binary, nil
+	}
+	return nil, fmt.Errorf("No binary in package for %s", device)
+}
+
+// All the files needed to install one binary from a package
+type PackageBinaryData struct {
+	Sketch    []byte // Still in hex format
+	FlashData []byte // May be empty
+	FlashSave []byte // May be empty
+}
+
+// Read the sketch, flashdata, and flashsave for the given binary
+func LoadPackageBinary(archive *zip.ReadCloser, binary *PackageBinary) (*PackageBinaryData, error) {
+	var result PackageBinaryData
+	var err error
+	result.Sketch, err = LoadPackageFile(archive, binary.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read sketch: %s", err)
+	}
+	if binary.FlashData != "" {
+		result.FlashData, err = LoadPackageFile(archive, binary.FlashData)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read flashdata: %s", err)
+		}
+	}
+	if binary.FlashSave != "" {
+		result.FlashSave, err = LoadPackageFile(archive, binary.FlashSave)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read flashsave: %s", err)
+		}
+	}
+	return &result, nil
+}
+
+// The flashdata and flashsave combined and aligned for writing to the end of
+// the flashcart as dev data (same as fxdata align). Empty if the binary has neither
+func (p *PackageBinaryData) DevData() []byte {
+	result := make([]byte, 0, len(p.FlashData)+len(p.FlashSave))
+	if len(p.FlashData) > 0 {
+		result = AlignData(append(result, p.FlashData...), FXPageSize)
+	}
+	if len(p.FlashSave) > 0 {
+		save := AlignData(append([]byte{}, p.FlashSave...), FxSaveAlignment)
+		result = append(result, save...)
+	}
+	return result
+}
+
 // func GetPackageReader(archive *zip.ReadCloser, filename string) ([]byte, error) {
 //   archive.
 // }
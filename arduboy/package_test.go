@@ -0,0 +1,79 @@
+package arduboy
+
+import (
+	"archive/zip"
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindDeviceBinary(t *testing.T) {
+	info := PackageInfo{
+		Binaries: []*PackageBinary{
+			{Title: "Plain", Device: ArduboyDeviceKey},
+			{Title: "Fancy", Device: ArduboyFXDeviceKey},
+		},
+	}
+	binary, err := FindDeviceBinary(&info, ArduboyFXDeviceKey, "")
+	if err != nil || binary.Title != "Fancy" {
+		t.Fatalf("Expected FX binary for FX device, got %v (%v)", binary, err)
+	}
+	binary, err = FindDeviceBinary(&info, ArduboyDeviceKey, "")
+	if err != nil || binary.Title != "Plain" {
+		t.Fatalf("Expected plain binary for Arduboy, got %v (%v)", binary, err)
+	}
+	binary, err = FindDeviceBinary(&info, ArduboyFXDeviceKey, "plain")
+	if err != nil || binary.Title != "Plain" {
+		t.Fatalf("Expected title to override device, got %v (%v)", binary, err)
+	}
+	if _, err = FindDeviceBinary(&info, ArduboyMiniDeviceKey, ""); err == nil {
+		t.Fatalf("Expected no binary for the mini")
+	}
+	// FX devices can fall back to plain binaries
+	info.Binaries = info.Binaries[:1]
+	binary, err = FindDeviceBinary(&info, ArduboyFXDeviceKey, "")
+	if err != nil || binary.Title != "Plain" {
+		t.Fatalf("Expected FX device to fall back to plain binary, got %v (%v)", binary, err)
+	}
+	// But it shouldn't pick between two good options
+	info.Binaries = append(info.Binaries, &PackageBinary{Title: "Other", Device: ArduboyDeviceKey})
+	if _, err = FindDeviceBinary(&info, ArduboyFXDeviceKey, ""); err == nil {
+		t.Fatalf("Expected error with multiple matching binaries")
+	}
+}
+
+func TestLoadPackageBinary(t *testing.T) {
+	archive, err := zip.OpenReader(fileTestPath(filepath.Join(CartBuilderFolder, "TexasHoldEmFX.arduboy")))
+	if err != nil {
+		t.Fatalf("Couldn't open package: %s", err)
+	}
+	defer archive.Close()
+	info, err := ReadPackageInfo(archive)
+	if err != nil {
+		t.Fatalf("Couldn't read package info: %s", err)
+	}
+	binary, err := FindDeviceBinary(&info, ArduboyFXDeviceKey, "")
+	if err != nil {
+		t.Fatalf("Couldn't find binary: %s", err)
+	}
+	data, err := LoadPackageBinary(archive, binary)
+	if err != nil {
+		t.Fatalf("Couldn't load binary: %s", err)
+	}
+	if len(data.Sketch) == 0 || len(data.FlashData) == 0 || len(data.FlashSave) == 0 {
+		t.Fatalf("Expected sketch, flashdata, and flashsave: %d, %d, %d",
+			len(data.Sketch), len(data.FlashData), len(data.FlashSave))
+	}
+	devdata := data.DevData()
+	datalen := int(AlignWidth(uint(len(data.FlashData)), uint(FXPageSize)))
+	savelen := int(AlignWidth(uint(len(data.FlashSave)), uint(FxSaveAlignment)))
+	if len(devdata) != datalen+savelen {
+		t.Fatalf("Expected dev data length %d, got %d", datalen+savelen, len(devdata))
+	}
+	if !bytes.Equal(devdata[:len(data.FlashData)], data.FlashData) {
+		t.Fatalf("Dev data doesn't start with flashdata")
+	}
+	if !bytes.Equal(devdata[datalen:datalen+len(data.FlashSave)], data.FlashSave) {
+		t.Fatalf("Flashsave not after aligned flashdata")
+	}
+}
@@ -18,6 +18,9 @@ const (
 		"\xff\xcf\x90\x93\xFF\x0A\xff\x91\xef\x91\x9f\x91\x8f\x91\x0f\xbe" +
 		"\x0f\x90\x18\x95"
 
+	// What the SSD1309 screen patch puts in place of the charge pump command
+	SSD1309_CHARGEPUMP = "\xE3\xE3"
+
 	RET_INSTRUCTION  = "\x08\x95"
 	RETI_INSTRUCTION = "\x18\x95"
 
@@ -36,93 +39,133 @@ const (
 	MBP_overflow_r31 = 58
 )
 
-// Directly modify the given program so that it allows resetting to the
-// bootloader with up and down
-func PatchMenuButtons(program []byte) (bool, string) {
+// Where the menu button patch goes (the timer0 overflow ISR), along with the
+// addresses of the timer variables the patch has to keep updating
+type menuPatchSite struct {
+	Address       int
+	Length        int
+	millis        int
+	fract         int
+	overflowCount int
+}
+
+// Find the timer0 ISR and check whether the menu patch fits. If it can't be
+// patched, the site is nil and the message says why
+func findMenuPatchSite(program []byte) (*menuPatchSite, string) {
 	if len(program) < 256 {
-		return false, "Program too short"
+		return nil, "Program too short"
 	}
 
-	var vector_23 int = (int(program[0x5E]) << 1) | (int(program[0x5F]) << 9) //ISR timer0 vector addr
-	var p int = vector_23
+	vector, ok := DecodeAvr(program, TIMER0OVFVector*AvrVectorSize).jumpTarget()
+	if !ok {
+		return nil, "No menu patch applied. Timer0 vector isn't a jump."
+	}
+	if vector < 0 || vector >= len(program) {
+		return nil, fmt.Sprintf("No menu patch applied. Timer0 vector points outside the program (%d)", vector)
+	}
+	site := menuPatchSite{Address: vector}
 	l := 0
 	lds := 0
 	branch := 0
-	timer0_millis := 0
-	timer0_fract := 0
-	timer0_overflow_count := 0
 
-	for p < (len(program) - 2) {
-		p += 2 // handle 2 byte instructions
-		if string(program[p-2:p]) == RET_INSTRUCTION {
+	for p := vector; p < (len(program) - 2); {
+		ins := DecodeAvr(program, p)
+		p += ins.Size
+		if ins.Opcode == 0x9508 { // ret
 			l = -1
 			break
 		}
-		if (program[p-1]&0xFC) == 0xF4 && (program[p-2]&0x07) == 0x00 { // brcc instruction may jump beyond reti
-			branch = (int(program[p-1]&0x03) << 6) + (int(program[p-2]&0xf8) >> 2)
-			if branch < 128 {
-				branch = p + branch
-			} else {
-				branch = p - 256 + branch
-			}
+		if (ins.Opcode & 0xFC07) == 0xF400 { // brcc instruction may jump beyond reti
+			branch, _ = ins.branchTarget()
 		}
-		if string(program[p-2:p]) == RETI_INSTRUCTION {
-			l = p - vector_23
+		if ins.Opcode == 0x9518 { // reti
+			l = p - vector
 			if p > branch { // there was no branch beyond reti instruction
 				break
 			}
 		}
 		if l != 0 { // branched beyond reti, look for rjmp instruction
-			if (program[p-1] & 0xF0) == 0xC0 {
-				l = p - vector_23
+			if (ins.Opcode & 0xF000) == 0xC000 {
+				l = p - vector
 				break
 			}
 		}
-		// handle 4 byte instructions
-		if (program[p-1]&0xFE) == 0x90 && (program[p-2]&0x0F) == 0x00 { // lds instruction
+		if (ins.Opcode & 0xFE0F) == 0x9000 { // lds instruction
 			lds += 1
 			if lds == 1 {
-				timer0_millis = int(program[p]) | (int(program[p+1]) << 8)
+				site.millis = int(ins.Extra)
 			} else if lds == 5 {
-				timer0_fract = int(program[p]) | (int(program[p+1]) << 8)
+				site.fract = int(ins.Extra)
 			} else if lds == 6 {
-				timer0_overflow_count = int(program[p]) | (int(program[p+1]) << 8)
+				site.overflowCount = int(ins.Extra)
 			}
-			p += 2
-		}
-		if (program[p-1]&0xFE) == 0x92 && (program[p-2]&0x0F) == 0x00 { // sts instruction
-			p += 2
 		}
 	}
+	site.Length = l
 
 	if l == -1 {
-		return false, "No menu patch applied. ISR contains subroutine."
+		return nil, "No menu patch applied. ISR contains subroutine."
 	} else if l < len(MENUBUTTONPATCH) {
-		return false, fmt.Sprintf("No menu patch applied. ISR size too small (%d bytes)", l)
-	} else if timer0_millis == 0 || timer0_fract == 0 || timer0_overflow_count == 0 {
-		return false, "No menu patch applied. Custom ISR in use."
-	} else {
-		// patch the new ISR code with 'hold UP + DOWN for 2 seconds to start bootloader menu' feature
-		copied := copy(program[vector_23:], []byte(MENUBUTTONPATCH))
-		if copied != len(MENUBUTTONPATCH) {
-			return false, "ARDUGOTOOLS PROGRAM ERROR: didn't copy whole menu patch!"
+		return nil, fmt.Sprintf("No menu patch applied. ISR size too small (%d bytes)", l)
+	} else if site.millis == 0 || site.fract == 0 || site.overflowCount == 0 {
+		return nil, "No menu patch applied. Custom ISR in use."
+	}
+	return &site, "Menu patch applied"
+}
+
+// Directly modify the given program so that it allows resetting to the
+// bootloader with up and down
+func PatchMenuButtons(program []byte) (bool, string) {
+	site, message := findMenuPatchSite(program)
+	if site == nil {
+		return false, message
+	}
+	vector_23 := site.Address
+	timer0_millis := site.millis
+	timer0_fract := site.fract
+	timer0_overflow_count := site.overflowCount
+	// patch the new ISR code with 'hold UP + DOWN for 2 seconds to start bootloader menu' feature
+	copied := copy(program[vector_23:], []byte(MENUBUTTONPATCH))
+	if copied != len(MENUBUTTONPATCH) {
+		return false, "ARDUGOTOOLS PROGRAM ERROR: didn't copy whole menu patch!"
+	}
+	// fix timer variables
+	program[vector_23+MBP_fract_lds+0] = byte(timer0_fract & 0xFF)
+	program[vector_23+MBP_fract_lds+1] = byte(timer0_fract >> 8)
+	program[vector_23+MBP_fract_sts+0] = byte(timer0_fract & 0xFF)
+	program[vector_23+MBP_fract_sts+1] = byte(timer0_fract >> 8)
+	program[vector_23+MBP_millis_r30+0] = byte(0xE0 | (timer0_millis>>0)&0x0F)
+	program[vector_23+MBP_millis_r30+1] = byte(0xE0 | (timer0_millis>>4)&0x0F)
+	program[vector_23+MBP_millis_r31+0] = byte(0xF0 | (timer0_millis>>8)&0x0F)
+	program[vector_23+MBP_millis_r31+1] = byte(0xE0 | (timer0_millis>>12)&0x0F)
+	program[vector_23+MBP_overflow_r30+0] = byte(0xE0 | (timer0_overflow_count>>0)&0x0F)
+	program[vector_23+MBP_overflow_r30+1] = byte(0xE0 | (timer0_overflow_count>>4)&0x0F)
+	program[vector_23+MBP_overflow_r31+0] = byte(0xF0 | (timer0_overflow_count>>8)&0x0F)
+	program[vector_23+MBP_overflow_r31+1] = byte(0xE0 | (timer0_overflow_count>>12)&0x0F)
+	return true, message
+}
+
+// Addresses of every copy of the screen init table (lcdBootProgram) in the
+// program. The contrast byte is allowed to be anything, and the charge pump
+// bytes may already be patched for the SSD1309
+func findScreenInitTables(flashdata []byte) []int {
+	result := make([]int, 0)
+	for pos := 0; pos+len(LCDBOOTPROGRAM) <= len(flashdata); pos++ {
+		found := bytes.Index(flashdata[pos:], []byte(LCDBOOTPROGRAM[:2]))
+		if found < 0 {
+			break
+		}
+		pos += found
+		if pos+len(LCDBOOTPROGRAM) > len(flashdata) {
+			break
+		}
+		table := flashdata[pos : pos+len(LCDBOOTPROGRAM)]
+		if (string(table[2:4]) == LCDBOOTPROGRAM[2:4] || string(table[2:4]) == SSD1309_CHARGEPUMP) &&
+			string(table[4:7]) == LCDBOOTPROGRAM[4:7] && string(table[8:]) == LCDBOOTPROGRAM[8:] {
+			result = append(result, pos)
 		}
-		//program[vector_23 : vector_23+len(MENUBUTTONPATCH)] = MENUBUTTONPATCH
-		// fix timer variables
-		program[vector_23+MBP_fract_lds+0] = byte(timer0_fract & 0xFF)
-		program[vector_23+MBP_fract_lds+1] = byte(timer0_fract >> 8)
-		program[vector_23+MBP_fract_sts+0] = byte(timer0_fract & 0xFF)
-		program[vector_23+MBP_fract_sts+1] = byte(timer0_fract >> 8)
-		program[vector_23+MBP_millis_r30+0] = byte(0xE0 | (timer0_millis>>0)&0x0F)
-		program[vector_23+MBP_millis_r30+1] = byte(0xE0 | (timer0_millis>>4)&0x0F)
-		program[vector_23+MBP_millis_r31+0] = byte(0xF0 | (timer0_millis>>8)&0x0F)
-		program[vector_23+MBP_millis_r31+1] = byte(0xE0 | (timer0_millis>>12)&0x0F)
-		program[vector_23+MBP_overflow_r30+0] = byte(0xE0 | (timer0_overflow_count>>0)&0x0F)
-		program[vector_23+MBP_overflow_r30+1] = byte(0xE0 | (timer0_overflow_count>>4)&0x0F)
-		program[vector_23+MBP_overflow_r31+0] = byte(0xF0 | (timer0_overflow_count>>8)&0x0F)
-		program[vector_23+MBP_overflow_r31+1] = byte(0xE0 | (timer0_overflow_count>>12)&0x0F)
-		return true, "Menu patch applied"
 	}
+	return result
 }
 
 // Apply a combination of screen patches to the given program
@@ -131,24 +174,16 @@ func PatchScreen(flashdata []byte, ssd1309 bool, contrast int) int {
 		return 0
 	}
 	//logging.debug(f"Patching screen data: ssd1309={ssd1309}, contrast={contrast}")
-	lcdBootProgram_addr := 0
-	found := 0
-	for lcdBootProgram_addr >= 0 {
-		lcdBootProgram_addr = bytes.Index(flashdata[lcdBootProgram_addr:], []byte(LCDBOOTPROGRAM[:7]))
-		//flashdata.find(LCDBOOTPROGRAM[:7], lcdBootProgram_addr)
-		if lcdBootProgram_addr >= 0 && string(flashdata[lcdBootProgram_addr+8:lcdBootProgram_addr+13]) == LCDBOOTPROGRAM[8:] {
-			found += 1
-			if ssd1309 {
-				flashdata[lcdBootProgram_addr+2] = 0xE3
-				flashdata[lcdBootProgram_addr+3] = 0xE3
-			}
-			if contrast >= 0 {
-				flashdata[lcdBootProgram_addr+7] = byte(contrast)
-			}
-			lcdBootProgram_addr += 8
+	found := findScreenInitTables(flashdata)
+	for _, lcdBootProgram_addr := range found {
+		if ssd1309 {
+			copy(flashdata[lcdBootProgram_addr+2:], SSD1309_CHARGEPUMP)
+		}
+		if contrast >= 0 {
+			flashdata[lcdBootProgram_addr+7] = byte(contrast)
 		}
 	}
-	return found
+	return len(found)
 }
 
 // Given binary data, patch EVERY instance of wrong LED polarity for Micro
@@ -0,0 +1,46 @@
+package arduboy
+
+import (
+	"log"
+)
+
+const (
+	ProgressPhaseBackfill = "backfill" // Reading data around a write so it isn't lost
+	ProgressPhaseRead     = "read"
+	ProgressPhaseCompare  = "compare" // Checking whether data on the device needs changing
+	ProgressPhaseWrite    = "write"
+	ProgressPhaseVerify   = "verify"
+)
+
+// How far along a long-running device operation is. Done and Total are in
+// bytes; Total is 0 when it isn't known ahead of time (such as reading a
+// flashcart, which ends wherever the slots do). Slot and Block are -1 when
+// they don't apply. Message is a human readable description, and may be empty
+// for events that only update the numbers
+type Progress struct {
+	Phase   string
+	Done    int
+	Total   int
+	Slot    int
+	Block   int
+	Message string
+}
+
+// Receives progress events from long-running device functions. The Progress
+// is only valid for the duration of the call. A nil reporter is allowed and
+// simply means nobody is listening
+type ProgressReporter func(*Progress)
+
+func (reporter ProgressReporter) report(progress Progress) {
+	if reporter != nil {
+		reporter(&progress)
+	}
+}
+
+// A ProgressReporter which logs the progress messages, the same way
+// long-running functions always have
+func LogProgress(progress *Progress) {
+	if progress.Message != "" {
+		log.Println(progress.Message)
+	}
+}
@@ -0,0 +1,213 @@
+package arduboy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// How often the server checks devices which can't block on reads (emulated ones)
+	ServePollInterval = time.Millisecond
+)
+
+// Shares a local device over TCP, one client at a time. Clients may send raw
+// bootloader commands (tcp://) or speak RFC2217 (rfc2217://); which one is
+// figured out from the first byte, since RFC2217 always starts with a telnet
+// command and the bootloader commands never do. Raw clients get the device
+// already in bootloader mode. RFC2217 clients reset the device the usual way,
+// by setting the baud rate to RebootBaudRate
+type DeviceServer struct {
+	Port string // The device to share, as given to ConnectWithBootloader
+	// Gets a bootloader connection to the device, once per client and again
+	// whenever an RFC2217 client resets the device. Defaults to ConnectWithBootloader
+	Connect func(port string) (io.ReadWriteCloser, *BasicDeviceInfo, error)
+}
+
+func (s *DeviceServer) connect() (io.ReadWriteCloser, error) {
+	connect := s.Connect
+	if connect == nil {
+		connect = ConnectWithBootloader
+	}
+	device, info, err := connect(s.Port)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Serving %s\n", info.SmallString())
+	return device, nil
+}
+
+// Accept and serve clients until the context is done or the listener fails.
+// Errors within a client's session are logged, not returned
+func (s *DeviceServer) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		log.Printf("Client connected from %s\n", conn.RemoteAddr())
+		err = s.handle(conn)
+		if err != nil {
+			log.Printf("Client %s failed: %s\n", conn.RemoteAddr(), err)
+		} else {
+			log.Printf("Client %s disconnected\n", conn.RemoteAddr())
+		}
+	}
+}
+
+// Copy everything the device says to the client until the device is closed
+func pumpDevice(device io.Reader, client io.Writer) error {
+	buffer := make([]byte, FXPageSize)
+	for {
+		n, err := device.Read(buffer)
+		if n > 0 {
+			if _, werr := client.Write(buffer[:n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, ErrNoEmulatedResponse) || (n == 0 && err == nil) {
+			time.Sleep(ServePollInterval)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *DeviceServer) handle(conn net.Conn) error {
+	defer conn.Close()
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if first[0] == telnetIAC {
+		return s.handleRFC2217(conn)
+	}
+	return s.handleRaw(conn, first)
+}
+
+func (s *DeviceServer) handleRaw(conn net.Conn, first []byte) error {
+	device, err := s.connect()
+	if err != nil {
+		return err
+	}
+	pumpDone := make(chan error, 1)
+	go func() {
+		err := pumpDevice(device, conn)
+		// Nobody to talk to anymore, so end the session
+		conn.Close()
+		pumpDone <- err
+	}()
+	_, err = device.Write(first)
+	if err == nil {
+		_, err = io.Copy(device, conn)
+	}
+	device.Close()
+	<-pumpDone
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// A device connection for an RFC2217 session, which can be swapped out when
+// the client resets the device
+type rfc2217Session struct {
+	server   *DeviceServer
+	client   *telnetConn
+	device   io.ReadWriteCloser
+	pumpDone chan error
+}
+
+func (r *rfc2217Session) stop() {
+	if r.device != nil {
+		r.device.Close()
+		<-r.pumpDone
+		r.device = nil
+	}
+}
+
+func (r *rfc2217Session) start() error {
+	device, err := r.server.connect()
+	if err != nil {
+		return err
+	}
+	r.device = device
+	r.pumpDone = make(chan error, 1)
+	go func() {
+		r.pumpDone <- pumpDevice(device, r.client)
+	}()
+	return nil
+}
+
+func (s *DeviceServer) handleRFC2217(conn net.Conn) error {
+	session := rfc2217Session{server: s, client: newTelnetConn(conn)}
+	defer session.stop()
+	var controlErr error
+	session.client.onOption = func(verb byte, option byte) {
+		if verb == telnetWILL && option == telnetComPortOption {
+			session.client.sendOption(telnetDO, option)
+		} else if verb == telnetWILL {
+			session.client.sendOption(telnetDONT, option)
+		} else if verb == telnetDO {
+			session.client.sendOption(telnetWONT, option)
+		}
+	}
+	session.client.onComPort = func(command []byte) {
+		if command[0] == rfc2217SetBaudRate && len(command) >= 5 {
+			rate := binary.BigEndian.Uint32(command[1:5])
+			if rate == uint32(RebootBaudRate) {
+				// Connecting again does the actual reset, just like a local port
+				log.Printf("Client asked for a reset\n")
+				session.stop()
+				controlErr = session.start()
+			} else if session.device == nil {
+				controlErr = session.start()
+			}
+		}
+		// Everything else (data size, parity, etc) doesn't matter for USB
+		// serial, so just say it happened
+		session.client.sendComPort(command[0]+rfc2217ServerOffset, command[1:])
+	}
+	// The first byte was already read to figure out the protocol
+	session.client.parse(telnetIAC)
+	for {
+		err := session.client.readSome()
+		if controlErr != nil {
+			return fmt.Errorf("couldn't connect device: %w", controlErr)
+		}
+		if len(session.client.pending) > 0 {
+			if session.device == nil {
+				if controlErr = session.start(); controlErr != nil {
+					return controlErr
+				}
+			}
+			if _, werr := session.device.Write(session.client.pending); werr != nil {
+				return werr
+			}
+			session.client.pending = session.client.pending[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
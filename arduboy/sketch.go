@@ -17,8 +17,19 @@ type SketchAnalysis struct {
 	OverwritesCaterina bool
 	OverwritesCathy    bool // If this happens, sketch is too large. Probably not used...
 	TotalPages         int
-	TrimmedData        []byte
+	TrimmedData        []byte `json:"-"`
 	DetectedDevice     string
+	// The rest is only for sketches, not bootloaders. Everything after Eeprom
+	// is filled in by ReportSketch
+	Eeprom         EepromFootprint
+	FlashUsed      int     // Bytes, up to the last used page
+	FlashAvailable int     // Bytes before the bootloader (Cathy, the smaller one)
+	FlashPercent   float64 // How much of the available flash is used
+	MenuPatch      SketchMenuPatch
+	Displays       []SketchDisplayInit
+	FxData         SketchFxPointer
+	FxSave         SketchFxPointer
+	Libraries      []SketchLibrary // Guessed from code signatures, see sketchLibrarySignatures
 }
 
 var (
@@ -53,9 +64,7 @@ func findCallRet(bindata []byte, initial []byte) bool {
 	return false
 }
 
-// NOTE: as far as analysis goes, we may eventually create a large table for all hashes
-// to see if your bootloader is "verified": https://github.com/MrBlinky/cathy3k/tree/main/cathy3k
-// and for 2k/caterina: https://github.com/MrBlinky/Arduboy/tree/master/cathy
+// NOTE: bootloaders are "verified" by hash rather than analysis, see bootloaders.toml
 
 // Compute various important attributes of the given flash data. It could be a
 // sketch or a bootloader
@@ -79,7 +88,7 @@ func AnalyzeSketch(bindata []byte, bootloader bool) SketchAnalysis {
 	}
 
 	// TODO: this may/will fail if the data isn't aligned!!
-	result.TrimmedData = bindata[:result.TotalPages*FlashPageSize]
+	result.TrimmedData = bindata[:min(result.TotalPages*FlashPageSize, len(bindata))]
 
 	// Use different device detection for bootloader vs sketch. bootloaders always disable the FX, apparently.
 	// Sketches may not
@@ -101,6 +110,7 @@ func AnalyzeSketch(bindata []byte, bootloader bool) SketchAnalysis {
 			// Probably dangerous to assume it's Arduboy but whatever...
 			result.DetectedDevice = ArduboyDeviceKey
 		}
+		result.Eeprom = AnalyzeEeprom(result.TrimmedData)
 	}
 
 	return result
@@ -153,11 +163,12 @@ func ReadSketch(sercon io.ReadWriter, trim bool) ([]byte, error) {
 // no sketch will ever have holes and simplify this dramatically, but I wanted this to be as
 // correct as possible. Alternatively, to write an "arduboy" sketch program, set fullClear to true
 // and you don't have to worry about any weirdness
-func WriteHex(sercon io.ReadWriter, rawSketch io.Reader, fullClear bool) ([]byte, []bool, error) {
+func WriteHex(sercon io.ReadWriter, rawSketch io.Reader, fullClear bool, progress ProgressReporter) ([]byte, []bool, error) {
 	// Read the existing sketch area. We will be writing back
 	// ONLY the parts that changed (this is what the intel hex format
 	// is for) Set some RGB for light indication of which stage we're on
-	log.Printf("Reading full sketch + applying hex in-memory\n")
+	progress.report(Progress{Phase: ProgressPhaseRead, Slot: -1, Block: -1,
+		Message: "Reading full sketch + applying hex in-memory"})
 	SetRgbButtonState(sercon, LEDCtrlBtnOff|LEDCtrlBlOn)
 	defer ResetRgbButtonState(sercon)
 	var sketch []byte
@@ -178,7 +189,8 @@ func WriteHex(sercon io.ReadWriter, rawSketch io.Reader, fullClear bool) ([]byte
 			writtenPages[i] = true
 		}
 	}
-	log.Printf("Writable flash area is %d bytes (%d pages)\n", len(sketch), len(sketch)/FlashPageSize)
+	progress.report(Progress{Phase: ProgressPhaseRead, Done: len(sketch), Total: len(sketch), Slot: -1, Block: -1,
+		Message: fmt.Sprintf("Writable flash area is %d bytes (%d pages)", len(sketch), len(sketch)/FlashPageSize)})
 	if len(sketch)%FlashPageSize > 0 {
 		return nil, nil, fmt.Errorf("PROGRAM ERROR: sketch area not page aligned! Length: %d", len(sketch))
 	}
@@ -202,12 +214,22 @@ func WriteHex(sercon io.ReadWriter, rawSketch io.Reader, fullClear bool) ([]byte
 		copy(sketch[segment.Address:], segment.Data)
 	}
 	// Now write it back page by page based on which pages have been touched
-	log.Printf("Writing ONLY modified sketch pages")
+	writeTotal := 0
+	for _, write := range writtenPages {
+		if write {
+			writeTotal += FlashPageSize
+		}
+	}
+	progress.report(Progress{Phase: ProgressPhaseWrite, Total: writeTotal, Slot: -1, Block: -1,
+		Message: "Writing ONLY modified sketch pages"})
 	SetRgbButtonState(sercon, LEDCtrlBtnOff|LEDCtrlRdOn)
 	rwep := ReadWriteErrorPass{rw: sercon}
 	onebyte := make([]byte, 1)
+	writeDone := 0
 	for p, write := range writtenPages {
 		if write {
+			progress.report(Progress{Phase: ProgressPhaseWrite, Done: writeDone, Total: writeTotal, Slot: -1, Block: -1})
+			writeDone += FlashPageSize
 			rwep.WritePass(AddressCommandFlashPage(uint16(p)))
 			rwep.ReadPass(onebyte)
 			rwep.WritePass(WriteFlashCommand(uint16(FlashPageSize)))
@@ -219,7 +241,8 @@ func WriteHex(sercon io.ReadWriter, rawSketch io.Reader, fullClear bool) ([]byte
 		return nil, nil, rwep.err
 	}
 	// Finally, verify the pages. This reads the sketch yet AGAIN into memory
-	log.Printf("Validating sketch")
+	progress.report(Progress{Phase: ProgressPhaseVerify, Done: writeTotal, Total: writeTotal, Slot: -1, Block: -1,
+		Message: "Validating sketch"})
 	SetRgbButtonState(sercon, LEDCtrlBtnOff|LEDCtrlGrOn)
 	newsketch, err := ReadSketch(sercon, false)
 	if err != nil {
@@ -0,0 +1,240 @@
+package arduboy
+
+import (
+	"fmt"
+)
+
+const (
+	FxDataPointerAddress = 0x14 // reti, then the page of the FX data
+	FxSavePointerAddress = 0x18 // reti, then the page of the FX save
+
+	TIMER1COMPAVector = 17
+	TIMER3COMPAVector = 32
+	TIMER4OVFVector   = 41
+
+	// I/O registers (data address - 0x20) which give the libraries away
+	avrPORTC  = 0x08 // The speaker pins are on port C
+	avrSPDR   = 0x2E // SPI data, which is how the display and FX chip are driven
+	avrTIMSK1 = 0x4F
+	avrOCR3AL = 0x78
+	avrTC4H   = 0x9F // Timer4 high byte; the high volume mode drives the speaker from timer4
+	avrIOEnd  = 0xE0 // Past this, sts is writing to RAM
+
+	isrScanLimit = 256 // Instructions followed in an ISR (including calls) before giving up
+)
+
+// State of the menu button patch (hold up + down to get to the bootloader)
+type SketchMenuPatch struct {
+	Present  bool   // The timer0 ISR has already been replaced
+	Possible bool   // The patch could be applied (false if already present)
+	Message  string // Why it can't be applied, if it can't
+}
+
+// A copy of the display init sequence (lcdBootProgram) within the sketch
+type SketchDisplayInit struct {
+	Address    int
+	Controller string // SSD1306 or SSD1309 (which is what the screen patch makes)
+	Contrast   int
+}
+
+// One of the pointers which flashcart building patches into the sketch
+type SketchFxPointer struct {
+	Patched bool
+	Page    int `json:",omitempty"` // In FX pages
+}
+
+// A library the sketch appears to use, and what gave it away
+type SketchLibrary struct {
+	Name     string
+	Evidence string
+}
+
+// Everything found out about a sketch's interrupts, for the library fingerprints
+type sketchInspection struct {
+	analysis *SketchAnalysis
+	vectors  map[int]int          // Vectors the sketch actually handles, to their targets
+	isrIO    map[int]map[int]bool // I/O registers written by each handled vector's ISR
+}
+
+// Signatures for the common Arduboy libraries. These are only educated
+// guesses: a sketch can always carry its own copy of something, and the
+// sound libraries in particular all drive the same timers
+var sketchLibrarySignatures = []struct {
+	name   string
+	detect func(*sketchInspection) (string, bool)
+}{
+	{"Arduboy2", func(s *sketchInspection) (string, bool) {
+		if len(s.analysis.Displays) > 0 {
+			return "Display init table (lcdBootProgram)", true
+		}
+		return "", false
+	}},
+	{"ArduboyFX", func(s *sketchInspection) (string, bool) {
+		if s.analysis.DetectedDevice != ArduboyDeviceKey {
+			return fmt.Sprintf("FX chip select routines for the %s", s.analysis.DetectedDevice), true
+		}
+		return "", false
+	}},
+	{"ArduboyG", func(s *sketchInspection) (string, bool) {
+		for _, v := range []int{TIMER1COMPAVector, TIMER3COMPAVector, TIMER4OVFVector} {
+			if s.isrIO[v][avrSPDR] {
+				return fmt.Sprintf("%s interrupt drives the display", AvrVectorNames[v]), true
+			}
+		}
+		return "", false
+	}},
+	{"ATMlib", func(s *sketchInspection) (string, bool) {
+		if _, ok := s.vectors[TIMER4OVFVector]; ok && !s.isrIO[TIMER4OVFVector][avrSPDR] {
+			return "TIMER4_OVF interrupt (sample output)", true
+		}
+		return "", false
+	}},
+	{"ArduboyPlaytune", func(s *sketchInspection) (string, bool) {
+		if _, ok := s.vectors[TIMER3COMPAVector]; ok && s.isrIO[TIMER1COMPAVector][avrTIMSK1] {
+			return "TIMER1_COMPA and TIMER3_COMPA interrupts, one per channel", true
+		}
+		return "", false
+	}},
+	{"ArduboyTones", func(s *sketchInspection) (string, bool) {
+		isr := s.isrIO[TIMER3COMPAVector]
+		if isr[avrOCR3AL] && (isr[avrPORTC] || isr[avrTC4H]) && !isr[avrTIMSK1] {
+			return "TIMER3_COMPA interrupt toggles the speaker", true
+		}
+		return "", false
+	}},
+}
+
+// The I/O register an instruction writes to, for out/sts/sbi/cbi
+func (ins AvrInstruction) ioTouched() (int, bool) {
+	if io, _, ok := ins.ioWrite(); ok {
+		return io, io < avrIOEnd
+	} else if (ins.Opcode & 0xFD00) == 0x9800 { // cbi/sbi
+		return int(ins.Opcode>>3) & 0x1F, true
+	}
+	return 0, false
+}
+
+// Every I/O register the ISR at the given address writes to, following
+// calls it makes (but not indirect ones)
+func isrIOWrites(program []byte, address int) map[int]bool {
+	result := make(map[int]bool)
+	visited := make(map[int]bool)
+	pending := []int{address}
+	for steps := 0; len(pending) > 0 && steps < isrScanLimit; {
+		pos := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for ; pos+1 < len(program) && !visited[pos] && steps < isrScanLimit; steps++ {
+			visited[pos] = true
+			ins := DecodeAvr(program, pos)
+			if io, ok := ins.ioTouched(); ok {
+				result[io] = true
+			}
+			if ins.isSkip() {
+				next := DecodeAvr(program, pos+ins.Size)
+				pending = append(pending, next.Address+next.Size)
+			}
+			if target, ok := ins.callTarget(); ok {
+				pending = append(pending, target)
+			} else if target, ok := ins.branchTarget(); ok {
+				pending = append(pending, target)
+			} else if target, ok := ins.jumpTarget(); ok {
+				pos = target
+				continue
+			}
+			if ins.isEnd() {
+				break
+			}
+			pos += ins.Size
+		}
+	}
+	return result
+}
+
+// Whether the timer0 ISR is already the menu button patch. The timer
+// variable addresses differ from sketch to sketch, so those are skipped
+func menuPatchPresent(program []byte) bool {
+	address, ok := DecodeAvr(program, TIMER0OVFVector*AvrVectorSize).jumpTarget()
+	if !ok || address < 0 || address+len(MENUBUTTONPATCH) > len(program) {
+		return false
+	}
+	variable := make(map[int]bool)
+	for _, offset := range []int{MBP_fract_lds, MBP_fract_sts, MBP_millis_r30, MBP_millis_r31,
+		MBP_overflow_r30, MBP_overflow_r31} {
+		variable[offset] = true
+		variable[offset+1] = true
+	}
+	for i := 0; i < len(MENUBUTTONPATCH); i++ {
+		if !variable[i] && program[address+i] != MENUBUTTONPATCH[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Read one of the FX pointers flashcart building writes into the vector table
+func readFxPointer(program []byte, address int) SketchFxPointer {
+	if address+4 > len(program) || string(program[address:address+2]) != RETI_INSTRUCTION {
+		return SketchFxPointer{}
+	}
+	return SketchFxPointer{Patched: true, Page: int(Get2ByteValue(program, address+2))}
+}
+
+// Fill in the parts of a sketch analysis which AnalyzeSketch leaves out: the
+// menu patch, display init, FX pointers, and which libraries were used. This
+// walks the interrupt handlers, so it's only done when someone wants the report
+func ReportSketch(result *SketchAnalysis) {
+	program := result.TrimmedData
+	result.FlashUsed = len(program)
+	result.FlashAvailable = CathyStartPage * FlashPageSize
+	result.FlashPercent = 100 * float64(result.FlashUsed) / float64(result.FlashAvailable)
+
+	result.MenuPatch.Present = menuPatchPresent(program)
+	if result.MenuPatch.Present {
+		result.MenuPatch.Message = "Menu patch already applied"
+	} else {
+		site, message := findMenuPatchSite(program)
+		result.MenuPatch.Possible = site != nil
+		if site == nil {
+			result.MenuPatch.Message = message
+		}
+	}
+
+	result.Displays = make([]SketchDisplayInit, 0)
+	for _, address := range findScreenInitTables(program) {
+		display := SketchDisplayInit{Address: address, Controller: "SSD1306", Contrast: int(program[address+7])}
+		if string(program[address+2:address+4]) == SSD1309_CHARGEPUMP {
+			display.Controller = "SSD1309"
+		}
+		result.Displays = append(result.Displays, display)
+	}
+
+	result.FxData = readFxPointer(program, FxDataPointerAddress)
+	result.FxSave = readFxPointer(program, FxSavePointerAddress)
+
+	inspection := sketchInspection{
+		analysis: result,
+		vectors:  make(map[int]int),
+		isrIO:    make(map[int]map[int]bool),
+	}
+	// Unused vectors all share the same target, so only count the unique ones
+	targets := make(map[int]int)
+	for v := 1; v < AvrVectorCount; v++ {
+		if target, ok := DecodeAvr(program, v*AvrVectorSize).jumpTarget(); ok {
+			inspection.vectors[v] = target
+			targets[target]++
+		}
+	}
+	for v, target := range inspection.vectors {
+		if targets[target] > 1 {
+			delete(inspection.vectors, v)
+		} else {
+			inspection.isrIO[v] = isrIOWrites(program, target)
+		}
+	}
+	result.Libraries = make([]SketchLibrary, 0)
+	for _, signature := range sketchLibrarySignatures {
+		if evidence, ok := signature.detect(&inspection); ok {
+			result.Libraries = append(result.Libraries, SketchLibrary{Name: signature.name, Evidence: evidence})
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package arduboy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func loadReportSketch(t *testing.T) []byte {
+	file, err := os.Open(fileTestPath("qr-generator.hex"))
+	if err != nil {
+		t.Fatalf("Couldn't open hex: %s", err)
+	}
+	defer file.Close()
+	sketch, err := HexToBin(file)
+	if err != nil {
+		t.Fatalf("Couldn't convert hex: %s", err)
+	}
+	return AlignData(sketch, FlashPageSize)
+}
+
+// Analyze the sketch along with the full report
+func reportTestSketch(sketch []byte) SketchAnalysis {
+	analysis := AnalyzeSketch(sketch, false)
+	ReportSketch(&analysis)
+	return analysis
+}
+
+// Add code to the end of the sketch and point the given vector at it
+func addTestIsr(sketch []byte, vector int, code ...byte) []byte {
+	isr := len(sketch)
+	sketch = AlignData(append(sketch, code...), FlashPageSize)
+	copy(sketch[vector*AvrVectorSize:], []byte{0x0c, 0x94, byte(isr / 2), byte(isr / 2 >> 8)})
+	return sketch
+}
+
+// Make sure the given library was found in the sketch
+func expectLibrary(t *testing.T, sketch []byte, name string) SketchAnalysis {
+	analysis := reportTestSketch(sketch)
+	for _, library := range analysis.Libraries {
+		if library.Name == name {
+			return analysis
+		}
+	}
+	t.Fatalf("Expected %s, got %v", name, analysis.Libraries)
+	return analysis
+}
+
+func TestReportSketch(t *testing.T) {
+	sketch := loadReportSketch(t)
+	analysis := reportTestSketch(sketch)
+	if analysis.FlashUsed != len(analysis.TrimmedData) || analysis.FlashPercent <= 0 || analysis.FlashPercent >= 100 {
+		t.Fatalf("Wrong flash usage: %d bytes, %f%%", analysis.FlashUsed, analysis.FlashPercent)
+	}
+	if analysis.MenuPatch.Present || !analysis.MenuPatch.Possible {
+		t.Fatalf("Menu patch should be possible but not present: %v", analysis.MenuPatch)
+	}
+	if len(analysis.Displays) != 1 || analysis.Displays[0].Controller != "SSD1306" || analysis.Displays[0].Contrast != CONTRAST_NORMAL {
+		t.Fatalf("Wrong display init: %v", analysis.Displays)
+	}
+	if analysis.FxData.Patched || analysis.FxSave.Patched {
+		t.Fatalf("FX pointers shouldn't be patched")
+	}
+	if len(analysis.Libraries) != 1 || analysis.Libraries[0].Name != "Arduboy2" {
+		t.Fatalf("Expected only Arduboy2, got %v", analysis.Libraries)
+	}
+
+	// Now patch everything the report knows about
+	if ok, message := PatchMenuButtons(sketch); !ok {
+		t.Fatalf("Couldn't patch menu buttons: %s", message)
+	}
+	if PatchScreen(sketch, true, CONTRAST_DIM) != 1 {
+		t.Fatalf("Couldn't patch screen")
+	}
+	copy(sketch[FxDataPointerAddress:], []byte{0x18, 0x95, 0x12, 0x34})
+	copy(sketch[FxSavePointerAddress:], []byte{0x18, 0x95, 0x00, 0x50})
+	analysis = reportTestSketch(sketch)
+	if !analysis.MenuPatch.Present || analysis.MenuPatch.Possible {
+		t.Fatalf("Menu patch should be present: %v", analysis.MenuPatch)
+	}
+	if len(analysis.Displays) != 1 || analysis.Displays[0].Controller != "SSD1309" || analysis.Displays[0].Contrast != CONTRAST_DIM {
+		t.Fatalf("Wrong patched display init: %v", analysis.Displays)
+	}
+	if analysis.FxData != (SketchFxPointer{Patched: true, Page: 0x1234}) || analysis.FxSave != (SketchFxPointer{Patched: true, Page: 0x50}) {
+		t.Fatalf("Wrong FX pointers: %v, %v", analysis.FxData, analysis.FxSave)
+	}
+}
+
+func TestReportSketchTones(t *testing.T) {
+	// A tiny TIMER3_COMPA ISR which does what ArduboyTones does
+	expectLibrary(t, addTestIsr(loadReportSketch(t), TIMER3COMPAVector,
+		0x80, 0x93, 0x98, 0x00, // sts OCR3AL, r24
+		0x88, 0xb1, // in r24, PORTC
+		0x88, 0xb9, // out PORTC, r24
+		0x18, 0x95, // reti
+	), "ArduboyTones")
+}
+
+func TestReportSketchPlaytune(t *testing.T) {
+	sketch := addTestIsr(loadReportSketch(t), TIMER1COMPAVector,
+		0x80, 0x93, 0x6f, 0x00, // sts TIMSK1, r24
+		0x18, 0x95, // reti
+	)
+	sketch = addTestIsr(sketch, TIMER3COMPAVector,
+		0x88, 0xb1, // in r24, PORTC
+		0x88, 0xb9, // out PORTC, r24
+		0x18, 0x95, // reti
+	)
+	expectLibrary(t, sketch, "ArduboyPlaytune")
+}
+
+func TestReportSketchATMlib(t *testing.T) {
+	analysis := expectLibrary(t, addTestIsr(loadReportSketch(t), TIMER4OVFVector,
+		0x80, 0x93, 0xcf, 0x00, // sts OCR4A, r24
+		0x18, 0x95, // reti
+	), "ATMlib")
+	for _, library := range analysis.Libraries {
+		if library.Name == "ArduboyG" {
+			t.Fatalf("Sample output ISR mistaken for ArduboyG")
+		}
+	}
+}
+
+func TestReportSketchArduboyG(t *testing.T) {
+	// The display is driven from the timer interrupt, including TIMER4_OVF
+	// (which would otherwise be ATMlib)
+	analysis := expectLibrary(t, addTestIsr(loadReportSketch(t), TIMER4OVFVector,
+		0x8e, 0xbd, // out SPDR, r24
+		0x18, 0x95, // reti
+	), "ArduboyG")
+	for _, library := range analysis.Libraries {
+		if library.Name == "ATMlib" {
+			t.Fatalf("ArduboyG display ISR mistaken for ATMlib")
+		}
+	}
+}
+
+func TestReportSketchArduboyFX(t *testing.T) {
+	sketch := loadReportSketch(t)
+	if reportTestSketch(sketch).DetectedDevice != ArduboyDeviceKey {
+		t.Fatalf("Plain sketch shouldn't be detected as FX")
+	}
+	// The FX chip select routines from ArduboyFX: cbi/sbi PORTD, 1, then ret
+	sketch = AlignData(append(sketch,
+		0x59, 0x98, 0x08, 0x95, // cbi PORTD, 1; ret
+		0x59, 0x9a, 0x08, 0x95, // sbi PORTD, 1; ret
+	), FlashPageSize)
+	analysis := expectLibrary(t, sketch, "ArduboyFX")
+	if analysis.DetectedDevice != ArduboyFXDeviceKey {
+		t.Fatalf("Expected %s, got %s", ArduboyFXDeviceKey, analysis.DetectedDevice)
+	}
+}
+
+func TestReportSketchBackwardVector(t *testing.T) {
+	// An rjmp in the timer0 vector which goes back past the start
+	sketch := loadReportSketch(t)
+	copy(sketch[TIMER0OVFVector*AvrVectorSize:], []byte{0x00, 0xc8, 0x00, 0x00})
+	analysis := reportTestSketch(sketch)
+	if analysis.MenuPatch.Present || analysis.MenuPatch.Possible {
+		t.Fatalf("Menu patch shouldn't be possible: %v", analysis.MenuPatch)
+	}
+}
+
+func TestRenderSketchAnalysis(t *testing.T) {
+	analysis := reportTestSketch(loadReportSketch(t))
+	var output bytes.Buffer
+	if err := RenderSketchAnalysis(&analysis, "qr-generator", "abc", &output); err != nil {
+		t.Fatalf("Couldn't render analysis: %s", err)
+	}
+	for _, expected := range []string{"<h1>qr-generator</h1>", "SSD1306 init at 0x065c, contrast 0xcf", "<th>Arduboy2</th>"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("Rendered analysis missing '%s'", expected)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package arduboy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// How often a stalled read checks whether it should give up
+	TimeoutPollInterval = 100 * time.Millisecond
+)
+
+var bootloaderCommandNames = map[byte]string{
+	'S': "software id",
+	'V': "version",
+	'r': "lock bits",
+	'j': "jedec id",
+	'x': "led control",
+	'E': "exit bootloader",
+	'A': "set address",
+	'g': "read",
+	'B': "write",
+}
+
+var bootloaderMemoryNames = map[byte]string{
+	'F': "flash",
+	'E': "eeprom",
+	'C': "flashcart",
+}
+
+// The device stopped answering a command. Address is the byte address within
+// Memory the command started at; for "set address", there is no memory yet
+// and Address is the raw address sent to the bootloader
+type TimeoutError struct {
+	Command string
+	Memory  string
+	Address int
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Memory == "" {
+		return fmt.Sprintf("device stopped responding to '%s' (address %d) for %s", e.Command, e.Address, e.Timeout)
+	}
+	return fmt.Sprintf("device stopped responding to '%s %s' at address %d for %s", e.Command, e.Memory, e.Address, e.Timeout)
+}
+
+// So errors.Is(err, context.DeadlineExceeded) works for timeouts from anywhere
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Serial ports can stop reads after a while; readers without this can't be
+// interrupted, so the timeout only applies between reads
+type readTimeouter interface {
+	SetReadTimeout(time.Duration) error
+}
+
+// A device connection which gives up when the device stops responding or the
+// context is cancelled. Since every device function takes an io.ReadWriter,
+// wrapping a connection with this makes all of them context aware. Writes are
+// watched to know which bootloader command a stalled read belongs to
+type TimeoutConnection struct {
+	ctx     context.Context
+	conn    io.ReadWriteCloser
+	timeout time.Duration
+
+	tracker commandTracker
+}
+
+// Wrap the connection so reads give up after the device sends nothing for
+// the given timeout (0 means no timeout), and everything stops once the
+// context is done
+func NewTimeoutConnection(ctx context.Context, conn io.ReadWriteCloser, timeout time.Duration) *TimeoutConnection {
+	return &TimeoutConnection{
+		ctx:     ctx,
+		conn:    conn,
+		timeout: timeout,
+	}
+}
+
+// Same as ConnectWithBootloader, but the connection is a TimeoutConnection
+// using the given context and timeout
+func ConnectWithBootloaderContext(ctx context.Context, port string, timeout time.Duration) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	sercon, device, err := ConnectWithBootloader(port)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewTimeoutConnection(ctx, sercon, timeout), device, nil
+}
+
+// Figure out the byte address of a command given the raw address and memory type
+func bootloaderByteAddress(raw uint16, memory byte) int {
+	switch memory {
+	case 'F':
+		return int(raw) * 2
+	case 'C':
+		return int(raw) * FXPageSize
+	default:
+		return int(raw)
+	}
+}
+
+func (c *TimeoutConnection) timeoutError() *TimeoutError {
+	result := TimeoutError{
+		Command: bootloaderCommandNames[c.tracker.command],
+		Memory:  bootloaderMemoryNames[c.tracker.memory],
+		Address: c.tracker.address,
+		Timeout: c.timeout,
+	}
+	if result.Command == "" {
+		result.Command = string(rune(c.tracker.command))
+	}
+	return &result
+}
+
+func (c *TimeoutConnection) Write(data []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	c.tracker.track(data)
+	return c.conn.Write(data)
+}
+
+// Read as usual, but give up with a TimeoutError if nothing arrives within the
+// timeout, or with the context error if the context finishes first. Only
+// connections which support read timeouts (like serial ports) can be
+// interrupted in the middle of a read
+func (c *TimeoutConnection) Read(data []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	timeouter, ok := c.conn.(readTimeouter)
+	if !ok || (c.timeout <= 0 && c.ctx.Done() == nil) {
+		return c.conn.Read(data)
+	}
+	err := timeouter.SetReadTimeout(TimeoutPollInterval)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	for {
+		n, err := c.conn.Read(data)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		// Nothing yet; see if we should give up
+		if err := c.ctx.Err(); err != nil {
+			return 0, err
+		}
+		if c.timeout > 0 && time.Since(start) >= c.timeout {
+			return 0, c.timeoutError()
+		}
+	}
+}
+
+func (c *TimeoutConnection) Close() error {
+	return c.conn.Close()
+}
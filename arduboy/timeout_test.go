@@ -0,0 +1,144 @@
+package arduboy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A device which answers every command with '\r' until told to stall, after
+// which reads return nothing (like a serial port with a read timeout)
+type stallingDevice struct {
+	stallOn  byte
+	stalled  bool
+	pending  int
+	timeout  time.Duration
+	timeouts int
+}
+
+func (d *stallingDevice) Write(data []byte) (int, error) {
+	if d.pending > 0 {
+		// Data for a write, answered once it's all here
+		d.pending -= min(d.pending, len(data))
+		return len(data), nil
+	}
+	if data[0] == d.stallOn {
+		d.stalled = true
+	} else if data[0] == 'B' {
+		d.pending = blockCommandLength(data)
+	}
+	return len(data), nil
+}
+
+func (d *stallingDevice) Read(data []byte) (int, error) {
+	if d.stalled {
+		time.Sleep(d.timeout)
+		return 0, nil
+	}
+	for i := range data {
+		data[i] = '\r'
+	}
+	return len(data), nil
+}
+
+func (d *stallingDevice) SetReadTimeout(timeout time.Duration) error {
+	d.timeout = timeout
+	d.timeouts++
+	return nil
+}
+
+func (d *stallingDevice) Close() error {
+	return nil
+}
+
+func TestTimeoutConnection_Stall(t *testing.T) {
+	check := func(stallOn byte, run func(*TimeoutConnection) error, expected TimeoutError) {
+		device := stallingDevice{stallOn: stallOn}
+		conn := NewTimeoutConnection(context.Background(), &device, 250*time.Millisecond)
+		start := time.Now()
+		err := run(conn)
+		var timeout *TimeoutError
+		if !errors.As(err, &timeout) {
+			t.Fatalf("Expected timeout error, got %v", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Timeout error should be a deadline exceeded")
+		}
+		if *timeout != expected {
+			t.Fatalf("Expected timeout %v, got %v", expected, *timeout)
+		}
+		if time.Since(start) < expected.Timeout {
+			t.Fatalf("Timed out too early")
+		}
+		if device.timeouts == 0 {
+			t.Fatalf("Read timeout never set on the device")
+		}
+	}
+
+	check('g', func(c *TimeoutConnection) error {
+		_, err := ReadFlashcart(c, 3*FXPageSize+7, 100)
+		return err
+	}, TimeoutError{Command: "read", Memory: "flashcart", Address: 3 * FXPageSize, Timeout: 250 * time.Millisecond})
+	check('g', func(c *TimeoutConnection) error {
+		_, err := ReadEeprom(c)
+		return err
+	}, TimeoutError{Command: "read", Memory: "eeprom", Address: 0, Timeout: 250 * time.Millisecond})
+	check('A', func(c *TimeoutConnection) error {
+		_, err := ReadFlashcart(c, FXBlockSize, 100)
+		return err
+	}, TimeoutError{Command: "set address", Address: FxPagesPerBlock, Timeout: 250 * time.Millisecond})
+	check('j', func(c *TimeoutConnection) error {
+		_, err := (&BootloaderInfo{Version: MinBootloaderWithFlash}).GetJedecInfo(c, false)
+		return err
+	}, TimeoutError{Command: "jedec id", Timeout: 250 * time.Millisecond})
+	// The payload of a write must not be mistaken for commands
+	check('x', func(c *TimeoutConnection) error {
+		data := make([]byte, FXBlockSize)
+		for i := range data {
+			data[i] = 'g'
+		}
+		_, _, err := WriteFlashcart(c, 0, data, nil)
+		if err != nil {
+			return err
+		}
+		_, err = c.Write(RgbButtonCommandRaw(0))
+		if err != nil {
+			return err
+		}
+		_, err = c.Read(data[:1])
+		return err
+	}, TimeoutError{Command: "led control", Address: 0, Timeout: 250 * time.Millisecond})
+}
+
+func TestTimeoutConnection_Cancel(t *testing.T) {
+	device := stallingDevice{stallOn: 'g'}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewTimeoutConnection(ctx, &device, 0)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	_, err := ReadEeprom(conn)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation, got %v", err)
+	}
+	// Everything after should fail immediately
+	_, err = conn.Write([]byte{'S'})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation on write, got %v", err)
+	}
+}
+
+func TestTimeoutConnection_Emulated(t *testing.T) {
+	// Connections that can't time out should work exactly as before
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	conn := NewTimeoutConnection(context.Background(), emu, time.Second)
+	extdata, err := QueryDevice(&BasicDeviceInfo{}, conn, false)
+	if err != nil {
+		t.Fatalf("Couldn't query through timeout connection: %s", err)
+	}
+	if extdata.Bootloader.Device != ArduboyFXDeviceKey {
+		t.Fatalf("Wrong device through timeout connection: %s", extdata.Bootloader.Device)
+	}
+}
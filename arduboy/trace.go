@@ -0,0 +1,366 @@
+package arduboy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	TracePortScheme = "trace://"
+	TraceWrite      = "write"
+	TraceRead       = "read"
+
+	Board_TraceReplay = "Trace Replay"
+)
+
+// Follows the bootloader commands written to a device, so connection wrappers
+// can tell what the device is being asked to do
+type commandTracker struct {
+	command    byte
+	memory     byte
+	rawAddress uint16
+	address    int
+	payload    int // How much of the remaining write is data, not a command
+}
+
+func memoryName(memory byte) string {
+	if name, ok := bootloaderMemoryNames[memory]; ok {
+		return name
+	}
+	return fmt.Sprintf("memory '%c'", memory)
+}
+
+// Track the data written to the device, returning a human readable
+// description of the commands in it
+func (t *commandTracker) track(data []byte) string {
+	meanings := make([]string, 0, 1)
+	for len(data) > 0 {
+		if t.payload > 0 {
+			skip := min(t.payload, len(data))
+			t.payload -= skip
+			data = data[skip:]
+			meanings = append(meanings, fmt.Sprintf("%s data (%d bytes)", memoryName(t.memory), skip))
+			continue
+		}
+		t.command = data[0]
+		t.memory = 0
+		switch t.command {
+		case 'A':
+			if len(data) >= 3 {
+				t.rawAddress = uint16(data[1])<<8 | uint16(data[2])
+				t.address = int(t.rawAddress)
+				meanings = append(meanings, fmt.Sprintf("set address 0x%04x", t.rawAddress))
+				data = data[3:]
+				continue
+			}
+		case 'g', 'B':
+			if len(data) >= 4 {
+				length := blockCommandLength(data[:4])
+				t.memory = data[3]
+				t.address = bootloaderByteAddress(t.rawAddress, t.memory)
+				if t.command == 'B' {
+					t.payload = length
+					meanings = append(meanings, fmt.Sprintf("write %d bytes to %s at 0x%x", length, memoryName(t.memory), t.address))
+				} else {
+					meanings = append(meanings, fmt.Sprintf("read %d bytes of %s at 0x%x", length, memoryName(t.memory), t.address))
+				}
+				data = data[4:]
+				continue
+			}
+		case 'x':
+			if len(data) >= 2 {
+				meanings = append(meanings, fmt.Sprintf("led control 0x%02x", data[1]))
+				data = data[2:]
+				continue
+			}
+		case 'S', 'V', 'r', 'j', 'E':
+			meanings = append(meanings, bootloaderCommandNames[t.command])
+			data = data[1:]
+			continue
+		}
+		// Commands are always written whole, so whatever's left is unknown or arguments
+		if name, ok := bootloaderCommandNames[t.command]; ok {
+			meanings = append(meanings, fmt.Sprintf("%s (incomplete)", name))
+		} else {
+			meanings = append(meanings, fmt.Sprintf("unknown command '%s'", EchoSpaceControls(string(rune(t.command)))))
+		}
+		return strings.Join(meanings, "; ")
+	}
+	return strings.Join(meanings, "; ")
+}
+
+// Describe a response read from the device, based on the last command sent
+func (t *commandTracker) describeResponse(data []byte) string {
+	if t.command == 'g' {
+		return fmt.Sprintf("%s data (%d bytes)", memoryName(t.memory), len(data))
+	}
+	if len(data) == 1 && data[0] == '\r' {
+		return "ok"
+	}
+	if len(data) == 1 && data[0] == '?' {
+		return "unknown command"
+	}
+	for _, r := range string(data) {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return fmt.Sprintf("%d bytes", len(data))
+		}
+	}
+	return fmt.Sprintf("%q", string(data))
+}
+
+// A single write to or read from a device, as saved in a trace. Data is hex.
+// Error is set if the operation failed, in which case Data is what made it
+// through before the failure
+type TraceEntry struct {
+	Time    time.Time
+	Device  string `json:",omitempty"`
+	Op      string
+	Data    string
+	Meaning string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+// A device connection which records everything sent to and received from
+// the device as json lines in the output, along with what it means. Wrap the
+// outermost connection (such as a TimeoutConnection) so failures are
+// recorded too. If several connections share an output, the output must be
+// safe to write from several goroutines
+type TraceConnection struct {
+	conn    io.ReadWriteCloser
+	output  io.Writer
+	device  string
+	tracker commandTracker
+	err     error // The first error writing the trace, if any
+}
+
+// Record all traffic on the connection to the output. The device is stored
+// in each entry so traces of several devices can be told apart
+func NewTraceConnection(conn io.ReadWriteCloser, output io.Writer, device string) *TraceConnection {
+	return &TraceConnection{
+		conn:   conn,
+		output: output,
+		device: device,
+	}
+}
+
+func (c *TraceConnection) record(op string, data []byte, meaning string, err error) {
+	entry := TraceEntry{
+		Time:    time.Now(),
+		Device:  c.device,
+		Op:      op,
+		Data:    hex.EncodeToString(data),
+		Meaning: meaning,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	raw, merr := json.Marshal(entry)
+	if merr != nil {
+		c.err = merr
+		return
+	}
+	// A single write per line, so shared outputs don't interleave entries
+	if _, werr := c.output.Write(append(raw, '\n')); werr != nil && c.err == nil {
+		c.err = werr
+	}
+}
+
+// The first error encountered while writing the trace. Tracing never causes
+// device operations to fail, so check this if the trace matters
+func (c *TraceConnection) TraceError() error {
+	return c.err
+}
+
+func (c *TraceConnection) Write(data []byte) (int, error) {
+	meaning := c.tracker.track(data)
+	n, err := c.conn.Write(data)
+	c.record(TraceWrite, data[:n], meaning, err)
+	return n, err
+}
+
+func (c *TraceConnection) Read(data []byte) (int, error) {
+	n, err := c.conn.Read(data)
+	if n == 0 && err == nil {
+		// Nothing happened, nothing to record
+		return n, err
+	}
+	c.record(TraceRead, data[:n], c.tracker.describeResponse(data[:n]), err)
+	return n, err
+}
+
+func (c *TraceConnection) Close() error {
+	return c.conn.Close()
+}
+
+// Read all entries from a trace written by a TraceConnection
+func ReadTrace(input io.Reader) ([]TraceEntry, error) {
+	result := make([]TraceEntry, 0)
+	scanner := bufio.NewScanner(input)
+	// Full flashcart blocks are 128K of hex
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*FXBlockSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry TraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("bad trace entry on line %d: %w", line, err)
+		}
+		result = append(result, entry)
+	}
+	return result, scanner.Err()
+}
+
+// A fake device which plays back a trace: reads return what the device sent
+// in the trace, and writes must exactly match what was sent to it. Recorded
+// errors are returned at the same point, so a failure captured on one
+// machine can be reproduced anywhere
+type TraceReplay struct {
+	entries []TraceEntry
+	data    [][]byte
+	index   int
+	offset  int   // How much of the current entry has been used
+	failed  error // Once the replay diverges from the trace, everything fails
+	tracker commandTracker
+}
+
+// Create a replay device from the given trace entries, which should all be
+// for the same device
+func NewTraceReplay(entries []TraceEntry) (*TraceReplay, error) {
+	result := TraceReplay{
+		entries: entries,
+		data:    make([][]byte, len(entries)),
+	}
+	for i, entry := range entries {
+		if entry.Op != TraceWrite && entry.Op != TraceRead {
+			return nil, fmt.Errorf("trace entry %d has unknown op '%s'", i, entry.Op)
+		}
+		var err error
+		result.data[i], err = hex.DecodeString(entry.Data)
+		if err != nil {
+			return nil, fmt.Errorf("trace entry %d has bad data: %w", i, err)
+		}
+	}
+	return &result, nil
+}
+
+// Load a trace file and make a replay device from it. If the trace has
+// several devices, only the first one is replayed
+func ConnectTraceReplay(path string) (*TraceReplay, *BasicDeviceInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	entries, err := ReadTrace(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil, fmt.Errorf("trace %s is empty", path)
+	}
+	device := entries[0].Device
+	filtered := make([]TraceEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Device == device {
+			filtered = append(filtered, entry)
+		}
+	}
+	replay, err := NewTraceReplay(filtered)
+	if err != nil {
+		return nil, nil, err
+	}
+	return replay, &BasicDeviceInfo{
+		Port:         TracePortScheme + path,
+		Product:      device,
+		BoardType:    Board_TraceReplay,
+		IsBootloader: true,
+	}, nil
+}
+
+// Whether every entry in the trace has been played back
+func (r *TraceReplay) Finished() bool {
+	return r.index >= len(r.entries)
+}
+
+// Move past the given amount of the current entry
+func (r *TraceReplay) advance(amount int) {
+	r.offset += amount
+	// Entries with errors stay put so the error is returned next
+	if r.offset >= len(r.data[r.index]) && r.entries[r.index].Error == "" {
+		r.index++
+		r.offset = 0
+	}
+}
+
+// The current entry, which must be of the given op. Recorded errors are only
+// returned once all data before them has been used
+func (r *TraceReplay) expect(op string, doing string) (*TraceEntry, []byte, error) {
+	if r.failed != nil {
+		return nil, nil, r.failed
+	}
+	if r.Finished() {
+		r.failed = fmt.Errorf("trace ended, but device was sent %s", doing)
+		return nil, nil, r.failed
+	}
+	entry := &r.entries[r.index]
+	if entry.Op != op {
+		r.failed = fmt.Errorf("trace entry %d expected %s (%s), but device was sent %s",
+			r.index, entry.Op, entry.Meaning, doing)
+		return nil, nil, r.failed
+	}
+	remaining := r.data[r.index][r.offset:]
+	if len(remaining) == 0 && entry.Error != "" {
+		r.index++
+		r.offset = 0
+		return nil, nil, errors.New(entry.Error)
+	}
+	return entry, remaining, nil
+}
+
+func (r *TraceReplay) Write(data []byte) (int, error) {
+	meaning := r.tracker.track(data)
+	written := 0
+	for written < len(data) {
+		entry, expected, err := r.expect(TraceWrite, meaning)
+		if err != nil {
+			return written, err
+		}
+		length := min(len(expected), len(data)-written)
+		for i := 0; i < length; i++ {
+			if expected[i] != data[written+i] {
+				r.failed = fmt.Errorf("write differs from trace entry %d (%s) at byte %d: expected 0x%02x, got 0x%02x",
+					r.index, entry.Meaning, r.offset+i, expected[i], data[written+i])
+				return written, r.failed
+			}
+		}
+		written += length
+		r.advance(length)
+	}
+	return written, nil
+}
+
+func (r *TraceReplay) Read(data []byte) (int, error) {
+	_, available, err := r.expect(TraceRead, "a read")
+	if err != nil {
+		return 0, err
+	}
+	n := copy(data, available)
+	r.advance(n)
+	return n, nil
+}
+
+func (r *TraceReplay) Close() error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package arduboy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Some device operations worth tracing; returns what they read back
+func traceTestOperations(t *testing.T, sercon io.ReadWriteCloser, block []byte) ([]byte, *ExtendedDeviceInfo) {
+	extdata, err := QueryDevice(&BasicDeviceInfo{}, sercon, false)
+	if err != nil {
+		t.Fatalf("Couldn't query device: %s", err)
+	}
+	if _, _, err = WriteFlashcart(sercon, FXBlockSize, block, nil); err != nil {
+		t.Fatalf("Couldn't write flashcart: %s", err)
+	}
+	eeprom, err := ReadEeprom(sercon)
+	if err != nil {
+		t.Fatalf("Couldn't read eeprom: %s", err)
+	}
+	return eeprom, extdata
+}
+
+func recordTestTrace(t *testing.T, block []byte) ([]TraceEntry, []byte) {
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	rand.Read(emu.Eeprom)
+	var output bytes.Buffer
+	conn := NewTraceConnection(emu, &output, "emulated")
+	eeprom, _ := traceTestOperations(t, conn, block)
+	if conn.TraceError() != nil {
+		t.Fatalf("Error writing trace: %s", conn.TraceError())
+	}
+	entries, err := ReadTrace(&output)
+	if err != nil {
+		t.Fatalf("Couldn't read trace: %s", err)
+	}
+	return entries, eeprom
+}
+
+func TestTraceConnection_Record(t *testing.T) {
+	block := make([]byte, FXBlockSize)
+	rand.Read(block)
+	entries, _ := recordTestTrace(t, block)
+	meanings := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Device != "emulated" {
+			t.Fatalf("Wrong device in trace entry: %s", entry.Device)
+		}
+		meanings = append(meanings, entry.Op+": "+entry.Meaning)
+	}
+	all := strings.Join(meanings, "\n")
+	expected := []string{
+		"write: jedec id",
+		"write: set address 0x0100",
+		"write: write 65536 bytes to flashcart at 0x10000",
+		"write: flashcart data (65536 bytes)",
+		"write: read 1024 bytes of eeprom at 0x0",
+		"read: eeprom data (1024 bytes)",
+		"read: ok",
+	}
+	for _, e := range expected {
+		if !strings.Contains(all, e) {
+			t.Fatalf("Trace missing '%s':\n%s", e, all)
+		}
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	block := make([]byte, FXBlockSize)
+	rand.Read(block)
+	entries, eeprom := recordTestTrace(t, block)
+
+	replay, err := NewTraceReplay(entries)
+	if err != nil {
+		t.Fatalf("Couldn't create replay: %s", err)
+	}
+	replayEeprom, extdata := traceTestOperations(t, replay, block)
+	if !bytes.Equal(eeprom, replayEeprom) {
+		t.Fatalf("Replayed eeprom doesn't match")
+	}
+	if extdata.Jedec == nil || extdata.Jedec.Capacity != 1<<20 {
+		t.Fatalf("Replayed device info wrong: %v", extdata)
+	}
+	if !replay.Finished() {
+		t.Fatalf("Replay should be finished")
+	}
+
+	// Writing something different than what was traced should fail
+	replay, err = NewTraceReplay(entries)
+	if err != nil {
+		t.Fatalf("Couldn't create replay: %s", err)
+	}
+	if _, err = QueryDevice(&BasicDeviceInfo{}, replay, false); err != nil {
+		t.Fatalf("Couldn't query replay: %s", err)
+	}
+	block[1000]++
+	_, _, err = WriteFlashcart(replay, FXBlockSize, block, nil)
+	if err == nil || !strings.Contains(err.Error(), "byte 1000") {
+		t.Fatalf("Expected write to differ at byte 1000, got %v", err)
+	}
+}
+
+func TestTraceReplay_Error(t *testing.T) {
+	// Record a device that stops responding partway through
+	var output bytes.Buffer
+	device := stallingDevice{stallOn: 'g'}
+	timeout := NewTimeoutConnection(context.Background(), &device, 200*time.Millisecond)
+	_, originalErr := ReadEeprom(NewTraceConnection(timeout, &output, ""))
+	if originalErr == nil {
+		t.Fatalf("Expected original read to fail")
+	}
+
+	// Save it to a file to replay through the normal connect
+	path, err := newRandomFilepath("trace.jsonl")
+	if err != nil {
+		t.Fatalf("Couldn't make trace path: %s", err)
+	}
+	if err = os.WriteFile(path, output.Bytes(), 0660); err != nil {
+		t.Fatalf("Couldn't write trace: %s", err)
+	}
+	sercon, info, err := ConnectWithBootloader(TracePortScheme + path)
+	if err != nil {
+		t.Fatalf("Couldn't connect to trace: %s", err)
+	}
+	if info.BoardType != Board_TraceReplay {
+		t.Fatalf("Wrong board type for replay: %s", info.BoardType)
+	}
+	_, err = ReadEeprom(sercon)
+	if err == nil || err.Error() != originalErr.Error() {
+		t.Fatalf("Expected replayed error '%s', got %v", originalErr, err)
+	}
+}
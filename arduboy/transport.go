@@ -0,0 +1,343 @@
+package arduboy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TCPPortScheme     = "tcp://"
+	RFC2217PortScheme = "rfc2217://"
+
+	Board_Network = "Network Device"
+
+	// How long to wait for an RFC2217 server to answer a control command. A
+	// reset has to wait for the device to come back as a bootloader
+	RFC2217CommandTimeout = 10 * time.Second
+)
+
+// Telnet and RFC2217 protocol bytes
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetComPortOption = 44
+	rfc2217SetBaudRate  = 1
+	rfc2217ServerOffset = 100 // Server responses are the client command + 100
+)
+
+// Connects to a device given everything in the port after the scheme. The
+// connection must already be talking to the bootloader
+type TransportFunc func(address string) (io.ReadWriteCloser, *BasicDeviceInfo, error)
+
+var (
+	transports = map[string]TransportFunc{
+		EmulatedPortScheme: func(address string) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+			return ConnectEmulated(address)
+		},
+		TracePortScheme: func(address string) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+			return ConnectTraceReplay(address)
+		},
+		TCPPortScheme:     ConnectTCP,
+		RFC2217PortScheme: ConnectRFC2217,
+	}
+	transportsLock sync.Mutex
+)
+
+// Add a way of reaching devices. Ports given to ConnectWithBootloader which
+// start with the scheme (such as "tcp://") are handed to the transport
+func RegisterTransport(scheme string, connect TransportFunc) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	transports[scheme] = connect
+}
+
+// Find the transport for the port, returning it along with the address after
+// the scheme. Returns nil for plain serial ports
+func findTransport(port string) (TransportFunc, string) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	for scheme, connect := range transports {
+		if strings.HasPrefix(port, scheme) {
+			return connect, strings.TrimPrefix(port, scheme)
+		}
+	}
+	return nil, ""
+}
+
+// A network connection which acts like a serial port: reads can be given a
+// timeout, after which they return nothing instead of an error
+type tcpConnection struct {
+	net.Conn
+	readTimeout time.Duration
+}
+
+func (c *tcpConnection) SetReadTimeout(timeout time.Duration) error {
+	c.readTimeout = timeout
+	return nil
+}
+
+func (c *tcpConnection) Read(data []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	} else if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(data)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, err
+}
+
+func networkDevice(port string) *BasicDeviceInfo {
+	return &BasicDeviceInfo{
+		Port:         port,
+		BoardType:    Board_Network,
+		IsBootloader: true,
+	}
+}
+
+// Connect to a device shared over a raw TCP socket (such as with
+// DeviceServer). Everything sent is passed straight to the bootloader, so the
+// server must already have the device in bootloader mode
+func ConnectTCP(address string) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tcpConnection{Conn: conn}, networkDevice(TCPPortScheme + address), nil
+}
+
+// Telnet encoding for RFC2217, used by both the client and server. Data bytes
+// of 0xFF are doubled, everything else is commands
+type telnetConn struct {
+	conn      io.ReadWriter
+	writeLock sync.Mutex
+	pending   []byte // Decoded data not yet read
+	raw       []byte
+
+	// Parser state, kept between reads since commands can be split
+	state   int
+	verb    byte
+	command []byte
+
+	// Called for each COM-PORT-OPTION subnegotiation, with the command byte first
+	onComPort func([]byte)
+	// Called for WILL/WONT/DO/DONT
+	onOption func(verb byte, option byte)
+}
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+func newTelnetConn(conn io.ReadWriter) *telnetConn {
+	return &telnetConn{conn: conn, raw: make([]byte, 4096)}
+}
+
+// Read one chunk from the connection and decode it. Returns nothing (not an
+// error) if the underlying read timed out
+func (t *telnetConn) readSome() error {
+	n, err := t.conn.Read(t.raw)
+	for _, b := range t.raw[:n] {
+		t.parse(b)
+	}
+	return err
+}
+
+func (t *telnetConn) parse(b byte) {
+	switch t.state {
+	case telnetStateData:
+		if b == telnetIAC {
+			t.state = telnetStateIAC
+		} else {
+			t.pending = append(t.pending, b)
+		}
+	case telnetStateIAC:
+		switch b {
+		case telnetIAC:
+			t.pending = append(t.pending, b)
+			t.state = telnetStateData
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			t.verb = b
+			t.state = telnetStateOption
+		case telnetSB:
+			t.command = t.command[:0]
+			t.state = telnetStateSB
+		default:
+			// Some other telnet command we don't care about
+			t.state = telnetStateData
+		}
+	case telnetStateOption:
+		if t.onOption != nil {
+			t.onOption(t.verb, b)
+		}
+		t.state = telnetStateData
+	case telnetStateSB:
+		if b == telnetIAC {
+			t.state = telnetStateSBIAC
+		} else {
+			t.command = append(t.command, b)
+		}
+	case telnetStateSBIAC:
+		if b == telnetIAC {
+			t.command = append(t.command, b)
+			t.state = telnetStateSB
+		} else {
+			// Should be SE. Either way, the subnegotiation is over
+			if len(t.command) > 1 && t.command[0] == telnetComPortOption && t.onComPort != nil {
+				t.onComPort(t.command[1:])
+			}
+			t.state = telnetStateData
+		}
+	}
+}
+
+func (t *telnetConn) Read(data []byte) (int, error) {
+	if len(t.pending) == 0 {
+		// This may be nothing if the read timed out, like a serial port
+		err := t.readSome()
+		if len(t.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(data, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+func telnetEscape(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	for _, b := range data {
+		result = append(result, b)
+		if b == telnetIAC {
+			result = append(result, telnetIAC)
+		}
+	}
+	return result
+}
+
+func (t *telnetConn) writeRaw(data []byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	_, err := t.conn.Write(data)
+	return err
+}
+
+func (t *telnetConn) Write(data []byte) (int, error) {
+	if err := t.writeRaw(telnetEscape(data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (t *telnetConn) sendOption(verb byte, option byte) error {
+	return t.writeRaw([]byte{telnetIAC, verb, option})
+}
+
+func (t *telnetConn) sendComPort(command byte, value []byte) error {
+	message := []byte{telnetIAC, telnetSB, telnetComPortOption, command}
+	message = append(message, telnetEscape(value)...)
+	message = append(message, telnetIAC, telnetSE)
+	return t.writeRaw(message)
+}
+
+// An RFC2217 client connection. Data goes to the device, control commands
+// (like the baud rate) are sent as telnet subnegotiations
+type rfc2217Client struct {
+	*telnetConn
+	tcp      *tcpConnection
+	baudRate uint32 // Last baud rate confirmed by the server
+}
+
+func (c *rfc2217Client) SetReadTimeout(timeout time.Duration) error {
+	return c.tcp.SetReadTimeout(timeout)
+}
+
+func (c *rfc2217Client) Close() error {
+	return c.tcp.Close()
+}
+
+// Set the baud rate and wait for the server to confirm it
+func (c *rfc2217Client) setBaudRate(rate uint32) error {
+	var value [4]byte
+	binary.BigEndian.PutUint32(value[:], rate)
+	c.baudRate = 0
+	if err := c.sendComPort(rfc2217SetBaudRate, value[:]); err != nil {
+		return err
+	}
+	c.tcp.SetReadTimeout(TimeoutPollInterval)
+	defer c.tcp.SetReadTimeout(0)
+	start := time.Now()
+	for c.baudRate != rate {
+		if time.Since(start) > RFC2217CommandTimeout {
+			return fmt.Errorf("rfc2217 server didn't confirm baud rate %d", rate)
+		}
+		if err := c.readSome(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect to a device shared with RFC2217 (such as with DeviceServer or
+// ser2net). The device is reset into its bootloader the same way as a local
+// serial port: by briefly asking for a 1200 baud connection
+func ConnectRFC2217(address string) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := rfc2217Client{
+		telnetConn: newTelnetConn(nil),
+		tcp:        &tcpConnection{Conn: conn},
+	}
+	client.conn = client.tcp
+	client.onComPort = func(command []byte) {
+		if command[0] == rfc2217ServerOffset+rfc2217SetBaudRate && len(command) >= 5 {
+			client.baudRate = binary.BigEndian.Uint32(command[1:5])
+		}
+	}
+	client.onOption = func(verb byte, option byte) {
+		// We only want the com port option; refuse anything else the server offers
+		if option != telnetComPortOption {
+			if verb == telnetWILL {
+				client.sendOption(telnetDONT, option)
+			} else if verb == telnetDO {
+				client.sendOption(telnetWONT, option)
+			}
+		}
+	}
+	if err = client.sendOption(telnetWILL, telnetComPortOption); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err = client.setBaudRate(uint32(RebootBaudRate)); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("couldn't reset device: %w", err)
+	}
+	if err = client.setBaudRate(uint32(DefaultBaudRate)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return &client, networkDevice(RFC2217PortScheme + address), nil
+}
@@ -0,0 +1,135 @@
+package arduboy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Serve an emulated device saved in a fresh directory on a loopback port.
+// Returns the address and a function giving how many times the device was connected
+func newTestDeviceServer(t *testing.T) (string, func() int) {
+	dir, err := newRandomFilepath("served")
+	if err != nil {
+		t.Fatalf("Couldn't make emulator path: %s", err)
+	}
+	emu := newTestEmulator(t, ArduboyFXDeviceKey, 1<<20)
+	if err = emu.SaveDirectory(dir); err != nil {
+		t.Fatalf("Couldn't save emulator: %s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s", err)
+	}
+	var lock sync.Mutex
+	connects := 0
+	server := DeviceServer{
+		Port: EmulatedPortScheme + dir,
+		Connect: func(port string) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+			lock.Lock()
+			connects++
+			lock.Unlock()
+			return ConnectWithBootloader(port)
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.Serve(ctx, listener)
+	return listener.Addr().String(), func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return connects
+	}
+}
+
+func TestDeviceServer(t *testing.T) {
+	address, connects := newTestDeviceServer(t)
+	eeprom := make([]byte, EepromSize)
+	rand.Read(eeprom)
+	// Lots of 0xFF, which RFC2217 has to escape
+	block := MakePadding(FXBlockSize)
+	rand.Read(block[:1000])
+
+	// Raw tcp first: write some stuff
+	sercon, device, err := ConnectWithBootloader(TCPPortScheme + address)
+	if err != nil {
+		t.Fatalf("Couldn't connect over tcp: %s", err)
+	}
+	if device.BoardType != Board_Network || device.Port != TCPPortScheme+address {
+		t.Fatalf("Wrong device info for tcp: %v", device)
+	}
+	extdata, err := QueryDevice(device, sercon, false)
+	if err != nil {
+		t.Fatalf("Couldn't query over tcp: %s", err)
+	}
+	if extdata.Bootloader.Device != ArduboyFXDeviceKey || extdata.Jedec.Capacity != 1<<20 {
+		t.Fatalf("Wrong device over tcp: %v", extdata)
+	}
+	if err = WriteEeprom(sercon, eeprom); err != nil {
+		t.Fatalf("Couldn't write eeprom over tcp: %s", err)
+	}
+	if _, _, err = WriteFlashcart(sercon, FXBlockSize, block, nil); err != nil {
+		t.Fatalf("Couldn't write flashcart over tcp: %s", err)
+	}
+	sercon.Close()
+
+	// Now read it back with rfc2217 (which is a new session, so it had to be saved)
+	sercon, _, err = ConnectWithBootloader(RFC2217PortScheme + address)
+	if err != nil {
+		t.Fatalf("Couldn't connect over rfc2217: %s", err)
+	}
+	defer sercon.Close()
+	readEeprom, err := ReadEeprom(sercon)
+	if err != nil {
+		t.Fatalf("Couldn't read eeprom over rfc2217: %s", err)
+	}
+	if !bytes.Equal(eeprom, readEeprom) {
+		t.Fatalf("Eeprom doesn't match over rfc2217")
+	}
+	readBlock, err := ReadFlashcart(sercon, FXBlockSize, FXBlockSize)
+	if err != nil {
+		t.Fatalf("Couldn't read flashcart over rfc2217: %s", err)
+	}
+	if !bytes.Equal(block, readBlock) {
+		t.Fatalf("Flashcart doesn't match over rfc2217")
+	}
+	// Write through rfc2217 too, since the escaping goes both ways
+	rand.Read(block[1000:2000])
+	if _, _, err = WriteFlashcart(sercon, 0, block, nil); err != nil {
+		t.Fatalf("Couldn't write flashcart over rfc2217: %s", err)
+	}
+	readBlock, err = ReadFlashcart(sercon, 0, FXBlockSize)
+	if err != nil {
+		t.Fatalf("Couldn't read flashcart over rfc2217: %s", err)
+	}
+	if !bytes.Equal(block, readBlock) {
+		t.Fatalf("Flashcart written over rfc2217 doesn't match")
+	}
+	// One connect for tcp, one for the rfc2217 reset
+	if connects() != 2 {
+		t.Fatalf("Expected 2 device connections, got %d", connects())
+	}
+}
+
+func TestRegisterTransport(t *testing.T) {
+	emu := newTestEmulator(t, ArduboyDeviceKey, 0)
+	RegisterTransport("test://", func(address string) (io.ReadWriteCloser, *BasicDeviceInfo, error) {
+		return emu, &BasicDeviceInfo{Port: "test://" + address, IsBootloader: true}, nil
+	})
+	defer func() {
+		transportsLock.Lock()
+		delete(transports, "test://")
+		transportsLock.Unlock()
+	}()
+	sercon, device, err := ConnectWithBootloader("test://thing")
+	if err != nil {
+		t.Fatalf("Couldn't connect with registered transport: %s", err)
+	}
+	if sercon != emu || device.Port != "test://thing" {
+		t.Fatalf("Registered transport not used")
+	}
+}
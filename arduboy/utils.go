@@ -106,6 +106,13 @@ func SetRgbButtonState(sercon io.ReadWriter, state uint8) error {
 	rwep := ReadWriteErrorPass{rw: sercon}
 	rwep.WritePass(RgbButtonCommand(state))
 	rwep.ReadPass(sb[:])
+	// Caterina has no LED control: it answers '?' to the 'x', then runs the
+	// state byte as a command of its own. The states sent are 0 or have
+	// LEDCtrlBtnOff set, so that's never a real command and is just another
+	// '?'. Read it too, or every later response would be off by one
+	if rwep.err == nil && sb[0] == '?' {
+		rwep.ReadPass(sb[:])
+	}
 	return rwep.err
 }
 
@@ -0,0 +1,233 @@
+package arduboy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	VaultFolder      = "vault"
+	VaultEnvironVar  = "ARDUGOTOOLS_VAULT"
+	vaultEepromExt   = ".bin"
+	vaultMetadataExt = ".json"
+)
+
+// Information about one eeprom snapshot in the vault. There's only ever one
+// snapshot per sketch: the latest
+type VaultEntry struct {
+	SketchMD5 string    // Hash of the trimmed sketch that was using this eeprom
+	EepromMD5 string    // Hash of the eeprom itself
+	Device    string    // Where the snapshot was taken from (just for information)
+	Timestamp time.Time // When the snapshot was taken
+}
+
+// A folder of eeprom snapshots, keyed by the hash of the sketch which owned
+// them. Non-FX games all share the same eeprom, so writing a new sketch tends
+// to destroy the saves of the old one; the vault keeps them around
+type EepromVault struct {
+	Directory string
+}
+
+// Where the vault is unless the environment says otherwise: next to the config
+// file (such as ~/.config/ardugotools/vault)
+func DefaultVaultPath() (string, error) {
+	if path := os.Getenv(VaultEnvironVar); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ConfigFolder, VaultFolder), nil
+}
+
+// The hash used to identify a sketch in the vault. This is the same as the
+// md5 of ReadSketch with trim on, but also works on sketches fresh out of a
+// hex file (which may not be page aligned)
+func SketchMD5(sketch []byte) string {
+	aligned := AlignData(append([]byte{}, sketch...), FlashPageSize)
+	return Md5String(TrimUnused(aligned, FlashPageSize))
+}
+
+// Sketch hashes become filenames, so make sure they really are just hashes
+func validateSketchMD5(sketchMD5 string) error {
+	raw, err := hex.DecodeString(sketchMD5)
+	if err != nil || len(raw) != 16 {
+		return fmt.Errorf("Invalid sketch hash '%s': must be a 32 character md5", sketchMD5)
+	}
+	return nil
+}
+
+func (v *EepromVault) path(sketchMD5 string, ext string) string {
+	return filepath.Join(v.Directory, strings.ToLower(sketchMD5)+ext)
+}
+
+// Saves to the same sketch (such as from sketch write --all) have to take
+// turns, or the eeprom and metadata could come from different saves
+var vaultLocks sync.Map
+
+func (v *EepromVault) lock(sketchMD5 string) *sync.Mutex {
+	lock, _ := vaultLocks.LoadOrStore(v.path(sketchMD5, ""), &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// Write the file all at once, so a crash never leaves half a snapshot. The
+// temporary file is unique, so writers never trip over each other's
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // Fails harmlessly after the rename
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Chmod(0644)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// Store the eeprom as the save for the given sketch, replacing any older one
+func (v *EepromVault) Save(sketchMD5 string, device string, eeprom []byte) (*VaultEntry, error) {
+	if err := validateSketchMD5(sketchMD5); err != nil {
+		return nil, err
+	}
+	if len(eeprom) != EepromSize {
+		return nil, fmt.Errorf("Wrong data size for eeprom! Expect: %d, got: %d", EepromSize, len(eeprom))
+	}
+	if err := os.MkdirAll(v.Directory, 0755); err != nil {
+		return nil, err
+	}
+	entry := VaultEntry{
+		SketchMD5: strings.ToLower(sketchMD5),
+		EepromMD5: Md5String(eeprom),
+		Device:    device,
+		Timestamp: time.Now(),
+	}
+	metadata, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	lock := v.lock(sketchMD5)
+	lock.Lock()
+	defer lock.Unlock()
+	if err = writeFileAtomic(v.path(sketchMD5, vaultEepromExt), eeprom); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(v.path(sketchMD5, vaultMetadataExt), metadata); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Get the save for the given sketch. If there isn't one, the error wraps
+// os.ErrNotExist
+func (v *EepromVault) Load(sketchMD5 string) (*VaultEntry, []byte, error) {
+	if err := validateSketchMD5(sketchMD5); err != nil {
+		return nil, nil, err
+	}
+	lock := v.lock(sketchMD5)
+	lock.Lock()
+	defer lock.Unlock()
+	metadata, err := os.ReadFile(v.path(sketchMD5, vaultMetadataExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry VaultEntry
+	if err = json.Unmarshal(metadata, &entry); err != nil {
+		return nil, nil, fmt.Errorf("Corrupt vault entry %s: %s", sketchMD5, err)
+	}
+	eeprom, err := os.ReadFile(v.path(sketchMD5, vaultEepromExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	if Md5String(eeprom) != entry.EepromMD5 {
+		return nil, nil, fmt.Errorf("Vault eeprom for %s doesn't match its hash; it may be corrupt", sketchMD5)
+	}
+	return &entry, eeprom, nil
+}
+
+// All saves in the vault, newest first. An empty or missing vault just has no entries
+func (v *EepromVault) List() ([]VaultEntry, error) {
+	files, err := os.ReadDir(v.Directory)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []VaultEntry{}, nil
+		}
+		return nil, err
+	}
+	result := make([]VaultEntry, 0)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), vaultMetadataExt) {
+			continue
+		}
+		metadata, err := os.ReadFile(filepath.Join(v.Directory, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var entry VaultEntry
+		if err = json.Unmarshal(metadata, &entry); err != nil {
+			return nil, fmt.Errorf("Corrupt vault entry %s: %s", f.Name(), err)
+		}
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Timestamp.After(result[j].Timestamp)
+	})
+	return result, nil
+}
+
+// Find the full sketch hash from the start of one, like git does with commits.
+// It must match exactly one save
+func (v *EepromVault) Resolve(prefix string) (string, error) {
+	entries, err := v.List()
+	if err != nil {
+		return "", err
+	}
+	prefix = strings.ToLower(prefix)
+	matches := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.SketchMD5, prefix) {
+			matches = append(matches, entry.SketchMD5)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("No save in vault for sketch '%s': %w", prefix, os.ErrNotExist)
+	} else if len(matches) > 1 {
+		return "", fmt.Errorf("Sketch '%s' is ambiguous, matches: %s", prefix, strings.Join(matches, ","))
+	}
+	return matches[0], nil
+}
+
+// Write the save for the given sketch out as a plain eeprom dump
+func (v *EepromVault) Export(sketchMD5 string, writer io.Writer) (*VaultEntry, error) {
+	entry, eeprom, err := v.Load(sketchMD5)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(eeprom)
+	return entry, err
+}
+
+// Read a plain eeprom dump into the vault as the save for the given sketch
+func (v *EepromVault) Import(sketchMD5 string, device string, reader io.Reader) (*VaultEntry, error) {
+	eeprom, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return v.Save(sketchMD5, device, eeprom)
+}
@@ -0,0 +1,144 @@
+package arduboy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestVault(t *testing.T) *EepromVault {
+	dir, err := newRandomFilepath("vault")
+	if err != nil {
+		t.Fatalf("Couldn't make vault path: %s", err)
+	}
+	return &EepromVault{Directory: dir}
+}
+
+func TestSketchMD5(t *testing.T) {
+	// The hash of a sketch straight from hex should match what's read back from the device
+	file, err := os.Open(fileTestPath("qr-generator.hex"))
+	if err != nil {
+		t.Fatalf("Couldn't open hex: %s", err)
+	}
+	defer file.Close()
+	hexdata, err := HexToBin(file)
+	if err != nil {
+		t.Fatalf("Couldn't convert hex: %s", err)
+	}
+	file.Seek(0, 0)
+	emu := newTestEmulator(t, ArduboyDeviceKey, 0)
+	if _, _, err = WriteHex(emu, file, true, nil); err != nil {
+		t.Fatalf("Couldn't write hex: %s", err)
+	}
+	sketch, err := ReadSketch(emu, true)
+	if err != nil {
+		t.Fatalf("Couldn't read sketch: %s", err)
+	}
+	if SketchMD5(hexdata) != Md5String(sketch) {
+		t.Fatalf("Sketch hash from hex doesn't match device: %s vs %s", SketchMD5(hexdata), Md5String(sketch))
+	}
+}
+
+func TestEepromVault(t *testing.T) {
+	vault := newTestVault(t)
+	entries, err := vault.List()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Expected empty vault, got %v (%v)", entries, err)
+	}
+	eeprom := make([]byte, EepromSize)
+	rand.Read(eeprom)
+	sketchA := Md5String([]byte("a"))
+	sketchB := Md5String([]byte("b"))
+	if _, err = vault.Save(sketchA, "test", eeprom); err != nil {
+		t.Fatalf("Couldn't save: %s", err)
+	}
+	if _, err = vault.Save(sketchB, "test", MakePadding(EepromSize)); err != nil {
+		t.Fatalf("Couldn't save: %s", err)
+	}
+	entry, loaded, err := vault.Load(sketchA)
+	if err != nil {
+		t.Fatalf("Couldn't load: %s", err)
+	}
+	if !bytes.Equal(loaded, eeprom) || entry.SketchMD5 != sketchA || entry.Device != "test" {
+		t.Fatalf("Loaded wrong save: %v", entry)
+	}
+	if _, _, err = vault.Load(Md5String([]byte("c"))); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected not exist for missing save, got %v", err)
+	}
+	entries, err = vault.List()
+	if err != nil || len(entries) != 2 || entries[0].SketchMD5 != sketchB {
+		t.Fatalf("Expected 2 entries, newest first: %v (%v)", entries, err)
+	}
+	// Hashes are filenames, so they must be checked
+	if _, err = vault.Save("../../escape", "test", eeprom); err == nil {
+		t.Fatalf("Expected error for bad sketch hash")
+	}
+	if _, err = vault.Save(sketchA, "test", eeprom[:10]); err == nil {
+		t.Fatalf("Expected error for bad eeprom size")
+	}
+}
+
+func TestEepromVault_Concurrent(t *testing.T) {
+	dir, err := newRandomFilepath("vault_concurrent")
+	if err != nil {
+		t.Fatalf("Couldn't make vault path: %s", err)
+	}
+	sketch := Md5String([]byte("a"))
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			// Each write gets its own vault, like each device in sketch write --all
+			_, err := (&EepromVault{Directory: dir}).Save(sketch, "test", bytes.Repeat([]byte{byte(i)}, EepromSize))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Couldn't save: %s", err)
+		}
+	}
+	if _, _, err = (&EepromVault{Directory: dir}).Load(sketch); err != nil {
+		t.Fatalf("Couldn't load after concurrent saves: %s", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Couldn't read vault: %s", err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			t.Fatalf("Temporary file left in vault: %s", f.Name())
+		}
+	}
+}
+
+func TestEepromVault_ExportImport(t *testing.T) {
+	vault := newTestVault(t)
+	eeprom := make([]byte, EepromSize)
+	rand.Read(eeprom)
+	sketch := Md5String([]byte("sketch"))
+	if _, err := vault.Import(sketch, "file", bytes.NewReader(eeprom)); err != nil {
+		t.Fatalf("Couldn't import: %s", err)
+	}
+	full, err := vault.Resolve(sketch[:6])
+	if err != nil || full != sketch {
+		t.Fatalf("Couldn't resolve prefix: %s (%v)", full, err)
+	}
+	if _, err = vault.Resolve("zzz"); err == nil {
+		t.Fatalf("Expected error resolving unknown prefix")
+	}
+	var output bytes.Buffer
+	if _, err = vault.Export(sketch, &output); err != nil {
+		t.Fatalf("Couldn't export: %s", err)
+	}
+	if !bytes.Equal(output.Bytes(), eeprom) {
+		t.Fatalf("Exported eeprom doesn't match")
+	}
+	// A corrupted save shouldn't be restored
+	os.WriteFile(vault.path(sketch, vaultEepromExt), MakePadding(EepromSize), 0644)
+	if _, _, err = vault.Load(sketch); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("Expected corrupt error, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package arduboy
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	DeviceEventAttach     = "attach"
+	DeviceEventDetach     = "detach"
+	DeviceEventBootloader = "bootloader"
+)
+
+// A single change in the set of connected devices. Bootloader events are
+// sent right after the attach event of any device which showed up in
+// bootloader mode, and are the only events which can have a Query result
+type DeviceEvent struct {
+	Event  string
+	Time   time.Time
+	Device BasicDeviceInfo
+	Query  *ExtendedDeviceInfo `json:",omitempty"`
+	Error  string              `json:",omitempty"` // Set if the query failed
+}
+
+// Devices are tracked by port AND vid/pid, since resetting into the bootloader
+// can leave a device on the same port but with a different identity
+func deviceWatchKey(device *BasicDeviceInfo) string {
+	return device.Port + "|" + device.VidPid
+}
+
+// Compute the events required to go from the 'previous' set of devices to
+// the 'current' set. Detaches come first, then attaches (with their bootloader
+// events) in the order the devices were found. Query results are not filled in
+func DiffBasicDevices(previous []BasicDeviceInfo, current []BasicDeviceInfo, now time.Time) []DeviceEvent {
+	result := make([]DeviceEvent, 0)
+	currentKeys := make(map[string]bool)
+	for i := range current {
+		currentKeys[deviceWatchKey(&current[i])] = true
+	}
+	previousKeys := make(map[string]bool)
+	for i := range previous {
+		key := deviceWatchKey(&previous[i])
+		previousKeys[key] = true
+		if !currentKeys[key] {
+			result = append(result, DeviceEvent{Event: DeviceEventDetach, Time: now, Device: previous[i]})
+		}
+	}
+	for i := range current {
+		if previousKeys[deviceWatchKey(&current[i])] {
+			continue
+		}
+		result = append(result, DeviceEvent{Event: DeviceEventAttach, Time: now, Device: current[i]})
+		if current[i].IsBootloader {
+			result = append(result, DeviceEvent{Event: DeviceEventBootloader, Time: now, Device: current[i]})
+		}
+	}
+	return result
+}
+
+// Connect to a device which just entered the bootloader and pull the extended
+// information. Failures are stored in the event rather than returned, since a
+// device disappearing (or stalling) mid-query shouldn't stop the watch
+func queryDeviceEvent(ctx context.Context, event *DeviceEvent, timeout time.Duration) {
+	sercon, device, err := ConnectWithBootloaderContext(ctx, event.Device.Port, timeout)
+	if err != nil {
+		event.Error = err.Error()
+		return
+	}
+	defer sercon.Close()
+	event.Query, err = QueryDevice(device, sercon, false)
+	if err != nil {
+		event.Error = err.Error()
+	}
+}
+
+// Watch for devices being connected, disconnected, or entering the bootloader,
+// calling handler for each event. Devices already connected when the watch
+// starts generate events immediately. If query is set, bootloader events come
+// with the full QueryDevice result (which means connecting to the device);
+// a device which stops responding for the timeout (0 for none) gives up.
+// Runs until the context is done (returning its error), or the handler or
+// the device scan returns an error, which is then returned
+func WatchDevices(ctx context.Context, interval time.Duration, query bool, timeout time.Duration, handler func(*DeviceEvent) error) error {
+	previous := make([]BasicDeviceInfo, 0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		current, err := getBasicDevices(false)
+		if err != nil {
+			return err
+		}
+		events := DiffBasicDevices(previous, current, time.Now())
+		for i := range events {
+			if query && events[i].Event == DeviceEventBootloader {
+				queryDeviceEvent(ctx, &events[i], timeout)
+			}
+			err = handler(&events[i])
+			if err != nil {
+				return err
+			}
+		}
+		previous = current
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
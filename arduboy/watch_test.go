@@ -0,0 +1,61 @@
+package arduboy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDiffBasicDevices(t *testing.T) {
+	now := time.Now()
+	normal := BasicDeviceInfo{Port: "/dev/ttyACM0", VidPid: VidPidString("2341", "8036"), BoardType: Board_ArduboyLeonardo}
+	bootloader := BasicDeviceInfo{Port: "/dev/ttyACM0", VidPid: VidPidString("2341", "0036"), BoardType: Board_ArduboyLeonardo, IsBootloader: true}
+	other := BasicDeviceInfo{Port: "/dev/ttyACM1", VidPid: VidPidString("2341", "8036"), BoardType: Board_ArduboyLeonardo}
+
+	check := func(previous []BasicDeviceInfo, current []BasicDeviceInfo, expected []string) {
+		events := DiffBasicDevices(previous, current, now)
+		if len(events) != len(expected) {
+			t.Fatalf("Expected %d events, got %d: %v", len(expected), len(events), events)
+		}
+		for i, e := range events {
+			if e.Event != expected[i] {
+				t.Fatalf("Expected event %d to be %s, got %s", i, expected[i], e.Event)
+			}
+			if !e.Time.Equal(now) {
+				t.Fatalf("Event %d has the wrong time", i)
+			}
+		}
+	}
+
+	check(nil, nil, []string{})
+	check(nil, []BasicDeviceInfo{normal}, []string{DeviceEventAttach})
+	check([]BasicDeviceInfo{normal}, []BasicDeviceInfo{normal}, []string{})
+	check([]BasicDeviceInfo{normal}, nil, []string{DeviceEventDetach})
+	// Resetting into the bootloader keeps the port but changes the vid/pid
+	check([]BasicDeviceInfo{normal}, []BasicDeviceInfo{bootloader},
+		[]string{DeviceEventDetach, DeviceEventAttach, DeviceEventBootloader})
+	check([]BasicDeviceInfo{normal}, []BasicDeviceInfo{normal, other}, []string{DeviceEventAttach})
+
+	events := DiffBasicDevices([]BasicDeviceInfo{normal, other}, []BasicDeviceInfo{bootloader}, now)
+	if events[0].Device != normal || events[1].Device != other || events[2].Device != bootloader {
+		t.Fatalf("Events have the wrong devices: %v", events)
+	}
+}
+
+func TestWatchDevices_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- WatchDevices(ctx, time.Hour, false, time.Second, func(*DeviceEvent) error { return nil })
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected the watch to stop with context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Watch didn't stop when the context was cancelled")
+	}
+}
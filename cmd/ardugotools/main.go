@@ -1,11 +1,20 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -26,9 +35,13 @@ func fatalIfErr(subject string, doing string, err error) {
 	}
 }
 
+// Cancelled when the user interrupts the program, so device operations stop cleanly
+var cliContext = context.Background()
+
 func connectWithBootloader(device string) (io.ReadWriteCloser, *arduboy.BasicDeviceInfo) {
-	sercon, d, err := arduboy.ConnectWithBootloader(device)
+	sercon, d, err := arduboy.ConnectWithBootloaderContext(cliContext, device, cli.Timeout)
 	fatalIfErr(device, "connect", err)
+	sercon = traceConnection(sercon, d)
 	log.Printf("Initial contact with %s, set to bootloader mode\n", d.SmallString())
 	return sercon, d
 }
@@ -57,6 +70,65 @@ func forceCreate(fp string) *os.File {
 	return f
 }
 
+// The outcome of running a command on one device out of many
+type deviceResult struct {
+	Port    string
+	Device  string
+	Success bool
+	Error   string                 `json:",omitempty"`
+	Result  map[string]interface{} `json:",omitempty"`
+}
+
+// Force every connected device into the bootloader, then run the given work on
+// all of them at once. Prints a summary of the results for each device, and
+// exits with an error if any of them failed
+func runOnAllDevices(doing string, work func(io.ReadWriteCloser, *arduboy.BasicDeviceInfo) (map[string]interface{}, error)) {
+	devices, err := arduboy.ResetAllToBootloader()
+	fatalIfErr("all", "find devices", err)
+	if len(devices) == 0 {
+		log.Fatalf("No devices found!")
+	}
+	log.Printf("Attempting to %s on %d devices\n", doing, len(devices))
+	results := make([]deviceResult, len(devices))
+	var wg sync.WaitGroup
+	for i := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Port = devices[i].Port
+			sercon, d, err := arduboy.ConnectWithBootloaderContext(cliContext, devices[i].Port, cli.Timeout)
+			if err == nil {
+				sercon = traceConnection(sercon, d)
+				defer sercon.Close()
+				results[i].Device = d.SmallString()
+				results[i].Result, err = work(sercon, d)
+			}
+			if err != nil {
+				log.Printf("%s - Couldn't %s: %s\n", devices[i].Port, doing, err)
+				results[i].Error = err.Error()
+			} else {
+				log.Printf("%s - Finished: %s\n", devices[i].Port, doing)
+				results[i].Success = true
+			}
+		}()
+	}
+	wg.Wait()
+	failed := 0
+	for _, r := range results {
+		if !r.Success {
+			failed++
+		}
+	}
+	summary := make(map[string]interface{})
+	summary["Devices"] = results
+	summary["Succeeded"] = len(results) - failed
+	summary["Failed"] = failed
+	PrintJson(summary)
+	if failed > 0 {
+		log.Fatalf("Couldn't %s on %d of %d devices\n", doing, failed, len(results))
+	}
+}
+
 // **********************************
 // *       DEVICES COMMANDS         *
 // **********************************
@@ -75,26 +147,157 @@ func (c *ScanCmd) Run() error {
 
 // Query command
 type QueryCmd struct {
-	Device string `arg:"" default:"any" help:"The system device to check (use 'any' for first)"`
+	Device      string `arg:"" default:"${defaultport}" help:"The system device to check (use 'any' for first)"`
+	Bootloaders string `type:"existingfile" help:"Extra known bootloader builds (toml, same format as the built-in list)"`
 }
 
 func (c *QueryCmd) Run() error {
+	if c.Bootloaders != "" {
+		file, _ := forceOpen(c.Bootloaders)
+		known, err := arduboy.ParseKnownBootloaders(file)
+		file.Close()
+		fatalIfErr(c.Bootloaders, "parse known bootloaders", err)
+		arduboy.AddKnownBootloaders(known)
+		log.Printf("Loaded %d extra known bootloaders\n", len(known))
+	}
 	sercon, d := connectWithBootloader(c.Device)
 	defer sercon.Close()
 	extdata, err := arduboy.QueryDevice(d, sercon, true)
 	fatalIfErr(c.Device, "query device information", err)
 	log.Printf("Device %s is probably a %s\n", d.SmallString(), extdata.Bootloader.Device)
+	if known := extdata.Bootloader.Known; known != nil {
+		log.Printf("Bootloader is %s %s for %s\n", known.Name, known.Version, known.Board)
+	}
+	for _, warning := range extdata.Bootloader.Warnings {
+		log.Printf("WARNING: %s\n", warning)
+	}
 	PrintJson(extdata)
 	return nil
 }
 
+// Watch command
+type WatchCmd struct {
+	Query    bool          `help:"Also query each device which enters the bootloader (gives up after --timeout)"`
+	Interval time.Duration `default:"500ms" help:"How often to check for device changes"`
+}
+
+func (c *WatchCmd) Run() error {
+	log.Printf("Watching for device changes every %s\n", c.Interval)
+	err := arduboy.WatchDevices(cliContext, c.Interval, c.Query, cli.Timeout, func(event *arduboy.DeviceEvent) error {
+		log.Printf("Device %s: %s\n", event.Event, event.Device.SmallString())
+		PrintJsonLine(event)
+		return nil
+	})
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Stopped watching\n")
+		return nil
+	}
+	fatalIfErr("watch", "watch devices", err)
+	return nil
+}
+
+// Backup command
+type BackupCmd struct {
+	Device      string `arg:"" default:"${defaultport}" help:"The system device to backup (use 'any' for first)"`
+	Outfile     string `type:"path" short:"o"`
+	Noflashcart bool   `help:"Don't backup the flashcart (much faster)"`
+}
+
+func (c *BackupCmd) Run() error {
+	// Figure out save location
+	if c.Outfile == "" {
+		c.Outfile = fmt.Sprintf("backup_%s.zip", FileSafeDateTime())
+	}
+	sercon, d := connectWithBootloader(c.Device)
+	defer sercon.Close()
+	file := forceCreate(c.Outfile)
+	defer file.Close()
+	manifest, err := arduboy.BackupDevice(sercon, d, file, !c.Noflashcart, progressReporter(""))
+	fatalIfErr(c.Device, "backup device", err)
+	log.Printf("Backed up %s to %s\n", d.SmallString(), c.Outfile)
+	result := make(map[string]interface{})
+	result["Filename"] = c.Outfile
+	result["Manifest"] = manifest
+	PrintJson(result)
+	return nil
+}
+
+// Restore command
+type RestoreCmd struct {
+	Device      string `arg:"" default:"${defaultport}" help:"The system device to restore to (use 'any' for first)"`
+	Infile      string `type:"existingfile" short:"i" required:"" help:"Backup zip created with device backup"`
+	Noflashcart bool   `help:"Don't restore the flashcart, even if it's in the backup"`
+}
+
+func (c *RestoreCmd) Run() error {
+	archive, err := zip.OpenReader(c.Infile)
+	fatalIfErr(c.Infile, "open backup", err)
+	defer archive.Close()
+	sercon, d := connectWithBootloader(c.Device)
+	defer sercon.Close()
+	manifest, err := arduboy.RestoreDevice(sercon, d, &archive.Reader, !c.Noflashcart, progressReporter(""))
+	fatalIfErr(c.Device, "restore device", err)
+	log.Printf("Restored %s from %s (backup taken %s)\n", d.SmallString(), c.Infile, manifest.Timestamp)
+	result := make(map[string]interface{})
+	result["Filename"] = c.Infile
+	result["Manifest"] = manifest
+	PrintJson(result)
+	return nil
+}
+
+// Emulate command
+type EmulateCmd struct {
+	Directory string `arg:"" type:"path" help:"Directory to store the emulated device in"`
+	Type      string `default:"ArduboyFX" enum:"Arduboy,ArduboyFX,ArduboyMini" help:"Type of device to emulate (Arduboy, ArduboyFX, ArduboyMini)"`
+	Capacity  int    `default:"16777216" help:"Size of the emulated flashcart in bytes (0 for none)"`
+}
+
+func (c *EmulateCmd) Run() error {
+	emulated, err := arduboy.NewEmulatedDevice(c.Type, c.Capacity)
+	fatalIfErr("emulate", "create emulated device", err)
+	err = emulated.SaveDirectory(c.Directory)
+	fatalIfErr(c.Directory, "save emulated device", err)
+	log.Printf("Created emulated %s in %s\n", c.Type, c.Directory)
+	result := make(map[string]interface{})
+	result["Device"] = arduboy.EmulatedPortScheme + c.Directory
+	result["Type"] = c.Type
+	result["Capacity"] = c.Capacity
+	PrintJson(result)
+	return nil
+}
+
+// Serve command
+type ServeCmd struct {
+	Device string `arg:"" default:"${defaultport}" help:"The system device to share (use 'any' for first)"`
+	Listen string `default:":2217" short:"l" help:"Address to listen on"`
+}
+
+func (c *ServeCmd) Run() error {
+	listener, err := net.Listen("tcp", c.Listen)
+	fatalIfErr(c.Listen, "listen", err)
+	log.Printf("Sharing %s on %s (tcp:// or rfc2217://), one client at a time\n", c.Device, listener.Addr())
+	server := arduboy.DeviceServer{
+		Port: c.Device,
+		Connect: func(port string) (io.ReadWriteCloser, *arduboy.BasicDeviceInfo, error) {
+			sercon, d, err := arduboy.ConnectWithBootloader(port)
+			if err != nil {
+				return nil, nil, err
+			}
+			return traceConnection(sercon, d), d, nil
+		},
+	}
+	err = server.Serve(cliContext, listener)
+	fatalIfErr(c.Listen, "serve", err)
+	return nil
+}
+
 // **********************************
 // *       SKETCH COMMANDS          *
 // **********************************
 
 // Sketch read command
 type SketchReadCmd struct {
-	Device  string `arg:"" default:"any" help:"The system device to read from (use 'any' for first)"`
+	Device  string `arg:"" default:"${defaultport}" help:"The system device to read from (use 'any' for first)"`
 	Outfile string `type:"path" short:"o"`
 }
 
@@ -126,7 +329,7 @@ func (c *SketchReadCmd) Run() error {
 
 // Raw Hex write command
 type RawHexWriteCmd struct {
-	Device string `arg:"" default:"any" help:"The system device to write to (use 'any' for first)"`
+	Device string `arg:"" default:"${defaultport}" help:"The system device to write to (use 'any' for first)"`
 	Infile string `type:"existingfile" default:"sketch.hex" short:"i" help:"File to load hex from"`
 	RunNow bool   `help:"Run sketch immediately"`
 }
@@ -138,7 +341,7 @@ func (c *RawHexWriteCmd) Run() error {
 	sketchRaw, _ := forceOpen(c.Infile)
 	defer sketchRaw.Close()
 	// Now write the sketch. This includes validation steps
-	sketch, writtenPages, err := arduboy.WriteHex(sercon, sketchRaw, false)
+	sketch, writtenPages, err := arduboy.WriteHex(sercon, sketchRaw, false, progressReporter(""))
 	fatalIfErr(c.Device, "write raw hex", err)
 	// Figure out some data to give back to the user about the sketch write
 	numwritten := 0
@@ -170,53 +373,175 @@ func (c *RawHexWriteCmd) Run() error {
 	return nil
 }
 
+// Eeprom vault flags, for everything which replaces the sketch
+type vaultFlags struct {
+	Novault bool   `help:"Don't snapshot the old sketch's eeprom into the vault or restore the new one's"`
+	Restore string `enum:"ask,yes,no" default:"ask" help:"Restore the new sketch's eeprom from the vault if it has one (ask,yes,no)"`
+}
+
+func (v *vaultFlags) vault() *arduboy.EepromVault {
+	if v.Novault || cli.Vault == "" {
+		return nil
+	}
+	return &arduboy.EepromVault{Directory: cli.Vault}
+}
+
+// Save the eeprom of whatever sketch is on the device before it gets replaced.
+// Returns the eeprom (nil if nothing was saved)
+func snapshotEeprom(vault *arduboy.EepromVault, sercon io.ReadWriter, d *arduboy.BasicDeviceInfo) ([]byte, error) {
+	sketch, err := arduboy.ReadSketch(sercon, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(sketch) == 0 {
+		return nil, nil
+	}
+	eeprom, err := arduboy.ReadEeprom(sercon)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(eeprom, arduboy.MakePadding(arduboy.EepromSize)) {
+		// Nothing worth keeping, and it shouldn't replace an older save
+		log.Printf("Eeprom on %s is empty, not saving to vault\n", d.SmallString())
+		return eeprom, nil
+	}
+	entry, err := vault.Save(arduboy.SketchMD5(sketch), d.Port, eeprom)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Saved eeprom for old sketch %s to vault\n", entry.SketchMD5)
+	return eeprom, nil
+}
+
+// Put the sketch's save from the vault back onto the device, if there is one
+// and the user wants it. The Arduboy2 system area (unit name, audio, etc)
+// belongs to the device rather than the sketch, so it's left alone. Returns
+// whether it was restored
+func (v *vaultFlags) restoreEeprom(vault *arduboy.EepromVault, sercon io.ReadWriter, d *arduboy.BasicDeviceInfo,
+	sketchMD5 string, current []byte) (bool, error) {
+	entry, eeprom, err := vault.Load(sketchMD5)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if current == nil {
+		if current, err = arduboy.ReadEeprom(sercon); err != nil {
+			return false, err
+		}
+	}
+	save := eeprom[arduboy.EepromSystemSize:]
+	if bytes.Equal(save, current[arduboy.EepromSystemSize:]) {
+		return false, nil
+	}
+	restore := v.Restore == "yes"
+	if v.Restore == "ask" {
+		restore = askYesNo(fmt.Sprintf("Vault has a save for this sketch from %s. Restore it?",
+			entry.Timestamp.Format(time.DateTime)))
+	}
+	if !restore {
+		log.Printf("Not restoring vault save for sketch %s (use --restore=yes to restore it)\n", sketchMD5)
+		return false, nil
+	}
+	if err = arduboy.WriteEepromAt(sercon, arduboy.EepromSystemSize, save); err != nil {
+		return false, err
+	}
+	log.Printf("Restored vault save for sketch %s to %s\n", sketchMD5, d.SmallString())
+	return true, nil
+}
+
 // Sketch write command (use this one)
 type SketchWriteCmd struct {
-	Device string `arg:"" default:"any" help:"The system device to write to (use 'any' for first)"`
+	Device string `arg:"" default:"${defaultport}" help:"The system device to write to (use 'any' for first)"`
 	Infile string `type:"existingfile" default:"sketch.hex" short:"i" help:"File to load hex from"`
 	Runnow bool   `help:"Run sketch immediately"`
+	All    bool   `help:"Write to every connected device at once (device is ignored)"`
+	vaultFlags
 }
 
 func (c *SketchWriteCmd) Run() error {
+	// Go find the file first. It's read fully so it can be written to many devices
+	sketchRaw, err := os.ReadFile(c.Infile)
+	fatalIfErr(c.Infile, "read hex file", err)
+	if c.All {
+		if c.Restore == "ask" {
+			// Can't ask about many devices at once
+			c.Restore = "no"
+		}
+		runOnAllDevices("write sketch", func(sercon io.ReadWriteCloser, d *arduboy.BasicDeviceInfo) (map[string]interface{}, error) {
+			return c.writeSketch(sercon, d, sketchRaw, progressReporter(d.Port))
+		})
+		return nil
+	}
 	sercon, d := connectWithBootloader(c.Device)
 	defer sercon.Close()
-	// Go find the file first
-	sketchRaw, _ := forceOpen(c.Infile)
-	defer sketchRaw.Close()
-	// Now write the sketch. This includes validation steps
-	sketch, writtenPages, err := arduboy.WriteHex(sercon, sketchRaw, true)
+	result, err := c.writeSketch(sercon, d, sketchRaw, progressReporter(""))
 	fatalIfErr(c.Device, "write raw hex", err)
+	PrintJson(result)
+	return nil
+}
+
+func (c *SketchWriteCmd) writeSketch(sercon io.ReadWriteCloser, d *arduboy.BasicDeviceInfo, sketchRaw []byte,
+	progress arduboy.ProgressReporter) (map[string]interface{}, error) {
+	vault := c.vault()
+	var oldEeprom []byte
+	var err error
+	if vault != nil {
+		oldEeprom, err = snapshotEeprom(vault, sercon, d)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't save eeprom to vault (use --novault to skip): %w", err)
+		}
+	}
+	// Now write the sketch. This includes validation steps
+	sketch, writtenPages, err := arduboy.WriteHex(sercon, bytes.NewReader(sketchRaw), true, progress)
+	if err != nil {
+		return nil, err
+	}
 	for i, w := range writtenPages {
 		if !w {
-			log.Fatalf("PROGRAM ERROR: Did not write full memory! Missing page %d", i)
+			return nil, fmt.Errorf("PROGRAM ERROR: Did not write full memory! Missing page %d", i)
 		}
 	}
 	trimmed := arduboy.TrimUnused(sketch, arduboy.FlashPageSize)
 	log.Printf("Wrote %d bytes to %s (sketch was %d)\n", len(sketch), d.SmallString(), len(trimmed))
-	if c.Runnow {
-		arduboy.ExitBootloader(sercon)
-	}
 	fullhash := arduboy.Md5String(sketch)
 	hash := arduboy.Md5String(trimmed)
 	// Return data about the eeprom (does this even matter?)
 	result := make(map[string]interface{})
+	if vault != nil {
+		restored, err := c.restoreEeprom(vault, sercon, d, hash, oldEeprom)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't restore eeprom from vault: %w", err)
+		}
+		result["VaultRestored"] = restored
+	}
+	if c.Runnow {
+		arduboy.ExitBootloader(sercon)
+	}
 	result["Filename"] = c.Infile
 	result["SketchLength"] = len(trimmed)
 	result["SketchMD5"] = hash
 	result["UsableFlashLength"] = len(sketch)
 	result["UsableFlashMD5"] = fullhash
-	PrintJson(result)
-	return nil
+	return result, nil
 }
 
 // **********************************
 // *       EEPROM COMMANDS          *
 // **********************************
 
+// Whether the file is intel hex for eeprom (such as avr-gcc's .eep) rather than a raw bin
+func isEepromHex(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".eep" || ext == ".hex"
+}
+
 // Eeprom read command
 type EepromReadCmd struct {
-	Device  string `arg:"" default:"any" help:"The system device to read from (use 'any' for first)"`
+	Device  string `arg:"" default:"${defaultport}" help:"The system device to read from (use 'any' for first)"`
 	Outfile string `type:"path" short:"o"`
+	Address int    `default:"0" help:"Where in eeprom to start reading"`
+	Length  int    `default:"0" help:"How many bytes to read (0 for everything after address)"`
 }
 
 func (c *EepromReadCmd) Run() error {
@@ -224,12 +549,15 @@ func (c *EepromReadCmd) Run() error {
 	if c.Outfile == "" {
 		c.Outfile = fmt.Sprintf("eeprom_%s.bin", FileSafeDateTime())
 	}
+	if c.Length == 0 {
+		c.Length = arduboy.EepromSize - c.Address
+	}
 	// Read eeprom
 	sercon, d := connectWithBootloader(c.Device)
 	defer sercon.Close()
-	eeprom, err := arduboy.ReadEeprom(sercon)
+	eeprom, err := arduboy.ReadEepromAt(sercon, c.Address, c.Length)
 	fatalIfErr(c.Device, "read eeprom", err)
-	log.Printf("Read %d bytes from %s (full eeprom)\n", len(eeprom), d.SmallString())
+	log.Printf("Read %d bytes at %d from %s\n", len(eeprom), c.Address, d.SmallString())
 	hash := arduboy.Md5String(eeprom)
 	// Open and save file
 	file := forceCreate(c.Outfile)
@@ -244,39 +572,88 @@ func (c *EepromReadCmd) Run() error {
 	result := make(map[string]interface{})
 	result["Filename"] = c.Outfile
 	result["MD5"] = hash
+	result["Address"] = c.Address
+	result["Length"] = len(eeprom)
 	PrintJson(result)
 	return nil
 }
 
 // Eeprom write command
 type EepromWriteCmd struct {
-	Device string `arg:"" default:"any" help:"The system device to read from (use 'any' for first)"`
-	Infile string `type:"existingfile" default:"eeprom.bin" short:"i"`
+	Device  string `arg:"" default:"${defaultport}" help:"The system device to read from (use 'any' for first)"`
+	Infile  string `type:"existingfile" default:"eeprom.bin" short:"i" help:"Raw bin, or intel hex (.eep/.hex, such as from avr-gcc)"`
+	Address int    `default:"0" help:"Where in eeprom to write a raw bin (intel hex has its own addresses)"`
 }
 
 func (c *EepromWriteCmd) Run() error {
+	// Go find the file first
+	var segments []arduboy.EepromSegment
+	if isEepromHex(c.Infile) {
+		if c.Address != 0 {
+			log.Fatalf("Can't give an address for intel hex; it has its own\n")
+		}
+		file, _ := forceOpen(c.Infile)
+		var err error
+		segments, err = arduboy.ParseEepromHex(file)
+		file.Close()
+		fatalIfErr(c.Infile, "parse eeprom hex", err)
+	} else {
+		eeprom, err := os.ReadFile(c.Infile)
+		fatalIfErr(c.Infile, "read file", err)
+		segments = []arduboy.EepromSegment{{Address: c.Address, Data: eeprom}}
+	}
+	written := 0
+	for _, segment := range segments {
+		written += len(segment.Data)
+	}
+	log.Printf("Read %d bytes in %d pieces from file %s\n", written, len(segments), c.Infile)
 	sercon, d := connectWithBootloader(c.Device)
 	defer sercon.Close()
-	// Go find the file first
-	eeprom, err := os.ReadFile(c.Infile)
-	fatalIfErr(c.Device, "read file", err)
-	log.Printf("Read %d bytes from file %s\n", len(eeprom), c.Infile)
 	// Now write the eeprom
-	err = arduboy.WriteEeprom(sercon, eeprom)
+	err := arduboy.WriteEepromSegments(sercon, segments)
 	fatalIfErr(c.Device, "write eeprom", err)
-	log.Printf("Wrote %d bytes to %s (full eeprom)\n", len(eeprom), d.SmallString())
-	hash := arduboy.Md5String(eeprom)
+	log.Printf("Wrote %d bytes to %s\n", written, d.SmallString())
 	// Return data about the eeprom (does this even matter?)
 	result := make(map[string]interface{})
 	result["Filename"] = c.Infile
-	result["MD5"] = hash
+	result["Segments"] = len(segments)
+	result["Length"] = written
+	if len(segments) == 1 {
+		result["Address"] = segments[0].Address
+		result["MD5"] = arduboy.Md5String(segments[0].Data)
+	}
 	PrintJson(result)
 	return nil
 }
 
+// Eeprom diff command
+type EepromDiffCmd struct {
+	Left  string `arg:"" help:"The first eeprom: a device, or a raw bin / intel hex file"`
+	Right string `arg:"" optional:"" default:"${defaultport}" help:"The second eeprom, same as the first (use 'any' for first device)"`
+}
+
+func (c *EepromDiffCmd) Run() error {
+	left, sercon := readEepromOrFile(c.Left)
+	if sercon != nil {
+		sercon.Close()
+	}
+	right, sercon := readEepromOrFile(c.Right)
+	if sercon != nil {
+		sercon.Close()
+	}
+	rows, changed, err := arduboy.DiffEeprom(left, right, 0)
+	fatalIfErr(c.Left, "diff eeprom", err)
+	log.Printf("%d bytes differ in %d rows\n", changed, len(rows))
+	if changed > 0 {
+		err = arduboy.WriteEepromDiff(os.Stdout, rows, c.Left, c.Right)
+		fatalIfErr(c.Left, "write diff", err)
+	}
+	return nil
+}
+
 // Eeprom delete command
 type EepromDeleteCmd struct {
-	Device string `arg:"" default:"any" help:"The system device to read from (use 'any' for first)"`
+	Device string `arg:"" default:"${defaultport}" help:"The system device to read from (use 'any' for first)"`
 }
 
 func (c *EepromDeleteCmd) Run() error {
@@ -288,13 +665,192 @@ func (c *EepromDeleteCmd) Run() error {
 	return nil
 }
 
+// Read the eeprom from either a device or a dump file. For devices, the
+// connection is returned too (and must be closed); it's nil for files
+func readEepromOrFile(device string) ([]byte, io.ReadWriteCloser) {
+	fileInfo, err := os.Stat(device)
+	if err == nil && fileInfo.Mode().IsRegular() {
+		log.Printf("%s is a file, reading eeprom dump\n", device)
+		if isEepromHex(device) {
+			// Intel hex only has some of the eeprom; the rest is as if erased
+			file, _ := forceOpen(device)
+			defer file.Close()
+			segments, err := arduboy.ParseEepromHex(file)
+			fatalIfErr(device, "parse eeprom hex", err)
+			eeprom := arduboy.MakePadding(arduboy.EepromSize)
+			arduboy.ApplyEepromSegments(eeprom, segments)
+			return eeprom, nil
+		}
+		eeprom, err := os.ReadFile(device)
+		fatalIfErr(device, "read eeprom (file)", err)
+		return eeprom, nil
+	}
+	sercon, d := connectWithBootloader(device)
+	eeprom, err := arduboy.ReadEeprom(sercon)
+	fatalIfErr(device, "read eeprom (device)", err)
+	log.Printf("Read %d bytes from %s (full eeprom)\n", len(eeprom), d.SmallString())
+	return eeprom, sercon
+}
+
+// Turn an on/off flag into a change (nil if not given)
+func onOffChange(value string) *bool {
+	if value == "" {
+		return nil
+	}
+	on := value == "on"
+	return &on
+}
+
+// Eeprom system show command
+type EepromSystemShowCmd struct {
+	Device string `arg:"" default:"${defaultport}" help:"The system device OR eeprom .bin file to read from (use 'any' for first device)"`
+}
+
+func (c *EepromSystemShowCmd) Run() error {
+	eeprom, sercon := readEepromOrFile(c.Device)
+	if sercon != nil {
+		sercon.Close()
+	}
+	system, err := arduboy.ParseEepromSystem(eeprom)
+	fatalIfErr(c.Device, "parse eeprom system area", err)
+	for _, warning := range system.Warnings {
+		log.Printf("WARNING: %s\n", warning)
+	}
+	PrintJson(system)
+	return nil
+}
+
+// Eeprom system set command
+type EepromSystemSetCmd struct {
+	Device       string  `arg:"" default:"${defaultport}" help:"The system device OR eeprom .bin file to change (use 'any' for first device)"`
+	Outfile      string  `type:"path" short:"o" help:"When changing a file, save the result here instead of overwriting it"`
+	UnitName     *string `help:"Unit name shown on the boot logo (up to 6 characters, empty to clear)"`
+	UnitId       *uint16 `help:"Unit ID (0-65535)"`
+	Audio        string  `enum:",on,off" default:"" help:"Sound on or off (on,off)"`
+	Logo         string  `enum:",on,off" default:"" help:"Show the boot logo (on,off)"`
+	LogoLeds     string  `enum:",on,off" default:"" name:"logo-leds" help:"Flash the RGB led during the boot logo (on,off)"`
+	ShowUnitName string  `enum:",on,off" default:"" help:"Show the unit name on the boot logo (on,off)"`
+}
+
+func (c *EepromSystemSetCmd) Run() error {
+	eeprom, sercon := readEepromOrFile(c.Device)
+	if sercon != nil {
+		defer sercon.Close()
+	}
+	original := append([]byte{}, eeprom...)
+	changes := arduboy.EepromSystemChanges{
+		ShowUnitName: onOffChange(c.ShowUnitName),
+		ShowLogo:     onOffChange(c.Logo),
+		ShowLogoLEDs: onOffChange(c.LogoLeds),
+		AudioOn:      onOffChange(c.Audio),
+		UnitID:       c.UnitId,
+		UnitName:     c.UnitName,
+	}
+	err := arduboy.ApplyEepromSystem(eeprom, &changes)
+	fatalIfErr(c.Device, "change eeprom system area", err)
+	start, end := arduboy.ChangedRange(original, eeprom)
+	result := make(map[string]interface{})
+	if end == start {
+		log.Printf("Nothing changed, not writing anything\n")
+	} else if sercon == nil {
+		if c.Outfile == "" {
+			c.Outfile = c.Device
+		}
+		err = os.WriteFile(c.Outfile, eeprom, 0644)
+		fatalIfErr(c.Outfile, "write eeprom (file)", err)
+		log.Printf("Wrote changed eeprom to file %s\n", c.Outfile)
+		result["Filename"] = c.Outfile
+	} else {
+		// Only the changed bytes, to save time and eeprom wear
+		err = arduboy.WriteEepromAt(sercon, start, eeprom[start:end])
+		fatalIfErr(c.Device, "write eeprom (device)", err)
+		log.Printf("Wrote %d changed bytes at %d to %s\n", end-start, start, c.Device)
+	}
+	system, err := arduboy.ParseEepromSystem(eeprom)
+	fatalIfErr(c.Device, "parse eeprom system area", err)
+	result["System"] = system
+	result["ChangedStart"] = start
+	result["ChangedLength"] = end - start
+	PrintJson(result)
+	return nil
+}
+
+func openVault() *arduboy.EepromVault {
+	if cli.Vault == "" {
+		log.Fatalf("No vault folder; set one with --vault\n")
+	}
+	return &arduboy.EepromVault{Directory: cli.Vault}
+}
+
+// Eeprom vault list command
+type EepromVaultListCmd struct {
+}
+
+func (c *EepromVaultListCmd) Run() error {
+	entries, err := openVault().List()
+	fatalIfErr(cli.Vault, "list vault", err)
+	log.Printf("Vault %s has saves for %d sketches\n", cli.Vault, len(entries))
+	PrintJson(entries)
+	return nil
+}
+
+// Eeprom vault export command
+type EepromVaultExportCmd struct {
+	Sketch  string `arg:"" help:"Hash of the sketch whose save to export (the start is enough, see vault list)"`
+	Outfile string `type:"path" short:"o"`
+}
+
+func (c *EepromVaultExportCmd) Run() error {
+	vault := openVault()
+	sketchMD5, err := vault.Resolve(c.Sketch)
+	fatalIfErr(c.Sketch, "find save", err)
+	if c.Outfile == "" {
+		c.Outfile = fmt.Sprintf("eeprom_%s.bin", sketchMD5[:8])
+	}
+	file := forceCreate(c.Outfile)
+	defer file.Close()
+	entry, err := vault.Export(sketchMD5, file)
+	fatalIfErr(c.Sketch, "export save", err)
+	log.Printf("Exported save for sketch %s to %s\n", sketchMD5, c.Outfile)
+	result := make(map[string]interface{})
+	result["Filename"] = c.Outfile
+	result["Entry"] = entry
+	PrintJson(result)
+	return nil
+}
+
+// Eeprom vault import command
+type EepromVaultImportCmd struct {
+	Sketch string `arg:"" help:"Sketch the save belongs to: either its hash or its .hex file"`
+	Infile string `type:"existingfile" default:"eeprom.bin" short:"i" help:"Eeprom dump to store"`
+}
+
+func (c *EepromVaultImportCmd) Run() error {
+	sketchMD5 := c.Sketch
+	fileInfo, err := os.Stat(c.Sketch)
+	if err == nil && fileInfo.Mode().IsRegular() {
+		file, _ := forceOpen(c.Sketch)
+		sketch, err := arduboy.HexToBin(file)
+		file.Close()
+		fatalIfErr(c.Sketch, "read sketch hex", err)
+		sketchMD5 = arduboy.SketchMD5(sketch)
+	}
+	file, _ := forceOpen(c.Infile)
+	defer file.Close()
+	entry, err := openVault().Import(sketchMD5, c.Infile, file)
+	fatalIfErr(c.Infile, "import save", err)
+	log.Printf("Imported %s as the save for sketch %s\n", c.Infile, entry.SketchMD5)
+	PrintJson(entry)
+	return nil
+}
+
 // **********************************
 // *      FLASHCART COMMANDS        *
 // **********************************
 
 // Flashcart scan command
 type FlashcartScanCmd struct {
-	Device string `arg:"" default:"any" help:"The system device OR file to read from (use 'any' for first device)"`
+	Device string `arg:"" default:"${defaultport}" help:"The system device OR file to read from (use 'any' for first device)"`
 	Html   bool   `help:"Generate as html instead"`
 	Images bool   `help:"Pull images (takes 4 times as long)"`
 }
@@ -339,7 +895,7 @@ func (c *FlashcartScanCmd) Run() error {
 
 // Flashcart read command (whole flashcart)
 type FlashcartReadCmd struct {
-	Device  string `arg:"" default:"any" help:"The system device to read from (use 'any' for first)"`
+	Device  string `arg:"" default:"${defaultport}" help:"The system device to read from (use 'any' for first)"`
 	Outfile string `type:"path" short:"o"`
 }
 
@@ -354,7 +910,7 @@ func (c *FlashcartReadCmd) Run() error {
 	sercon, d := connectWithBootloader(c.Device)
 	defer sercon.Close()
 	_ = mustHaveFlashcart(sercon, d)
-	length, slots, err := arduboy.ReadWholeFlashcart(sercon, file, true)
+	length, slots, err := arduboy.ReadWholeFlashcart(sercon, file, progressReporter(""))
 	fatalIfErr(c.Device, "read flashcart", err)
 	log.Printf("Read %d bytes, %d slots from %s, wrote to %s\n", length, slots, d.SmallString(), c.Outfile)
 	// Return data about the save
@@ -368,43 +924,133 @@ func (c *FlashcartReadCmd) Run() error {
 
 // Flashcart write command (whole flashcart)
 type FlashcartWriteCmd struct {
-	Device           string `arg:"" default:"any" help:"The system device to write to (use 'any' for first)"`
+	Device           string `arg:"" default:"${defaultport}" help:"The system device to write to (use 'any' for first)"`
 	Infile           string `type:"existingfile" default:"flashcart.bin" short:"i"`
-	OverrideCapacity int    `help:"Force device capacity (NOT RECOMMENDED)"`
+	OverrideCapacity int    `default:"${overridecapacity}" help:"Force device capacity (NOT RECOMMENDED)"`
 	Noverify         bool   `help:"Do not verify flashcart (not recommended)"`
+	Diff             bool   `help:"Only write blocks which differ from the device (much faster for small changes)"`
+	All              bool   `help:"Write to every connected device at once (device is ignored)"`
+	Resume           bool   `help:"Continue an interrupted write from its checkpoint file"`
+	Checkpoint       string `type:"path" help:"Where to keep progress for --resume (default: infile + .checkpoint)"`
+	Upgrade          bool   `help:"Upgrade old format slot headers (no FX data length) to the new format while writing"`
+}
+
+// Load the whole flashcart file, upgrading the old format headers
+func (c *FlashcartWriteCmd) loadFlashcart() []byte {
+	flashcart, err := os.ReadFile(c.Infile)
+	fatalIfErr(c.Infile, "read flashcart file", err)
+	if c.Upgrade {
+		upgraded, err := arduboy.UpgradeFlashcartHeaders(flashcart)
+		fatalIfErr(c.Infile, "upgrade flashcart headers", err)
+		log.Printf("Upgraded %d old format headers in %s\n", upgraded, c.Infile)
+	}
+	return flashcart
 }
 
 func (c *FlashcartWriteCmd) Run() error {
-	// Open arduboy, force flashcart existence
+	if c.All {
+		if c.Resume {
+			log.Fatalf("Can't resume writes to all devices; checkpoints are per device")
+		}
+		// Every device needs its own reader, so just load the whole thing
+		flashcart := c.loadFlashcart()
+		runOnAllDevices("write flashcart", func(sercon io.ReadWriteCloser, d *arduboy.BasicDeviceInfo) (map[string]interface{}, error) {
+			return c.writeFlashcart(sercon, d, bytes.NewReader(flashcart), len(flashcart), "", progressReporter(d.Port))
+		})
+		return nil
+	}
+	// Open arduboy
 	sercon, d := connectWithBootloader(c.Device)
 	defer sercon.Close()
-	extdata := mustHaveFlashcart(sercon, d)
+	// Figure out save location, open file
+	file, fi := forceOpen(c.Infile)
+	defer file.Close()
+	if c.Checkpoint == "" {
+		c.Checkpoint = c.Infile + ".checkpoint"
+	}
+	var data io.ReadSeeker = file
+	if c.Upgrade {
+		data = bytes.NewReader(c.loadFlashcart())
+	}
+	result, err := c.writeFlashcart(sercon, d, data, int(fi.Size()), c.Checkpoint, progressReporter(""))
+	fatalIfErr(c.Device, "write flashcart", err)
+	PrintJson(result)
+	return nil
+}
+
+// Write the flashcart, keeping a checkpoint at the given path as it goes (if
+// not empty) which is removed once the write finishes
+func (c *FlashcartWriteCmd) writeFlashcart(sercon io.ReadWriteCloser, d *arduboy.BasicDeviceInfo, file io.ReadSeeker, fileSize int,
+	checkpointPath string, progress arduboy.ProgressReporter) (map[string]interface{}, error) {
+	// Force flashcart existence
+	extdata, err := arduboy.QueryDevice(d, sercon, false)
+	if err != nil {
+		return nil, err
+	}
+	if extdata.Jedec == nil {
+		return nil, fmt.Errorf("device %s doesn't seem to have a flashcart", extdata.Bootloader.Device)
+	}
+	log.Printf("Device %s has flashcart: %v\n", d.SmallString(), extdata.Jedec)
 	if c.OverrideCapacity > 0 {
 		// Spooky user desires
 		extdata.Jedec.Capacity = c.OverrideCapacity
 	}
-	// Figure out save location, open file
-	file, fi := forceOpen(c.Infile)
-	defer file.Close()
-	fileSize := int(fi.Size())
 	if !extdata.Jedec.FitsFlashcart(fileSize) {
-		log.Fatalf("Flashcart too big for device! Size: %d, capacity: %d\n",
+		return nil, fmt.Errorf("flashcart too big for device! Size: %d, capacity: %d",
 			fileSize, extdata.Jedec.Capacity)
 	}
 	// Actually write the thing
-	blocks, err := arduboy.WriteWholeFlashcart(sercon, file, !c.Noverify, true)
-	fatalIfErr(c.Device, "write flashcart", err)
-	log.Printf("Finished writing %d blocks to flashcart (%d bytes)\n",
-		blocks, blocks*arduboy.FXBlockSize)
+	var blocks, written, resumed int
+	if checkpointPath != "" {
+		checkpoint, err := arduboy.NewFlashcartCheckpoint(file, extdata)
+		if err != nil {
+			return nil, err
+		}
+		if c.Resume {
+			saved, err := arduboy.LoadFlashcartCheckpoint(checkpointPath)
+			if err != nil {
+				return nil, fmt.Errorf("can't load checkpoint to resume: %w", err)
+			}
+			if err = saved.CheckResume(checkpoint); err != nil {
+				return nil, fmt.Errorf("can't resume from %s: %w", checkpointPath, err)
+			}
+			checkpoint = saved
+			resumed = checkpoint.LastGoodBlock + 1
+			log.Printf("Resuming flashcart write after block %d (%d bytes already written)\n",
+				checkpoint.LastGoodBlock, resumed*arduboy.FXBlockSize)
+		}
+		blocks, written, err = arduboy.WriteWholeFlashcartCheckpointed(sercon, file, checkpoint, checkpointPath,
+			!c.Noverify, c.Diff, progress)
+		if err != nil {
+			if checkpoint.LastGoodBlock >= 0 {
+				log.Printf("Flashcart write stopped; progress saved to %s (use --resume to continue)\n", checkpointPath)
+			}
+			return nil, err
+		}
+		if err = os.Remove(checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("WARN: couldn't remove finished checkpoint %s: %s\n", checkpointPath, err)
+		}
+	} else if c.Diff {
+		blocks, written, err = arduboy.WriteWholeFlashcartDiff(sercon, file, fileSize, !c.Noverify, progress)
+	} else {
+		blocks, err = arduboy.WriteWholeFlashcart(sercon, file, fileSize, !c.Noverify, progress)
+		written = blocks
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Finished writing %d of %d blocks to flashcart on %s (%d bytes)\n",
+		written, blocks, d.SmallString(), written*arduboy.FXBlockSize)
 	// Return data about the save
 	result := make(map[string]interface{})
 	result["Filename"] = c.Infile
 	result["Length"] = fileSize
-	result["Written"] = blocks * arduboy.FXBlockSize
+	result["Written"] = written * arduboy.FXBlockSize
+	result["Unchanged"] = (blocks - written - resumed) * arduboy.FXBlockSize
+	result["Resumed"] = resumed * arduboy.FXBlockSize
 	result["Capacity"] = extdata.Jedec.Capacity
 	result["Verified"] = !c.Noverify
-	PrintJson(result)
-	return nil
+	return result, nil
 }
 
 // Flashcart read any command
@@ -414,7 +1060,7 @@ type FlashcartReadAtCmd struct {
 	Length           int    `arg:"" help:"The length of data to retrieve"`
 	Outfile          string `type:"path" short:"o"`
 	Fromend          bool   `help:"Interpret address as CAPACITY-address (like a negative index)"`
-	OverrideCapacity int    `help:"Force device capacity (NOT RECOMMENDED)"`
+	OverrideCapacity int    `default:"${overridecapacity}" help:"Force device capacity (NOT RECOMMENDED)"`
 }
 
 func (c *FlashcartReadAtCmd) Run() error {
@@ -468,7 +1114,7 @@ type FlashcartWriteAtCmd struct {
 	Address          int    `arg:"" help:"The byte-level address to start writing to."`
 	Infile           string `type:"existingfile" default:"flashchunk.bin" short:"i"`
 	Fromend          bool   `help:"Interpret address as CAPACITY-address (like a negative index)"`
-	OverrideCapacity int    `help:"Force device capacity (NOT RECOMMENDED)"`
+	OverrideCapacity int    `default:"${overridecapacity}" help:"Force device capacity (NOT RECOMMENDED)"`
 }
 
 func (c *FlashcartWriteAtCmd) Run() error {
@@ -500,7 +1146,7 @@ func (c *FlashcartWriteAtCmd) Run() error {
 	// Now, we can simply write the data
 	arduboy.SetRgbButtonState(sercon, arduboy.LEDCtrlGrOn|arduboy.LEDCtrlRdOn)
 	defer arduboy.ResetRgbButtonState(sercon)
-	realAddress, realLength, err := arduboy.WriteFlashcart(sercon, c.Address, rawfile, true)
+	realAddress, realLength, err := arduboy.WriteFlashcart(sercon, c.Address, rawfile, progressReporter(""))
 	fatalIfErr(c.Device, "write to flashcart", err)
 	log.Printf("Wrote %d total bytes at %d using file %s\n", realLength, realAddress, c.Infile)
 	// Return data about the save
@@ -516,9 +1162,9 @@ func (c *FlashcartWriteAtCmd) Run() error {
 
 // Flashcart write dev data command
 type FlashcartWriteDevCmd struct {
-	Device           string `arg:"" default:"any" help:"The system device to write to (use 'any' for first)"`
+	Device           string `arg:"" default:"${defaultport}" help:"The system device to write to (use 'any' for first)"`
 	Infile           string `type:"existingfile" default:"fxdata.bin" short:"i"`
-	OverrideCapacity int    `help:"Force device capacity (NOT RECOMMENDED)"`
+	OverrideCapacity int    `default:"${overridecapacity}" help:"Force device capacity (NOT RECOMMENDED)"`
 	NoAlignCheck     bool   `help:"Don't validate fxdata size (NOT RECOMMENDED)"`
 	NoOverwriteCheck bool   `help:"Don't check if fx dev data overwrites flashcart (NOT RECOMMENDED)"`
 }
@@ -555,7 +1201,7 @@ func (c *FlashcartWriteDevCmd) Run() error {
 	address := extdata.Jedec.Capacity - len(fxdata)
 	arduboy.SetRgbButtonState(sercon, arduboy.LEDCtrlGrOn|arduboy.LEDCtrlRdOn)
 	defer arduboy.ResetRgbButtonState(sercon)
-	realAddress, realLength, err := arduboy.WriteFlashcart(sercon, address, fxdata, true)
+	realAddress, realLength, err := arduboy.WriteFlashcart(sercon, address, fxdata, progressReporter(""))
 	fatalIfErr(c.Device, "write flash data", err)
 	log.Printf("Finished writing %d bytes to flashcart at address %d\n", realLength, realAddress)
 	// Return data about the write
@@ -578,7 +1224,11 @@ type FlashcartGenerateCmd struct {
 	Arguments []string `arg:"" optional:"" help:"Arguments passed to the lua script (optional)"`
 
 	// I think the rest of the args to pass to the script will go here
-	Datadir string `type:"path" short:"d" help:"Folder where data is located (optional)"`
+	Datadir  string   `type:"path" short:"d" help:"Folder where data is located (optional)"`
+	Ssd1309  bool     `name:"ssd1309" negatable:"" default:"${ssd1309}" help:"Patch sketches in new flashcarts for SSD1309 screens"`
+	Microled bool     `negatable:"" default:"${microled}" help:"Patch sketches in new flashcarts for the micro LED polarity"`
+	Contrast int      `default:"${contrast}" help:"Patch sketches in new flashcarts to this screen contrast (-1 leaves it alone)"`
+	Devices  []string `default:"${devices}" help:"Devices to pick package binaries for when packageany isn't given any"`
 }
 
 func (c *FlashcartGenerateCmd) Run() error {
@@ -586,7 +1236,13 @@ func (c *FlashcartGenerateCmd) Run() error {
 	script, err := os.ReadFile(c.Infile)
 	fatalIfErr("flashcartgenerate", "read lua file", err)
 	// Actually run the flashcart script
-	errout, err := arduboy.RunLuaFlashcartGenerator(string(script), c.Arguments, c.Datadir)
+	defaults := arduboy.DeviceDefaults{
+		PatchSsd1309:  c.Ssd1309,
+		PatchMicroLED: c.Microled,
+		Contrast:      c.Contrast,
+		Devices:       c.Devices,
+	}
+	errout, err := arduboy.RunLuaFlashcartGeneratorWithDefaults(string(script), c.Arguments, c.Datadir, &defaults)
 	// ALWAYS print their logs even if there's an error, so the user can see
 	fmt.Fprintf(os.Stderr, errout)
 	fatalIfErr("flashcartgenerate", "run script", err)
@@ -598,11 +1254,369 @@ func (c *FlashcartGenerateCmd) Run() error {
 	return nil
 }
 
+// Flashcart eeprom map command
+type FlashcartEepromMapCmd struct {
+	Infile   string `arg:"" type:"existingfile" help:"The flashcart file to analyze"`
+	Accesses bool   `help:"Include every eeprom access found in each game"`
+}
+
+func (c *FlashcartEepromMapCmd) Run() error {
+	file, _ := forceOpen(c.Infile)
+	defer file.Close()
+	slots, err := arduboy.MapFlashcartEeprom(file)
+	fatalIfErr(c.Infile, "analyze flashcart eeprom", err)
+	overlaps, unknown := arduboy.FindEepromOverlaps(slots)
+	if !c.Accesses {
+		for i := range slots {
+			slots[i].Eeprom.Accesses = nil
+		}
+	}
+	log.Printf("Analyzed %d games, %d overlap in eeprom, %d with eeprom use that couldn't be worked out\n",
+		len(slots), len(overlaps), len(unknown))
+	result := make(map[string]interface{})
+	result["Games"] = slots
+	result["Overlaps"] = overlaps
+	result["Unknown"] = unknown
+	PrintJson(result)
+	return nil
+}
+
+// Read the used part of the flashcart from either a device or a file. The used
+// part ends at the first broken slot link, so set whole to read the entire
+// flashcart from a device instead (slower, but nothing is missed)
+func readFlashcartOrFile(device string, whole bool) []byte {
+	fileInfo, err := os.Stat(device)
+	if err == nil && fileInfo.Mode().IsRegular() {
+		log.Printf("%s is a file, reading flashcart file\n", device)
+		flashcart, err := os.ReadFile(device)
+		fatalIfErr(device, "read flashcart (file)", err)
+		return flashcart
+	}
+	sercon, d := connectWithBootloader(device)
+	defer sercon.Close()
+	extdata := mustHaveFlashcart(sercon, d)
+	size := extdata.Jedec.Capacity
+	used := "whole"
+	if !whole {
+		size, _, err = arduboy.ScanFlashcartSize(sercon)
+		fatalIfErr(device, "scan flashcart size", err)
+		used = "used"
+	}
+	flashcart, err := arduboy.ReadFlashcart(sercon, 0, size)
+	fatalIfErr(device, "read flashcart (device)", err)
+	log.Printf("Read %d bytes from %s (%s flashcart)\n", len(flashcart), d.SmallString(), used)
+	return flashcart
+}
+
+// Flashcart check command (file or device)
+type FlashcartCheckCmd struct {
+	Device  string `arg:"" default:"${defaultport}" help:"The system device OR file to check (use 'any' for first device)"`
+	Repair  bool   `help:"Write the flashcart with the fixable problems fixed to a new file"`
+	Outfile string `type:"path" short:"o" help:"Where to write the repaired flashcart"`
+}
+
+func (c *FlashcartCheckCmd) Run() error {
+	// A broken link is exactly what check is looking for, so don't stop at one
+	flashcart := readFlashcartOrFile(c.Device, true)
+	problems, slots := arduboy.CheckFlashcart(flashcart, c.Repair)
+	fixed := 0
+	for _, p := range problems {
+		if p.Fixed {
+			fixed++
+		}
+	}
+	log.Printf("Checked %d slots, found %d problems\n", slots, len(problems))
+	result := make(map[string]interface{})
+	result["Slots"] = slots
+	result["Problems"] = problems
+	if c.Repair {
+		if c.Outfile == "" {
+			c.Outfile = fmt.Sprintf("flashcart_repaired_%s.bin", FileSafeDateTime())
+		}
+		if c.Outfile == c.Device {
+			log.Fatalf("Repaired flashcart must go to a new file, not %s\n", c.Device)
+		}
+		err := os.WriteFile(c.Outfile, flashcart, 0644)
+		fatalIfErr(c.Outfile, "write repaired flashcart", err)
+		log.Printf("Fixed %d problems, wrote repaired flashcart to %s\n", fixed, c.Outfile)
+		result["Repaired"] = c.Outfile
+	}
+	PrintJson(result)
+	return nil
+}
+
+// Flashcart export to a CSV index (flashcart-builder.py format)
+type FlashcartExportCsvCmd struct {
+	Infile string `arg:"" type:"existingfile" help:"The flashcart file to export"`
+	Outdir string `type:"path" short:"o" help:"Folder to put the index and files in (default: flashcart_csv_<date>)"`
+}
+
+func (c *FlashcartExportCsvCmd) Run() error {
+	if c.Outdir == "" {
+		c.Outdir = fmt.Sprintf("flashcart_csv_%s", FileSafeDateTime())
+	}
+	flashcart, err := os.ReadFile(c.Infile)
+	fatalIfErr(c.Infile, "read flashcart file", err)
+	slots, err := arduboy.ExportFlashcartCsv(flashcart, c.Outdir)
+	fatalIfErr(c.Infile, "export flashcart csv", err)
+	index := filepath.Join(c.Outdir, arduboy.FlashcartCsvName)
+	log.Printf("Exported %d slots to %s\n", slots, index)
+	result := make(map[string]interface{})
+	result["Index"] = index
+	result["Slots"] = slots
+	PrintJson(result)
+	return nil
+}
+
+// Flashcart build from a CSV index (flashcart-builder.py format)
+type FlashcartBuildCsvCmd struct {
+	Infile   string `arg:"" type:"existingfile" help:"The CSV index (files in it are relative to it)"`
+	Outfile  string `type:"path" short:"o" help:"Where to write the flashcart (default: flashcart_<date>.bin)"`
+	Ssd1309  bool   `name:"ssd1309" negatable:"" default:"${ssd1309}" help:"Patch sketches for SSD1309 screens"`
+	Microled bool   `negatable:"" default:"${microled}" help:"Patch sketches for the micro LED polarity"`
+	Contrast int    `default:"${contrast}" help:"Patch sketches to this screen contrast (-1 leaves it alone)"`
+}
+
+func (c *FlashcartBuildCsvCmd) Run() error {
+	if c.Outfile == "" {
+		c.Outfile = fmt.Sprintf("flashcart_%s.bin", FileSafeDateTime())
+	}
+	slots, err := arduboy.ReadFlashcartCsv(c.Infile)
+	fatalIfErr(c.Infile, "read flashcart csv", err)
+	file := forceCreate(c.Outfile)
+	defer file.Close()
+	builder := arduboy.NewFlashcartBuilder(file)
+	builder.PatchSsd1309 = c.Ssd1309
+	builder.PatchMicroLED = c.Microled
+	builder.Contrast = c.Contrast
+	for _, slot := range slots {
+		_, err = builder.WriteSlot(slot)
+		fatalIfErr(c.Outfile, "write slot", err)
+	}
+	err = builder.Finish()
+	fatalIfErr(c.Outfile, "finish flashcart", err)
+	length, err := file.Seek(0, io.SeekCurrent)
+	fatalIfErr(c.Outfile, "get flashcart length", err)
+	log.Printf("Built %d slots from %s into %s\n", len(slots), c.Infile, c.Outfile)
+	result := make(map[string]interface{})
+	result["Filename"] = c.Outfile
+	result["Length"] = length
+	result["Slots"] = len(slots)
+	PrintJson(result)
+	return nil
+}
+
+// Flashcart extract command (file or device)
+type FlashcartExtractCmd struct {
+	Device string `arg:"" help:"The system device OR file to extract from (use 'any' for first device)"`
+	Outdir string `arg:"" type:"path" help:"Folder to put the packages and category manifest in"`
+}
+
+func (c *FlashcartExtractCmd) Run() error {
+	flashcart := readFlashcartOrFile(c.Device, false)
+	categories, err := arduboy.ExtractFlashcartPackages(flashcart, c.Outdir)
+	fatalIfErr(c.Device, "extract packages", err)
+	packages := 0
+	for _, category := range categories {
+		packages += len(category.Packages)
+	}
+	manifest := filepath.Join(c.Outdir, arduboy.FlashcartManifestName)
+	log.Printf("Extracted %d packages in %d categories to %s\n", packages, len(categories), c.Outdir)
+	result := make(map[string]interface{})
+	result["Manifest"] = manifest
+	result["Packages"] = packages
+	result["Categories"] = categories
+	PrintJson(result)
+	return nil
+}
+
+// Flashcart diff command (files or devices)
+type FlashcartDiffCmd struct {
+	Left   string `arg:"" help:"The first flashcart: a device or a file"`
+	Right  string `arg:"" optional:"" default:"${defaultport}" help:"The second flashcart, same as the first (use 'any' for first device)"`
+	Format string `enum:"json,text" default:"json" help:"Output as json or human readable text"`
+}
+
+func (c *FlashcartDiffCmd) Run() error {
+	left := readFlashcartOrFile(c.Left, false)
+	right := readFlashcartOrFile(c.Right, false)
+	diff, err := arduboy.DiffFlashcarts(bytes.NewReader(left), bytes.NewReader(right))
+	fatalIfErr(c.Left, "diff flashcarts", err)
+	log.Printf("%d categories and %d games differ\n", len(diff.Categories), len(diff.Games))
+	if c.Format == "text" {
+		err = arduboy.WriteFlashcartDiff(os.Stdout, diff, c.Left, c.Right)
+		fatalIfErr(c.Left, "write diff", err)
+	} else {
+		PrintJson(diff)
+	}
+	return nil
+}
+
+// **********************************
+// *       PACKAGE COMMANDS         *
+// **********************************
+
+// Package install command
+type PackageInstallCmd struct {
+	Infile           string `arg:"" type:"existingfile" help:"The .arduboy package to install"`
+	Device           string `arg:"" optional:"" default:"${defaultport}" help:"The system device to install to (use 'any' for first)"`
+	Title            string `help:"Install the binary with this title rather than picking one for the device"`
+	OverrideCapacity int    `default:"${overridecapacity}" help:"Force device capacity (NOT RECOMMENDED)"`
+	NoOverwriteCheck bool   `help:"Don't check if fx dev data overwrites flashcart (NOT RECOMMENDED)"`
+	Runnow           bool   `help:"Run sketch immediately"`
+	vaultFlags
+}
+
+func (c *PackageInstallCmd) Run() error {
+	archive, err := zip.OpenReader(c.Infile)
+	fatalIfErr(c.Infile, "open package", err)
+	defer archive.Close()
+	info, err := arduboy.ReadPackageInfo(archive)
+	fatalIfErr(c.Infile, "read package info", err)
+	// The binary depends on what kind of device this is
+	sercon, d := connectWithBootloader(c.Device)
+	defer sercon.Close()
+	extdata, err := arduboy.QueryDevice(d, sercon, false)
+	fatalIfErr(c.Device, "query device information", err)
+	device := extdata.Bootloader.Device
+	binary, err := arduboy.FindDeviceBinary(&info, device, c.Title)
+	fatalIfErr(c.Infile, "find binary for "+device, err)
+	log.Printf("Installing '%s' (for %s) on %s\n", binary.Title, binary.Device, device)
+	data, err := arduboy.LoadPackageBinary(archive, binary)
+	fatalIfErr(c.Infile, "load binary", err)
+	// Check everything before writing anything, so a bad package doesn't leave
+	// the device half installed
+	devdata := data.DevData()
+	var address, flashcartSize int
+	if len(devdata) > 0 {
+		if extdata.Jedec == nil {
+			log.Fatalf("Binary '%s' has fx data, but %s doesn't seem to have a flashcart!\n", binary.Title, device)
+		}
+		if c.OverrideCapacity > 0 {
+			// Spooky user desires
+			extdata.Jedec.Capacity = c.OverrideCapacity
+		}
+		if !c.NoOverwriteCheck {
+			flashcartSize, _, err = arduboy.ScanFlashcartSize(sercon)
+			fatalIfErr(c.Device, "get flashcart size", err)
+			if err := extdata.Jedec.ValidateFitsFxData(flashcartSize, len(devdata), false); err != nil {
+				log.Fatalf("%s - Capacity: %d, Flashcart: %d, FxData: %d\n",
+					err, extdata.Jedec.Capacity, flashcartSize, len(devdata))
+			}
+		}
+		address = extdata.Jedec.Capacity - len(devdata)
+	}
+	arduboy.SetRgbButtonState(sercon, arduboy.LEDCtrlGrOn|arduboy.LEDCtrlRdOn)
+	defer arduboy.ResetRgbButtonState(sercon)
+	// Data goes first, so the sketch has what it needs once it runs
+	if len(devdata) > 0 {
+		realAddress, realLength, err := arduboy.WriteFlashcart(sercon, address, devdata, progressReporter(""))
+		fatalIfErr(c.Device, "write flash data", err)
+		log.Printf("Finished writing %d bytes to flashcart at address %d\n", realLength, realAddress)
+	}
+	sketchWrite := SketchWriteCmd{Infile: binary.Filename, Runnow: c.Runnow, vaultFlags: c.vaultFlags}
+	result, err := sketchWrite.writeSketch(sercon, d, data.Sketch, progressReporter(""))
+	fatalIfErr(c.Device, "write sketch", err)
+	result["Package"] = c.Infile
+	result["Title"] = info.Title
+	result["Binary"] = binary.Title
+	result["BinaryDevice"] = binary.Device
+	result["Device"] = device
+	result["DevDataLength"] = len(devdata)
+	if len(devdata) > 0 {
+		result["DevDataAddress"] = address
+		result["Capacity"] = extdata.Jedec.Capacity
+		if !c.NoOverwriteCheck {
+			result["FlashcartLength"] = flashcartSize
+		}
+	}
+	PrintJson(result)
+	return nil
+}
+
 // **********************************
 // *       CONVERT COMMANDS         *
 // **********************************
 
 // ------------ Sketches --------------
+// Sketch disassemble command
+type SketchDisasmCmd struct {
+	Infile  string `arg:"" type:"existingfile" help:"The sketch to disassemble (.hex or .bin)"`
+	Outfile string `type:"path" short:"o" help:"Where to write the disassembly (default stdout)"`
+}
+
+func (c *SketchDisasmCmd) Run() error {
+	var sketch []byte
+	var err error
+	if strings.ToLower(filepath.Ext(c.Infile)) == ".hex" {
+		file, _ := forceOpen(c.Infile)
+		sketch, err = arduboy.HexToBin(file)
+		file.Close()
+		fatalIfErr(c.Infile, "read sketch hex", err)
+	} else {
+		sketch, err = os.ReadFile(c.Infile)
+		fatalIfErr(c.Infile, "read sketch bin", err)
+	}
+	// Don't bother showing the erased flash after the sketch
+	sketch = arduboy.TrimUnused(arduboy.AlignData(sketch, arduboy.FlashPageSize), arduboy.FlashPageSize)
+	annotations := arduboy.AnnotateSketch(sketch)
+	output := os.Stdout
+	if c.Outfile != "" {
+		output = forceCreate(c.Outfile)
+		defer output.Close()
+	}
+	err = arduboy.WriteDisassembly(output, sketch, annotations)
+	fatalIfErr(c.Infile, "write disassembly", err)
+	log.Printf("Disassembled %d bytes (%d annotations)\n", len(sketch), len(annotations))
+	return nil
+}
+
+// Sketch analyze command (file or device)
+type SketchAnalyzeCmd struct {
+	Device string `arg:"" default:"${defaultport}" help:"The system device OR sketch file (.hex or .bin) to analyze (use 'any' for first device)"`
+	Html   bool   `help:"Generate as html instead"`
+}
+
+func (c *SketchAnalyzeCmd) Run() error {
+	var sketch []byte
+	name := c.Device
+	fileInfo, err := os.Stat(c.Device)
+	if err == nil && fileInfo.Mode().IsRegular() {
+		log.Printf("%s is a file, analyzing file\n", c.Device)
+		if strings.ToLower(filepath.Ext(c.Device)) == ".hex" {
+			file, _ := forceOpen(c.Device)
+			sketch, err = arduboy.HexToBin(file)
+			file.Close()
+			fatalIfErr(c.Device, "read sketch hex", err)
+		} else {
+			sketch, err = os.ReadFile(c.Device)
+			fatalIfErr(c.Device, "read sketch bin", err)
+		}
+	} else {
+		sercon, d := connectWithBootloader(c.Device)
+		defer sercon.Close()
+		name = d.SmallString()
+		sketch, err = arduboy.ReadSketch(sercon, true)
+		fatalIfErr(c.Device, "read sketch", err)
+	}
+	sketch = arduboy.AlignData(sketch, arduboy.FlashPageSize)
+	analysis := arduboy.AnalyzeSketch(sketch, false)
+	arduboy.ReportSketch(&analysis)
+	hash := arduboy.SketchMD5(sketch)
+	log.Printf("Analyzed %d byte sketch from %s\n", analysis.FlashUsed, name)
+	if c.Html {
+		err = arduboy.RenderSketchAnalysis(&analysis, name, hash, os.Stdout)
+		fatalIfErr(c.Device, "render sketch analysis into HTML", err)
+	} else {
+		result := make(map[string]interface{})
+		result["Sketch"] = name
+		result["MD5"] = hash
+		result["Analysis"] = analysis
+		PrintJson(result)
+	}
+	return nil
+}
+
 type Hex2BinCmd struct {
 	Outfile string `type:"path" short:"o"`
 	Infile  string `type:"existingfile" default:"sketch.hex" short:"i"`
@@ -952,33 +1966,57 @@ func (c *FxDataAlignCmd) Run() error {
 
 var cli struct {
 	Device struct {
-		Scan  ScanCmd  `cmd:"" help:"Search for Arduboys and return basic information on them"`
-		Query QueryCmd `cmd:"" help:"Get deeper information about a particular Arduboy"`
+		Scan    ScanCmd    `cmd:"" help:"Search for Arduboys and return basic information on them"`
+		Query   QueryCmd   `cmd:"" help:"Get deeper information about a particular Arduboy"`
+		Watch   WatchCmd   `cmd:"" help:"Watch for devices being connected, disconnected, or entering the bootloader (json lines)"`
+		Backup  BackupCmd  `cmd:"" help:"Backup sketch, flash, eeprom, and flashcart into a single zip"`
+		Restore RestoreCmd `cmd:"" help:"Restore a backup made with device backup (bootloader is not restored)"`
+		Emulate EmulateCmd `cmd:"" help:"Create an emulated Arduboy usable as emulated://<directory>"`
+		Serve   ServeCmd   `cmd:"" help:"Share a device over the network, usable as tcp://<host:port> or rfc2217://<host:port>"`
 	} `cmd:"" help:"Commands which retrieve information about devices"`
 	Sketch struct {
-		Read     SketchReadCmd  `cmd:"" help:"Read just the sketch portion of flash, saved as a .hex file"`
-		Write    SketchWriteCmd `cmd:"" help:"Write arduboy hex file to arduboy (standard procedure)"`
-		WriteRaw RawHexWriteCmd `cmd:"" help:"Write hex file to arduboy precisely as-is"`
-		Hex2Bin  Hex2BinCmd     `cmd:"" help:"Convert sketch hex to bin" name:"hex2bin"`
-		Bin2Hex  Bin2HexCmd     `cmd:"" help:"Convert sketch bin to hex" name:"bin2hex"`
-		// Could analyze sketch to figure out what device it might be for
+		Read     SketchReadCmd    `cmd:"" help:"Read just the sketch portion of flash, saved as a .hex file"`
+		Write    SketchWriteCmd   `cmd:"" help:"Write arduboy hex file to arduboy (standard procedure)"`
+		WriteRaw RawHexWriteCmd   `cmd:"" help:"Write hex file to arduboy precisely as-is"`
+		Hex2Bin  Hex2BinCmd       `cmd:"" help:"Convert sketch hex to bin" name:"hex2bin"`
+		Bin2Hex  Bin2HexCmd       `cmd:"" help:"Convert sketch bin to hex" name:"bin2hex"`
+		Disasm   SketchDisasmCmd  `cmd:"" help:"Disassemble a sketch, pointing out vectors and known Arduboy code"`
+		Analyze  SketchAnalyzeCmd `cmd:"" help:"Report flash use, patches, display init, FX pointers, and libraries (works on files too)"`
 	} `cmd:"" help:"Commands which work directly on sketches, whether on device or filesystem"`
 	Eeprom struct {
 		Read   EepromReadCmd   `cmd:"" help:"Read entire eeprom, saved as a .bin file"`
 		Write  EepromWriteCmd  `cmd:"" help:"Write data to eeprom"`
 		Delete EepromDeleteCmd `cmd:"" help:"Reset entire eeprom"`
+		Diff   EepromDiffCmd   `cmd:"" help:"Compare eeprom between a device and a file, or two files, as a hexdump"`
+		System struct {
+			Show EepromSystemShowCmd `cmd:"" help:"Show the Arduboy2 system settings (unit name, audio, logo, etc)"`
+			Set  EepromSystemSetCmd  `cmd:"" help:"Change the Arduboy2 system settings, writing only what changed"`
+		} `cmd:"" help:"Commands for the Arduboy2 system area at the start of eeprom (works on .bin files too)"`
+		Vault struct {
+			List   EepromVaultListCmd   `cmd:"" help:"List the eeprom saves kept for each sketch"`
+			Export EepromVaultExportCmd `cmd:"" help:"Save a sketch's eeprom from the vault to a .bin file"`
+			Import EepromVaultImportCmd `cmd:"" help:"Store a .bin file in the vault as a sketch's eeprom"`
+		} `cmd:"" help:"Commands for the eeprom saves kept when sketches are replaced"`
 	} `cmd:"" help:"Commands which work directly on eeprom, whether on device or filesystem"`
 	Flashcart struct {
-		Scan     FlashcartScanCmd     `cmd:"" help:"Scan flashcart and return categories/games (works on files too)"`
-		Read     FlashcartReadCmd     `cmd:"" help:"Read entire flashcart, saved as a .bin file"`
-		Write    FlashcartWriteCmd    `cmd:"" help:"Write full flashcart to arduboy"`
-		Writedev FlashcartWriteDevCmd `cmd:"" help:"Write dev data to the end of arduboy flashcart"`
-		Readat   FlashcartReadAtCmd   `cmd:"" help:"Read some subset of data from anywhere in the flashcart"`
-		Writeat  FlashcartWriteAtCmd  `cmd:"" help:"Write some arbitrary data anywhere in the flashcart"`
-		Generate FlashcartGenerateCmd `cmd:"" help:"Run a lua script to generate a flashcart"`
-		// Could analyze flashcart to figure out what device it might be for, and whether
-		// it's technically invalid
+		Scan      FlashcartScanCmd      `cmd:"" help:"Scan flashcart and return categories/games (works on files too)"`
+		Read      FlashcartReadCmd      `cmd:"" help:"Read entire flashcart, saved as a .bin file"`
+		Write     FlashcartWriteCmd     `cmd:"" help:"Write full flashcart to arduboy"`
+		Writedev  FlashcartWriteDevCmd  `cmd:"" help:"Write dev data to the end of arduboy flashcart"`
+		Readat    FlashcartReadAtCmd    `cmd:"" help:"Read some subset of data from anywhere in the flashcart"`
+		Writeat   FlashcartWriteAtCmd   `cmd:"" help:"Write some arbitrary data anywhere in the flashcart"`
+		Generate  FlashcartGenerateCmd  `cmd:"" help:"Run a lua script to generate a flashcart"`
+		EepromMap FlashcartEepromMapCmd `cmd:"" help:"Estimate the eeprom used by each game in a flashcart file and report overlaps" name:"eeprom-map"`
+		Check     FlashcartCheckCmd     `cmd:"" help:"Check the flashcart structure, headers, and hashes for problems (works on files too)"`
+		ExportCsv FlashcartExportCsvCmd `cmd:"" help:"Unpack a flashcart file into a flashcart-builder.py style CSV index and files" name:"export-csv"`
+		BuildCsv  FlashcartBuildCsvCmd  `cmd:"" help:"Build a flashcart file from a flashcart-builder.py style CSV index" name:"build-csv"`
+		Extract   FlashcartExtractCmd   `cmd:"" help:"Extract every game as a .arduboy package, plus a category manifest (works on files too)"`
+		Diff      FlashcartDiffCmd      `cmd:"" help:"Compare the categories and games of two flashcarts (devices or files)"`
+		// Could analyze flashcart to figure out what device it might be for
 	} `cmd:"" help:"Commands which work directly on flashcarts, whether on device or filesystem"`
+	Package struct {
+		Install PackageInstallCmd `cmd:"" help:"Install a .arduboy package (sketch and fx data) onto a device"`
+	} `cmd:"" help:"Commands which work directly on .arduboy packages"`
 	Image struct {
 		Bin2Img   Bin2ImgCmd   `cmd:"" help:"Convert 1024 byte bin to png img" name:"bin2img"`
 		Img2Bin   Img2BinCmd   `cmd:"" help:"Convert any image to arduboy 1024 byte bin format" name:"img2bin"`
@@ -989,22 +2027,64 @@ var cli struct {
 		Generate FxDataGenerateCmd `cmd:"" help:"Generate fxdata headers and binaries from an fxdata config (lua)"`
 		Align    FxDataAlignCmd    `cmd:"" help:"Align fxdata, optionally appending fxsave for use in flashcart writedev"`
 	} `cmd:"" help:"Commands for working with fxdata (such as generating fxdata)"`
-	Version kong.VersionFlag `help:"Show version information"`
-	Norgb   bool             `help:"Disable all rgb while accessing device"`
+	Version  kong.VersionFlag `help:"Show version information"`
+	Norgb    bool             `help:"Disable all rgb while accessing device"`
+	Progress string           `enum:"log,json" default:"log" help:"How to report progress: log messages, or json lines on stderr (log,json)"`
+	Timeout  time.Duration    `default:"10s" help:"Give up if the device stops responding for this long (0 to wait forever)"`
+	Trace    string           `type:"path" help:"Record all communication with devices to this file (replay it with trace://file as the device)"`
+	Vault    string           `type:"path" default:"${vaultpath}" help:"Folder where sketch writes keep each game's eeprom"`
 }
 
 func main() {
+	// The config file has to come first, since it sets the defaults for flags
+	// Without a config folder there's no config file, so just use the defaults.
+	// Only a config file which is actually broken should stop us
+	var config *arduboy.Config
+	configPath, err := arduboy.DefaultConfigPath()
+	if err != nil {
+		log.Printf("No config folder (%s), using default config\n", err)
+		config, err = arduboy.ParseConfig(strings.NewReader(""))
+		fatalIfErr("config", "create default config", err)
+	} else {
+		config, err = arduboy.LoadConfig(configPath)
+		fatalIfErr(configPath, "load config file", err)
+	}
+	config.Apply()
+	defaultPort := config.Defaults.Port
+	if defaultPort == "" {
+		defaultPort = arduboy.AnyPortKey
+	}
+	// Without a config folder, there's just no vault unless one is given
+	vaultPath, err := arduboy.DefaultVaultPath()
+	if err != nil {
+		vaultPath = ""
+	}
 	ctx := kong.Parse(&cli,
 		kong.Name("ardugotools"),
 		kong.ShortUsageOnError(),
 		kong.Description("A set of tools for working with Arduboy"),
 		kong.Vars{
-			"version": AppVersion,
+			"version":          AppVersion,
+			"defaultport":      defaultPort,
+			"overridecapacity": strconv.Itoa(config.Defaults.OverrideCapacity),
+			"ssd1309":          strconv.FormatBool(config.Defaults.PatchSsd1309),
+			"microled":         strconv.FormatBool(config.Defaults.PatchMicroLED),
+			"contrast":         strconv.Itoa(config.Defaults.Contrast),
+			"devices":          strings.Join(config.Defaults.Devices, ","),
+			"vaultpath":        vaultPath,
 		},
 	)
 	if cli.Norgb {
 		arduboy.SetRgbEnabledGlobal(false)
 	}
-	err := ctx.Run()
+	if cli.Trace != "" {
+		file := forceCreate(cli.Trace)
+		defer file.Close()
+		traceOutput = &lockedWriter{writer: file}
+	}
+	var stop context.CancelFunc
+	cliContext, stop = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = ctx.Run()
 	ctx.FatalIfErrorf(err)
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/randomouscrap98/ardugotools/arduboy"
 )
 
 // Most commands need this, so... yeah
@@ -16,8 +23,86 @@ func PrintJson(obj interface{}) {
 	fmt.Println(string(rawjson))
 }
 
+// For streams of results, print each as its own single line of json
+func PrintJsonLine(obj interface{}) {
+	rawjson, err := json.Marshal(obj)
+	if err != nil {
+		log.Fatalln("Couldn't serialize json: ", err)
+	}
+	fmt.Println(string(rawjson))
+}
+
 // Get a filesafe datetime, condensed (local time, I hope)
 func FileSafeDateTime() string {
 	currentTime := time.Now()
 	return currentTime.Format("20060102-150405")
 }
+
+// A progress event as printed with --progress=json. Device is only set when
+// several devices are being worked on at once
+type progressEvent struct {
+	Device string `json:",omitempty"`
+	*arduboy.Progress
+}
+
+var progressLock sync.Mutex
+
+// Get the progress reporter chosen on the command line. Give a name if
+// several devices are reporting at once, so the events can be told apart
+func progressReporter(name string) arduboy.ProgressReporter {
+	if cli.Progress == "json" {
+		return func(progress *arduboy.Progress) {
+			rawjson, err := json.Marshal(progressEvent{Device: name, Progress: progress})
+			if err != nil {
+				log.Fatalln("Couldn't serialize json: ", err)
+			}
+			progressLock.Lock()
+			defer progressLock.Unlock()
+			fmt.Fprintln(os.Stderr, string(rawjson))
+		}
+	}
+	if name == "" {
+		return arduboy.LogProgress
+	}
+	return func(progress *arduboy.Progress) {
+		if progress.Message != "" {
+			log.Printf("%s - %s\n", name, progress.Message)
+		}
+	}
+}
+
+// A writer that can be shared by several goroutines
+type lockedWriter struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writer.Write(data)
+}
+
+// Where device communication is recorded with --trace (nil if not tracing)
+var traceOutput io.Writer
+
+// Record everything on the connection if --trace was given
+func traceConnection(sercon io.ReadWriteCloser, device *arduboy.BasicDeviceInfo) io.ReadWriteCloser {
+	if traceOutput == nil {
+		return sercon
+	}
+	return arduboy.NewTraceConnection(sercon, traceOutput, device.Port)
+}
+
+// Ask the user a yes/no question on the terminal. Without a terminal (such as
+// when another program is running us), the answer is always no
+func askYesNo(question string) bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}